@@ -1,6 +1,8 @@
 module github.com/peer-calls/peer-calls
 
-go 1.14
+// go.opentelemetry.io/otel v1.7.0 requires go 1.16 and testify v1.7.1. Go 1.17
+// prunes the grpc and protobuf modules the OTLP exporter depends on.
+go 1.17
 
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
@@ -8,7 +10,7 @@ require (
 	github.com/go-redis/redis/v7 v7.2.0
 	github.com/gobuffalo/packd v0.3.0
 	github.com/gobuffalo/packr v1.30.1
-	github.com/google/uuid v1.1.1
+	github.com/google/uuid v1.3.0
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c
 	github.com/pion/logging v0.2.2
 	github.com/pion/rtcp v1.2.1
@@ -16,11 +18,62 @@ require (
 	github.com/pion/webrtc/v2 v2.2.11
 	github.com/prometheus/client_golang v1.6.0
 	github.com/prometheus/common v0.9.1
-	github.com/stretchr/testify v1.5.1
+	github.com/stretchr/testify v1.8.2
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
 	go.uber.org/goleak v1.0.0
+	golang.org/x/crypto v0.10.0
 	gopkg.in/yaml.v2 v2.2.8
 	nhooyr.io/websocket v1.8.4
 )
 
+require (
+	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751 // indirect
+	github.com/alecthomas/units v0.0.0-20190717042225-c3de453c63f4 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cenkalti/backoff/v4 v4.1.3 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/gobuffalo/envy v1.7.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/grpc-ecosystem/grpc-gateway/v2 v2.15.2 // indirect
+	github.com/joho/godotenv v1.3.0 // indirect
+	github.com/klauspost/compress v1.10.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/pion/datachannel v1.4.17 // indirect
+	github.com/pion/dtls/v2 v2.0.0 // indirect
+	github.com/pion/ice v0.7.15 // indirect
+	github.com/pion/mdns v0.0.4 // indirect
+	github.com/pion/quic v0.1.1 // indirect
+	github.com/pion/sctp v1.7.6 // indirect
+	github.com/pion/sdp/v2 v2.3.7 // indirect
+	github.com/pion/srtp v1.3.2 // indirect
+	github.com/pion/stun v0.3.3 // indirect
+	github.com/pion/transport v0.10.0 // indirect
+	github.com/pion/turn/v2 v2.0.3 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/procfs v0.0.11 // indirect
+	github.com/rogpeppe/go-internal v1.3.0 // indirect
+	github.com/sirupsen/logrus v1.4.2 // indirect
+	go.opentelemetry.io/otel/exporters/otlp/internal/retry v1.7.0 // indirect
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace v1.7.0 // indirect
+	go.opentelemetry.io/proto/otlp v0.16.0 // indirect
+	golang.org/x/net v0.11.0 // indirect
+	golang.org/x/sys v0.9.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	golang.org/x/xerrors v0.0.0-20220907171357-04be3eba64a2 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
+	google.golang.org/grpc v1.54.0 // indirect
+	google.golang.org/protobuf v1.30.0 // indirect
+	gopkg.in/alecthomas/kingpin.v2 v2.2.6 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
 // replace github.com/pion/webrtc/v2 => github.com/jeremija/webrtc/v2 v2.2.6-0.20200420091005-4cc16a2df9e0
 // replace github.com/pion/webrtc/v2 => ../../pion/webrtc
@@ -9,11 +9,14 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 
 	"github.com/peer-calls/peer-calls/server"
 	"github.com/peer-calls/peer-calls/server/logger"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var gitDescribe string = "v0.0.0"
@@ -31,30 +34,87 @@ func configure(loggerFactory *logger.Factory, args []string) (net.Listener, *ser
 		configFiles = append(configFiles, configFilename)
 	}
 
-	c, err := server.ReadConfig(configFiles)
+	c, err := server.ReadConfig(log, configFiles)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Error reading config: %w", err)
 	}
 
-	server.InitAuth([]byte(c.JwtSecret))
-
-	log.Printf("Using config: %+v", c)
+	log.Debug("Using config", logger.Fields{"config": fmt.Sprintf("%+v", c.Redacted())})
+	shutdownTracing, err := server.ConfigureTracing(loggerFactory, c.Tracing)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error configuring tracing: %w", err)
+	}
+	auth, err := server.NewAuthenticator(loggerFactory, c.Auth, c.JwtSecret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error creating authenticator: %w", err)
+	}
 	newAdapter := server.NewAdapterFactory(loggerFactory, c.Store)
 	rooms := server.NewAdapterRoomManager(newAdapter.NewAdapter)
-	tracks := server.NewMemoryTracksManager(loggerFactory, c.Network.SFU.JitterBuffer)
-	mux := server.NewMux(loggerFactory, c.BaseURL, gitDescribe, c.Network, c.ICEServers, rooms, tracks, c.Prometheus, c.RecordServiceURL)
+	var relay *server.Relay
+	if c.Network.Type == server.NetworkTypeSFU && c.Network.SFU.Relay.BindAddr != "" {
+		relay, err = server.ListenRelay(loggerFactory, newAdapter.RelayDiscovery, c.Network.SFU.Relay)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error starting relay: %w", err)
+		}
+	}
+	tracks := server.NewMemoryTracksManager(loggerFactory, c.Network.SFU.JitterBuffer, relay)
+	recorder, err := server.NewRecorder(loggerFactory, c.Record, c.RecordServiceURL, c.Network.Type, tracks)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error creating recorder: %w", err)
+	}
+	var affinity *server.RoomAffinity
+	if c.Network.Type == server.NetworkTypeSFU && c.Network.SFU.Affinity.AdvertiseURL != "" {
+		affinity, err = server.NewRoomAffinity(loggerFactory, newAdapter.RoomLeases, c.Network.SFU.Affinity)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error configuring room affinity: %w", err)
+		}
+	}
+	if c.Prometheus.RoomMetrics.Enabled {
+		collector := server.NewRoomMetricsCollector(loggerFactory, rooms, tracks, c.Prometheus.RoomMetrics)
+		if err := prometheus.Register(collector); err != nil {
+			return nil, nil, fmt.Errorf("Error registering room metrics: %w", err)
+		}
+	}
+	drainer := server.NewDrainer(loggerFactory)
+	checks := []server.HealthCheck{{
+		Name:  "drain",
+		Check: drainer.HealthCheck,
+	}}
+	if c.Store.Type == server.StoreTypeRedis {
+		checks = append(checks, server.HealthCheck{
+			Name:  "redis",
+			Check: newAdapter.HealthCheck,
+		})
+	}
+	if c.Network.Type == server.NetworkTypeSFU {
+		checks = append(checks, server.HealthCheck{
+			Name:  "webrtc",
+			Check: server.NewWebRTCTransportFactory(loggerFactory, c.ICEServers, c.Network.SFU).HealthCheck,
+		})
+	}
+	if httpRecorder, ok := recorder.(*server.HTTPRecorder); ok && c.Record.Type == server.RecordTypeHTTP {
+		checks = append(checks, server.HealthCheck{
+			Name:  "recorder",
+			Check: httpRecorder.HealthCheck,
+		})
+	}
+	probes := server.NewProbes(loggerFactory, server.DefaultProbeTimeout, checks...)
+	mux := server.NewMux(loggerFactory, c.BaseURL, gitDescribe, c.Network, c.ICEServers, rooms, tracks, newAdapter.RoomStore, auth, c.Prometheus, c.Admin, recorder, affinity, drainer, probes)
 	l, err := net.Listen("tcp", net.JoinHostPort(c.BindHost, strconv.Itoa(c.BindPort)))
 	if err != nil {
 		return nil, nil, fmt.Errorf("Error starting server listener: %w", err)
 	}
 	startStopper := server.NewStartStopper(server.ServerParams{
-		TLSCertFile: c.TLS.Cert,
-		TLSKeyFile:  c.TLS.Key,
+		TLSCertFile:  c.TLS.Cert,
+		TLSKeyFile:   c.TLS.Key,
+		Drainer:      drainer,
+		DrainTimeout: c.Shutdown.DrainTimeout,
+		Shutdown:     shutdownTracing,
 	}, mux)
 	return l, startStopper, nil
 }
 
-func start(args []string) (addr *net.TCPAddr, stop func() error, errChan <-chan error) {
+func newLoggerFactory() *logger.Factory {
 	loggerFactory := logger.NewFactoryFromEnv("PEERCALLS_", os.Stderr)
 	loggerFactory.SetDefaultEnabled([]string{
 		"-sdp",
@@ -67,6 +127,10 @@ func start(args []string) (addr *net.TCPAddr, stop func() error, errChan <-chan
 		"-pion:*:info",
 		"*",
 	})
+	return loggerFactory
+}
+
+func start(loggerFactory *logger.Factory, args []string) (addr *net.TCPAddr, stop func() error, errChan <-chan error) {
 	log := loggerFactory.GetLogger("main")
 
 	ch := make(chan error, 1)
@@ -77,7 +141,7 @@ func start(args []string) (addr *net.TCPAddr, stop func() error, errChan <-chan
 		return nil, nil, ch
 	}
 	addr = l.Addr().(*net.TCPAddr)
-	log.Printf("Listening on: %s", addr.String())
+	log.Info("Listening", logger.Fields{"addr": addr.String()})
 	go func() {
 		err := startStopper.Start(l)
 		if err != http.ErrServerClosed {
@@ -91,10 +155,26 @@ func start(args []string) (addr *net.TCPAddr, stop func() error, errChan <-chan
 }
 
 func main() {
-	_, _, errChan := start(os.Args[1:])
+	loggerFactory := newLoggerFactory()
+	log := loggerFactory.GetLogger("main")
+
+	_, stop, errChan := start(loggerFactory, os.Args[1:])
+
+	if stop != nil {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		go func() {
+			<-signals
+			// Restore the default behavior so that another signal stops the
+			// server immediately.
+			signal.Stop(signals)
+			stop()
+		}()
+	}
+
 	err := <-errChan
 	if err != nil {
-		fmt.Println("Error starting server: %w", err)
+		log.Error("Error starting server", logger.Fields{"error": err})
 		os.Exit(1)
 	}
 }
@@ -17,7 +17,7 @@ func TestStartMissingConfig(t *testing.T) {
 	defer test.UnsetEnvPrefix(prefix)
 	os.Setenv(prefix+"BIND_PORT", "0")
 	os.Setenv(prefix+"LOG", "-*")
-	_, stop, errCh := start([]string{"-c", "/missing/file.yml"})
+	_, stop, errCh := start(newLoggerFactory(), []string{"-c", "/missing/file.yml"})
 	assert.Nil(t, stop)
 	err := <-errCh
 	require.Error(t, err)
@@ -29,7 +29,7 @@ func TestStartWrongPort(t *testing.T) {
 	defer test.UnsetEnvPrefix(prefix)
 	os.Setenv(prefix+"BIND_PORT", "100000")
 	os.Setenv(prefix+"LOG", "-*")
-	_, stop, errCh := start([]string{})
+	_, stop, errCh := start(newLoggerFactory(), []string{})
 	assert.Nil(t, stop)
 	err := <-errCh
 	require.Error(t, err)
@@ -41,7 +41,7 @@ func TestStart(t *testing.T) {
 	defer test.UnsetEnvPrefix(prefix)
 	os.Setenv(prefix+"BIND_PORT", "0")
 	os.Setenv(prefix+"LOG", "-*")
-	addr, stop, errCh := start([]string{})
+	addr, stop, errCh := start(newLoggerFactory(), []string{})
 	r, err := http.Get("http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(addr.Port)))
 	assert.NoError(t, err)
 	assert.Equal(t, 200, r.StatusCode)
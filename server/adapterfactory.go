@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"strconv"
 
@@ -11,7 +13,10 @@ type AdapterFactory struct {
 	pubClient *redis.Client
 	subClient *redis.Client
 
-	NewAdapter func(room string) Adapter
+	NewAdapter     func(room string) Adapter
+	RoomStore      RoomStore
+	RelayDiscovery RelayDiscovery
+	RoomLeases     RoomLeases
 }
 
 func NewAdapterFactory(
@@ -26,7 +31,10 @@ func NewAdapterFactory(
 	case StoreTypeRedis:
 		addr := net.JoinHostPort(c.Redis.Host, strconv.Itoa(c.Redis.Port))
 		prefix := c.Redis.Prefix
-		log.Printf("Using RedisAdapter: %s with prefix %s", addr, prefix)
+		log.Info("Using RedisAdapter", Fields{
+			"addr":   addr,
+			"prefix": prefix,
+		})
 		f.pubClient = redis.NewClient(&redis.Options{
 			Addr: addr,
 		})
@@ -36,11 +44,17 @@ func NewAdapterFactory(
 		f.NewAdapter = func(room string) Adapter {
 			return NewRedisAdapter(loggerFactory, f.pubClient, f.subClient, prefix, room)
 		}
+		f.RoomStore = NewRedisRoomStore(f.pubClient, prefix, c.RoomTTL)
+		f.RelayDiscovery = NewRedisRelayDiscovery(f.pubClient, prefix)
+		f.RoomLeases = NewRedisRoomLeases(f.pubClient, prefix)
 	default:
-		log.Printf("Using MemoryAdapter")
+		log.Info("Using MemoryAdapter", nil)
 		f.NewAdapter = func(room string) Adapter {
 			return NewMemoryAdapter(room)
 		}
+		f.RoomStore = NewMemoryRoomStore(c.RoomTTL)
+		f.RelayDiscovery = NewMemoryRelayDiscovery()
+		f.RoomLeases = NewMemoryRoomLeases()
 	}
 
 	return &f
@@ -48,6 +62,9 @@ func NewAdapterFactory(
 
 func (a *AdapterFactory) Close() (err error) {
 	var errs []error
+	if a.RoomStore != nil {
+		errs = append(errs, a.RoomStore.Close())
+	}
 	if a.pubClient != nil {
 		errs = append(errs, a.pubClient.Close())
 	}
@@ -56,3 +73,16 @@ func (a *AdapterFactory) Close() (err error) {
 	}
 	return firstError(errs...)
 }
+
+// HealthCheck pings the redis clients, when the redis store is used.
+func (a *AdapterFactory) HealthCheck(ctx context.Context) error {
+	for _, client := range []*redis.Client{a.pubClient, a.subClient} {
+		if client == nil {
+			continue
+		}
+		if err := client.WithContext(ctx).Ping().Err(); err != nil {
+			return fmt.Errorf("Error pinging redis: %w", err)
+		}
+	}
+	return nil
+}
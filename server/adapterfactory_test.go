@@ -1,6 +1,7 @@
 package server_test
 
 import (
+	"context"
 	"testing"
 
 	"github.com/peer-calls/peer-calls/server"
@@ -22,9 +23,12 @@ func TestNewAdapterFactory_redis(t *testing.T) {
 
 	redisAdapter, ok := f.NewAdapter("test-room").(*server.RedisAdapter)
 	assert.True(t, ok)
+	assert.IsType(t, &server.RedisRoomStore{}, f.RoomStore)
 
 	err := redisAdapter.Close()
 	assert.Nil(t, err)
+
+	assert.NoError(t, f.HealthCheck(context.Background()))
 }
 
 func TestNewAdapterFactory_memory(t *testing.T) {
@@ -36,4 +40,22 @@ func TestNewAdapterFactory_memory(t *testing.T) {
 
 	_, ok := f.NewAdapter("test-room").(*server.MemoryAdapter)
 	assert.True(t, ok)
+	assert.IsType(t, &server.MemoryRoomStore{}, f.RoomStore)
+
+	assert.NoError(t, f.HealthCheck(context.Background()))
+}
+
+func TestAdapterFactory_HealthCheck_unavailable(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	f := server.NewAdapterFactory(loggerFactory, server.StoreConfig{
+		Type: "redis",
+		Redis: server.RedisConfig{
+			Prefix: "peercalls",
+			Host:   "127.0.0.1",
+			Port:   1,
+		},
+	})
+	defer f.Close()
+
+	assert.Error(t, f.HealthCheck(context.Background()))
 }
@@ -0,0 +1,386 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// AdminRoom summarizes a room with clients on this instance.
+type AdminRoom struct {
+	Room         string `json:"room"`
+	Participants int    `json:"participants"`
+}
+
+// AdminParticipant is a client in a room and its metadata.
+type AdminParticipant struct {
+	ClientID string `json:"clientId"`
+	Metadata string `json:"metadata"`
+}
+
+// AdminRoomDetails describes a room. Participants include the clients
+// connected to all instances when the redis store is used, while transports
+// only include the transports of this instance.
+type AdminRoomDetails struct {
+	Room         string             `json:"room"`
+	Settings     *RoomInfo          `json:"settings,omitempty"`
+	Participants []AdminParticipant `json:"participants"`
+	// Lobby contains the clients waiting to be admitted.
+	Lobby      []AdminParticipant `json:"lobby"`
+	Transports []TransportState   `json:"transports,omitempty"`
+	Recording  *RecordingStatus   `json:"recording,omitempty"`
+}
+
+// AdminLogRules is the body of a request which replaces the rules that enable
+// loggers. When Minutes is greater than zero, the rules override the default
+// rules until that many minutes have passed.
+type AdminLogRules struct {
+	Rules   []string `json:"rules"`
+	Minutes int      `json:"minutes"`
+}
+
+// AdminHandler serves the admin API used to inspect rooms and participants,
+// close rooms, kick clients, drain the server and change which loggers are
+// enabled. All requests must have the admin access token.
+type AdminHandler struct {
+	log         Logger
+	handler     *chi.Mux
+	accessToken string
+	rooms       RoomManager
+	tracks      TracksManager
+	roomStore   RoomStore
+	recorder    Recorder
+	drainer     *Drainer
+	logRules    LogRules
+}
+
+// NewAdminHandler creates the admin API. Draining is not available when
+// drainer is nil, and the loggers cannot be changed when logRules is nil.
+func NewAdminHandler(
+	loggerFactory LoggerFactory,
+	admin AdminConfig,
+	rooms RoomManager,
+	tracks TracksManager,
+	roomStore RoomStore,
+	recorder Recorder,
+	drainer *Drainer,
+	logRules LogRules,
+) *AdminHandler {
+	handler := chi.NewRouter()
+
+	a := &AdminHandler{
+		log:         loggerFactory.GetLogger("admin"),
+		handler:     handler,
+		accessToken: admin.AccessToken,
+		rooms:       rooms,
+		tracks:      tracks,
+		roomStore:   roomStore,
+		recorder:    recorder,
+		drainer:     drainer,
+		logRules:    logRules,
+	}
+
+	handler.Use(a.authenticate)
+	handler.Get("/rooms", a.routeRooms)
+	handler.Get("/rooms/{room}", a.routeRoom)
+	handler.Delete("/rooms/{room}", a.routeCloseRoom)
+	handler.Get("/rooms/{room}/stats", a.routeStats)
+	handler.Delete("/rooms/{room}/clients/{clientID}", a.routeKick)
+	if drainer != nil {
+		handler.Post("/drain", a.routeDrain)
+	}
+	if logRules != nil {
+		handler.Get("/log", a.routeLogRules)
+		handler.Put("/log", a.routeSetLogRules)
+		handler.Delete("/log/override", a.routeResetLogOverride)
+	}
+
+	return a
+}
+
+func (a *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.handler.ServeHTTP(w, r)
+}
+
+func (a *AdminHandler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasAccessToken(r, a.accessToken) {
+			writeAdminError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{
+		"error": message,
+	})
+}
+
+// participants returns the clients of room sorted by client ID.
+func (a *AdminHandler) participants(room string) ([]AdminParticipant, error) {
+	adapter := a.rooms.Enter(room)
+	defer a.rooms.Exit(room)
+
+	clients, err := adapter.Clients()
+	if err != nil {
+		return nil, err
+	}
+
+	participants := make([]AdminParticipant, 0, len(clients))
+	for clientID, metadata := range clients {
+		participants = append(participants, AdminParticipant{
+			ClientID: clientID,
+			Metadata: metadata,
+		})
+	}
+
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].ClientID < participants[j].ClientID
+	})
+
+	return participants, nil
+}
+
+func (a *AdminHandler) routeRooms(w http.ResponseWriter, r *http.Request) {
+	rooms := []AdminRoom{}
+
+	for _, room := range a.rooms.Rooms() {
+		// skip the lobbies of rooms, which are listed in the room details.
+		if strings.Contains(room, "/") {
+			continue
+		}
+
+		participants, err := a.participants(room)
+		if err != nil {
+			a.log.Error("Error retrieving participants of room", Fields{
+				"room":  room,
+				"error": err,
+			})
+		}
+
+		rooms = append(rooms, AdminRoom{
+			Room:         room,
+			Participants: len(participants),
+		})
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"rooms": rooms,
+	})
+}
+
+func (a *AdminHandler) routeRoom(w http.ResponseWriter, r *http.Request) {
+	room := chi.URLParam(r, "room")
+
+	participants, err := a.participants(room)
+	if err != nil {
+		a.log.Error("Error retrieving participants of room", Fields{
+			"room":  room,
+			"error": err,
+		})
+		writeAdminError(w, http.StatusInternalServerError, "Error retrieving participants")
+		return
+	}
+
+	lobby, err := a.participants(lobbyRoomName(room))
+	if err != nil {
+		a.log.Error("Error retrieving lobby of room", Fields{
+			"room":  room,
+			"error": err,
+		})
+		writeAdminError(w, http.StatusInternalServerError, "Error retrieving lobby")
+		return
+	}
+
+	details := AdminRoomDetails{
+		Room:         room,
+		Participants: participants,
+		Lobby:        lobby,
+	}
+
+	if info, err := a.roomStore.Get(room); err == nil {
+		details.Settings = &info
+	}
+
+	if len(participants) == 0 && len(lobby) == 0 && details.Settings == nil {
+		writeAdminError(w, http.StatusNotFound, "Room not found")
+		return
+	}
+
+	if transports, ok := a.tracks.Transports(room); ok {
+		details.Transports = transports
+	}
+
+	if a.recorder != nil {
+		status, err := a.recorder.Status(room)
+		if err != nil {
+			a.log.Error("Error retrieving recording status of room", Fields{
+				"room":  room,
+				"error": err,
+			})
+		} else {
+			details.Recording = &status
+		}
+	}
+
+	writeAdminJSON(w, http.StatusOK, details)
+}
+
+// routeStats responds with the statistics of the SFU transports and tracks in
+// a room on this instance.
+func (a *AdminHandler) routeStats(w http.ResponseWriter, r *http.Request) {
+	room := chi.URLParam(r, "room")
+
+	stats, ok := a.tracks.Stats(room)
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, "Room not found")
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, stats)
+}
+
+// routeCloseRoom ends the meeting in a room like the moderator does. Everyone
+// in the room receives meeting_ended and is disconnected.
+func (a *AdminHandler) routeCloseRoom(w http.ResponseWriter, r *http.Request) {
+	room := chi.URLParam(r, "room")
+
+	a.log.Info("Closing room", Fields{"room": room})
+
+	adapter := a.rooms.Enter(room)
+	defer a.rooms.Exit(room)
+
+	if err := adapter.Broadcast(NewMessage(messageTypeEndMeeting, room, nil)); err != nil {
+		a.log.Error("Error closing room", Fields{
+			"room":  room,
+			"error": err,
+		})
+		writeAdminError(w, http.StatusInternalServerError, "Error closing room")
+		return
+	}
+
+	if err := a.roomStore.Remove(room); err != nil {
+		a.log.Error("Error removing room", Fields{
+			"room":  room,
+			"error": err,
+		})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// routeKick disconnects a client and bans it from the room like the
+// moderator does.
+func (a *AdminHandler) routeKick(w http.ResponseWriter, r *http.Request) {
+	room := chi.URLParam(r, "room")
+	clientID := chi.URLParam(r, "clientID")
+
+	adapter := a.rooms.Enter(room)
+	defer a.rooms.Exit(room)
+
+	clients, err := adapter.Clients()
+	if err != nil {
+		a.log.Error("Error retrieving participants of room", Fields{
+			"room":  room,
+			"error": err,
+		})
+		writeAdminError(w, http.StatusInternalServerError, "Error retrieving participants")
+		return
+	}
+
+	if _, ok := clients[clientID]; !ok {
+		writeAdminError(w, http.StatusNotFound, "Client not found")
+		return
+	}
+
+	a.log.Info("Kicking client from room", Fields{
+		"room":     room,
+		"clientId": clientID,
+	})
+
+	if err := adapter.Emit(clientID, NewMessage(messageTypeKick, room, nil)); err != nil {
+		a.log.Error("Error kicking client from room", Fields{
+			"room":     room,
+			"clientId": clientID,
+			"error":    err,
+		})
+		writeAdminError(w, http.StatusInternalServerError, "Error kicking client")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// routeDrain starts draining the server, after which it shuts down once all
+// rooms are empty.
+func (a *AdminHandler) routeDrain(w http.ResponseWriter, r *http.Request) {
+	a.log.Info("Drain requested by admin endpoint", nil)
+	a.drainer.Drain()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *AdminHandler) routeLogRules(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, a.logRules.Rules())
+}
+
+// routeSetLogRules replaces the rules which enable loggers, or overrides them
+// for a number of minutes. Existing loggers are re-evaluated so that logging
+// can be turned on without restarting the server.
+func (a *AdminHandler) routeSetLogRules(w http.ResponseWriter, r *http.Request) {
+	var body AdminLogRules
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if body.Rules == nil {
+		writeAdminError(w, http.StatusBadRequest, "Rules are required")
+		return
+	}
+
+	if body.Minutes < 0 {
+		writeAdminError(w, http.StatusBadRequest, "Minutes must not be negative")
+		return
+	}
+
+	rules := make([]string, 0, len(body.Rules))
+	for _, rule := range body.Rules {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			rules = append(rules, rule)
+		}
+	}
+
+	if body.Minutes > 0 {
+		a.logRules.OverrideRules(rules, time.Duration(body.Minutes)*time.Minute)
+	} else {
+		a.logRules.SetRules(rules)
+	}
+
+	a.log.Info("Log rules changed by admin endpoint", Fields{
+		"rules":   strings.Join(rules, ","),
+		"minutes": body.Minutes,
+	})
+
+	writeAdminJSON(w, http.StatusOK, a.logRules.Rules())
+}
+
+// routeResetLogOverride removes the override of the rules which enable
+// loggers before it expires.
+func (a *AdminHandler) routeResetLogOverride(w http.ResponseWriter, r *http.Request) {
+	a.logRules.ResetOverride()
+	a.log.Info("Log rules override removed by admin endpoint", nil)
+	writeAdminJSON(w, http.StatusOK, a.logRules.Rules())
+}
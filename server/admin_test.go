@@ -0,0 +1,271 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peer-calls/peer-calls/server"
+	"github.com/peer-calls/peer-calls/server/logger"
+	"github.com/pion/webrtc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"nhooyr.io/websocket"
+)
+
+const adminAccessToken = "admin1234"
+
+func setupAdminServer(t *testing.T) (wsURL string, admin *httptest.Server, cleanup func()) {
+	newAdapter := server.NewAdapterFactory(loggerFactory, server.StoreConfig{})
+	rooms := server.NewAdapterRoomManager(newAdapter.NewAdapter)
+	store := server.NewMemoryRoomStore(time.Hour)
+	wss := server.NewWSS(loggerFactory, rooms, server.NewAnonymousAuthenticator([]byte(jwtSecret)), server.NewRoomAccess(loggerFactory, rooms, store), nil, nil)
+
+	// echo messages back so that tests can verify a client has been admitted
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sub, err := wss.Subscribe(w, r)
+		if err != nil {
+			return
+		}
+		for msg := range sub.Messages {
+			_ = sub.Adapter.Emit(sub.ClientID, msg)
+		}
+	}))
+
+	admin = httptest.NewServer(server.NewAdminHandler(
+		loggerFactory,
+		server.AdminConfig{AccessToken: adminAccessToken},
+		rooms,
+		newMockTracksManager(),
+		store,
+		newMockRecorder(),
+		nil,
+		nil,
+	))
+
+	_, _, err := store.Create(room, creatorID)
+	require.NoError(t, err)
+
+	wsURL = "ws" + strings.TrimPrefix(s.URL, "http") + "/ws/" + room + "/"
+	return wsURL, admin, func() {
+		admin.Close()
+		s.Close()
+		newAdapter.Close()
+	}
+}
+
+func adminRequest(t *testing.T, method string, url string, token string) (*http.Response, map[string]interface{}) {
+	t.Helper()
+	return adminRequestBody(t, method, url, token, nil)
+}
+
+func adminRequestBody(t *testing.T, method string, url string, token string, reqBody interface{}) (*http.Response, map[string]interface{}) {
+	t.Helper()
+	var reader io.Reader
+	if reqBody != nil {
+		data, err := json.Marshal(reqBody)
+		require.NoError(t, err)
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body := map[string]interface{}{}
+	if res.Header.Get("Content-Type") == "application/json" {
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	}
+	return res, body
+}
+
+func TestAdminHandler(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	defer http.DefaultClient.CloseIdleConnections()
+	wsURL, admin, cleanup := setupAdminServer(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ws1 := dialAsUser(t, ctx, wsURL+clientID, creatorID)
+	defer ws1.Close(websocket.StatusNormalClosure, "")
+	mustWriteWS(t, ctx, ws1, server.NewMessage("ready", room, nil))
+	readWSType(t, ctx, ws1, "ready")
+
+	ws2 := dialAsUser(t, ctx, wsURL+clientID2, "other-user")
+	defer ws2.Close(websocket.StatusNormalClosure, "")
+	mustWriteWS(t, ctx, ws2, server.NewMessage("ready", room, nil))
+	readWSType(t, ctx, ws2, "ready")
+
+	res, _ := adminRequest(t, "GET", admin.URL+"/rooms", "")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	res, _ = adminRequest(t, "GET", admin.URL+"/rooms", "invalid")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res, body := adminRequest(t, "GET", admin.URL+"/rooms", adminAccessToken)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, map[string]interface{}{
+		"rooms": []interface{}{
+			map[string]interface{}{"room": room, "participants": float64(2)},
+		},
+	}, body)
+
+	res, body = adminRequest(t, "GET", admin.URL+"/rooms/"+room, adminAccessToken)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, room, body["room"])
+	participants, _ := body["participants"].([]interface{})
+	require.Equal(t, 2, len(participants))
+	assert.Equal(t, clientID, participants[0].(map[string]interface{})["clientId"])
+	assert.Equal(t, clientID2, participants[1].(map[string]interface{})["clientId"])
+	assert.Equal(t, []interface{}{}, body["lobby"])
+	assert.Equal(t, creatorID, body["settings"].(map[string]interface{})["creatorId"])
+	assert.Equal(t, map[string]interface{}{"room": room, "recording": false}, body["recording"])
+
+	res, _ = adminRequest(t, "GET", admin.URL+"/rooms/missing", adminAccessToken)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, _ = adminRequest(t, "GET", admin.URL+"/rooms/"+room+"/stats", adminAccessToken)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "no tracks manager stats for mesh room")
+
+	res, _ = adminRequest(t, "DELETE", admin.URL+"/rooms/"+room+"/clients/missing", adminAccessToken)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, _ = adminRequest(t, "DELETE", admin.URL+"/rooms/"+room+"/clients/"+clientID2, adminAccessToken)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, _, err := ws2.Read(ctx)
+	assert.Equal(t, websocket.StatusPolicyViolation, websocket.CloseStatus(err), "client kicked")
+
+	res, _ = adminRequest(t, "DELETE", admin.URL+"/rooms/"+room, adminAccessToken)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	readWSType(t, ctx, ws1, "meeting_ended")
+	_, _, err = ws1.Read(ctx)
+	assert.Equal(t, websocket.StatusNormalClosure, websocket.CloseStatus(err), "room closed")
+
+	res, _ = adminRequest(t, "POST", admin.URL+"/drain", adminAccessToken)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "draining without drainer")
+}
+
+func TestAdminHandler_LogRules(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	defer http.DefaultClient.CloseIdleConnections()
+
+	logRules := logger.NewFactory(ioutil.Discard, []string{"-sdp", "*"})
+	sdpLog := logRules.GetLogger("sdp")
+
+	admin := httptest.NewServer(server.NewAdminHandler(
+		loggerFactory,
+		server.AdminConfig{AccessToken: adminAccessToken},
+		server.NewAdapterRoomManager(func(room string) server.Adapter {
+			return server.NewMemoryAdapter(room)
+		}),
+		newMockTracksManager(),
+		server.NewMemoryRoomStore(time.Hour),
+		newMockRecorder(),
+		nil,
+		logRules,
+	))
+	defer admin.Close()
+
+	res, _ := adminRequest(t, "GET", admin.URL+"/log", "")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res, body := adminRequest(t, "GET", admin.URL+"/log", adminAccessToken)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, map[string]interface{}{
+		"enabled": []interface{}{"-sdp", "*"},
+		"default": []interface{}{"-sdp", "*"},
+		"expires": nil,
+	}, body)
+
+	res, _ = adminRequestBody(t, "PUT", admin.URL+"/log", adminAccessToken, map[string]interface{}{})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "rules are required")
+	res, _ = adminRequestBody(t, "PUT", admin.URL+"/log", adminAccessToken, server.AdminLogRules{
+		Rules:   []string{"*"},
+		Minutes: -1,
+	})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "negative minutes")
+
+	res, body = adminRequestBody(t, "PUT", admin.URL+"/log", adminAccessToken, server.AdminLogRules{
+		Rules:   []string{"sdp", " "},
+		Minutes: 10,
+	})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []interface{}{"sdp"}, body["enabled"])
+	assert.Equal(t, []interface{}{"-sdp", "*"}, body["default"])
+	assert.NotNil(t, body["expires"])
+	assert.True(t, sdpLog.IsEnabled(logger.LevelInfo), "sdp enabled by override")
+
+	res, body = adminRequest(t, "DELETE", admin.URL+"/log/override", adminAccessToken)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, nil, body["expires"])
+	assert.False(t, sdpLog.IsEnabled(logger.LevelInfo), "override removed")
+
+	res, body = adminRequestBody(t, "PUT", admin.URL+"/log", adminAccessToken, server.AdminLogRules{
+		Rules: []string{"sdp:debug", "*"},
+	})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []interface{}{"sdp:debug", "*"}, body["default"])
+	assert.True(t, sdpLog.IsEnabled(logger.LevelDebug), "default rules replaced")
+}
+
+func TestRoomPeersManager_Transports(t *testing.T) {
+	manager := newTestRoomPeersManager()
+	defer manager.Close()
+
+	client1 := newFakeTransport("client1")
+	manager.Add(client1)
+	defer client1.Close()
+	client2 := newFakeTransport("client2")
+	manager.Add(client2)
+	defer client2.Close()
+
+	track := server.TrackInfo{
+		PayloadType: 111,
+		SSRC:        123,
+		ID:          "track1",
+		Label:       "stream1",
+		Kind:        webrtc.RTPCodecTypeAudio,
+	}
+	client1.publish(track)
+
+	select {
+	case <-client2.addedTracks:
+	case <-time.After(timeout):
+		require.Fail(t, "timed out waiting for track")
+	}
+
+	require.NoError(t, manager.Mute("client1", webrtc.RTPCodecTypeAudio, true))
+
+	state := server.TrackState{
+		SSRC:        123,
+		PayloadType: 111,
+		ID:          "track1",
+		Label:       "stream1",
+		Kind:        "audio",
+		Publisher:   "client1",
+		Muted:       true,
+	}
+
+	assert.Equal(t, []server.TransportState{{
+		ClientID:     "client1",
+		LocalTracks:  []server.TrackState{},
+		RemoteTracks: []server.TrackState{state},
+	}, {
+		ClientID:     "client2",
+		LocalTracks:  []server.TrackState{state},
+		RemoteTracks: []server.TrackState{},
+	}}, manager.Transports())
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const anonymousTokenCookieTTL = 30 * 24 * time.Hour
+
+// AnonymousAuthenticator creates a random user_id for every visitor and
+// stores it in a signed token in a cookie named jwt. Tokens signed with
+// DefaultJwtSecret could be signed by anyone, so only their user_id claim is
+// read. The other claims, like role and rooms, are trusted when the secret is
+// configured, so that a backend which knows it can mint tokens for its users.
+type AnonymousAuthenticator struct {
+	tokenAuth   *JWTAuth
+	trustClaims bool
+}
+
+var _ Authenticator = &AnonymousAuthenticator{}
+
+func NewAnonymousAuthenticator(secretKey []byte) *AnonymousAuthenticator {
+	return &AnonymousAuthenticator{
+		tokenAuth:   NewHMACJWTAuth(secretKey),
+		trustClaims: len(secretKey) > 0 && string(secretKey) != DefaultJwtSecret,
+	}
+}
+
+// Authenticate never fails. Users without a valid cookie remain anonymous
+// until Login is called. The nickname is read from the X-Forwarded-User
+// header when set.
+func (a *AnonymousAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	identity := Identity{
+		Nickname: r.Header.Get("X-Forwarded-User"),
+	}
+
+	cookie, err := r.Cookie("jwt")
+	if err != nil {
+		return identity, nil
+	}
+
+	claims, err := a.tokenAuth.DecodeClaims(cookie.Value)
+	if err != nil {
+		return identity, nil
+	}
+
+	identity.UserID, _ = claims["user_id"].(string)
+	identity.Claims = claims
+	if !a.trustClaims {
+		identity.Claims = map[string]interface{}{"user_id": identity.UserID}
+	}
+	return identity, nil
+}
+
+// Login creates a new token and saves it in a cookie named jwt.
+func (a *AnonymousAuthenticator) Login(w http.ResponseWriter, r *http.Request) (Identity, error) {
+	userID := NewUUIDBase62()
+	claims := jwt.MapClaims{"user_id": userID}
+
+	_, tokenString, err := a.tokenAuth.Encode(claims)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:    "jwt",
+		Value:   tokenString,
+		Path:    "/",
+		Expires: time.Now().Add(anonymousTokenCookieTTL),
+	})
+
+	return Identity{
+		UserID:   userID,
+		Nickname: r.Header.Get("X-Forwarded-User"),
+		Claims:   claims,
+	}, nil
+}
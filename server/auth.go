@@ -4,8 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net/http"
-	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/prometheus/common/log"
@@ -32,10 +30,10 @@ var (
 	ErrorCtxKey = &contextKey{"Error"}
 )
 
-var tokenAuth *JWTAuth
-
-func InitAuth(secretKey []byte) {
-	tokenAuth = &JWTAuth{
+// NewHMACJWTAuth creates a JWTAuth which signs and verifies tokens with the
+// HS256 algorithm.
+func NewHMACJWTAuth(secretKey []byte) *JWTAuth {
+	return &JWTAuth{
 		signKey:   secretKey,
 		verifyKey: nil,
 		signer:    jwt.GetSigningMethod("HS256"),
@@ -43,6 +41,33 @@ func InitAuth(secretKey []byte) {
 	}
 }
 
+// NewPublicKeyJWTAuth creates a JWTAuth which verifies tokens signed by
+// someone else. The PEM encoded public key can be an RSA key for the RS256
+// algorithm or an ECDSA key for ES256. The returned JWTAuth cannot sign
+// tokens.
+func NewPublicKeyJWTAuth(publicKeyPEM []byte) (*JWTAuth, error) {
+	var verifyKey interface{}
+	var signer jwt.SigningMethod
+
+	if rsaKey, err := jwt.ParseRSAPublicKeyFromPEM(publicKeyPEM); err == nil {
+		verifyKey = rsaKey
+		signer = jwt.SigningMethodRS256
+	} else if ecKey, err := jwt.ParseECPublicKeyFromPEM(publicKeyPEM); err == nil {
+		verifyKey = ecKey
+		signer = jwt.SigningMethodES256
+	} else {
+		return nil, errors.New("Error parsing public key: not an RSA or ECDSA public key")
+	}
+
+	return &JWTAuth{
+		verifyKey: verifyKey,
+		signer:    signer,
+		parser: &jwt.Parser{
+			ValidMethods: []string{signer.Alg()},
+		},
+	}, nil
+}
+
 func (ja *JWTAuth) Encode(claims jwt.Claims) (token *jwt.Token, tokenString string, err error) {
 	token = jwt.New(ja.signer)
 	token.Claims = claims
@@ -91,15 +116,9 @@ func FromAuthContext(ctx context.Context) (*jwt.Token, jwt.MapClaims, error) {
 	return token, claims, err
 }
 
-// JWTTokenFromCookie tries to retrieve the jwt.MapClaims from a cookie named
-// "jwt".
-func JWTTokenFromCookie(r *http.Request) (jwt.MapClaims, error) {
-	cookie, err := r.Cookie("jwt")
-	if err != nil {
-		return nil, ErrNoTokenFound
-	}
-
-	token, err := tokenAuth.Decode(cookie.Value)
+// DecodeClaims verifies a token and returns its claims.
+func (ja *JWTAuth) DecodeClaims(tokenString string) (jwt.MapClaims, error) {
+	token, err := ja.Decode(tokenString)
 	if err != nil {
 		if validationErr, ok := err.(*jwt.ValidationError); ok {
 			if validationErr.Errors&jwt.ValidationErrorExpired > 0 {
@@ -118,7 +137,7 @@ func JWTTokenFromCookie(r *http.Request) (jwt.MapClaims, error) {
 	}
 
 	// Verify signing algorithm
-	if token.Method != tokenAuth.signer {
+	if token.Method != ja.signer {
 		return nil, ErrAlgoInvalid
 	}
 	if tokenClaims, ok := token.Claims.(jwt.MapClaims); ok {
@@ -128,22 +147,6 @@ func JWTTokenFromCookie(r *http.Request) (jwt.MapClaims, error) {
 	return nil, ErrUnauthorized
 }
 
-// CreateTokenCookie create new jwt and saved in cookie named jwt
-func CreateTokenCookie(w http.ResponseWriter) string {
-	userID := NewUUIDBase62()
-
-	_, tokenString, _ := tokenAuth.Encode(jwt.MapClaims{"user_id": userID})
-
-	http.SetCookie(w, &http.Cookie{
-		Name:    "jwt",
-		Value:   tokenString,
-		Path:    "/",
-		Expires: time.Now().Add(time.Hour * 24 * 30),
-	})
-	return userID
-
-}
-
 // contextKey is a value for use with context.WithValue. It's used as
 // a pointer so it fits in an interface{} without allocation. This technique
 // for defining context keys was copied from Go 1.7's new use of context in net/http.
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+)
+
+// Role is the role claim of a user's token.
+type Role string
+
+const (
+	// RoleModerator can moderate every room the user can join.
+	RoleModerator Role = "moderator"
+	// RoleParticipant can publish and receive tracks.
+	RoleParticipant Role = "participant"
+	// RoleViewer can only receive tracks.
+	RoleViewer Role = "viewer"
+)
+
+// Identity is the user a request has been authenticated as.
+type Identity struct {
+	UserID   string
+	Nickname string
+	// Claims contains the claims of the user's token, if any.
+	Claims map[string]interface{}
+}
+
+// Role returns the role claim. Users without a role claim are participants,
+// and unknown roles are treated as viewers.
+func (i Identity) Role() Role {
+	role, ok := i.Claims["role"].(string)
+	if !ok {
+		return RoleParticipant
+	}
+
+	switch Role(role) {
+	case RoleModerator, RoleParticipant:
+		return Role(role)
+	default:
+		return RoleViewer
+	}
+}
+
+// CanJoin checks the rooms claim, which contains room IDs or patterns like
+// team-*. Users without a rooms claim can join any room.
+func (i Identity) CanJoin(room string) bool {
+	var patterns []interface{}
+
+	switch rooms := i.Claims["rooms"].(type) {
+	case nil:
+		return true
+	case string:
+		patterns = []interface{}{rooms}
+	case []interface{}:
+		patterns = rooms
+	default:
+		return false
+	}
+
+	for _, value := range patterns {
+		pattern, _ := value.(string)
+		if matched, err := path.Match(pattern, room); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ExpiresAt returns the time of the exp claim, if any.
+func (i Identity) ExpiresAt() (time.Time, bool) {
+	switch exp := i.Claims["exp"].(type) {
+	case float64:
+		return time.Unix(int64(exp), 0), true
+	case int64:
+		return time.Unix(exp, 0), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// Authenticator identifies the users who open calls and connect to rooms.
+type Authenticator interface {
+	// Authenticate returns the identity of the user who sent the request. An
+	// empty identity is returned when the user is allowed to remain anonymous,
+	// and an error when the request must be rejected.
+	Authenticate(r *http.Request) (Identity, error)
+	// Login is called when a user without an identity opens a call. It can
+	// create a new identity and store it in the response, for example in a
+	// cookie.
+	Login(w http.ResponseWriter, r *http.Request) (Identity, error)
+}
+
+// NewAuthenticator creates the Authenticator selected in config. Anonymous
+// users are identified by tokens signed with jwtSecret.
+func NewAuthenticator(loggerFactory LoggerFactory, config AuthConfig, jwtSecret string) (Authenticator, error) {
+	log := loggerFactory.GetLogger("auth")
+
+	switch config.Type {
+	case AuthenticatorTypeAnonymous, "":
+		log.Info("Using anonymous authentication", nil)
+		if jwtSecret == DefaultJwtSecret {
+			log.Warn("Using the default jwt_secret, only the user_id claim of tokens is used", nil)
+		}
+		return NewAnonymousAuthenticator([]byte(jwtSecret)), nil
+	case AuthenticatorTypeJWT:
+		log.Info("Using JWT authentication", Fields{"publicKey": config.JWT.PublicKeyFile})
+		return NewJWTAuthenticatorFromFile(config.JWT)
+	case AuthenticatorTypeProxy:
+		log.Info("Using reverse proxy authentication", Fields{"userHeader": config.Proxy.UserHeader})
+		return NewProxyAuthenticator(config.Proxy)
+	default:
+		return nil, fmt.Errorf("Unknown auth type: %s", config.Type)
+	}
+}
@@ -0,0 +1,341 @@
+package server_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/peer-calls/peer-calls/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"nhooyr.io/websocket"
+)
+
+func TestAnonymousAuthenticator(t *testing.T) {
+	auth := server.NewAnonymousAuthenticator([]byte(jwtSecret))
+
+	r := httptest.NewRequest("GET", "/call/abc", nil)
+	r.Header.Set("X-Forwarded-User", "Jane")
+	identity, err := auth.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, "", identity.UserID)
+	assert.Equal(t, "Jane", identity.Nickname)
+
+	w := httptest.NewRecorder()
+	identity, err = auth.Login(w, r)
+	require.NoError(t, err)
+	assert.NotEqual(t, "", identity.UserID)
+
+	cookies := w.Result().Cookies()
+	require.Equal(t, 1, len(cookies))
+	assert.Equal(t, "jwt", cookies[0].Name)
+
+	r = httptest.NewRequest("GET", "/call/abc", nil)
+	r.AddCookie(cookies[0])
+	identity2, err := auth.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, identity.UserID, identity2.UserID)
+
+	other := server.NewAnonymousAuthenticator([]byte("other-secret"))
+	identity3, err := other.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, "", identity3.UserID)
+}
+
+func TestAnonymousAuthenticator_defaultSecretIgnoresClaims(t *testing.T) {
+	auth := server.NewAnonymousAuthenticator([]byte(server.DefaultJwtSecret))
+
+	token := signToken(t, jwt.SigningMethodHS256, []byte(server.DefaultJwtSecret), jwt.MapClaims{
+		"user_id": "user1",
+		"role":    "moderator",
+		"rooms":   []string{"other"},
+	})
+	r := httptest.NewRequest("GET", "/call/abc", nil)
+	r.AddCookie(&http.Cookie{Name: "jwt", Value: token})
+	identity, err := auth.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", identity.UserID)
+	assert.Equal(t, server.RoleParticipant, identity.Role())
+	assert.True(t, identity.CanJoin("abc"))
+}
+
+func TestAnonymousAuthenticator_configuredSecretTrustsClaims(t *testing.T) {
+	auth := server.NewAnonymousAuthenticator([]byte(jwtSecret))
+
+	token := signToken(t, jwt.SigningMethodHS256, []byte(jwtSecret), jwt.MapClaims{
+		"user_id": "user1",
+		"role":    "moderator",
+		"rooms":   []string{"other"},
+	})
+	r := httptest.NewRequest("GET", "/call/abc", nil)
+	r.AddCookie(&http.Cookie{Name: "jwt", Value: token})
+	identity, err := auth.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", identity.UserID)
+	assert.Equal(t, server.RoleModerator, identity.Role())
+	assert.False(t, identity.CanJoin("abc"))
+	assert.True(t, identity.CanJoin("other"))
+}
+
+func encodePublicKey(t *testing.T, key interface{}) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	require.NoError(t, err)
+	return token
+}
+
+func authenticateToken(auth server.Authenticator, token string) (server.Identity, error) {
+	r := httptest.NewRequest("GET", "/ws/room/client", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return auth.Authenticate(r)
+}
+
+func testJWTAuthenticator(t *testing.T, method jwt.SigningMethod, privateKey interface{}, publicKey interface{}) {
+	auth, err := server.NewJWTAuthenticator(server.AuthConfigJWT{
+		Issuer:   "https://sso.example.com",
+		Audience: "peer-calls",
+	}, encodePublicKey(t, publicKey))
+	require.NoError(t, err)
+
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub":  "user1",
+			"name": "User One",
+			"iss":  "https://sso.example.com",
+			"aud":  []interface{}{"other", "peer-calls"},
+			"exp":  time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	identity, err := authenticateToken(auth, signToken(t, method, privateKey, claims()))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", identity.UserID)
+	assert.Equal(t, "User One", identity.Nickname)
+	assert.Equal(t, "user1", identity.Claims["sub"])
+
+	c := claims()
+	c["iss"] = "https://evil.example.com"
+	_, err = authenticateToken(auth, signToken(t, method, privateKey, c))
+	assert.Error(t, err, "wrong issuer")
+
+	c = claims()
+	c["aud"] = "other"
+	_, err = authenticateToken(auth, signToken(t, method, privateKey, c))
+	assert.Error(t, err, "wrong audience")
+
+	c = claims()
+	c["exp"] = time.Now().Add(-time.Hour).Unix()
+	_, err = authenticateToken(auth, signToken(t, method, privateKey, c))
+	assert.Equal(t, server.ErrExpired, err)
+
+	c = claims()
+	delete(c, "sub")
+	_, err = authenticateToken(auth, signToken(t, method, privateKey, c))
+	assert.Error(t, err, "missing sub")
+
+	_, err = authenticateToken(auth, signToken(t, jwt.SigningMethodHS256, encodePublicKey(t, publicKey), claims()))
+	assert.Error(t, err, "token signed with public key as HMAC secret")
+
+	_, err = auth.Authenticate(httptest.NewRequest("GET", "/ws/room/client", nil))
+	assert.Equal(t, server.ErrNoTokenFound, err)
+
+	r := httptest.NewRequest("GET", "/ws/room/client", nil)
+	r.AddCookie(&http.Cookie{Name: "jwt", Value: signToken(t, method, privateKey, claims())})
+	identity, err = auth.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", identity.UserID)
+
+	r = httptest.NewRequest("GET", "/ws/room/client?access_token="+signToken(t, method, privateKey, claims()), nil)
+	identity, err = auth.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", identity.UserID)
+
+	_, err = auth.Login(httptest.NewRecorder(), r)
+	assert.Equal(t, server.ErrUnauthorized, err)
+}
+
+func TestJWTAuthenticator_RS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	testJWTAuthenticator(t, jwt.SigningMethodRS256, key, &key.PublicKey)
+}
+
+func TestJWTAuthenticator_ES256(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	testJWTAuthenticator(t, jwt.SigningMethodES256, key, &key.PublicKey)
+}
+
+func TestJWTAuthenticator_invalidKey(t *testing.T) {
+	_, err := server.NewJWTAuthenticator(server.AuthConfigJWT{}, []byte("invalid"))
+	assert.Error(t, err)
+}
+
+func TestProxyAuthenticator(t *testing.T) {
+	auth, err := server.NewProxyAuthenticator(server.AuthConfigProxy{
+		TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"},
+	})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/call/abc", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-User", "user1")
+	identity, err := auth.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, server.Identity{UserID: "user1", Nickname: "user1"}, identity)
+
+	r.Header.Set("X-Forwarded-Preferred-Username", "User One")
+	identity, err = auth.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, server.Identity{UserID: "user1", Nickname: "User One"}, identity)
+
+	r.RemoteAddr = "192.168.1.1:1234"
+	_, err = auth.Authenticate(r)
+	assert.NoError(t, err)
+
+	r.RemoteAddr = "192.168.1.2:1234"
+	_, err = auth.Authenticate(r)
+	assert.Error(t, err, "untrusted proxy")
+
+	r = httptest.NewRequest("GET", "/call/abc", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	_, err = auth.Authenticate(r)
+	assert.Error(t, err, "missing header")
+}
+
+func TestProxyAuthenticator_noTrustedProxies(t *testing.T) {
+	_, err := server.NewProxyAuthenticator(server.AuthConfigProxy{})
+	assert.Error(t, err)
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	auth, err := server.NewAuthenticator(loggerFactory, server.AuthConfig{}, jwtSecret)
+	require.NoError(t, err)
+	assert.IsType(t, &server.AnonymousAuthenticator{}, auth)
+
+	auth, err = server.NewAuthenticator(loggerFactory, server.AuthConfig{
+		Type: server.AuthenticatorTypeProxy,
+		Proxy: server.AuthConfigProxy{
+			TrustedProxies: []string{"127.0.0.1"},
+		},
+	}, jwtSecret)
+	require.NoError(t, err)
+	assert.IsType(t, &server.ProxyAuthenticator{}, auth)
+
+	_, err = server.NewAuthenticator(loggerFactory, server.AuthConfig{
+		Type: server.AuthenticatorTypeJWT,
+		JWT: server.AuthConfigJWT{
+			PublicKeyFile: "missing.pem",
+		},
+	}, jwtSecret)
+	assert.Error(t, err)
+
+	_, err = server.NewAuthenticator(loggerFactory, server.AuthConfig{
+		Type: "invalid",
+	}, jwtSecret)
+	assert.Error(t, err)
+}
+
+func TestIdentity_Role(t *testing.T) {
+	assert.Equal(t, server.RoleParticipant, server.Identity{}.Role())
+	for _, role := range []server.Role{server.RoleModerator, server.RoleParticipant, server.RoleViewer} {
+		identity := server.Identity{Claims: map[string]interface{}{"role": string(role)}}
+		assert.Equal(t, role, identity.Role())
+	}
+	identity := server.Identity{Claims: map[string]interface{}{"role": "admin"}}
+	assert.Equal(t, server.RoleViewer, identity.Role())
+}
+
+func TestIdentity_CanJoin(t *testing.T) {
+	assert.True(t, server.Identity{}.CanJoin("room1"))
+
+	identity := server.Identity{Claims: map[string]interface{}{
+		"rooms": []interface{}{"room1", "team-*"},
+	}}
+	assert.True(t, identity.CanJoin("room1"))
+	assert.True(t, identity.CanJoin("team-a"))
+	assert.False(t, identity.CanJoin("room2"))
+
+	identity = server.Identity{Claims: map[string]interface{}{"rooms": "room1"}}
+	assert.True(t, identity.CanJoin("room1"))
+	assert.False(t, identity.CanJoin("room2"))
+
+	identity = server.Identity{Claims: map[string]interface{}{"rooms": []interface{}{}}}
+	assert.False(t, identity.CanJoin("room1"))
+}
+
+func setupJWTServer(t *testing.T) (key *ecdsa.PrivateKey, url string, cleanup func()) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	auth, err := server.NewJWTAuthenticator(server.AuthConfigJWT{}, encodePublicKey(t, &key.PublicKey))
+	require.NoError(t, err)
+
+	newAdapter := server.NewAdapterFactory(loggerFactory, server.StoreConfig{})
+	rooms := server.NewAdapterRoomManager(newAdapter.NewAdapter)
+	wss := server.NewWSS(loggerFactory, rooms, auth, nil, nil, nil)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sub, err := wss.Subscribe(w, r)
+		if err != nil {
+			return
+		}
+		for msg := range sub.Messages {
+			_ = sub.Adapter.Emit(sub.ClientID, msg)
+		}
+	}))
+
+	url = "ws" + strings.TrimPrefix(s.URL, "http") + "/ws/" + room + "/"
+	return key, url, func() {
+		s.Close()
+		newAdapter.Close()
+	}
+}
+
+func TestWSS_claims(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	key, url, cleanup := setupJWTServer(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	dial := func(claims jwt.MapClaims) (*websocket.Conn, *http.Response, error) {
+		token := signToken(t, jwt.SigningMethodES256, key, claims)
+		return websocket.Dial(ctx, url+"client1?access_token="+token, nil)
+	}
+
+	_, resp, err := websocket.Dial(ctx, url+"client1", nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	_, resp, err = dial(jwt.MapClaims{"sub": "user1", "rooms": []string{"other"}})
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	ws, _, err := dial(jwt.MapClaims{"sub": "user1", "rooms": []string{room}})
+	require.NoError(t, err)
+	assertEcho(t, ctx, ws)
+	ws.Close(websocket.StatusNormalClosure, "")
+
+	ws, _, err = dial(jwt.MapClaims{"sub": "user1", "exp": time.Now().Add(time.Second).Unix()})
+	require.NoError(t, err)
+	assertEcho(t, ctx, ws)
+	assertClosed(t, ctx, ws, websocket.StatusPolicyViolation)
+}
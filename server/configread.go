@@ -3,10 +3,10 @@ package server
 import (
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -31,14 +31,10 @@ func ReadConfigFiles(filenames []string, c *Config) (err error) {
 	return err
 }
 
-func InitConfig(c *Config) {
-	c.BindPort = 3000
-	c.Network.Type = NetworkTypeMesh
-	c.Store.Type = StoreTypeMemory
-	c.RecordServiceURL = "http://localhost:8081"
-	// Just a random string
-	// Highly recommended set this in config
-	c.JwtSecret = `jfoObcXCpJLLeYfYimqF
+// DefaultJwtSecret signs the tokens of anonymous users when no jwt_secret is
+// configured. It is public, so only the user_id claim of tokens signed with it
+// can be trusted.
+const DefaultJwtSecret = `jfoObcXCpJLLeYfYimqF
 					EksfBfMxFZjpQIsoqX2K
 					3fc1z1IiVeOdAFWrFOVh
 					hmg6KfrTK4Gguy9tGegL
@@ -58,22 +54,75 @@ func InitConfig(c *Config) {
 					ZONh8VFxOd3jLgXrrRRq
 					LZWVuUxgeOjJCoJZ15ck
 					46C7kV3iiNJG0zsUcN0I`
-	// c.ICEServers = []ICEServer{{
-	// 	// URLs: []string{"stun:77.73.69.56:3478"}, //URLs: []string{"stun:stun.l.google.com:19302"},
-	// 	// }, {
-	// 	// 	URLs: []string{"stun:77.73.69.56:3478"}, //URLs: []string{"stun:global.stun.twilio.com:3478?transport=udp"},
-	// }}
+
+func InitConfig(c *Config) {
+	c.BindPort = 3000
+	c.Network.Type = NetworkTypeMesh
+	c.Network.SFU.DisconnectGracePeriod = DefaultDisconnectGracePeriod
+	c.Network.SFU.ResumeTimeout = DefaultResumeTimeout
+	c.Network.SFU.Relay.Interval = DefaultRelayInterval
+	c.Network.SFU.Affinity.Mode = AffinityModeProxy
+	c.Network.SFU.Affinity.LeaseTTL = DefaultAffinityLeaseTTL
+	c.Shutdown.DrainTimeout = DefaultDrainTimeout
+	c.Tracing.ServiceName = DefaultTracingServiceName
+	c.Tracing.SampleRatio = DefaultTracingSampleRatio
+	c.Prometheus.RoomMetrics.MaxRooms = DefaultRoomMetricsMaxRooms
+	c.Prometheus.RoomMetrics.MaxTracks = DefaultRoomMetricsMaxTracks
+	c.Store.Type = StoreTypeMemory
+	c.Store.RoomTTL = 24 * time.Hour
+	c.Auth.Type = AuthenticatorTypeAnonymous
+	c.RecordServiceURL = "http://localhost:8081"
+	c.Record.Dir = "recordings"
+	c.Record.Format = RecordFormatWebM
+	c.JwtSecret = DefaultJwtSecret
+	c.ICEServers = []ICEServer{{
+		URLs: []string{"stun:stun.l.google.com:19302"},
+	}, {
+		URLs: []string{"stun:global.stun.twilio.com:3478?transport=udp"},
+	}}
 }
 
-func ReadConfig(filenames []string) (c Config, err error) {
+func ReadConfig(log Logger, filenames []string) (c Config, err error) {
 	InitConfig(&c)
-	log.Printf("After init config: %+v", c)
+	log.Debug("After init config", Fields{"config": fmt.Sprintf("%+v", c.Redacted())})
 	err = ReadConfigFiles(filenames, &c)
-	log.Printf("After read config files : %+v", c)
+	log.Debug("After read config files", Fields{"config": fmt.Sprintf("%+v", c.Redacted())})
 	ReadConfigFromEnv("PEERCALLS_", &c)
 	return c, err
 }
 
+// redacted is logged in place of secrets.
+const redacted = "[redacted]"
+
+// Redacted returns a copy of the config with secrets, tokens and passwords
+// replaced so that it can be logged.
+func (c Config) Redacted() Config {
+	redact := func(value *string) {
+		if *value != "" {
+			*value = redacted
+		}
+	}
+
+	redact(&c.JwtSecret)
+	redact(&c.Admin.AccessToken)
+	redact(&c.Prometheus.AccessToken)
+	redact(&c.Network.SFU.Relay.Secret)
+
+	if c.ICEServers != nil {
+		iceServers := make([]ICEServer, len(c.ICEServers))
+		copy(iceServers, c.ICEServers)
+
+		for i := range iceServers {
+			redact(&iceServers[i].AuthSecret.Secret)
+			redact(&iceServers[i].AuthStatic.Password)
+		}
+
+		c.ICEServers = iceServers
+	}
+
+	return c
+}
+
 func ReadConfigYAML(reader io.Reader, c *Config) error {
 	decoder := yaml.NewDecoder(reader)
 	if err := decoder.Decode(c); err != nil {
@@ -89,16 +138,40 @@ func ReadConfigFromEnv(prefix string, c *Config) {
 	setEnvString(&c.TLS.Cert, prefix+"TLS_CERT")
 	setEnvString(&c.TLS.Key, prefix+"TLS_KEY")
 	setEnvString(&c.JwtSecret, prefix+"JWT_SECRET")
+	setEnvAuthenticatorType(&c.Auth.Type, prefix+"AUTH_TYPE")
+	setEnvString(&c.Auth.JWT.PublicKeyFile, prefix+"AUTH_JWT_PUBLIC_KEY_FILE")
+	setEnvString(&c.Auth.JWT.Issuer, prefix+"AUTH_JWT_ISSUER")
+	setEnvString(&c.Auth.JWT.Audience, prefix+"AUTH_JWT_AUDIENCE")
+	setEnvString(&c.Auth.JWT.UserClaim, prefix+"AUTH_JWT_USER_CLAIM")
+	setEnvString(&c.Auth.JWT.NicknameClaim, prefix+"AUTH_JWT_NICKNAME_CLAIM")
+	setEnvString(&c.Auth.JWT.Cookie, prefix+"AUTH_JWT_COOKIE")
+	setEnvString(&c.Auth.Proxy.UserHeader, prefix+"AUTH_PROXY_USER_HEADER")
+	setEnvString(&c.Auth.Proxy.NicknameHeader, prefix+"AUTH_PROXY_NICKNAME_HEADER")
+	setEnvStringArray(&c.Auth.Proxy.TrustedProxies, prefix+"AUTH_PROXY_TRUSTED_PROXIES")
 	setEnvString(&c.RecordServiceURL, prefix+"RECORD_SERVICE_URL")
+	setEnvRecordType(&c.Record.Type, prefix+"RECORD_TYPE")
+	setEnvString(&c.Record.Dir, prefix+"RECORD_DIR")
+	setEnvRecordFormat(&c.Record.Format, prefix+"RECORD_FORMAT")
 
 	setEnvStoreType(&c.Store.Type, prefix+"STORE_TYPE")
 	setEnvString(&c.Store.Redis.Host, prefix+"STORE_REDIS_HOST")
 	setEnvInt(&c.Store.Redis.Port, prefix+"STORE_REDIS_PORT")
 	setEnvString(&c.Store.Redis.Prefix, prefix+"STORE_REDIS_PREFIX")
+	setEnvDuration(&c.Store.RoomTTL, prefix+"STORE_ROOM_TTL")
 
 	setEnvNetworkType(&c.Network.Type, prefix+"NETWORK_TYPE")
 	setEnvStringArray(&c.Network.SFU.Interfaces, prefix+"NETWORK_SFU_INTERFACES")
 	setEnvBool(&c.Network.SFU.JitterBuffer, prefix+"NETWORK_SFU_JITTER_BUFFER")
+	setEnvDuration(&c.Network.SFU.DisconnectGracePeriod, prefix+"NETWORK_SFU_DISCONNECT_GRACE_PERIOD")
+	setEnvDuration(&c.Network.SFU.ResumeTimeout, prefix+"NETWORK_SFU_RESUME_TIMEOUT")
+	setEnvDuration(&c.Network.SFU.StatsInterval, prefix+"NETWORK_SFU_STATS_INTERVAL")
+	setEnvString(&c.Network.SFU.Relay.BindAddr, prefix+"NETWORK_SFU_RELAY_BIND_ADDR")
+	setEnvString(&c.Network.SFU.Relay.AdvertiseAddr, prefix+"NETWORK_SFU_RELAY_ADVERTISE_ADDR")
+	setEnvString(&c.Network.SFU.Relay.Secret, prefix+"NETWORK_SFU_RELAY_SECRET")
+	setEnvDuration(&c.Network.SFU.Relay.Interval, prefix+"NETWORK_SFU_RELAY_INTERVAL")
+	setEnvString(&c.Network.SFU.Affinity.AdvertiseURL, prefix+"NETWORK_SFU_AFFINITY_ADVERTISE_URL")
+	setEnvAffinityMode(&c.Network.SFU.Affinity.Mode, prefix+"NETWORK_SFU_AFFINITY_MODE")
+	setEnvDuration(&c.Network.SFU.Affinity.LeaseTTL, prefix+"NETWORK_SFU_AFFINITY_LEASE_TTL")
 
 	var ice ICEServer
 	setEnvSlice(&ice.URLs, prefix+"ICE_SERVER_URLS")
@@ -107,6 +180,9 @@ func ReadConfigFromEnv(prefix string, c *Config) {
 		setEnvAuthType(&ice.AuthType, prefix+"ICE_SERVER_AUTH_TYPE")
 		setEnvString(&ice.AuthSecret.Secret, prefix+"ICE_SERVER_SECRET")
 		setEnvString(&ice.AuthSecret.Username, prefix+"ICE_SERVER_USERNAME")
+		setEnvDuration(&ice.AuthSecret.TTL, prefix+"ICE_SERVER_TTL")
+		setEnvString(&ice.AuthStatic.Username, prefix+"ICE_SERVER_USERNAME")
+		setEnvString(&ice.AuthStatic.Password, prefix+"ICE_SERVER_PASSWORD")
 		if len(c.ICEServers) < 1 {
 			c.ICEServers = []ICEServer{ice}
 		} else {
@@ -116,6 +192,14 @@ func ReadConfigFromEnv(prefix string, c *Config) {
 	}
 
 	setEnvString(&c.Prometheus.AccessToken, prefix+"PROMETHEUS_ACCESS_TOKEN")
+	setEnvBool(&c.Prometheus.RoomMetrics.Enabled, prefix+"PROMETHEUS_ROOM_METRICS_ENABLED")
+	setEnvInt(&c.Prometheus.RoomMetrics.MaxRooms, prefix+"PROMETHEUS_ROOM_METRICS_MAX_ROOMS")
+	setEnvInt(&c.Prometheus.RoomMetrics.MaxTracks, prefix+"PROMETHEUS_ROOM_METRICS_MAX_TRACKS")
+	setEnvString(&c.Admin.AccessToken, prefix+"ADMIN_ACCESS_TOKEN")
+	setEnvDuration(&c.Shutdown.DrainTimeout, prefix+"SHUTDOWN_DRAIN_TIMEOUT")
+	setEnvString(&c.Tracing.Endpoint, prefix+"TRACING_ENDPOINT")
+	setEnvString(&c.Tracing.ServiceName, prefix+"TRACING_SERVICE_NAME")
+	setEnvFloat(&c.Tracing.SampleRatio, prefix+"TRACING_SAMPLE_RATIO")
 }
 
 func setEnvSlice(dest *[]string, name string) {
@@ -141,6 +225,20 @@ func setEnvInt(dest *int, name string) {
 	}
 }
 
+func setEnvFloat(dest *float64, name string) {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err == nil {
+		*dest = value
+	}
+}
+
+func setEnvDuration(dest *time.Duration, name string) {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err == nil {
+		*dest = value
+	}
+}
+
 func setEnvBool(dest *bool, name string) {
 	*dest = os.Getenv(name) == "true"
 }
@@ -150,11 +248,25 @@ func setEnvAuthType(authType *AuthType, name string) {
 	switch AuthType(value) {
 	case AuthTypeSecret:
 		*authType = AuthTypeSecret
+	case AuthTypeStatic:
+		*authType = AuthTypeStatic
 	case AuthTypeNone:
 		*authType = AuthTypeNone
 	}
 }
 
+func setEnvAuthenticatorType(authenticatorType *AuthenticatorType, name string) {
+	value := os.Getenv(name)
+	switch AuthenticatorType(value) {
+	case AuthenticatorTypeAnonymous:
+		*authenticatorType = AuthenticatorTypeAnonymous
+	case AuthenticatorTypeJWT:
+		*authenticatorType = AuthenticatorTypeJWT
+	case AuthenticatorTypeProxy:
+		*authenticatorType = AuthenticatorTypeProxy
+	}
+}
+
 func setEnvNetworkType(networkType *NetworkType, name string) {
 	value := os.Getenv(name)
 	switch NetworkType(value) {
@@ -165,6 +277,16 @@ func setEnvNetworkType(networkType *NetworkType, name string) {
 	}
 }
 
+func setEnvAffinityMode(affinityMode *AffinityMode, name string) {
+	value := os.Getenv(name)
+	switch AffinityMode(value) {
+	case AffinityModeProxy:
+		*affinityMode = AffinityModeProxy
+	case AffinityModeRedirect:
+		*affinityMode = AffinityModeRedirect
+	}
+}
+
 func setEnvStoreType(storeType *StoreType, name string) {
 	value := os.Getenv(name)
 	switch StoreType(value) {
@@ -175,6 +297,26 @@ func setEnvStoreType(storeType *StoreType, name string) {
 	}
 }
 
+func setEnvRecordType(recordType *RecordType, name string) {
+	value := os.Getenv(name)
+	switch RecordType(value) {
+	case RecordTypeLocal:
+		*recordType = RecordTypeLocal
+	case RecordTypeHTTP:
+		*recordType = RecordTypeHTTP
+	}
+}
+
+func setEnvRecordFormat(recordFormat *RecordFormat, name string) {
+	value := os.Getenv(name)
+	switch RecordFormat(value) {
+	case RecordFormatWebM:
+		*recordFormat = RecordFormatWebM
+	case RecordFormatOgg:
+		*recordFormat = RecordFormatOgg
+	}
+}
+
 func setEnvStringArray(interfaces *[]string, name string) {
 	value := os.Getenv(name)
 	if value != "" {
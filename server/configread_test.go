@@ -1,9 +1,11 @@
 package server_test
 
 import (
+	"fmt"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/peer-calls/peer-calls/server"
 	"github.com/peer-calls/peer-calls/server/test"
@@ -12,7 +14,7 @@ import (
 )
 
 func TestReadConfig(t *testing.T) {
-	c, err := server.ReadConfig([]string{})
+	c, err := server.ReadConfig(loggerFactory.GetLogger("config"), []string{})
 	assert.Nil(t, err, "error reading config")
 	assert.Equal(t, 2, len(c.ICEServers))
 	assert.Equal(t, []string{"stun:stun.l.google.com:19302"}, c.ICEServers[0].URLs)
@@ -32,13 +34,19 @@ func TestReadConfigFiles(t *testing.T) {
 	assert.Equal(t, "localhost", c.Store.Redis.Host)
 	assert.Equal(t, 6379, c.Store.Redis.Port)
 	assert.Equal(t, "peercalls", c.Store.Redis.Prefix)
+	assert.Equal(t, 2*time.Hour, c.Store.RoomTTL)
 	assert.Equal(t, 1, len(c.ICEServers))
 	ice := c.ICEServers[0]
 	assert.Equal(t, []string{"stun:stun.l.google.com:19302"}, ice.URLs)
 	assert.Equal(t, server.AuthTypeSecret, ice.AuthType)
 	assert.Equal(t, "test_user", ice.AuthSecret.Username)
 	assert.Equal(t, "test_secret", ice.AuthSecret.Secret)
+	assert.Equal(t, 12*time.Hour, ice.AuthSecret.TTL)
 	assert.Equal(t, []string(nil), c.Network.SFU.Interfaces)
+	assert.Equal(t, server.AuthenticatorTypeJWT, c.Auth.Type)
+	assert.Equal(t, "sso.pem", c.Auth.JWT.PublicKeyFile)
+	assert.Equal(t, "https://sso.example.com", c.Auth.JWT.Issuer)
+	assert.Equal(t, "peer-calls", c.Auth.JWT.Audience)
 }
 
 func TestReadConfigFiles_Error(t *testing.T) {
@@ -57,6 +65,28 @@ func TestReadYAML_error(t *testing.T) {
 	assert.Regexp(t, "Error parsing YAML", err.Error())
 }
 
+func TestConfig_Redacted(t *testing.T) {
+	var c server.Config
+	c.JwtSecret = "jwt_secret"
+	c.Admin.AccessToken = "admin_token"
+	c.Prometheus.AccessToken = "prometheus_token"
+	c.Network.SFU.Relay.Secret = "relay_secret"
+	c.ICEServers = make([]server.ICEServer, 2)
+	c.ICEServers[0].AuthSecret.Username = "test_user"
+	c.ICEServers[0].AuthSecret.Secret = "ice_secret"
+	c.ICEServers[1].AuthStatic.Password = "ice_password"
+
+	r := c.Redacted()
+
+	assert.NotContains(t, fmt.Sprintf("%+v", r), "secret")
+	assert.NotContains(t, fmt.Sprintf("%+v", r), "token")
+	assert.NotContains(t, fmt.Sprintf("%+v", r), "password")
+	assert.Equal(t, "[redacted]", r.Admin.AccessToken)
+	assert.Equal(t, "test_user", r.ICEServers[0].AuthSecret.Username)
+	assert.Equal(t, "", r.ICEServers[1].AuthSecret.Secret)
+	assert.Equal(t, "ice_secret", c.ICEServers[0].AuthSecret.Secret, "original modified")
+}
+
 func TestReadFromEnv(t *testing.T) {
 	prefix := "PEERCALLSTEST_"
 	defer test.UnsetEnvPrefix(prefix)
@@ -67,14 +97,40 @@ func TestReadFromEnv(t *testing.T) {
 	os.Setenv(prefix+"STORE_REDIS_HOST", "localhost")
 	os.Setenv(prefix+"STORE_REDIS_PORT", "6379")
 	os.Setenv(prefix+"STORE_REDIS_PREFIX", "peercalls")
+	os.Setenv(prefix+"STORE_ROOM_TTL", "1h30m")
 	os.Setenv(prefix+"ICE_SERVER_URLS", "stun:stun.l.google.com:19302,stuns:stun.l.google.com:19302")
 	os.Setenv(prefix+"ICE_SERVER_AUTH_TYPE", "secret")
 	os.Setenv(prefix+"ICE_SERVER_USERNAME", "test_user")
 	os.Setenv(prefix+"ICE_SERVER_SECRET", "test_secret")
+	os.Setenv(prefix+"ICE_SERVER_TTL", "2h")
 	os.Setenv(prefix+"NETWORK_TYPE", "sfu")
 	os.Setenv(prefix+"NETWORK_SFU_INTERFACES", "a,b")
 	os.Setenv(prefix+"NETWORK_SFU_JITTER_BUFFER", "true")
+	os.Setenv(prefix+"NETWORK_SFU_DISCONNECT_GRACE_PERIOD", "45s")
+	os.Setenv(prefix+"NETWORK_SFU_RESUME_TIMEOUT", "1m")
+	os.Setenv(prefix+"NETWORK_SFU_STATS_INTERVAL", "5s")
+	os.Setenv(prefix+"NETWORK_SFU_RELAY_BIND_ADDR", "0.0.0.0:3002")
+	os.Setenv(prefix+"NETWORK_SFU_RELAY_ADVERTISE_ADDR", "10.0.0.1:3002")
+	os.Setenv(prefix+"NETWORK_SFU_RELAY_SECRET", "relay_secret")
+	os.Setenv(prefix+"NETWORK_SFU_RELAY_INTERVAL", "5s")
+	os.Setenv(prefix+"NETWORK_SFU_AFFINITY_ADVERTISE_URL", "http://10.0.0.1:3000")
+	os.Setenv(prefix+"NETWORK_SFU_AFFINITY_MODE", "redirect")
+	os.Setenv(prefix+"NETWORK_SFU_AFFINITY_LEASE_TTL", "1m")
 	os.Setenv(prefix+"PROMETHEUS_ACCESS_TOKEN", "at1234")
+	os.Setenv(prefix+"PROMETHEUS_ROOM_METRICS_ENABLED", "true")
+	os.Setenv(prefix+"PROMETHEUS_ROOM_METRICS_MAX_ROOMS", "10")
+	os.Setenv(prefix+"PROMETHEUS_ROOM_METRICS_MAX_TRACKS", "50")
+	os.Setenv(prefix+"ADMIN_ACCESS_TOKEN", "admin1234")
+	os.Setenv(prefix+"SHUTDOWN_DRAIN_TIMEOUT", "5m")
+	os.Setenv(prefix+"TRACING_ENDPOINT", "http://localhost:4318")
+	os.Setenv(prefix+"TRACING_SERVICE_NAME", "peer-calls-test")
+	os.Setenv(prefix+"TRACING_SAMPLE_RATIO", "0.25")
+	os.Setenv(prefix+"RECORD_TYPE", "http")
+	os.Setenv(prefix+"RECORD_DIR", "/tmp/recordings")
+	os.Setenv(prefix+"RECORD_FORMAT", "ogg")
+	os.Setenv(prefix+"AUTH_TYPE", "proxy")
+	os.Setenv(prefix+"AUTH_PROXY_USER_HEADER", "X-User")
+	os.Setenv(prefix+"AUTH_PROXY_TRUSTED_PROXIES", "10.0.0.0/8,127.0.0.1")
 	var c server.Config
 	server.ReadConfigFromEnv(prefix, &c)
 	assert.Equal(t, "/test", c.BaseURL)
@@ -84,6 +140,7 @@ func TestReadFromEnv(t *testing.T) {
 	assert.Equal(t, "localhost", c.Store.Redis.Host)
 	assert.Equal(t, 6379, c.Store.Redis.Port)
 	assert.Equal(t, "peercalls", c.Store.Redis.Prefix)
+	assert.Equal(t, 90*time.Minute, c.Store.RoomTTL)
 	assert.Equal(t, 1, len(c.ICEServers))
 	ice := c.ICEServers[0]
 	assert.Equal(t, []string{
@@ -93,8 +150,41 @@ func TestReadFromEnv(t *testing.T) {
 	assert.Equal(t, server.AuthTypeSecret, ice.AuthType)
 	assert.Equal(t, "test_user", ice.AuthSecret.Username)
 	assert.Equal(t, "test_secret", ice.AuthSecret.Secret)
+	assert.Equal(t, 2*time.Hour, ice.AuthSecret.TTL)
 	assert.Equal(t, server.NetworkType("sfu"), c.Network.Type)
 	assert.Equal(t, []string{"a", "b"}, c.Network.SFU.Interfaces)
 	assert.Equal(t, true, c.Network.SFU.JitterBuffer)
+	assert.Equal(t, 45*time.Second, c.Network.SFU.DisconnectGracePeriod)
+	assert.Equal(t, time.Minute, c.Network.SFU.ResumeTimeout)
+	assert.Equal(t, 5*time.Second, c.Network.SFU.StatsInterval)
+	assert.Equal(t, server.NetworkConfigSFURelay{
+		BindAddr:      "0.0.0.0:3002",
+		AdvertiseAddr: "10.0.0.1:3002",
+		Secret:        "relay_secret",
+		Interval:      5 * time.Second,
+	}, c.Network.SFU.Relay)
+	assert.Equal(t, server.NetworkConfigSFUAffinity{
+		AdvertiseURL: "http://10.0.0.1:3000",
+		Mode:         server.AffinityModeRedirect,
+		LeaseTTL:     time.Minute,
+	}, c.Network.SFU.Affinity)
 	assert.Equal(t, "at1234", c.Prometheus.AccessToken)
+	assert.Equal(t, server.RoomMetricsConfig{
+		Enabled:   true,
+		MaxRooms:  10,
+		MaxTracks: 50,
+	}, c.Prometheus.RoomMetrics)
+	assert.Equal(t, "admin1234", c.Admin.AccessToken)
+	assert.Equal(t, 5*time.Minute, c.Shutdown.DrainTimeout)
+	assert.Equal(t, server.TracingConfig{
+		Endpoint:    "http://localhost:4318",
+		ServiceName: "peer-calls-test",
+		SampleRatio: 0.25,
+	}, c.Tracing)
+	assert.Equal(t, server.RecordTypeHTTP, c.Record.Type)
+	assert.Equal(t, "/tmp/recordings", c.Record.Dir)
+	assert.Equal(t, server.RecordFormatOgg, c.Record.Format)
+	assert.Equal(t, server.AuthenticatorTypeProxy, c.Auth.Type)
+	assert.Equal(t, "X-User", c.Auth.Proxy.UserHeader)
+	assert.Equal(t, []string{"10.0.0.0/8", "127.0.0.1"}, c.Auth.Proxy.TrustedProxies)
 }
@@ -1,19 +1,30 @@
 package server
 
+import "time"
+
 type AuthType string
 
 const (
 	AuthTypeSecret AuthType = "secret"
+	AuthTypeStatic AuthType = "static"
 	AuthTypeNone   AuthType = ""
 )
 
+// ICEServer is a STUN or TURN server. With AuthTypeSecret clients get
+// time-limited TURN REST credentials which are valid for AuthSecret.TTL, and
+// with AuthTypeStatic they get the username and password from AuthStatic.
 type ICEServer struct {
 	URLs       []string `yaml:"urls"`
 	AuthType   AuthType `yaml:"auth_type"`
 	AuthSecret struct {
-		Username string `yaml:"username"`
-		Secret   string `yaml:"secret"`
+		Username string        `yaml:"username"`
+		Secret   string        `yaml:"secret"`
+		TTL      time.Duration `yaml:"ttl"`
 	} `yaml:"auth_secret"`
+	AuthStatic struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"auth_static"`
 }
 
 type TLSConfig struct {
@@ -34,9 +45,12 @@ type RedisConfig struct {
 	Prefix string `yaml:"prefix"`
 }
 
+// StoreConfig selects where rooms and their clients are stored. Rooms which
+// have not been used for RoomTTL are removed.
 type StoreConfig struct {
-	Type  StoreType   `yaml:"type"`
-	Redis RedisConfig `yaml:"redis"`
+	Type    StoreType     `yaml:"type"`
+	Redis   RedisConfig   `yaml:"redis"`
+	RoomTTL time.Duration `yaml:"room_ttl"`
 }
 
 type NetworkType string
@@ -54,12 +68,159 @@ type NetworkConfig struct {
 type NetworkConfigSFU struct {
 	Interfaces   []string `yaml:"interfaces"`
 	JitterBuffer bool     `yaml:"jitter_buffer"`
+	// DisconnectGracePeriod is the time a peer has to reconnect after ICE
+	// disconnects before its tracks are removed. The peer is removed
+	// immediately when it is zero.
+	DisconnectGracePeriod time.Duration `yaml:"disconnect_grace_period"`
+	// ResumeTimeout is the time a client has to reconnect its websocket and
+	// resume its session. Sessions cannot be resumed when it is zero.
+	ResumeTimeout time.Duration `yaml:"resume_timeout"`
+	// StatsInterval is how often the moderator of a room receives the
+	// statistics of the transports and tracks in the room. Statistics are not
+	// sent when it is zero.
+	StatsInterval time.Duration            `yaml:"stats_interval"`
+	Relay         NetworkConfigSFURelay    `yaml:"relay"`
+	Affinity      NetworkConfigSFUAffinity `yaml:"affinity"`
+}
+
+type AffinityMode string
+
+const (
+	// AffinityModeProxy proxies requests for rooms owned by other instances.
+	AffinityModeProxy AffinityMode = "proxy"
+	// AffinityModeRedirect redirects clients to the instance which owns the
+	// room.
+	AffinityModeRedirect AffinityMode = "redirect"
+)
+
+// NetworkConfigSFUAffinity pins each room to the instance which claimed it
+// first, so that all clients in a room connect to the same instance. Affinity
+// is enabled when AdvertiseURL is set. Instances claim rooms through the
+// store, so all instances must use the same redis store.
+type NetworkConfigSFUAffinity struct {
+	// AdvertiseURL is the URL requests for rooms owned by this instance are
+	// proxied or redirected to, for example http://10.0.0.1:3000.
+	AdvertiseURL string       `yaml:"advertise_url"`
+	Mode         AffinityMode `yaml:"mode"`
+	// LeaseTTL is the time an instance keeps a room after its last client has
+	// left.
+	LeaseTTL time.Duration `yaml:"lease_ttl"`
+}
+
+// NetworkConfigSFURelay configures relaying tracks between server instances
+// with clients in the same room. Relaying is enabled when BindAddr is set.
+// Instances find each other through the store, so all instances must use the
+// same redis store.
+type NetworkConfigSFURelay struct {
+	// BindAddr is the UDP address to receive packets from other instances on.
+	BindAddr string `yaml:"bind_addr"`
+	// AdvertiseAddr is the address other instances send packets to. It
+	// defaults to BindAddr.
+	AdvertiseAddr string `yaml:"advertise_addr"`
+	// Secret authenticates the packets exchanged between instances. It is
+	// required.
+	Secret string `yaml:"secret"`
+	// Interval is how often instances look for other instances in their rooms.
+	Interval time.Duration `yaml:"interval"`
 }
 
 type PrometheusConfig struct {
+	AccessToken string            `yaml:"access_token"`
+	RoomMetrics RoomMetricsConfig `yaml:"room_metrics"`
+}
+
+// RoomMetricsConfig enables exporting the participants and track statistics
+// of each room. At most MaxRooms rooms and MaxTracks tracks are exported.
+type RoomMetricsConfig struct {
+	Enabled   bool `yaml:"enabled"`
+	MaxRooms  int  `yaml:"max_rooms"`
+	MaxTracks int  `yaml:"max_tracks"`
+}
+
+// AdminConfig configures the admin endpoints, which are disabled when no
+// AccessToken is set.
+type AdminConfig struct {
 	AccessToken string `yaml:"access_token"`
 }
 
+// ShutdownConfig configures draining the server before it shuts down.
+type ShutdownConfig struct {
+	// DrainTimeout is the time to wait for rooms to become empty before the
+	// remaining clients are disconnected.
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+}
+
+// TracingConfig configures exporting traces of signalling to an OTLP
+// collector. Tracing is disabled when no Endpoint is set.
+type TracingConfig struct {
+	// Endpoint is the URL of the OTLP HTTP endpoint, for example
+	// http://localhost:4318. Traces are sent without TLS to http URLs.
+	Endpoint    string `yaml:"endpoint"`
+	ServiceName string `yaml:"service_name"`
+	// SampleRatio is the fraction of traces to sample, between 0 and 1.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+type RecordFormat string
+
+const (
+	RecordFormatWebM RecordFormat = "webm"
+	RecordFormatOgg  RecordFormat = "ogg"
+)
+
+type RecordType string
+
+const (
+	RecordTypeLocal RecordType = "local"
+	RecordTypeHTTP  RecordType = "http"
+)
+
+// RecordConfig selects the recorder. The local recorder is only available in
+// SFU mode. Audio and video tracks are written to separate files either as
+// WebM, or as Ogg for audio and IVF for video. The http recorder uses the
+// service at RecordServiceURL.
+type RecordConfig struct {
+	Type   RecordType   `yaml:"type"`
+	Dir    string       `yaml:"dir"`
+	Format RecordFormat `yaml:"format"`
+}
+
+type AuthenticatorType string
+
+const (
+	AuthenticatorTypeAnonymous AuthenticatorType = "anonymous"
+	AuthenticatorTypeJWT       AuthenticatorType = "jwt"
+	AuthenticatorTypeProxy     AuthenticatorType = "proxy"
+)
+
+// AuthConfig selects how users are authenticated. Anonymous users get a
+// random user ID stored in a token signed with JwtSecret.
+type AuthConfig struct {
+	Type  AuthenticatorType `yaml:"type"`
+	JWT   AuthConfigJWT     `yaml:"jwt"`
+	Proxy AuthConfigProxy   `yaml:"proxy"`
+}
+
+// AuthConfigJWT configures the verification of RS256 or ES256 tokens issued
+// by an external identity provider. The issuer and audience are only checked
+// when set.
+type AuthConfigJWT struct {
+	PublicKeyFile string `yaml:"public_key_file"`
+	Issuer        string `yaml:"issuer"`
+	Audience      string `yaml:"audience"`
+	UserClaim     string `yaml:"user_claim"`
+	NicknameClaim string `yaml:"nickname_claim"`
+	Cookie        string `yaml:"cookie"`
+}
+
+// AuthConfigProxy configures the headers set by a trusted reverse proxy.
+// TrustedProxies contains IPs or CIDRs the proxy connects from.
+type AuthConfigProxy struct {
+	UserHeader     string   `yaml:"user_header"`
+	NicknameHeader string   `yaml:"nickname_header"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
 type Config struct {
 	BaseURL          string           `yaml:"base_url"`
 	BindHost         string           `yaml:"bind_host"`
@@ -69,6 +230,11 @@ type Config struct {
 	Store            StoreConfig      `yaml:"store"`
 	Network          NetworkConfig    `yaml:"network"`
 	Prometheus       PrometheusConfig `yaml:"prometheus"`
+	Admin            AdminConfig      `yaml:"admin"`
+	Shutdown         ShutdownConfig   `yaml:"shutdown"`
+	Tracing          TracingConfig    `yaml:"tracing"`
 	JwtSecret        string           `yaml:"jwt_secret"`
+	Auth             AuthConfig       `yaml:"auth"`
 	RecordServiceURL string           `yaml:"record_service_url"`
+	Record           RecordConfig     `yaml:"record"`
 }
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// DefaultDrainTimeout is the time to wait for rooms to become empty before
+// shutting down when no timeout is configured.
+const DefaultDrainTimeout = 60 * time.Second
+
+// ErrDraining is returned by the health check of a Drainer while draining.
+var ErrDraining = errors.New("Server is draining")
+
+// drainCloseTimeout is the time to wait for clients to leave their rooms
+// after their connections have been closed.
+const drainCloseTimeout = 5 * time.Second
+
+// Drainer keeps track of the rooms and websocket connections of this
+// instance so that it can shut down without dropping calls. While draining,
+// the health probe fails, no new rooms are created and clients are asked to
+// reconnect, which gives them the chance to continue their calls on another
+// instance.
+type Drainer struct {
+	log Logger
+
+	mu       sync.Mutex
+	draining bool
+	drained  bool
+	// rooms contains the number of clients in the rooms with clients on this
+	// instance.
+	rooms map[string]int
+	conns map[*wsConn]struct{}
+
+	drainingCh chan struct{}
+	drainedCh  chan struct{}
+}
+
+func NewDrainer(loggerFactory LoggerFactory) *Drainer {
+	return &Drainer{
+		log:        loggerFactory.GetLogger("drainer"),
+		rooms:      map[string]int{},
+		conns:      map[*wsConn]struct{}{},
+		drainingCh: make(chan struct{}),
+		drainedCh:  make(chan struct{}),
+	}
+}
+
+// Drain starts draining and sends a going_away message to all connected
+// clients. It is safe to call Drain more than once.
+func (d *Drainer) Drain() {
+	d.mu.Lock()
+	if d.draining {
+		d.mu.Unlock()
+		return
+	}
+	d.draining = true
+	close(d.drainingCh)
+	d.checkDrained()
+	conns := d.connections()
+	d.log.Info("Draining", Fields{
+		"rooms":       len(d.rooms),
+		"connections": len(conns),
+	})
+	d.mu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(conns))
+	for _, conn := range conns {
+		go func(conn *wsConn) {
+			defer wg.Done()
+			d.sendGoingAway(conn)
+		}(conn)
+	}
+	wg.Wait()
+}
+
+// IsDraining returns true after Drain has been called.
+func (d *Drainer) IsDraining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// HealthCheck fails while draining so that load balancers stop sending
+// requests to this instance.
+func (d *Drainer) HealthCheck(ctx context.Context) error {
+	if d.IsDraining() {
+		return ErrDraining
+	}
+	return nil
+}
+
+// Draining returns a channel which is closed when draining starts.
+func (d *Drainer) Draining() <-chan struct{} {
+	return d.drainingCh
+}
+
+// Drained returns a channel which is closed when all rooms are empty after
+// draining has started.
+func (d *Drainer) Drained() <-chan struct{} {
+	return d.drainedCh
+}
+
+// Wait waits until all rooms are empty or timeout passes. The remaining
+// websocket connections are then closed with the going away status.
+func (d *Drainer) Wait(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-d.drainedCh:
+		return
+	case <-timer.C:
+	}
+
+	d.mu.Lock()
+	conns := d.connections()
+	d.mu.Unlock()
+
+	d.log.Warn("Drain timeout passed, closing connections", Fields{"connections": len(conns)})
+	var wg sync.WaitGroup
+	wg.Add(len(conns))
+	for _, conn := range conns {
+		go func(conn *wsConn) {
+			defer wg.Done()
+			conn.Close(websocket.StatusGoingAway, "Server shutting down")
+		}(conn)
+	}
+	wg.Wait()
+
+	closeTimer := time.NewTimer(drainCloseTimeout)
+	defer closeTimer.Stop()
+
+	select {
+	case <-d.drainedCh:
+	case <-closeTimer.C:
+		d.log.Warn("Timed out waiting for clients to leave their rooms", nil)
+	}
+}
+
+// Handler refuses requests for rooms without clients on this instance while
+// draining, and serves all other requests with next. The room of a request
+// is returned by getRoom.
+func (d *Drainer) Handler(getRoom func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		room := getRoom(r)
+
+		d.mu.Lock()
+		refuse := d.draining && d.rooms[room] == 0
+		d.mu.Unlock()
+
+		if refuse {
+			d.log.Info("Refusing request for new room while draining", Fields{"room": room})
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Server is shutting down"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RoomManager returns a RoomManager which keeps track of the rooms with
+// clients on this instance.
+func (d *Drainer) RoomManager(rooms RoomManager) RoomManager {
+	return &drainRoomManager{
+		RoomManager: rooms,
+		drainer:     d,
+	}
+}
+
+func (d *Drainer) enter(room string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.rooms[room]++
+}
+
+func (d *Drainer) exit(room string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.rooms[room]--
+	if d.rooms[room] <= 0 {
+		delete(d.rooms, room)
+	}
+	d.checkDrained()
+}
+
+// checkDrained must be called with the lock held.
+func (d *Drainer) checkDrained() {
+	if d.draining && !d.drained && len(d.rooms) == 0 {
+		d.drained = true
+		close(d.drainedCh)
+	}
+}
+
+// connections must be called with the lock held.
+func (d *Drainer) connections() []*wsConn {
+	conns := make([]*wsConn, 0, len(d.conns))
+	for conn := range d.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// add keeps track of a websocket connection until the returned function is
+// called. Connections added while draining are asked to reconnect
+// immediately.
+func (d *Drainer) add(conn *wsConn) (remove func()) {
+	d.mu.Lock()
+	d.conns[conn] = struct{}{}
+	draining := d.draining
+	d.mu.Unlock()
+
+	if draining {
+		d.sendGoingAway(conn)
+	}
+
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.conns, conn)
+	}
+}
+
+func (d *Drainer) sendGoingAway(conn *wsConn) {
+	err := conn.client.Write(NewMessage("going_away", conn.room, GoingAwayPayload{
+		Reason:    "Server shutting down",
+		Reconnect: true,
+	}))
+	if err != nil {
+		conn.log.Error("Error sending going away message", Fields{"error": err})
+	}
+}
+
+type drainRoomManager struct {
+	RoomManager
+	drainer *Drainer
+}
+
+func (m *drainRoomManager) Enter(room string) Adapter {
+	m.drainer.enter(room)
+	return m.RoomManager.Enter(room)
+}
+
+func (m *drainRoomManager) Exit(room string) {
+	m.RoomManager.Exit(room)
+	m.drainer.exit(room)
+}
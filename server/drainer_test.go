@@ -0,0 +1,143 @@
+package server_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peer-calls/peer-calls/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"nhooyr.io/websocket"
+)
+
+func setupDrainServer(t *testing.T, drainer *server.Drainer) (url string, cleanup func()) {
+	newAdapter := server.NewAdapterFactory(loggerFactory, server.StoreConfig{})
+	rooms := drainer.RoomManager(server.NewAdapterRoomManager(newAdapter.NewAdapter))
+	wss := server.NewWSS(loggerFactory, rooms, nil, nil, nil, drainer)
+
+	s := httptest.NewServer(drainer.Handler(func(r *http.Request) string {
+		return path.Base(path.Dir(r.URL.Path))
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sub, err := wss.Subscribe(w, r)
+		if err != nil {
+			return
+		}
+		// echo messages back so that tests can verify a client has been added
+		for msg := range sub.Messages {
+			_ = sub.Adapter.Emit(sub.ClientID, msg)
+		}
+	})))
+
+	url = "ws" + strings.TrimPrefix(s.URL, "http") + "/ws/"
+	return url, func() {
+		s.Close()
+		newAdapter.Close()
+	}
+}
+
+func TestDrainer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	drainer := server.NewDrainer(loggerFactory)
+	url, cleanup := setupDrainServer(t, drainer)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ws := mustDialWS(t, ctx, url+room+"/"+clientID)
+	defer ws.Close(websocket.StatusNormalClosure, "")
+	mustWriteWS(t, ctx, ws, server.NewMessage("ready", room, nil))
+	readWSType(t, ctx, ws, "ready")
+
+	select {
+	case <-drainer.Draining():
+		assert.Fail(t, "draining before Drain was called")
+	default:
+	}
+
+	drainer.Drain()
+	assert.True(t, drainer.IsDraining())
+
+	msg := readWSType(t, ctx, ws, "going_away")
+	assert.Equal(t, room, msg.Room)
+	assert.Equal(t, map[string]interface{}{
+		"reason":    "Server shutting down",
+		"reconnect": true,
+	}, msg.Payload)
+
+	_, _, err := websocket.Dial(ctx, url+"other-room/"+clientID2, nil)
+	assert.Error(t, err, "new rooms are refused while draining")
+
+	ws2 := mustDialWS(t, ctx, url+room+"/"+clientID2)
+	defer ws2.Close(websocket.StatusNormalClosure, "")
+	readWSType(t, ctx, ws2, "going_away")
+
+	select {
+	case <-drainer.Drained():
+		assert.Fail(t, "drained before rooms are empty")
+	default:
+	}
+
+	ws.Close(websocket.StatusNormalClosure, "")
+	ws2.Close(websocket.StatusNormalClosure, "")
+
+	select {
+	case <-drainer.Drained():
+	case <-time.After(timeout):
+		assert.Fail(t, "timed out waiting for rooms to become empty")
+	}
+}
+
+func TestDrainer_Wait_timeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	drainer := server.NewDrainer(loggerFactory)
+	url, cleanup := setupDrainServer(t, drainer)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ws := mustDialWS(t, ctx, url+room+"/"+clientID)
+	defer ws.Close(websocket.StatusNormalClosure, "")
+	mustWriteWS(t, ctx, ws, server.NewMessage("ready", room, nil))
+	readWSType(t, ctx, ws, "ready")
+
+	drainer.Drain()
+	readWSType(t, ctx, ws, "going_away")
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := ws.Read(ctx)
+		readErr <- err
+	}()
+
+	drainer.Wait(50 * time.Millisecond)
+
+	select {
+	case <-drainer.Drained():
+	default:
+		assert.Fail(t, "rooms not empty after the remaining clients were disconnected")
+	}
+
+	assert.Equal(t, websocket.StatusGoingAway, websocket.CloseStatus(<-readErr))
+}
+
+func TestDrainer_empty(t *testing.T) {
+	drainer := server.NewDrainer(loggerFactory)
+	drainer.Drain()
+	drainer.Drain()
+
+	select {
+	case <-drainer.Drained():
+	default:
+		assert.Fail(t, "not drained without rooms")
+	}
+
+	require.True(t, drainer.IsDraining())
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const httpRecorderTimeout = 15 * time.Second
+
+// HTTPRecorder delegates recording to an external service which manages
+// recording sessions under /api/sessions/{room}.
+type HTTPRecorder struct {
+	client     *http.Client
+	serviceURL string
+
+	mu        sync.Mutex
+	recording map[string]RecordingStatus
+}
+
+var _ Recorder = &HTTPRecorder{}
+
+func NewHTTPRecorder(serviceURL string) *HTTPRecorder {
+	return &HTTPRecorder{
+		client: &http.Client{
+			Timeout: httpRecorderTimeout,
+		},
+		serviceURL: serviceURL,
+		recording:  map[string]RecordingStatus{},
+	}
+}
+
+func (r *HTTPRecorder) sessionURL(room string) string {
+	return r.serviceURL + "/api/sessions/" + url.PathEscape(room)
+}
+
+// do sends a request to the recording service and returns the response body.
+func (r *HTTPRecorder) do(method string, url string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error sending request to recording service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading response from recording service: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("Unexpected status code from recording service: %d", resp.StatusCode)
+	}
+
+	return respBody, nil
+}
+
+// HealthCheck checks that the recording service responds without a server
+// error.
+func (r *HTTPRecorder) HealthCheck(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.serviceURL, nil)
+	if err != nil {
+		return fmt.Errorf("Error creating request: %w", err)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error sending request to recording service: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("Unexpected status code from recording service: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Start creates a recording session. The service responds with the URL of
+// the stream.
+func (r *HTTPRecorder) Start(room string) (RecordingStatus, error) {
+	body, err := r.do(http.MethodPost, r.sessionURL(room), nil)
+	if err != nil {
+		return RecordingStatus{}, err
+	}
+
+	status := RecordingStatus{
+		Room:      room,
+		Recording: true,
+		URL:       string(body),
+	}
+
+	r.mu.Lock()
+	r.recording[room] = status
+	r.mu.Unlock()
+
+	return status, nil
+}
+
+func (r *HTTPRecorder) Stop(room string) (RecordingStatus, error) {
+	_, err := r.do(http.MethodDelete, r.sessionURL(room), nil)
+	if err != nil {
+		return RecordingStatus{}, err
+	}
+
+	r.mu.Lock()
+	delete(r.recording, room)
+	r.mu.Unlock()
+
+	return RecordingStatus{
+		Room:      room,
+		Recording: false,
+	}, nil
+}
+
+// Status returns the status of recordings started by this instance. The
+// service is not queried.
+func (r *HTTPRecorder) Status(room string) (RecordingStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if status, ok := r.recording[room]; ok {
+		return status, nil
+	}
+
+	return RecordingStatus{Room: room}, nil
+}
+
+func (r *HTTPRecorder) Join(room string, userID string, body io.Reader) ([]byte, error) {
+	return r.do(http.MethodPost, r.sessionURL(room)+"/join/"+url.PathEscape(userID), body)
+}
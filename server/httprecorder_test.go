@@ -0,0 +1,114 @@
+package server_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/peer-calls/peer-calls/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordedRequest struct {
+	method string
+	path   string
+	body   string
+}
+
+func newRecordingService(t *testing.T, statusCode int, response string) (*httptest.Server, chan recordedRequest) {
+	requests := make(chan recordedRequest, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		requests <- recordedRequest{r.Method, r.URL.EscapedPath(), string(body)}
+		w.WriteHeader(statusCode)
+		w.Write([]byte(response))
+	}))
+	return s, requests
+}
+
+func TestHTTPRecorder(t *testing.T) {
+	s, requests := newRecordingService(t, http.StatusOK, "rtmp://stream")
+	defer s.Close()
+
+	recorder := server.NewHTTPRecorder(s.URL)
+
+	status, err := recorder.Start("my room")
+	require.NoError(t, err)
+	assert.Equal(t, server.RecordingStatus{
+		Room:      "my room",
+		Recording: true,
+		URL:       "rtmp://stream",
+	}, status)
+	assert.Equal(t, recordedRequest{"POST", "/api/sessions/my%20room", ""}, <-requests)
+
+	status, err = recorder.Status("my room")
+	require.NoError(t, err)
+	assert.True(t, status.Recording)
+
+	_, err = recorder.Join("my room", "user1", strings.NewReader(`{"a":1}`))
+	require.NoError(t, err)
+	assert.Equal(t, recordedRequest{"POST", "/api/sessions/my%20room/join/user1", `{"a":1}`}, <-requests)
+
+	status, err = recorder.Stop("my room")
+	require.NoError(t, err)
+	assert.False(t, status.Recording)
+	assert.Equal(t, recordedRequest{"DELETE", "/api/sessions/my%20room", ""}, <-requests)
+
+	status, err = recorder.Status("my room")
+	require.NoError(t, err)
+	assert.False(t, status.Recording)
+}
+
+func TestHTTPRecorder_error(t *testing.T) {
+	s, _ := newRecordingService(t, http.StatusInternalServerError, "")
+	defer s.Close()
+
+	recorder := server.NewHTTPRecorder(s.URL)
+
+	_, err := recorder.Start(room)
+	assert.Error(t, err)
+
+	status, err := recorder.Status(room)
+	require.NoError(t, err)
+	assert.False(t, status.Recording)
+
+	_, err = recorder.Join(room, "user1", nil)
+	assert.Error(t, err)
+}
+
+func TestNewRecorder(t *testing.T) {
+	trk := newMockTracksManager()
+
+	r, err := server.NewRecorder(loggerFactory, server.RecordConfig{}, "", server.NetworkTypeSFU, trk)
+	require.NoError(t, err)
+	assert.IsType(t, &server.LocalRecorder{}, r)
+
+	r, err = server.NewRecorder(loggerFactory, server.RecordConfig{}, "", server.NetworkTypeMesh, trk)
+	require.NoError(t, err)
+	assert.IsType(t, &server.HTTPRecorder{}, r)
+
+	r, err = server.NewRecorder(loggerFactory, server.RecordConfig{Type: server.RecordTypeHTTP}, "", server.NetworkTypeSFU, trk)
+	require.NoError(t, err)
+	assert.IsType(t, &server.HTTPRecorder{}, r)
+
+	_, err = server.NewRecorder(loggerFactory, server.RecordConfig{Type: server.RecordTypeLocal}, "", server.NetworkTypeMesh, trk)
+	assert.Error(t, err)
+
+	_, err = server.NewRecorder(loggerFactory, server.RecordConfig{Type: "invalid"}, "", server.NetworkTypeSFU, trk)
+	assert.Error(t, err)
+}
+
+func TestHTTPRecorder_HealthCheck(t *testing.T) {
+	s, _ := newRecordingService(t, http.StatusNotFound, "")
+	defer s.Close()
+	assert.NoError(t, server.NewHTTPRecorder(s.URL).HealthCheck(context.Background()))
+
+	s2, _ := newRecordingService(t, http.StatusInternalServerError, "")
+	defer s2.Close()
+	assert.Error(t, server.NewHTTPRecorder(s2.URL).HealthCheck(context.Background()))
+}
@@ -1,42 +1,95 @@
 package server
 
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// DefaultICEAuthSecretTTL is the validity of TURN REST credentials when no
+// TTL is configured.
+const DefaultICEAuthSecretTTL = 24 * time.Hour
+
 type ICEAuthServer struct {
 	URLs       []string `json:"urls"`
 	Username   string   `json:"username,omitempty"`
 	Credential string   `json:"credential,omitempty"`
 }
 
+// GetICEAuthServers returns the ICE servers with the credentials clients
+// should use. Servers with AuthTypeSecret get new time-limited credentials on
+// every call.
 func GetICEAuthServers(servers []ICEServer) (result []ICEAuthServer) {
+	return getICEAuthServers(servers, "", time.Now())
+}
+
+// GetICEAuthServersForUser is like GetICEAuthServers, but binds the
+// time-limited credentials to userID instead of the configured username.
+func GetICEAuthServersForUser(servers []ICEServer, userID string) (result []ICEAuthServer) {
+	return getICEAuthServers(servers, userID, time.Now())
+}
+
+func getICEAuthServers(servers []ICEServer, userID string, now time.Time) (result []ICEAuthServer) {
 	for _, server := range servers {
-		result = append(result, newICEServer(server))
+		result = append(result, newICEServer(server, userID, now))
 	}
 	return
 }
 
-func newICEServer(server ICEServer) ICEAuthServer {
+func newICEServer(server ICEServer, userID string, now time.Time) ICEAuthServer {
 	switch server.AuthType {
 	case AuthTypeSecret:
-		return getICEStaticAuthSecretCredentials(server)
+		return getICEAuthSecretCredentials(server, userID, now)
+	case AuthTypeStatic:
+		return ICEAuthServer{
+			URLs:       server.URLs,
+			Username:   server.AuthStatic.Username,
+			Credential: server.AuthStatic.Password,
+		}
 	default:
 		return ICEAuthServer{URLs: server.URLs}
 	}
 }
 
-func getICEStaticAuthSecretCredentials(server ICEServer) ICEAuthServer {
-	// timestamp := time.Now().Unix() + 24*3600
-	// username := fmt.Sprintf("%d:%s", timestamp, server.AuthSecret.Username)
-	// h := hmac.New(sha1.New, []byte(server.AuthSecret.Secret))
-	// h.Write([]byte(username))
-	// credential := base64.StdEncoding.EncodeToString(h.Sum(nil))
-
-	// return ICEAuthServer{
-	// 	URLs:       server.URLs,
-	// 	Username:   username,
-	// 	Credential: credential,
-	// }
+// getICEAuthSecretCredentials creates ephemeral credentials for the TURN REST
+// API, which are supported by coturn's static-auth-secret option. The
+// username contains the expiry timestamp, and the credential is the
+// HMAC-SHA1 of the username signed with the shared secret, so the secret is
+// never sent to clients.
+func getICEAuthSecretCredentials(server ICEServer, userID string, now time.Time) ICEAuthServer {
+	ttl := server.AuthSecret.TTL
+	if ttl <= 0 {
+		ttl = DefaultICEAuthSecretTTL
+	}
+
+	if userID == "" {
+		userID = server.AuthSecret.Username
+	}
+
+	timestamp := now.Add(ttl).Unix()
+	username := fmt.Sprintf("%d:%s", timestamp, userID)
+
+	h := hmac.New(sha1.New, []byte(server.AuthSecret.Secret))
+	h.Write([]byte(username))
+	credential := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
 	return ICEAuthServer{
 		URLs:       server.URLs,
-		Username:   server.AuthSecret.Username,
-		Credential: server.AuthSecret.Secret,
+		Username:   username,
+		Credential: credential,
 	}
 }
+
+func handleICEServersMessage(
+	adapter Adapter,
+	iceServers []ICEServer,
+	room string,
+	clientID string,
+	identity Identity,
+) error {
+	return adapter.Emit(clientID, NewMessage("ice_servers", room, ICEServersPayload{
+		ICEServers: GetICEAuthServersForUser(iceServers, identity.UserID),
+	}))
+}
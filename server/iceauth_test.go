@@ -1,10 +1,17 @@
 package server_test
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/peer-calls/peer-calls/server"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetICEAuthServers(t *testing.T) {
@@ -32,3 +39,62 @@ func TestGetICEAuthServers(t *testing.T) {
 	assert.Regexp(t, "^[0-9]+:test$", r2.Username)
 	assert.NotEmpty(t, r2.Credential)
 }
+
+func TestGetICEAuthServers_secret(t *testing.T) {
+	s := server.ICEServer{
+		URLs:     []string{"turn:"},
+		AuthType: server.AuthTypeSecret,
+	}
+	s.AuthSecret.Username = "test"
+	s.AuthSecret.Secret = "sec"
+	s.AuthSecret.TTL = time.Hour
+
+	result := server.GetICEAuthServers([]server.ICEServer{s})
+	require.Equal(t, 1, len(result))
+	r := result[0]
+
+	parts := strings.SplitN(r.Username, ":", 2)
+	require.Equal(t, 2, len(parts))
+	assert.Equal(t, "test", parts[1])
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Now().Add(time.Hour).Unix(), expiry, 5)
+
+	h := hmac.New(sha1.New, []byte("sec"))
+	h.Write([]byte(r.Username))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(h.Sum(nil)), r.Credential)
+	assert.NotContains(t, r.Credential, "sec")
+}
+
+func TestGetICEAuthServers_static(t *testing.T) {
+	s := server.ICEServer{
+		URLs:     []string{"turn:"},
+		AuthType: server.AuthTypeStatic,
+	}
+	s.AuthStatic.Username = "user"
+	s.AuthStatic.Password = "pass"
+
+	result := server.GetICEAuthServers([]server.ICEServer{s})
+	assert.Equal(t, []server.ICEAuthServer{{
+		URLs:       []string{"turn:"},
+		Username:   "user",
+		Credential: "pass",
+	}}, result)
+}
+
+func TestGetICEAuthServersForUser(t *testing.T) {
+	s := server.ICEServer{
+		URLs:     []string{"turn:"},
+		AuthType: server.AuthTypeSecret,
+	}
+	s.AuthSecret.Username = "test"
+	s.AuthSecret.Secret = "sec"
+
+	result := server.GetICEAuthServersForUser([]server.ICEServer{s}, "user1")
+	require.Equal(t, 1, len(result))
+	assert.Regexp(t, "^[0-9]+:user1$", result[0].Username)
+
+	result = server.GetICEAuthServersForUser([]server.ICEServer{s}, "")
+	require.Equal(t, 1, len(result))
+	assert.Regexp(t, "^[0-9]+:test$", result[0].Username)
+}
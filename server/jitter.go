@@ -40,7 +40,11 @@ func (n *NackHandler) HandleNack(nack *rtcp.TransportLayerNack) ([]*rtp.Packet,
 	var rtpPackets []*rtp.Packet
 
 	for _, nackPair := range nack.Nacks {
-		n.nackLog.Printf("NACK for track: %d (fsn: %d, blp: %#b)", nack.MediaSSRC, nackPair.PacketID, nackPair.LostPackets)
+		n.nackLog.Debug("NACK for track", Fields{
+			"ssrc": nack.MediaSSRC,
+			"fsn":  nackPair.PacketID,
+			"blp":  nackPair.LostPackets,
+		})
 
 		nackPackets := nackPair.PacketList()
 		notFound := make([]uint16, 0, len(nackPackets))
@@ -48,12 +52,18 @@ func (n *NackHandler) HandleNack(nack *rtcp.TransportLayerNack) ([]*rtp.Packet,
 			rtpPacket := n.jitterBuffer.GetPacket(nack.MediaSSRC, sn)
 			if rtpPacket == nil {
 				// missing packet not found in jitter buffer
-				n.nackLog.Printf("RTP packet (ssrc: %d, sn: %d) missing", nack.MediaSSRC, sn)
+				n.nackLog.Debug("RTP packet missing", Fields{
+					"ssrc": nack.MediaSSRC,
+					"sn":   sn,
+				})
 				notFound = append(notFound, sn)
 				continue
 			}
 
-			n.nackLog.Printf("RTP packet (ssrc: %d, sn: %d) found in JitterBuffer", nack.MediaSSRC, sn)
+			n.nackLog.Debug("RTP packet found in JitterBuffer", Fields{
+				"ssrc": nack.MediaSSRC,
+				"sn":   sn,
+			})
 
 			// JitterBuffer had the missing packet, add it to the list
 			rtpPackets = append(rtpPackets, rtpPacket)
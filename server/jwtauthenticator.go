@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// JWTAuthenticator authenticates users with tokens signed by an external
+// identity provider, for example an SSO gateway. The token is read from the
+// Authorization header, the configured cookie, or the access_token query
+// parameter, since browsers cannot set headers for websocket connections.
+type JWTAuthenticator struct {
+	tokenAuth *JWTAuth
+	config    AuthConfigJWT
+}
+
+var _ Authenticator = &JWTAuthenticator{}
+
+// NewJWTAuthenticator creates a new JWTAuthenticator which verifies tokens
+// using the PEM encoded RSA or ECDSA public key.
+func NewJWTAuthenticator(config AuthConfigJWT, publicKeyPEM []byte) (*JWTAuthenticator, error) {
+	tokenAuth, err := NewPublicKeyJWTAuth(publicKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.UserClaim == "" {
+		config.UserClaim = "sub"
+	}
+	if config.NicknameClaim == "" {
+		config.NicknameClaim = "name"
+	}
+	if config.Cookie == "" {
+		config.Cookie = "jwt"
+	}
+
+	return &JWTAuthenticator{
+		tokenAuth: tokenAuth,
+		config:    config,
+	}, nil
+}
+
+// NewJWTAuthenticatorFromFile reads the public key from config.PublicKeyFile.
+func NewJWTAuthenticatorFromFile(config AuthConfigJWT) (*JWTAuthenticator, error) {
+	publicKeyPEM, err := ioutil.ReadFile(config.PublicKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading JWT public key: %w", err)
+	}
+
+	return NewJWTAuthenticator(config, publicKeyPEM)
+}
+
+func (a *JWTAuthenticator) token(r *http.Request) string {
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		return authorization[len("Bearer "):]
+	}
+
+	if cookie, err := r.Cookie(a.config.Cookie); err == nil {
+		return cookie.Value
+	}
+
+	return r.URL.Query().Get("access_token")
+}
+
+// Authenticate verifies the token, its issuer and audience, and returns an
+// error when the request has no valid token.
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	tokenString := a.token(r)
+	if tokenString == "" {
+		return Identity{}, ErrNoTokenFound
+	}
+
+	claims, err := a.tokenAuth.DecodeClaims(tokenString)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	if a.config.Issuer != "" && !claims.VerifyIssuer(a.config.Issuer, true) {
+		return Identity{}, fmt.Errorf("Invalid token issuer: %w", ErrUnauthorized)
+	}
+
+	if a.config.Audience != "" && !verifyAudience(claims, a.config.Audience) {
+		return Identity{}, fmt.Errorf("Invalid token audience: %w", ErrUnauthorized)
+	}
+
+	userID, _ := claims[a.config.UserClaim].(string)
+	if userID == "" {
+		return Identity{}, fmt.Errorf("Token has no %s claim: %w", a.config.UserClaim, ErrUnauthorized)
+	}
+
+	nickname, _ := claims[a.config.NicknameClaim].(string)
+
+	return Identity{
+		UserID:   userID,
+		Nickname: nickname,
+		Claims:   claims,
+	}, nil
+}
+
+// Login always fails because tokens are issued by the identity provider.
+func (a *JWTAuthenticator) Login(w http.ResponseWriter, r *http.Request) (Identity, error) {
+	return Identity{}, ErrUnauthorized
+}
+
+// verifyAudience checks the aud claim, which can be either a string or an
+// array of strings.
+func verifyAudience(claims jwt.MapClaims, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, value := range aud {
+			if value == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+	"github.com/pion/webrtc/v2/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v2/pkg/media/oggwriter"
+)
+
+// recorderSinkID is the ID of the recording sink in a room. There is at most
+// one recording per room.
+const recorderSinkID = "__RECORDER__"
+
+// recordingQueueSize is the number of packets buffered for writing before
+// packets start being dropped.
+const recordingQueueSize = 512
+
+var unsafeFileNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// safeFileName replaces characters which might not be safe to use in a file
+// name. Room names and client IDs are chosen by the clients.
+func safeFileName(name string) string {
+	name = unsafeFileNameChars.ReplaceAllString(name, "_")
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return name
+}
+
+type recordingTrack struct {
+	writer media.Writer
+	munger *RTPMunger
+}
+
+type recordingPacket struct {
+	trackSSRC uint32
+	packet    *rtp.Packet
+}
+
+// RecordingSink writes each track of a room to a separate file in dir. It is
+// added to a room through TracksManager so it receives the same packets the
+// peers do. Packets are written from a separate goroutine so that slow disks
+// do not affect forwarding.
+type RecordingSink struct {
+	log    Logger
+	dir    string
+	format RecordFormat
+
+	mu     sync.Mutex
+	tracks map[uint32]*recordingTrack
+	files  []string
+
+	packets   chan recordingPacket
+	closeChan chan struct{}
+	doneChan  chan struct{}
+	closeOnce sync.Once
+}
+
+var _ TrackSink = &RecordingSink{}
+
+func NewRecordingSink(log Logger, dir string, format RecordFormat) *RecordingSink {
+	s := &RecordingSink{
+		log:       log,
+		dir:       dir,
+		format:    format,
+		tracks:    map[uint32]*recordingTrack{},
+		packets:   make(chan recordingPacket, recordingQueueSize),
+		closeChan: make(chan struct{}),
+		doneChan:  make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+func (s *RecordingSink) ID() string {
+	return recorderSinkID
+}
+
+// AddTrack creates a new file for the track. Only Opus and VP8 tracks are
+// supported.
+func (s *RecordingSink) AddTrack(clientID string, track TrackInfo) error {
+	var clockRate uint32
+	switch track.PayloadType {
+	case webrtc.DefaultPayloadTypeOpus:
+		clockRate = opusSampleRate
+	case webrtc.DefaultPayloadTypeVP8:
+		clockRate = videoClock
+	default:
+		return fmt.Errorf("Unsupported payload type: %d", track.PayloadType)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tracks[track.SSRC]; ok {
+		return fmt.Errorf("Track already added: %d", track.SSRC)
+	}
+
+	filename := filepath.Join(s.dir, fmt.Sprintf(
+		"%s_%s_%d.%s",
+		safeFileName(clientID),
+		track.Kind,
+		track.SSRC,
+		recordingFileExtension(s.format, track.Kind),
+	))
+
+	writer, err := newRecordingWriter(s.format, filename, track.Kind)
+	if err != nil {
+		return fmt.Errorf("Error creating recording file: %w", err)
+	}
+
+	s.log.Info("Recording track", Fields{
+		"clientId": clientID,
+		"ssrc":     track.SSRC,
+		"filename": filename,
+	})
+
+	s.tracks[track.SSRC] = &recordingTrack{
+		writer: writer,
+		munger: NewRTPMunger(track.SSRC, clockRate),
+	}
+	s.files = append(s.files, filename)
+
+	return nil
+}
+
+// RemoveTrack closes the file of a track.
+func (s *RecordingSink) RemoveTrack(ssrc uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	track, ok := s.tracks[ssrc]
+	if !ok {
+		return nil
+	}
+
+	delete(s.tracks, ssrc)
+	return track.writer.Close()
+}
+
+// WriteTrackRTP queues a packet for writing. It never blocks, packets are
+// dropped when the queue is full.
+func (s *RecordingSink) WriteTrackRTP(trackSSRC uint32, packet *rtp.Packet) error {
+	select {
+	case <-s.closeChan:
+		return fmt.Errorf("Recording sink closed")
+	default:
+	}
+
+	select {
+	case s.packets <- recordingPacket{trackSSRC, packet}:
+		return nil
+	default:
+		return fmt.Errorf("Recording queue full, dropping packet")
+	}
+}
+
+// Files returns the paths of all files written by the sink.
+func (s *RecordingSink) Files() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.files...)
+}
+
+// Done returns a channel which is closed once the sink has been closed and
+// all files have been written.
+func (s *RecordingSink) Done() <-chan struct{} {
+	return s.doneChan
+}
+
+// Close stops writing packets and closes all files.
+func (s *RecordingSink) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeChan)
+	})
+	<-s.doneChan
+	return nil
+}
+
+func (s *RecordingSink) run() {
+	defer close(s.doneChan)
+
+	for {
+		select {
+		case p := <-s.packets:
+			s.writeRTP(p.trackSSRC, p.packet)
+		case <-s.closeChan:
+			s.drain()
+			s.closeTracks()
+			return
+		}
+	}
+}
+
+// drain writes the packets which were queued before the sink was closed.
+func (s *RecordingSink) drain() {
+	for {
+		select {
+		case p := <-s.packets:
+			s.writeRTP(p.trackSSRC, p.packet)
+		default:
+			return
+		}
+	}
+}
+
+func (s *RecordingSink) writeRTP(trackSSRC uint32, packet *rtp.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	track, ok := s.tracks[trackSSRC]
+	if !ok {
+		return
+	}
+
+	// simulcast layers have different SSRCs and sequence numbers
+	packet, ok = track.munger.Munge(packet)
+	if !ok {
+		return
+	}
+
+	if err := track.writer.WriteRTP(packet); err != nil {
+		s.log.Error("Error writing recording of track", Fields{
+			"ssrc":  trackSSRC,
+			"error": err,
+		})
+	}
+}
+
+func (s *RecordingSink) closeTracks() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ssrc, track := range s.tracks {
+		if err := track.writer.Close(); err != nil {
+			s.log.Error("Error closing recording of track", Fields{
+				"ssrc":  ssrc,
+				"error": err,
+			})
+		}
+		delete(s.tracks, ssrc)
+	}
+
+	s.log.Info("Recording finished", Fields{"files": s.files})
+}
+
+func recordingFileExtension(format RecordFormat, kind webrtc.RTPCodecType) string {
+	switch format {
+	case RecordFormatOgg:
+		if kind == webrtc.RTPCodecTypeAudio {
+			return "ogg"
+		}
+		return "ivf"
+	default:
+		return "webm"
+	}
+}
+
+func newRecordingWriter(format RecordFormat, filename string, kind webrtc.RTPCodecType) (media.Writer, error) {
+	if format == RecordFormatOgg {
+		if kind == webrtc.RTPCodecTypeAudio {
+			return oggwriter.New(filename, opusSampleRate, opusChannels)
+		}
+		return ivfwriter.New(filename)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := NewWebMWriter(&bufferedFile{bufio.NewWriter(f), f}, kind)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+type bufferedFile struct {
+	*bufio.Writer
+	file *os.File
+}
+
+func (b *bufferedFile) Close() error {
+	err := b.Flush()
+	return firstError(err, b.file.Close())
+}
+
+// LocalRecorder records SFU rooms to files in a local directory. Each room
+// is recorded into its own directory, and every recording into a
+// subdirectory named after the time it was started.
+type LocalRecorder struct {
+	log           Logger
+	tracksManager TracksManager
+	config        RecordConfig
+
+	mu    sync.Mutex
+	sinks map[string]*RecordingSink
+}
+
+var _ Recorder = &LocalRecorder{}
+
+func NewLocalRecorder(loggerFactory LoggerFactory, tracksManager TracksManager, config RecordConfig) *LocalRecorder {
+	return &LocalRecorder{
+		log:           loggerFactory.GetLogger("recorder"),
+		tracksManager: tracksManager,
+		config:        config,
+		sinks:         map[string]*RecordingSink{},
+	}
+}
+
+// Start starts recording a room. The returned status contains the files
+// created for tracks which are already being published. The recording stops
+// when the last peer leaves the room.
+func (r *LocalRecorder) Start(room string) (RecordingStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.sinks[room]; ok {
+		return RecordingStatus{}, fmt.Errorf("Room is already being recorded: %s", room)
+	}
+
+	dir := filepath.Join(r.config.Dir, safeFileName(room), time.Now().Format("20060102-150405"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return RecordingStatus{}, fmt.Errorf("Error creating recording directory: %w", err)
+	}
+
+	sink := NewRecordingSink(r.log.WithFields(Fields{"room": room}), dir, r.config.Format)
+	if err := r.tracksManager.AddSink(room, sink); err != nil {
+		sink.Close()
+		return RecordingStatus{}, fmt.Errorf("Error starting recording: %w", err)
+	}
+
+	r.log.Info("Started recording room", Fields{
+		"room": room,
+		"dir":  dir,
+	})
+	r.sinks[room] = sink
+
+	go func() {
+		<-sink.Done()
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if r.sinks[room] == sink {
+			delete(r.sinks, room)
+		}
+	}()
+
+	return RecordingStatus{
+		Room:      room,
+		Recording: true,
+		Files:     sink.Files(),
+	}, nil
+}
+
+// Stop stops recording a room. The returned status contains the paths of all
+// recorded files.
+func (r *LocalRecorder) Stop(room string) (RecordingStatus, error) {
+	r.mu.Lock()
+	sink, ok := r.sinks[room]
+	delete(r.sinks, room)
+	r.mu.Unlock()
+
+	if !ok {
+		return RecordingStatus{}, fmt.Errorf("Room is not being recorded: %s", room)
+	}
+
+	r.tracksManager.RemoveSink(room, sink.ID())
+	// in case the room was closed in the meantime
+	sink.Close()
+
+	r.log.Info("Stopped recording room", Fields{"room": room})
+
+	return RecordingStatus{
+		Room:      room,
+		Recording: false,
+		Files:     sink.Files(),
+	}, nil
+}
+
+func (r *LocalRecorder) Status(room string) (RecordingStatus, error) {
+	r.mu.Lock()
+	sink, ok := r.sinks[room]
+	r.mu.Unlock()
+
+	status := RecordingStatus{
+		Room:      room,
+		Recording: ok,
+	}
+	if ok {
+		status.Files = sink.Files()
+	}
+
+	return status, nil
+}
+
+// Join returns the recording status as JSON. Users do not need to join
+// recordings made by the server, so it only checks that the room is being
+// recorded.
+func (r *LocalRecorder) Join(room string, userID string, body io.Reader) ([]byte, error) {
+	status, err := r.Status(room)
+	if err != nil {
+		return nil, err
+	}
+
+	if !status.Recording {
+		return nil, fmt.Errorf("Room is not being recorded: %s", room)
+	}
+
+	return json.Marshal(status)
+}
@@ -0,0 +1,225 @@
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peer-calls/peer-calls/server"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sinkTracksManager struct {
+	*mockTracksManager
+	sinks map[string]server.TrackSink
+	err   error
+}
+
+func newSinkTracksManager() *sinkTracksManager {
+	return &sinkTracksManager{
+		mockTracksManager: newMockTracksManager(),
+		sinks:             map[string]server.TrackSink{},
+	}
+}
+
+func (m *sinkTracksManager) AddSink(room string, sink server.TrackSink) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.sinks[room] = sink
+	return nil
+}
+
+func (m *sinkTracksManager) RemoveSink(room string, sinkID string) {
+	delete(m.sinks, room)
+}
+
+func newOpusPacket(ssrc uint32, sn uint16, ts uint32) *rtp.Packet {
+	packet := &rtp.Packet{Payload: []byte{0xfc, 0xff, 0xfe}}
+	packet.SSRC = ssrc
+	packet.SequenceNumber = sn
+	packet.Timestamp = ts
+	return packet
+}
+
+func mustTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "peercalls-recording")
+	require.NoError(t, err)
+	return dir
+}
+
+func TestRecordingSink(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	sink := server.NewRecordingSink(loggerFactory.GetLogger("recorder"), dir, server.RecordFormatWebM)
+
+	err := sink.AddTrack("client/1", server.TrackInfo{
+		PayloadType: webrtc.DefaultPayloadTypeOpus,
+		SSRC:        1,
+		Kind:        webrtc.RTPCodecTypeAudio,
+	})
+	require.NoError(t, err)
+
+	err = sink.AddTrack("client/1", server.TrackInfo{
+		PayloadType: webrtc.DefaultPayloadTypeH264,
+		SSRC:        2,
+		Kind:        webrtc.RTPCodecTypeVideo,
+	})
+	assert.Error(t, err, "unsupported codec")
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, sink.WriteTrackRTP(1, newOpusPacket(1, uint16(i), uint32(i*960))))
+	}
+
+	require.NoError(t, sink.Close())
+	<-sink.Done()
+
+	assert.Error(t, sink.WriteTrackRTP(1, newOpusPacket(1, 10, 9600)))
+
+	files := sink.Files()
+	require.Equal(t, []string{filepath.Join(dir, "client_1_audio_1.webm")}, files)
+
+	data, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	require.True(t, len(data) > 4)
+	assert.Equal(t, []byte{0x1A, 0x45, 0xDF, 0xA3}, data[:4])
+	assert.True(t, strings.Contains(string(data), "A_OPUS"))
+}
+
+func TestRecordingSink_ogg(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	sink := server.NewRecordingSink(loggerFactory.GetLogger("recorder"), dir, server.RecordFormatOgg)
+
+	require.NoError(t, sink.AddTrack("client1", server.TrackInfo{
+		PayloadType: webrtc.DefaultPayloadTypeOpus,
+		SSRC:        1,
+		Kind:        webrtc.RTPCodecTypeAudio,
+	}))
+	require.NoError(t, sink.AddTrack("client1", server.TrackInfo{
+		PayloadType: webrtc.DefaultPayloadTypeVP8,
+		SSRC:        2,
+		Kind:        webrtc.RTPCodecTypeVideo,
+	}))
+	require.NoError(t, sink.RemoveTrack(2))
+	require.NoError(t, sink.Close())
+
+	assert.Equal(t, []string{
+		filepath.Join(dir, "client1_audio_1.ogg"),
+		filepath.Join(dir, "client1_video_2.ivf"),
+	}, sink.Files())
+	for _, file := range sink.Files() {
+		_, err := os.Stat(file)
+		assert.NoError(t, err)
+	}
+}
+
+func TestLocalRecorder(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	tracks := newSinkTracksManager()
+	recorder := server.NewLocalRecorder(loggerFactory, tracks, server.RecordConfig{
+		Dir:    dir,
+		Format: server.RecordFormatWebM,
+	})
+
+	assert.False(t, isRecording(t, recorder))
+	_, err := recorder.Stop(room)
+	assert.Error(t, err, "not recording")
+
+	_, err = recorder.Start(room)
+	require.NoError(t, err)
+	assert.True(t, isRecording(t, recorder))
+	require.NotNil(t, tracks.sinks[room])
+
+	_, err = recorder.Start(room)
+	assert.Error(t, err, "already recording")
+
+	sink := tracks.sinks[room]
+	require.NoError(t, sink.AddTrack(clientID, server.TrackInfo{
+		PayloadType: webrtc.DefaultPayloadTypeOpus,
+		SSRC:        1,
+		Kind:        webrtc.RTPCodecTypeAudio,
+	}))
+
+	status, err := recorder.Stop(room)
+	require.NoError(t, err)
+	assert.False(t, isRecording(t, recorder))
+	assert.Nil(t, tracks.sinks[room])
+	require.Equal(t, 1, len(status.Files))
+	assert.True(t, strings.HasPrefix(status.Files[0], filepath.Join(dir, room)+string(filepath.Separator)))
+}
+
+func TestLocalRecorder_Join(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	tracks := newSinkTracksManager()
+	recorder := server.NewLocalRecorder(loggerFactory, tracks, server.RecordConfig{Dir: dir})
+
+	_, err := recorder.Join(room, "user1", nil)
+	assert.Error(t, err, "not recording")
+
+	_, err = recorder.Start(room)
+	require.NoError(t, err)
+
+	body, err := recorder.Join(room, "user1", nil)
+	require.NoError(t, err)
+	var status server.RecordingStatus
+	require.NoError(t, json.Unmarshal(body, &status))
+	assert.Equal(t, room, status.Room)
+	assert.True(t, status.Recording)
+
+	_, err = recorder.Stop(room)
+	require.NoError(t, err)
+}
+
+func TestLocalRecorder_roomClosed(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	tracks := newSinkTracksManager()
+	recorder := server.NewLocalRecorder(loggerFactory, tracks, server.RecordConfig{Dir: dir})
+
+	_, err := recorder.Start(room)
+	require.NoError(t, err)
+
+	// the tracks manager closes the sinks when the last peer leaves
+	require.NoError(t, tracks.sinks[room].Close())
+
+	deadline := time.Now().Add(time.Second)
+	for isRecording(t, recorder) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.False(t, isRecording(t, recorder))
+}
+
+func TestLocalRecorder_roomNotFound(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	tracks := newSinkTracksManager()
+	tracks.err = fmt.Errorf("Room not found")
+	recorder := server.NewLocalRecorder(loggerFactory, tracks, server.RecordConfig{Dir: dir})
+
+	_, err := recorder.Start(room)
+	assert.Error(t, err)
+	assert.False(t, isRecording(t, recorder))
+}
+
+func isRecording(t *testing.T, recorder server.Recorder) bool {
+	status, err := recorder.Status(room)
+	require.NoError(t, err)
+	return status.Recording
+}
@@ -1,9 +1,27 @@
 package server
 
-import "github.com/peer-calls/peer-calls/server/logger"
+import (
+	"time"
+
+	"github.com/peer-calls/peer-calls/server/logger"
+)
 
 type Logger = logger.Logger
 
+// Fields are added to log messages, for example the room and clientID.
+type Fields = logger.Fields
+
 type LoggerFactory interface {
 	GetLogger(name string) Logger
 }
+
+// LogRules reads and replaces the rules which enable loggers while the server
+// is running.
+type LogRules interface {
+	Rules() logger.Rules
+	SetRules(names []string)
+	OverrideRules(names []string, duration time.Duration)
+	ResetOverride()
+}
+
+var _ LogRules = &logger.Factory{}
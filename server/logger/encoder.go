@@ -0,0 +1,144 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fields are key value pairs added to log messages, for example the room or
+// the clientID a message is about.
+type Fields map[string]interface{}
+
+// Entry is a single log message.
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Logger  string
+	Message string
+	Fields  Fields
+}
+
+// Encoder formats log entries before they are written to the output.
+type Encoder interface {
+	Encode(entry Entry) []byte
+}
+
+// NewEncoder returns the encoder for a format, which can be text or json.
+func NewEncoder(format string) (Encoder, error) {
+	switch strings.ToLower(format) {
+	case "", "text":
+		return TextEncoder{}, nil
+	case "json":
+		return JSONEncoder{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown log format: %q", format)
+	}
+}
+
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// TextEncoder formats entries as a single line of text, followed by the
+// fields sorted by key.
+type TextEncoder struct{}
+
+var _ Encoder = TextEncoder{}
+
+func (e TextEncoder) Encode(entry Entry) []byte {
+	var b bytes.Buffer
+
+	b.WriteString(entry.Time.Format(LoggerTimeFormat))
+	fmt.Fprintf(&b, " %-5s [%15s] ", strings.ToUpper(entry.Level.String()), entry.Logger)
+	b.WriteString(entry.Message)
+
+	for _, key := range sortedKeys(entry.Fields) {
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(textValue(entry.Fields[key]))
+	}
+
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+func textValue(value interface{}) string {
+	str := fmt.Sprint(value)
+	if str == "" || strings.ContainsAny(str, " =\"\n") {
+		return strconv.Quote(str)
+	}
+	return str
+}
+
+// JSONEncoder formats entries as JSON objects on a single line. Fields are
+// added to the object next to the time, level, logger and message keys so
+// that log pipelines can filter on them. Fields named like one of those keys
+// are prefixed with "fields.".
+type JSONEncoder struct{}
+
+var _ Encoder = JSONEncoder{}
+
+var jsonReservedKeys = map[string]struct{}{
+	"time":    {},
+	"level":   {},
+	"logger":  {},
+	"message": {},
+}
+
+func (e JSONEncoder) Encode(entry Entry) []byte {
+	var b bytes.Buffer
+
+	b.WriteString(`{"time":`)
+	writeJSON(&b, entry.Time.Format(LoggerTimeFormat))
+	b.WriteString(`,"level":`)
+	writeJSON(&b, entry.Level.String())
+	b.WriteString(`,"logger":`)
+	writeJSON(&b, entry.Logger)
+	b.WriteString(`,"message":`)
+	writeJSON(&b, entry.Message)
+
+	for _, key := range sortedKeys(entry.Fields) {
+		name := key
+		if _, ok := jsonReservedKeys[key]; ok {
+			name = "fields." + key
+		}
+
+		b.WriteByte(',')
+		writeJSON(&b, name)
+		b.WriteByte(':')
+		writeJSON(&b, entry.Fields[key])
+	}
+
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// writeJSON writes value as JSON. Errors are written as their message, and
+// values which cannot be marshalled as their default string format.
+func writeJSON(b *bytes.Buffer, value interface{}) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(value); err != nil {
+		buf.Reset()
+		_ = enc.Encode(fmt.Sprint(value))
+	}
+
+	b.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
@@ -0,0 +1,70 @@
+package logger_test
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/peer-calls/peer-calls/server/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextEncoder(t *testing.T) {
+	entry := logger.Entry{
+		Time:    time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Level:   logger.LevelWarn,
+		Logger:  "sfu",
+		Message: "Test",
+		Fields: logger.Fields{
+			"room":  "my room",
+			"ssrc":  uint32(123),
+			"error": errors.New("test"),
+			"empty": "",
+		},
+	}
+
+	assert.Equal(t,
+		"2020-01-02T03:04:05.000000Z WARN  [            sfu] Test empty=\"\" error=test room=\"my room\" ssrc=123\n",
+		string(logger.TextEncoder{}.Encode(entry)),
+	)
+}
+
+func TestJSONEncoder(t *testing.T) {
+	entry := logger.Entry{
+		Time:    time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Level:   logger.LevelInfo,
+		Logger:  "sfu",
+		Message: "<Test>",
+		Fields: logger.Fields{
+			"room":    "test",
+			"ssrc":    uint32(123),
+			"error":   errors.New("test"),
+			"message": "field",
+			"bitrate": math.Inf(1),
+		},
+	}
+
+	assert.Equal(t,
+		`{"time":"2020-01-02T03:04:05.000000Z","level":"info","logger":"sfu","message":"<Test>",`+
+			`"bitrate":"+Inf","error":"test","fields.message":"field","room":"test","ssrc":123}`+"\n",
+		string(logger.JSONEncoder{}.Encode(entry)),
+	)
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, expected := range map[string]logger.Level{
+		"trace": logger.LevelDebug,
+		"DEBUG": logger.LevelDebug,
+		"info":  logger.LevelInfo,
+		"warn":  logger.LevelWarn,
+		"error": logger.LevelError,
+	} {
+		level, err := logger.ParseLevel(name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, expected, level, name)
+	}
+
+	_, err := logger.ParseLevel("verbose")
+	assert.EqualError(t, err, `Unknown log level: "verbose"`)
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,8 +14,11 @@ import (
 type WriterLogger struct {
 	name    string
 	out     io.Writer
-	outMu   sync.Mutex
-	Enabled bool
+	outMu   *sync.Mutex
+	encoder Encoder
+	// levels has a bit set for each enabled level. It is accessed atomically
+	// because the Factory can change it while messages are written.
+	levels uint32
 }
 
 // Logger is an interface for logger
@@ -25,51 +29,209 @@ type Logger interface {
 	// Println writes all values similar to fmt.Println. If logger is not enabled,
 	// the message will not be formatted
 	Println(values ...interface{})
+	// Debug, Info, Warn and Error write a message with fields at their level
+	// when the level is enabled. Fields can be nil.
+	Debug(message string, fields Fields)
+	Info(message string, fields Fields)
+	Warn(message string, fields Fields)
+	Error(message string, fields Fields)
+	// WithFields returns a logger with the same name which adds fields to all
+	// messages.
+	WithFields(fields Fields) Logger
+	// IsEnabled returns true when messages at level are written.
+	IsEnabled(level Level) bool
 }
 
 // LoggerTimeFormat is the time format used by loggers in this package
 var LoggerTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
 
-// NewWriterLogger creates a new logger
+// NewWriterLogger creates a new logger which writes text. When it is enabled,
+// messages at the info level and above are written.
 func NewWriterLogger(name string, out io.Writer, enabled bool) *WriterLogger {
-	return &WriterLogger{name: name, out: out, Enabled: enabled}
+	l := &WriterLogger{
+		name:    name,
+		out:     out,
+		outMu:   &sync.Mutex{},
+		encoder: TextEncoder{},
+	}
+	l.SetEnabled(enabled)
+	return l
+}
+
+var _ Logger = &WriterLogger{}
+
+// IsEnabled implements Logger#IsEnabled func.
+func (l *WriterLogger) IsEnabled(level Level) bool {
+	return atomic.LoadUint32(&l.levels)&levelBit(level) != 0
+}
+
+// SetEnabled enables messages at the info level and above, including the
+// messages of Printf and Println, or disables all messages.
+func (l *WriterLogger) SetEnabled(enabled bool) {
+	var levels uint32
+	if enabled {
+		for level := LevelInfo; level <= LevelError; level++ {
+			levels |= levelBit(level)
+		}
+	}
+	l.setLevels(levels)
+}
+
+func (l *WriterLogger) setLevels(levels uint32) {
+	atomic.StoreUint32(&l.levels, levels)
+}
+
+func levelBit(level Level) uint32 {
+	if level < LevelDebug || level > LevelError {
+		return 0
+	}
+	return 1 << uint(level)
 }
 
 // Printf implements Logger#Printf func.
 func (l *WriterLogger) Printf(message string, values ...interface{}) {
-	if l.Enabled {
-		l.printf(message, values...)
+	if l.IsEnabled(LevelInfo) {
+		l.write(LevelInfo, fmt.Sprintf(message, values...), nil)
 	}
 }
 
 // Println implements Logger#Println func.
 func (l *WriterLogger) Println(values ...interface{}) {
-	if l.Enabled {
-		l.println(values...)
+	if l.IsEnabled(LevelInfo) {
+		l.write(LevelInfo, strings.TrimSuffix(fmt.Sprintln(values...), "\n"), nil)
 	}
 }
 
-func (l *WriterLogger) printf(message string, values ...interface{}) {
-	l.outMu.Lock()
-	defer l.outMu.Unlock()
-	date := time.Now().Format(LoggerTimeFormat)
-	l.out.Write([]byte(date + fmt.Sprintf(" [%15s] ", l.name) + fmt.Sprintf(message+"\n", values...)))
+// Debug implements Logger#Debug func.
+func (l *WriterLogger) Debug(message string, fields Fields) {
+	l.log(LevelDebug, message, fields)
+}
+
+// Info implements Logger#Info func.
+func (l *WriterLogger) Info(message string, fields Fields) {
+	l.log(LevelInfo, message, fields)
 }
 
-func (l *WriterLogger) println(values ...interface{}) {
+// Warn implements Logger#Warn func.
+func (l *WriterLogger) Warn(message string, fields Fields) {
+	l.log(LevelWarn, message, fields)
+}
+
+// Error implements Logger#Error func.
+func (l *WriterLogger) Error(message string, fields Fields) {
+	l.log(LevelError, message, fields)
+}
+
+// WithFields implements Logger#WithFields func.
+func (l *WriterLogger) WithFields(fields Fields) Logger {
+	return &fieldsLogger{logger: l, fields: fields}
+}
+
+func (l *WriterLogger) log(level Level, message string, fields Fields) {
+	if l.IsEnabled(level) {
+		l.write(level, message, fields)
+	}
+}
+
+func (l *WriterLogger) write(level Level, message string, fields Fields) {
+	data := l.encoder.Encode(Entry{
+		Time:    time.Now(),
+		Level:   level,
+		Logger:  l.name,
+		Message: message,
+		Fields:  fields,
+	})
+
 	l.outMu.Lock()
 	defer l.outMu.Unlock()
-	date := time.Now().Format(LoggerTimeFormat)
-	l.out.Write([]byte(date + fmt.Sprintf(" [%15s] ", l.name) + fmt.Sprintln(values...)))
+	_, _ = l.out.Write(data)
+}
+
+// fieldsLogger adds fields to the messages of a WriterLogger.
+type fieldsLogger struct {
+	logger *WriterLogger
+	fields Fields
+}
+
+var _ Logger = &fieldsLogger{}
+
+func (l *fieldsLogger) IsEnabled(level Level) bool {
+	return l.logger.IsEnabled(level)
+}
+
+func (l *fieldsLogger) Printf(message string, values ...interface{}) {
+	if l.logger.IsEnabled(LevelInfo) {
+		l.logger.write(LevelInfo, fmt.Sprintf(message, values...), l.fields)
+	}
+}
+
+func (l *fieldsLogger) Println(values ...interface{}) {
+	if l.logger.IsEnabled(LevelInfo) {
+		l.logger.write(LevelInfo, strings.TrimSuffix(fmt.Sprintln(values...), "\n"), l.fields)
+	}
+}
+
+func (l *fieldsLogger) Debug(message string, fields Fields) {
+	l.log(LevelDebug, message, fields)
+}
+
+func (l *fieldsLogger) Info(message string, fields Fields) {
+	l.log(LevelInfo, message, fields)
+}
+
+func (l *fieldsLogger) Warn(message string, fields Fields) {
+	l.log(LevelWarn, message, fields)
+}
+
+func (l *fieldsLogger) Error(message string, fields Fields) {
+	l.log(LevelError, message, fields)
+}
+
+func (l *fieldsLogger) WithFields(fields Fields) Logger {
+	return &fieldsLogger{logger: l.logger, fields: mergeFields(l.fields, fields)}
+}
+
+func (l *fieldsLogger) log(level Level, message string, fields Fields) {
+	if l.logger.IsEnabled(level) {
+		l.logger.write(level, message, mergeFields(l.fields, fields))
+	}
+}
+
+// mergeFields returns the fields of both a and b, with the values of b
+// replacing the values of a with the same key.
+func mergeFields(a Fields, b Fields) Fields {
+	if len(b) == 0 {
+		return a
+	}
+	if len(a) == 0 {
+		return b
+	}
+
+	fields := make(Fields, len(a)+len(b))
+	for key, value := range a {
+		fields[key] = value
+	}
+	for key, value := range b {
+		fields[key] = value
+	}
+	return fields
 }
 
 // Factory creates new loggers. Only one logger with a specific name
 // will be created.
 type Factory struct {
 	out            io.Writer
+	outMu          sync.Mutex
+	encoder        Encoder
+	level          Level
 	loggers        map[string]*WriterLogger
 	defaultEnabled []string
 	loggersMu      sync.Mutex
+
+	// override replaces defaultEnabled until overrideExpires.
+	override        []string
+	overrideExpires time.Time
+	overrideTimer   *time.Timer
 }
 
 // NewFactory creates a new logger factory. The enabled slice can be used
@@ -79,36 +241,199 @@ type Factory struct {
 // the enabled string to `myproject:a:b`, or `myproject:*` or `myproject:*:b`.
 // To disable a logger, add a minus to the beginning of the name. For example,
 // to enable all loggers but one use: `-myproject:a:b,*`.
+//
+// Enabled loggers write messages at the minimum level and above, which is
+// info by default. When the last part of an enabled string is a level, it
+// enables or disables only that level of the matching loggers, regardless of
+// the minimum level. For example, `myproject:*:debug` enables debug messages
+// of all loggers under `myproject`.
 func NewFactory(out io.Writer, enabled []string) *Factory {
 	return &Factory{
 		out:            out,
+		encoder:        TextEncoder{},
+		level:          DefaultLevel,
 		loggers:        map[string]*WriterLogger{},
 		defaultEnabled: enabled,
 	}
 }
 
 // NewFactoryFromEnv creates a new Factory and reads the enabled
-// loggers from a comma-delimited environment variable.
+// loggers from a comma-delimited environment variable. The minimum level is
+// read from the LOG_LEVEL and the output format, text or json, from the
+// LOG_FORMAT environment variables with the same prefix.
 func NewFactoryFromEnv(prefix string, out io.Writer) *Factory {
 	log := os.Getenv(prefix + "LOG")
 	var enabled []string
 	if len(log) > 0 {
 		enabled = strings.Split(log, ",")
 	}
-	return NewFactory(out, enabled)
+	factory := NewFactory(out, enabled)
+
+	var errs []error
+
+	if format := os.Getenv(prefix + "LOG_FORMAT"); format != "" {
+		encoder, err := NewEncoder(format)
+		if err == nil {
+			factory.SetEncoder(encoder)
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	if levelName := os.Getenv(prefix + "LOG_LEVEL"); levelName != "" {
+		level, err := ParseLevel(levelName)
+		if err == nil {
+			factory.SetLevel(level)
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, err := range errs {
+		factory.GetLogger("logger").Warn("Error configuring logger", Fields{"error": err})
+	}
+
+	return factory
+}
+
+// SetEncoder sets the encoder used by all loggers. Unlike the rules, the
+// encoder should not be changed while loggers are in use.
+func (l *Factory) SetEncoder(encoder Encoder) {
+	l.loggersMu.Lock()
+	defer l.loggersMu.Unlock()
+	l.encoder = encoder
+	for _, logger := range l.loggers {
+		logger.encoder = encoder
+	}
+}
+
+// SetLevel sets the minimum level of messages written by enabled loggers.
+func (l *Factory) SetLevel(level Level) {
+	l.loggersMu.Lock()
+	defer l.loggersMu.Unlock()
+	l.level = level
+	l.updateLoggers()
 }
 
 // SetDefaultEnabled sets enabled loggers if the Factory has been
 // initialized with no loggers.
 func (l *Factory) SetDefaultEnabled(names []string) {
+	l.loggersMu.Lock()
+	defer l.loggersMu.Unlock()
 	if len(l.defaultEnabled) == 0 {
 		l.defaultEnabled = names
-		for name, logger := range l.loggers {
-			if !logger.Enabled {
-				logger.Enabled = l.isEnabled(name)
-			}
+		l.updateLoggers()
+	}
+}
+
+// Rules describes the rules which enable loggers.
+type Rules struct {
+	// Enabled are the rules in effect.
+	Enabled []string `json:"enabled"`
+	// Default are the rules in effect when there is no override.
+	Default []string `json:"default"`
+	// Expires is the time the override expires at, or nil when there is no
+	// override.
+	Expires *time.Time `json:"expires"`
+}
+
+// Rules returns the rules which enable loggers.
+func (l *Factory) Rules() Rules {
+	l.loggersMu.Lock()
+	defer l.loggersMu.Unlock()
+
+	rules := Rules{
+		Enabled: copyRules(l.enabledRules()),
+		Default: copyRules(l.defaultEnabled),
+	}
+
+	if l.override != nil {
+		expires := l.overrideExpires
+		rules.Expires = &expires
+	}
+
+	return rules
+}
+
+// SetRules replaces the default rules which enable loggers, and re-evaluates
+// all existing loggers. An override stays in effect until it expires.
+func (l *Factory) SetRules(names []string) {
+	l.loggersMu.Lock()
+	defer l.loggersMu.Unlock()
+	l.defaultEnabled = copyRules(names)
+	l.updateLoggers()
+}
+
+// OverrideRules replaces the rules which enable loggers until duration has
+// passed, after which the default rules are used again. It replaces any
+// previous override.
+func (l *Factory) OverrideRules(names []string, duration time.Duration) {
+	l.loggersMu.Lock()
+	defer l.loggersMu.Unlock()
+
+	l.stopOverride()
+
+	var timer *time.Timer
+	timer = time.AfterFunc(duration, func() {
+		l.loggersMu.Lock()
+		defer l.loggersMu.Unlock()
+		// the override might have been replaced after the timer fired.
+		if l.overrideTimer == timer {
+			l.stopOverride()
+			l.updateLoggers()
 		}
+	})
+
+	l.override = copyRules(names)
+	l.overrideExpires = time.Now().Add(duration)
+	l.overrideTimer = timer
+	l.updateLoggers()
+}
+
+// ResetOverride removes the override before it expires.
+func (l *Factory) ResetOverride() {
+	l.loggersMu.Lock()
+	defer l.loggersMu.Unlock()
+	l.stopOverride()
+	l.updateLoggers()
+}
+
+func (l *Factory) stopOverride() {
+	if l.overrideTimer != nil {
+		l.overrideTimer.Stop()
+	}
+	l.override = nil
+	l.overrideExpires = time.Time{}
+	l.overrideTimer = nil
+}
+
+func (l *Factory) enabledRules() []string {
+	if l.override != nil {
+		return l.override
 	}
+	return l.defaultEnabled
+}
+
+func copyRules(names []string) []string {
+	rules := make([]string, len(names))
+	copy(rules, names)
+	return rules
+}
+
+func (l *Factory) updateLoggers() {
+	for _, logger := range l.loggers {
+		l.setLevels(logger)
+	}
+}
+
+func (l *Factory) setLevels(logger *WriterLogger) {
+	var levels uint32
+	for level := LevelDebug; level <= LevelError; level++ {
+		if l.isEnabled(logger.name, level) {
+			levels |= levelBit(level)
+		}
+	}
+	logger.setLevels(levels)
 }
 
 func split(name string) (parts []string) {
@@ -143,10 +468,21 @@ func partsMatch(parts []string, enabledParts []string) bool {
 	return true
 }
 
-func (l *Factory) isEnabled(name string) bool {
+// ruleLevel returns the level of a rule when its last part is the name of a
+// level.
+func ruleLevel(enabledParts []string) (Level, bool) {
+	if len(enabledParts) < 2 {
+		return 0, false
+	}
+
+	level, err := ParseLevel(enabledParts[len(enabledParts)-1])
+	return level, err == nil
+}
+
+func (l *Factory) isEnabled(name string, level Level) bool {
 	parts := split(name)
 
-	for _, enabledName := range l.defaultEnabled {
+	for _, enabledName := range l.enabledRules() {
 		isEnabled := true
 
 		if strings.HasPrefix(enabledName, "-") {
@@ -156,8 +492,21 @@ func (l *Factory) isEnabled(name string) bool {
 
 		enabledParts := split(enabledName)
 
+		if enabledLevel, ok := ruleLevel(enabledParts); ok {
+			if enabledLevel == level && partsMatch(parts, enabledParts[:len(enabledParts)-1]) {
+				return isEnabled
+			}
+
+			// a level rule can still match the whole name of a logger, for
+			// example a:*:warn matches the logger a:one:warn, but it should not
+			// enable all levels of the logger a.
+			if len(enabledParts) > len(parts) {
+				continue
+			}
+		}
+
 		if partsMatch(parts, enabledParts) {
-			return isEnabled
+			return isEnabled && level >= l.level
 		}
 	}
 
@@ -171,8 +520,13 @@ func (l *Factory) GetLogger(name string) Logger {
 	defer l.loggersMu.Unlock()
 	logger, ok := l.loggers[name]
 	if !ok {
-		enabled := l.isEnabled(name)
-		logger = NewWriterLogger(name, l.out, enabled)
+		logger = &WriterLogger{
+			name:    name,
+			out:     l.out,
+			outMu:   &l.outMu,
+			encoder: l.encoder,
+		}
+		l.setLevels(logger)
 		l.loggers[name] = logger
 	}
 	return logger
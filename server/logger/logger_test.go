@@ -1,9 +1,12 @@
 package logger_test
 
 import (
+	"encoding/json"
+	"errors"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/peer-calls/peer-calls/server/logger"
 	"github.com/peer-calls/peer-calls/server/test"
@@ -52,9 +55,9 @@ func TestSetDefaultEnabled(t *testing.T) {
 	loggerFactory := logger.NewFactoryFromEnv("TESTLOG_", &out)
 	logB := loggerFactory.GetLogger("b")
 	b := logB.(*logger.WriterLogger)
-	b.Enabled = false
+	b.SetEnabled(false)
 	loggerFactory.SetDefaultEnabled([]string{"b"})
-	assert.True(t, b.Enabled)
+	assert.True(t, b.IsEnabled(logger.LevelInfo))
 	logB.Println(1, "one")
 	assert.Regexp(t, " \\[              b] 1 one\n", out.String())
 }
@@ -137,3 +140,151 @@ func TestGetLogger_Wildcard_Disabled(t *testing.T) {
 	require.Equal(t, 1, len(result))
 	assert.Regexp(t, " \\[     b:one:warn] b one warn", result[0])
 }
+
+func TestGetLogger_Levels(t *testing.T) {
+	defer test.UnsetEnvPrefix("TESTLOG_")
+	os.Setenv("TESTLOG_LOG", "-a:warn,a,b:debug,-b:info,b")
+	var out strings.Builder
+	loggerFactory := logger.NewFactoryFromEnv("TESTLOG_", &out)
+	logA := loggerFactory.GetLogger("a")
+	logB := loggerFactory.GetLogger("b")
+
+	for _, log := range []logger.Logger{logA, logB} {
+		log.Debug("debug", nil)
+		log.Info("info", nil)
+		log.Warn("warn", nil)
+		log.Error("error", nil)
+	}
+
+	result := strings.Split(strings.Trim(out.String(), "\n"), "\n")
+	require.Equal(t, 5, len(result))
+	assert.Regexp(t, " INFO  \\[              a] info$", result[0])
+	assert.Regexp(t, " ERROR \\[              a] error$", result[1])
+	assert.Regexp(t, " DEBUG \\[              b] debug$", result[2])
+	assert.Regexp(t, " WARN  \\[              b] warn$", result[3])
+	assert.Regexp(t, " ERROR \\[              b] error$", result[4])
+
+	assert.False(t, logA.IsEnabled(logger.LevelDebug))
+	assert.True(t, logB.IsEnabled(logger.LevelDebug))
+	assert.False(t, logB.IsEnabled(logger.LevelInfo))
+}
+
+func TestGetLogger_MinimumLevel(t *testing.T) {
+	defer test.UnsetEnvPrefix("TESTLOG_")
+	os.Setenv("TESTLOG_LOG", "*")
+	os.Setenv("TESTLOG_LOG_LEVEL", "warn")
+	var out strings.Builder
+	loggerFactory := logger.NewFactoryFromEnv("TESTLOG_", &out)
+	log := loggerFactory.GetLogger("a")
+	log.Printf("info")
+	log.Warn("warn", nil)
+
+	loggerFactory.SetLevel(logger.LevelDebug)
+	log.Debug("debug", nil)
+
+	result := strings.Split(strings.Trim(out.String(), "\n"), "\n")
+	require.Equal(t, 2, len(result))
+	assert.Regexp(t, " WARN  \\[              a] warn$", result[0])
+	assert.Regexp(t, " DEBUG \\[              a] debug$", result[1])
+}
+
+func TestGetLogger_WithFields(t *testing.T) {
+	defer test.UnsetEnvPrefix("TESTLOG_")
+	os.Setenv("TESTLOG_LOG", "a")
+	var out strings.Builder
+	loggerFactory := logger.NewFactoryFromEnv("TESTLOG_", &out)
+	log := loggerFactory.GetLogger("a").WithFields(logger.Fields{"room": "test", "clientId": "1"})
+	log.Printf("Test: %d", 1)
+	log.WithFields(logger.Fields{"clientId": "2"}).Info("Test 2", logger.Fields{"ssrc": 123})
+	log.Debug("Test 3", nil)
+
+	result := strings.Split(strings.Trim(out.String(), "\n"), "\n")
+	require.Equal(t, 2, len(result))
+	assert.Regexp(t, " INFO  \\[              a] Test: 1 clientId=1 room=test$", result[0])
+	assert.Regexp(t, " INFO  \\[              a] Test 2 clientId=2 room=test ssrc=123$", result[1])
+}
+
+func TestGetLogger_JSON(t *testing.T) {
+	defer test.UnsetEnvPrefix("TESTLOG_")
+	os.Setenv("TESTLOG_LOG", "a")
+	os.Setenv("TESTLOG_LOG_FORMAT", "json")
+	var out strings.Builder
+	loggerFactory := logger.NewFactoryFromEnv("TESTLOG_", &out)
+	log := loggerFactory.GetLogger("a").WithFields(logger.Fields{"room": "test"})
+	log.Error("Test", logger.Fields{"error": errors.New("test error")})
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(out.String()), &entry))
+	assert.NotEmpty(t, entry["time"])
+	delete(entry, "time")
+	assert.Equal(t, map[string]interface{}{
+		"level":   "error",
+		"logger":  "a",
+		"message": "Test",
+		"room":    "test",
+		"error":   "test error",
+	}, entry)
+}
+
+func TestNewFactoryFromEnv_Invalid(t *testing.T) {
+	defer test.UnsetEnvPrefix("TESTLOG_")
+	os.Setenv("TESTLOG_LOG", "*")
+	os.Setenv("TESTLOG_LOG_FORMAT", "xml")
+	os.Setenv("TESTLOG_LOG_LEVEL", "verbose")
+	var out strings.Builder
+	logger.NewFactoryFromEnv("TESTLOG_", &out)
+
+	result := strings.Split(strings.Trim(out.String(), "\n"), "\n")
+	require.Equal(t, 2, len(result))
+	assert.Regexp(t, `Error configuring logger error="Unknown log format: \\"xml\\""$`, result[0])
+	assert.Regexp(t, `Error configuring logger error="Unknown log level: \\"verbose\\""$`, result[1])
+}
+
+func TestFactory_SetRules(t *testing.T) {
+	var out strings.Builder
+	loggerFactory := logger.NewFactory(&out, []string{"a"})
+	logA := loggerFactory.GetLogger("a")
+	logB := loggerFactory.GetLogger("b")
+	assert.True(t, logA.IsEnabled(logger.LevelInfo))
+	assert.False(t, logB.IsEnabled(logger.LevelInfo))
+
+	loggerFactory.SetRules([]string{"-a", "*"})
+	assert.False(t, logA.IsEnabled(logger.LevelInfo))
+	assert.True(t, logB.IsEnabled(logger.LevelInfo))
+	assert.Equal(t, logger.Rules{
+		Enabled: []string{"-a", "*"},
+		Default: []string{"-a", "*"},
+	}, loggerFactory.Rules())
+}
+
+func TestFactory_OverrideRules(t *testing.T) {
+	var out strings.Builder
+	loggerFactory := logger.NewFactory(&out, []string{"a"})
+	logA := loggerFactory.GetLogger("a")
+	logB := loggerFactory.GetLogger("b")
+
+	loggerFactory.OverrideRules([]string{"b:debug", "a"}, time.Hour)
+	assert.True(t, logB.IsEnabled(logger.LevelDebug))
+	assert.False(t, logB.IsEnabled(logger.LevelInfo))
+	assert.True(t, logA.IsEnabled(logger.LevelInfo))
+
+	rules := loggerFactory.Rules()
+	assert.Equal(t, []string{"b:debug", "a"}, rules.Enabled)
+	assert.Equal(t, []string{"a"}, rules.Default)
+	require.NotNil(t, rules.Expires)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *rules.Expires, time.Minute)
+
+	loggerFactory.ResetOverride()
+	assert.False(t, logB.IsEnabled(logger.LevelDebug))
+	assert.Nil(t, loggerFactory.Rules().Expires)
+
+	loggerFactory.OverrideRules([]string{"b"}, 10*time.Millisecond)
+	assert.True(t, logB.IsEnabled(logger.LevelInfo))
+	assert.Eventually(t, func() bool {
+		return !logB.IsEnabled(logger.LevelInfo)
+	}, time.Second, 5*time.Millisecond, "override expired")
+	assert.Equal(t, logger.Rules{
+		Enabled: []string{"a"},
+		Default: []string{"a"},
+	}, loggerFactory.Rules())
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryRoom struct {
+	info    RoomInfo
+	expires time.Time
+}
+
+// MemoryRoomStore keeps rooms in memory of a single instance. Expired rooms
+// are removed when a new room is created.
+type MemoryRoomStore struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu    sync.Mutex
+	rooms map[string]*memoryRoom
+	// bans contains ban expiry times by room and banned ID.
+	bans map[memoryBan]time.Time
+}
+
+type memoryBan struct {
+	room string
+	id   string
+}
+
+var _ RoomStore = &MemoryRoomStore{}
+
+func NewMemoryRoomStore(ttl time.Duration) *MemoryRoomStore {
+	return &MemoryRoomStore{
+		ttl:   ttl,
+		now:   time.Now,
+		rooms: map[string]*memoryRoom{},
+		bans:  map[memoryBan]time.Time{},
+	}
+}
+
+// get returns the room if it exists and has not expired. Must be called with
+// the lock held.
+func (s *MemoryRoomStore) get(room string, now time.Time) (*memoryRoom, bool) {
+	r, ok := s.rooms[room]
+	if !ok {
+		return nil, false
+	}
+
+	if s.ttl > 0 && !now.Before(r.expires) {
+		delete(s.rooms, room)
+		return nil, false
+	}
+
+	return r, true
+}
+
+func (s *MemoryRoomStore) removeExpired(now time.Time) {
+	for ban, expires := range s.bans {
+		if !now.Before(expires) {
+			delete(s.bans, ban)
+		}
+	}
+
+	if s.ttl <= 0 {
+		return
+	}
+
+	for room, r := range s.rooms {
+		if !now.Before(r.expires) {
+			delete(s.rooms, room)
+		}
+	}
+}
+
+func (s *MemoryRoomStore) Create(room string, creatorID string) (RoomInfo, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.removeExpired(now)
+
+	if r, ok := s.rooms[room]; ok {
+		r.expires = now.Add(s.ttl)
+		return r.info, false, nil
+	}
+
+	r := &memoryRoom{
+		info: RoomInfo{
+			Room:      room,
+			CreatorID: creatorID,
+		},
+		expires: now.Add(s.ttl),
+	}
+	s.rooms[room] = r
+
+	return r.info, true, nil
+}
+
+func (s *MemoryRoomStore) Get(room string) (RoomInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.get(room, s.now())
+	if !ok {
+		return RoomInfo{}, ErrRoomNotFound
+	}
+
+	return r.info, nil
+}
+
+// update modifies the room and extends its expiry.
+func (s *MemoryRoomStore) update(room string, fn func(info *RoomInfo)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	r, ok := s.get(room, now)
+	if !ok {
+		return ErrRoomNotFound
+	}
+
+	fn(&r.info)
+	r.expires = now.Add(s.ttl)
+	return nil
+}
+
+func (s *MemoryRoomStore) SetRecording(room string, recording bool) error {
+	return s.update(room, func(info *RoomInfo) {
+		info.Recording = recording
+	})
+}
+
+func (s *MemoryRoomStore) SetPassword(room string, passwordHash string) error {
+	return s.update(room, func(info *RoomInfo) {
+		info.PasswordHash = passwordHash
+	})
+}
+
+func (s *MemoryRoomStore) SetLocked(room string, locked bool) error {
+	return s.update(room, func(info *RoomInfo) {
+		info.Locked = locked
+	})
+}
+
+func (s *MemoryRoomStore) SetLobby(room string, lobby bool) error {
+	return s.update(room, func(info *RoomInfo) {
+		info.Lobby = lobby
+	})
+}
+
+func (s *MemoryRoomStore) SetCreator(room string, creatorID string) error {
+	return s.update(room, func(info *RoomInfo) {
+		info.CreatorID = creatorID
+	})
+}
+
+func (s *MemoryRoomStore) Ban(room string, id string, duration time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bans[memoryBan{room, id}] = s.now().Add(duration)
+	return nil
+}
+
+func (s *MemoryRoomStore) Banned(room string, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires, ok := s.bans[memoryBan{room, id}]
+	return ok && s.now().Before(expires), nil
+}
+
+func (s *MemoryRoomStore) Touch(room string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	r, ok := s.get(room, now)
+	if !ok {
+		return ErrRoomNotFound
+	}
+
+	r.expires = now.Add(s.ttl)
+	return nil
+}
+
+func (s *MemoryRoomStore) Remove(room string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.rooms, room)
+	return nil
+}
+
+func (s *MemoryRoomStore) Close() error {
+	return nil
+}
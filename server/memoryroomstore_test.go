@@ -0,0 +1,103 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryRoomStore(t *testing.T) {
+	s := NewMemoryRoomStore(time.Hour)
+	defer s.Close()
+
+	_, err := s.Get("room1")
+	assert.Equal(t, ErrRoomNotFound, err)
+	assert.Equal(t, ErrRoomNotFound, s.SetRecording("room1", true))
+	assert.Equal(t, ErrRoomNotFound, s.Touch("room1"))
+
+	info, created, err := s.Create("room1", "user1")
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, RoomInfo{Room: "room1", CreatorID: "user1"}, info)
+
+	info, created, err = s.Create("room1", "user2")
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, "user1", info.CreatorID)
+
+	require.NoError(t, s.SetRecording("room1", true))
+	info, err = s.Get("room1")
+	require.NoError(t, err)
+	assert.Equal(t, RoomInfo{Room: "room1", CreatorID: "user1", Recording: true}, info)
+
+	require.NoError(t, s.SetPassword("room1", "hash"))
+	require.NoError(t, s.SetLocked("room1", true))
+	require.NoError(t, s.SetLobby("room1", true))
+	require.NoError(t, s.SetCreator("room1", "user2"))
+	info, err = s.Get("room1")
+	require.NoError(t, err)
+	assert.Equal(t, RoomInfo{
+		Room:         "room1",
+		CreatorID:    "user2",
+		Recording:    true,
+		PasswordHash: "hash",
+		Locked:       true,
+		Lobby:        true,
+	}, info)
+
+	require.NoError(t, s.Remove("room1"))
+	_, err = s.Get("room1")
+	assert.Equal(t, ErrRoomNotFound, err)
+}
+
+func TestMemoryRoomStore_expire(t *testing.T) {
+	now := time.Now()
+
+	s := NewMemoryRoomStore(time.Minute)
+	s.now = func() time.Time { return now }
+
+	_, _, err := s.Create("room1", "user1")
+	require.NoError(t, err)
+	_, _, err = s.Create("room2", "user2")
+	require.NoError(t, err)
+
+	now = now.Add(50 * time.Second)
+	require.NoError(t, s.Touch("room1"))
+
+	now = now.Add(50 * time.Second)
+	_, err = s.Get("room1")
+	assert.NoError(t, err)
+	_, err = s.Get("room2")
+	assert.Equal(t, ErrRoomNotFound, err)
+
+	now = now.Add(time.Minute)
+	_, _, err = s.Create("room3", "user3")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(s.rooms), "expired rooms should be removed")
+}
+
+func TestMemoryRoomStore_ban(t *testing.T) {
+	now := time.Now()
+
+	s := NewMemoryRoomStore(time.Hour)
+	s.now = func() time.Time { return now }
+
+	banned, err := s.Banned("room1", "user1")
+	require.NoError(t, err)
+	assert.False(t, banned)
+
+	require.NoError(t, s.Ban("room1", "user1", time.Minute))
+	banned, err = s.Banned("room1", "user1")
+	require.NoError(t, err)
+	assert.True(t, banned)
+	banned, err = s.Banned("room2", "user1")
+	require.NoError(t, err)
+	assert.False(t, banned)
+
+	now = now.Add(time.Minute)
+	banned, err = s.Banned("room1", "user1")
+	require.NoError(t, err)
+	assert.False(t, banned)
+}
@@ -1,30 +1,21 @@
 package server
 
 import (
-	"io/ioutil"
 	"net/http"
-	"sync"
-	"time"
 )
 
-type ReadyMessage struct {
-	UserID string `json:"userId"`
-	Room   string `json:"room"`
-}
-
-func NewMeshHandler(loggerFactory LoggerFactory, wss *WSS, activeRooms *sync.Map, recordServiceURL string) http.Handler {
+func NewMeshHandler(loggerFactory LoggerFactory, wss *WSS, iceServers []ICEServer, roomStore RoomStore, recorder Recorder) http.Handler {
 	log := loggerFactory.GetLogger("mesh")
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		sub, err := wss.Subscribe(w, r)
-		token, err := JWTTokenFromCookie(r)
 		if err != nil {
-			w.WriteHeader(http.StatusForbidden)
-			w.Write([]byte("Forbidden"))
+			log.Warn("Error subscribing to websocket messages", Fields{"error": err})
 			return
 		}
-		if err != nil {
-			log.Printf("Error subscribing to websocket messages: %s", err)
-		}
+		log := log.WithFields(Fields{
+			"room":     sub.Room,
+			"clientId": sub.ClientID,
+		})
 		for msg := range sub.Messages {
 			adapter := sub.Adapter
 			room := sub.Room
@@ -35,41 +26,46 @@ func NewMeshHandler(loggerFactory LoggerFactory, wss *WSS, activeRooms *sync.Map
 
 			switch msg.Type {
 			case "hangUp":
-				log.Printf("[%s] hangUp event", clientID)
+				log.Info("hangUp event", nil)
 				adapter.SetMetadata(clientID, "")
 			case "ready":
-				// FIXME check for errors
-				payload, _ := msg.Payload.(map[string]interface{})
-				adapter.SetMetadata(clientID, payload["nickname"].(string))
+				var payload ReadyPayload
+				if err = sub.Deserializer.DeserializePayload(msg, &payload); err != nil {
+					break
+				}
+				adapter.SetMetadata(clientID, payload.Nickname)
 
 				clients, readyClientsErr := getReadyClients(adapter)
 				if readyClientsErr != nil {
-					log.Printf("Error retrieving clients: %s", readyClientsErr)
+					log.Error("Error retrieving clients", Fields{"error": readyClientsErr})
 				}
 				responseEventName = "users"
-				log.Printf("Got clients: %s", clients)
+				log.Debug("Got clients", Fields{"clients": clients})
 				err = adapter.Broadcast(
-					NewMessage(responseEventName, room, map[string]interface{}{
-						"initiator":    clientID,
-						"peerIds":      clientsToPeerIDs(clients),
-						"nicknames":    clients,
-						"recordStatus": getRoomRecordStatus(room, activeRooms),
+					NewMessage(responseEventName, room, UsersPayload{
+						Initiator:    clientID,
+						PeerIDs:      clientsToPeerIDs(clients),
+						Nicknames:    clients,
+						RecordStatus: touchRoom(log, roomStore, room).Recording,
 					}),
 				)
 				if len(clients) == 0 {
-					removeRoom(room, activeRooms)
+					if removeErr := roomStore.Remove(room); removeErr != nil {
+						log.Error("Error removing room", Fields{"error": removeErr})
+					}
 				}
 			case "signal":
 				// todo check for auth
-				payload, _ := msg.Payload.(map[string]interface{})
-				signal, _ := payload["signal"]
-				targetClientID, _ := payload["userId"].(string)
+				var payload Payload
+				if err = sub.Deserializer.DeserializePayload(msg, &payload); err != nil {
+					break
+				}
 
 				responseEventName = "signal"
-				log.Printf("Send signal from: %s to %s", clientID, targetClientID)
-				err = adapter.Emit(targetClientID, NewMessage(responseEventName, room, map[string]interface{}{
-					"userId": clientID,
-					"signal": signal,
+				log.Debug("Send signal", Fields{"targetClientId": payload.UserID})
+				err = adapter.Emit(payload.UserID, NewMessage(responseEventName, room, Payload{
+					UserID: clientID,
+					Signal: payload.Signal,
 				}))
 
 				/* 			case "ping":
@@ -78,120 +74,35 @@ func NewMeshHandler(loggerFactory LoggerFactory, wss *WSS, activeRooms *sync.Map
 					"message": "pong",
 				})) */
 			case "create_room":
-				payload, _ := msg.Payload.(map[string]interface{})
-				roomReq, _ := payload["room"].(string)
-
-				if roomExists(roomReq, activeRooms) {
-					err = adapter.Emit(clientID, NewMessage("room_created", room, map[string]interface{}{ //TODO: room?
-						"successful": "0",
-						"creatorId":  getRoomCreator(roomReq, activeRooms),
-					}))
-				} else {
-					createRoom(token["user_id"].(string), room, activeRooms)
-					err = adapter.Emit(clientID, NewMessage("room_created", room, map[string]interface{}{ //TODO: room?
-						"successful": "1",
-						"creatorId":  token["user_id"].(string),
-					}))
-				}
+				err = handleCreateRoomMessage(log, roomStore, adapter, room, clientID, sub.UserID)
 
 			case "record":
+				err = handleRecordMessage(log, recorder, adapter, roomStore, sub.Deserializer, msg, room, clientID, sub.Identity)
 
-				payload, _ := msg.Payload.(map[string]interface{})
-				status, _ := payload["recordStatus"].(bool)
+			case "ice_servers":
+				responseEventName = "ice_servers"
+				err = handleICEServersMessage(adapter, iceServers, room, clientID, sub.Identity)
 
-				if token["user_id"].(string) != getRoomCreator(room, activeRooms) {
-					err = adapter.Broadcast(
-						NewMessage("record_callback", room, map[string]interface{}{
-							"successful": false,
-						}),
-					)
-				} else {
-					client := &http.Client{
-						Timeout: 15 * time.Second,
-					}
-					var err error
-					var resp *http.Response
-					if status {
-						resp, err = client.Post(recordServiceURL+"/api/sessions/"+room, "application/json", nil)
-					} else {
-						req, errRequest := http.NewRequest("DELETE", recordServiceURL+"/api/sessions/"+room, nil)
-						if errRequest == nil {
-							_, err = client.Do(req)
-						} else {
-							err = errRequest
-						}
-					}
-
-					if err != nil {
-						log.Printf("Error create record session %v", err)
-						err = adapter.Broadcast(
-							NewMessage("record_callback", room, map[string]interface{}{
-								"successful": false,
-							}),
-						)
-					} else {
-						if resp != nil {
-							streamURL, err := ioutil.ReadAll(resp.Body)
-							resp.Body.Close()
-							if err == nil {
-								err = adapter.Emit(clientID, NewMessage("stream_url", room, map[string]interface{}{
-									"successful": "1",
-									"stream_url": string(streamURL),
-								}))
-							}
-						}
-
-						err = adapter.Broadcast(
-							NewMessage("record_callback", room, map[string]interface{}{
-								"successful":   true,
-								"recordStatus": status,
-							}),
-						)
-						updateRoomRecordStatus(room, activeRooms, status)
-					}
-
-				}
+			case "ping":
+			default:
+				err = newUnknownTypeError(msg)
 			}
 
 			if err != nil {
-				log.Printf("Error sending event (event: %s, room: %s, source: %s)", responseEventName, room, clientID)
+				log.Error("Error handling websocket message", Fields{
+					"type":  msg.Type,
+					"event": responseEventName,
+					"error": err,
+				})
+				if err := replyError(adapter, room, clientID, sub.Version(), err); err != nil {
+					log.Error("Error sending error message", Fields{"error": err})
+				}
 			}
 		}
 	}
 	return http.HandlerFunc(fn)
 }
 
-func removeRoom(room string, activeRooms *sync.Map) {
-	activeRooms.Delete(room)
-}
-
-func roomExists(room string, activeRooms *sync.Map) bool {
-	if _, ok := activeRooms.Load(room); ok {
-		return true
-	}
-	return false
-}
-
-func getRoomCreator(room string, activeRooms *sync.Map) string {
-	if room, ok := activeRooms.Load(room); ok {
-		return room.(*ActiveRoom).creatorId
-	}
-	return ""
-}
-
-func getRoomRecordStatus(room string, activeRooms *sync.Map) bool {
-	if room, ok := activeRooms.Load(room); ok {
-		return room.(*ActiveRoom).recordingStatus
-	}
-	return false
-}
-
-func updateRoomRecordStatus(room string, activeRooms *sync.Map, recordStatus bool) {
-	if room, ok := activeRooms.Load(room); ok {
-		room.(*ActiveRoom).recordingStatus = recordStatus
-	}
-}
-
 func getReadyClients(adapter Adapter) (map[string]string, error) {
 	filteredClients := map[string]string{}
 	clients, err := adapter.Clients()
@@ -214,7 +125,3 @@ func clientsToPeerIDs(clients map[string]string) (peers []string) {
 	}
 	return
 }
-
-func createRoom(roomCreatorID string, room string, activeRooms *sync.Map) {
-	activeRooms.Store(room, &ActiveRoom{creatorId: roomCreatorID, recordingStatus: false})
-}
@@ -2,6 +2,7 @@ package server_test
 
 import (
 	"context"
+	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
@@ -46,6 +47,10 @@ func (r *MockRoomManager) Exit(room string) {
 	r.exit <- room
 }
 
+func (r *MockRoomManager) Rooms() []string {
+	return nil
+}
+
 func (r *MockRoomManager) close() {
 	close(r.enter)
 	close(r.exit)
@@ -111,6 +116,16 @@ func mustDialWS(t *testing.T, ctx context.Context, url string) *websocket.Conn {
 	return ws
 }
 
+// mustDialWSVersion connects with a version of the protocol.
+func mustDialWSVersion(t *testing.T, ctx context.Context, url string, version int) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		Subprotocols: []string{server.ProtocolSubprotocol(version)},
+	})
+	require.Nil(t, err)
+	return ws
+}
+
 func mustWriteWS(t *testing.T, ctx context.Context, ws *websocket.Conn, msg server.Message) {
 	t.Helper()
 	data, err := serializer.Serialize(msg)
@@ -130,7 +145,7 @@ func mustReadWS(t *testing.T, ctx context.Context, ws *websocket.Conn) server.Me
 }
 
 func setupMeshServer(rooms server.RoomManager) (s *httptest.Server, url string) {
-	handler := server.NewMeshHandler(loggerFactory, server.NewWSS(loggerFactory, rooms), nil)
+	handler := server.NewMeshHandler(loggerFactory, server.NewWSS(loggerFactory, rooms, nil, nil, nil, nil), iceServers, server.NewMemoryRoomStore(time.Hour), nil)
 	s = httptest.NewServer(handler)
 	url = "ws" + strings.TrimPrefix(s.URL, "http") + "/ws/" + roomName + "/" + clientID
 	return
@@ -172,15 +187,14 @@ func TestMesh_event_ready(t *testing.T) {
 	// msg := mustReadWS(t, ctx, ws)
 	msg := <-rooms.broadcast
 	assert.Equal(t, "users", msg.Type)
-	payload, ok := msg.Payload.(map[string]interface{})
-	require.True(t, ok)
-	assert.Equal(t, map[string]interface{}{
-		"initiator": clientID,
-		"peerIds":   []string{"client1"},
-		"nicknames": map[string]string{
+	assert.Equal(t, server.UsersPayload{
+		Initiator: clientID,
+		PeerIDs:   []string{"client1"},
+		Nicknames: map[string]string{
 			"client1": "abc",
 		},
-	}, payload)
+		RecordStatus: false,
+	}, msg.Payload)
 }
 
 func TestMesh_event_signal(t *testing.T) {
@@ -204,8 +218,110 @@ func TestMesh_event_signal(t *testing.T) {
 	require.True(t, ok, "rooms.emit channel is closed")
 	assert.Equal(t, emit.clientID, otherClientID)
 	assert.Equal(t, "signal", emit.message.Type)
-	payload, ok := emit.message.Payload.(map[string]interface{})
+	assert.Equal(t, server.Payload{
+		UserID: clientID,
+		Signal: signal,
+	}, emit.message.Payload)
+}
+
+func TestMesh_event_ice_servers(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	rooms := NewMockRoomManager()
+	defer rooms.close()
+	srv, url := setupMeshServer(rooms)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ws := mustDialWS(t, ctx, url)
+	defer func() { <-rooms.exit }()
+	defer ws.Close(websocket.StatusGoingAway, "")
+	mustWriteWS(t, ctx, ws, server.NewMessage("ice_servers", "test-room", nil))
+	emit, ok := <-rooms.emit
+	require.True(t, ok, "rooms.emit channel is closed")
+	assert.Equal(t, clientID, emit.clientID)
+	assert.Equal(t, "ice_servers", emit.message.Type)
+	payload, ok := emit.message.Payload.(server.ICEServersPayload)
 	require.True(t, ok, "unexpected payload type: %s", emit.message.Payload)
-	assert.Equal(t, signal, payload["signal"])
-	assert.Equal(t, clientID, payload["userId"])
+	assert.Equal(t, server.GetICEAuthServers(iceServers), payload.ICEServers)
+}
+
+func TestMesh_protocolVersion(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	rooms := NewMockRoomManager()
+	defer rooms.close()
+	srv, url := setupMeshServer(rooms)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ws, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		Subprotocols: []string{"peer-calls.v99", "peer-calls.v2", "peer-calls.v1"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "peer-calls.v2", ws.Subprotocol(), "latest supported version")
+	<-rooms.enter
+	ws.Close(websocket.StatusNormalClosure, "")
+	<-rooms.exit
+
+	_, res, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		Subprotocols: []string{"peer-calls.v99"},
+	})
+	require.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "no supported version")
+}
+
+func TestMesh_event_ready_invalid(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	rooms := NewMockRoomManager()
+	defer rooms.close()
+	srv, url := setupMeshServer(rooms)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ws := mustDialWSVersion(t, ctx, url, server.ProtocolVersion2)
+	defer func() { <-rooms.exit }()
+	defer ws.Close(websocket.StatusGoingAway, "")
+
+	mustWriteWS(t, ctx, ws, server.NewMessage("ready", "test-room", map[string]interface{}{
+		"nickname": 123,
+	}))
+	emit, ok := <-rooms.emit
+	require.True(t, ok, "rooms.emit channel is closed")
+	assert.Equal(t, clientID, emit.clientID)
+	assert.Equal(t, server.MessageTypeError, emit.message.Type)
+	payload, ok := emit.message.Payload.(server.ErrorPayload)
+	require.True(t, ok, "unexpected payload type: %T", emit.message.Payload)
+	assert.Equal(t, "ready", payload.Type)
+	assert.Equal(t, server.ErrorCodeInvalidPayload, payload.Code)
+
+	mustWriteWS(t, ctx, ws, server.NewMessage("ready", "test-room", nil))
+	emit = <-rooms.emit
+	assert.Equal(t, server.ErrorCodeInvalidPayload, emit.message.Payload.(server.ErrorPayload).Code, "nickname is required")
+
+	mustWriteWS(t, ctx, ws, server.NewMessage("unknown", "test-room", nil))
+	emit = <-rooms.emit
+	assert.Equal(t, server.ErrorCodeUnknownType, emit.message.Payload.(server.ErrorPayload).Code)
+}
+
+func TestMesh_event_ready_invalidVersion1(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	rooms := NewMockRoomManager()
+	defer rooms.close()
+	srv, url := setupMeshServer(rooms)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ws := mustDialWS(t, ctx, url)
+	defer func() { <-rooms.exit }()
+	defer ws.Close(websocket.StatusGoingAway, "")
+
+	mustWriteWS(t, ctx, ws, server.NewMessage("ready", "test-room", map[string]interface{}{
+		"nickname": 123,
+	}))
+	// clients of version 1 do not receive errors, but the connection is still
+	// handled.
+	mustWriteWS(t, ctx, ws, server.NewMessage("ice_servers", "test-room", nil))
+	emit, ok := <-rooms.emit
+	require.True(t, ok, "rooms.emit channel is closed")
+	assert.Equal(t, "ice_servers", emit.message.Type)
 }
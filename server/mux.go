@@ -3,19 +3,18 @@ package server
 import (
 	"encoding/json"
 	"html/template"
-	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"path"
 	"strings"
-	"sync"
-	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/gobuffalo/packr"
+	"github.com/pion/webrtc/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 func buildManifest(baseURL string) []byte {
@@ -36,13 +35,15 @@ func buildManifest(baseURL string) []byte {
 }
 
 type Mux struct {
-	BaseURL          string
-	handler          *chi.Mux
-	iceServers       []ICEServer
-	network          NetworkConfig
-	version          string
-	activeRooms      *sync.Map
-	recordServiceURL string
+	BaseURL    string
+	log        Logger
+	handler    *chi.Mux
+	iceServers []ICEServer
+	network    NetworkConfig
+	version    string
+	roomStore  RoomStore
+	auth       Authenticator
+	recorder   Recorder
 }
 
 func (mux *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -52,6 +53,11 @@ func (mux *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 type TracksManager interface {
 	Add(room string, transport *WebRTCTransport)
 	GetTracksMetadata(room string, clientID string) ([]TrackMetadata, bool)
+	AddSink(room string, sink TrackSink) error
+	RemoveSink(room string, sinkID string)
+	Mute(room string, clientID string, kind webrtc.RTPCodecType, muted bool) error
+	Transports(room string) ([]TransportState, bool)
+	Stats(room string) (RoomStats, bool)
 }
 
 func withGauge(counter prometheus.Counter, h http.HandlerFunc) http.HandlerFunc {
@@ -64,11 +70,8 @@ func withGauge(counter prometheus.Counter, h http.HandlerFunc) http.HandlerFunc
 type RoomManager interface {
 	Enter(room string) Adapter
 	Exit(room string)
-}
-
-type ActiveRoom struct {
-	creatorId       string
-	recordingStatus bool
+	// Rooms returns the rooms with clients on this instance.
+	Rooms() []string
 }
 
 func NewMux(
@@ -79,8 +82,14 @@ func NewMux(
 	iceServers []ICEServer,
 	rooms RoomManager,
 	tracks TracksManager,
+	roomStore RoomStore,
+	auth Authenticator,
 	prom PrometheusConfig,
-	recordServiceURL string,
+	admin AdminConfig,
+	recorder Recorder,
+	affinity *RoomAffinity,
+	drainer *Drainer,
+	probes *Probes,
 ) *Mux {
 	box := packr.NewBox("./templates")
 	templates := ParseTemplates(box)
@@ -88,13 +97,15 @@ func NewMux(
 
 	handler := chi.NewRouter()
 	mux := &Mux{
-		BaseURL:          baseURL,
-		handler:          handler,
-		iceServers:       iceServers,
-		network:          network,
-		version:          version,
-		activeRooms:      &sync.Map{},
-		recordServiceURL: recordServiceURL,
+		BaseURL:    baseURL,
+		log:        loggerFactory.GetLogger("mux"),
+		handler:    handler,
+		iceServers: iceServers,
+		network:    network,
+		version:    version,
+		roomStore:  roomStore,
+		auth:       auth,
+		recorder:   recorder,
 	}
 
 	var root string
@@ -104,16 +115,56 @@ func NewMux(
 		root = baseURL
 	}
 
+	if probes == nil {
+		probes = NewProbes(loggerFactory, DefaultProbeTimeout)
+	}
+
+	// The admin API uses the rooms before they are wrapped so that looking up
+	// a room does not claim it or count as a client in it.
+	// The loggers can be changed through the admin API when the factory
+	// supports it.
+	logRules, _ := loggerFactory.(LogRules)
+	adminHandler := NewAdminHandler(loggerFactory, admin, rooms, tracks, roomStore, recorder, drainer, logRules)
+
+	if affinity != nil {
+		rooms = affinity.RoomManager(rooms)
+	}
+	if drainer != nil {
+		rooms = drainer.RoomManager(rooms)
+	}
+
+	var sessions *ResumableSessions
+	if network.Type == NetworkTypeSFU && network.SFU.ResumeTimeout > 0 {
+		sessions = NewResumableSessions(loggerFactory, network.SFU.ResumeTimeout)
+	}
+
 	wsHandler := newWebSocketHandler(
 		loggerFactory,
 		network,
-		NewWSS(loggerFactory, rooms),
+		NewWSS(loggerFactory, rooms, auth, NewRoomAccess(loggerFactory, rooms, roomStore), sessions, drainer),
 		iceServers,
 		tracks,
-		mux.activeRooms,
-		recordServiceURL,
+		roomStore,
+		recorder,
 	)
 
+	getCallRoom := func(r *http.Request) string {
+		return path.Base(r.URL.Path)
+	}
+	getWSRoom := func(r *http.Request) string {
+		return path.Base(path.Dir(r.URL.Path))
+	}
+
+	callHandler := http.Handler(renderer.Render(mux.routeCall))
+	if affinity != nil {
+		callHandler = affinity.Handler(getCallRoom, callHandler)
+		wsHandler = affinity.Handler(getWSRoom, wsHandler)
+	}
+	if drainer != nil {
+		callHandler = drainer.Handler(getCallRoom, callHandler)
+		wsHandler = drainer.Handler(getWSRoom, wsHandler)
+	}
+
 	manifest := buildManifest(baseURL)
 	handler.Route(root, func(router chi.Router) {
 		router.Get("/", withGauge(prometheusHomeViewsTotal, renderer.Render(mux.routeIndex)))
@@ -121,33 +172,23 @@ func NewMux(
 		router.Handle("/res/*", static(baseURL+"/res", packr.NewBox("../res")))
 		router.Post("/call", withGauge(prometheusCallJoinTotal, mux.routeNewCall))
 		router.Post("/api/sessions/{room}/join/{user}", withGauge(prometheusCallJoinRecord, mux.routeJoinRoom))
-		router.Get("/call/{callID}", withGauge(prometheusCallViewsTotal, renderer.Render(mux.routeCall)))
-		router.Get("/probes/liveness", func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-		})
-		router.Get("/probes/health", func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-		})
+		router.Get("/call/{callID}", withGauge(prometheusCallViewsTotal, callHandler.ServeHTTP))
+		router.Get("/api/ice-servers", mux.routeICEServers)
+		router.Get("/probes/liveness", probes.ServeLiveness)
+		router.Get("/probes/health", probes.ServeReadiness)
+		router.Get("/probes/readiness", probes.ServeReadiness)
 		router.Get("/manifest.json", func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 			w.Write(manifest)
 		})
 		router.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
-			accessToken := r.Header.Get("Authorization")
-			if strings.HasPrefix(accessToken, "Bearer ") {
-				accessToken = accessToken[len("Bearer "):]
-			} else {
-				accessToken = r.FormValue("access_token")
-			}
-
-			if accessToken == "" || accessToken != prom.AccessToken {
+			if !hasAccessToken(r, prom.AccessToken) {
 				w.WriteHeader(401)
 				return
 			}
 			promhttp.Handler().ServeHTTP(w, r)
 		})
+		router.Mount("/api/admin", adminHandler)
 
 		router.Mount("/ws", wsHandler)
 	})
@@ -155,15 +196,29 @@ func NewMux(
 	return mux
 }
 
-func newWebSocketHandler(loggerFactory LoggerFactory, network NetworkConfig, wss *WSS, iceServers []ICEServer, tracks TracksManager, activeRooms *sync.Map, recordServiceURL string) http.Handler {
+// hasAccessToken returns true when the request has the expected bearer token
+// in the Authorization header or the access_token parameter. Requests are
+// never authorized when no token is expected.
+func hasAccessToken(r *http.Request, expected string) bool {
+	accessToken := r.Header.Get("Authorization")
+	if strings.HasPrefix(accessToken, "Bearer ") {
+		accessToken = accessToken[len("Bearer "):]
+	} else {
+		accessToken = r.FormValue("access_token")
+	}
+
+	return accessToken != "" && accessToken == expected
+}
+
+func newWebSocketHandler(loggerFactory LoggerFactory, network NetworkConfig, wss *WSS, iceServers []ICEServer, tracks TracksManager, roomStore RoomStore, recorder Recorder) http.Handler {
 	log := loggerFactory.GetLogger("mux")
 	switch network.Type {
 	case NetworkTypeSFU:
-		log.Println("Using network type sfu")
-		return NewSFUHandler(loggerFactory, wss, iceServers, network.SFU, tracks)
+		log.Info("Using network type sfu", nil)
+		return NewSFUHandler(loggerFactory, wss, iceServers, network.SFU, tracks, roomStore, recorder)
 	default:
-		log.Println("Using network type mesh")
-		return NewMeshHandler(loggerFactory, wss, activeRooms, recordServiceURL)
+		log.Info("Using network type mesh", nil)
+		return NewMeshHandler(loggerFactory, wss, iceServers, roomStore, recorder)
 	}
 }
 
@@ -188,39 +243,83 @@ func (mux *Mux) routeIndex(w http.ResponseWriter, r *http.Request) (string, inte
 func (mux *Mux) routeCall(w http.ResponseWriter, r *http.Request) (string, interface{}, error) {
 	callID := url.PathEscape(path.Base(r.URL.Path))
 	userID := NewUUIDBase62()
-	_, err := JWTTokenFromCookie(r)
+
+	ctx, span := startRequestSpan(r, "Mux.routeCall", attribute.String("room", callID))
+	defer span.End()
+
+	identity, err := mux.auth.Authenticate(r)
+	if err == nil && identity.UserID == "" {
+		identity, err = mux.auth.Login(w, r)
+	}
 	if err != nil {
-		CreateTokenCookie(w)
+		mux.log.Warn("Error authenticating user", Fields{"error": err})
+		span.SetStatus(codes.Error, "Unauthorized")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized"))
+		return "", nil, nil
+	}
+
+	if !identity.CanJoin(path.Base(r.URL.Path)) {
+		mux.log.Warn("User is not allowed to join room", Fields{
+			"room":   callID,
+			"userId": identity.UserID,
+		})
+		span.SetStatus(codes.Error, "Forbidden")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Forbidden"))
+		return "", nil, nil
 	}
 
-	iceServers := GetICEAuthServers(mux.iceServers)
+	iceServers := GetICEAuthServersForUser(mux.iceServers, identity.UserID)
 	iceServersJSON, _ := json.Marshal(iceServers)
 	data := map[string]interface{}{
-		"Nickname":   r.Header.Get("X-Forwarded-User"),
+		"Nickname":   identity.Nickname,
 		"CallID":     callID,
 		"UserID":     userID,
 		"ICEServers": template.HTML(iceServersJSON),
 		"Network":    mux.network.Type,
 		"Version":    mux.version,
+		// TraceParent is sent back when the websocket connects so that the
+		// join is a single trace.
+		"TraceParent": traceParent(ctx),
 	}
 	return "call.html", data, nil
 }
 
-func (mux *Mux) routeJoinRoom(w http.ResponseWriter, r *http.Request) {
-
-	client := &http.Client{
-		Timeout: 15 * time.Second,
+// routeICEServers returns fresh ICE server credentials so that clients can
+// refresh them before they expire, for example before an ICE restart.
+func (mux *Mux) routeICEServers(w http.ResponseWriter, r *http.Request) {
+	identity, err := mux.auth.Authenticate(r)
+	if err == nil && identity.UserID == "" {
+		err = ErrUnauthorized
+	}
+	if err != nil {
+		mux.log.Warn("Error authenticating ICE servers request", Fields{"error": err})
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized"))
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"iceServers": GetICEAuthServersForUser(mux.iceServers, identity.UserID),
+	})
+}
+
+func (mux *Mux) routeJoinRoom(w http.ResponseWriter, r *http.Request) {
 	room := chi.URLParam(r, "room")
 	user := chi.URLParam(r, "user")
 
-	resp, err := client.Post(mux.recordServiceURL+"/api/sessions/"+room+"/join/"+user, "application/json", r.Body)
+	body, err := mux.recorder.Join(room, user, r.Body)
 	if err != nil {
-		log.Printf("Error join record session %v", err)
+		mux.log.Warn("Error joining record session", Fields{
+			"room":  room,
+			"error": err,
+		})
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("Forbidden"))
 		return
 	}
-	io.Copy(w, resp.Body)
-	resp.Body.Close()
+	w.Write(body)
 }
@@ -1,13 +1,21 @@
 package server_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/peer-calls/peer-calls/server"
+	"github.com/pion/webrtc/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -44,6 +52,52 @@ func (m *mockTracksManager) GetTracksMetadata(room string, clientID string) ([]s
 	return nil, true
 }
 
+func (m *mockTracksManager) AddSink(room string, sink server.TrackSink) error {
+	return nil
+}
+
+func (m *mockTracksManager) RemoveSink(room string, sinkID string) {
+}
+
+func (m *mockTracksManager) Mute(room string, clientID string, kind webrtc.RTPCodecType, muted bool) error {
+	return nil
+}
+
+func (m *mockTracksManager) Transports(room string) ([]server.TransportState, bool) {
+	return nil, false
+}
+
+func (m *mockTracksManager) Stats(room string) (server.RoomStats, bool) {
+	return server.RoomStats{}, false
+}
+
+type mockRecorder struct {
+	joinBody []byte
+	joinErr  error
+}
+
+var _ server.Recorder = &mockRecorder{}
+
+func newMockRecorder() *mockRecorder {
+	return &mockRecorder{}
+}
+
+func (m *mockRecorder) Start(room string) (server.RecordingStatus, error) {
+	return server.RecordingStatus{Room: room, Recording: true}, nil
+}
+
+func (m *mockRecorder) Stop(room string) (server.RecordingStatus, error) {
+	return server.RecordingStatus{Room: room}, nil
+}
+
+func (m *mockRecorder) Status(room string) (server.RecordingStatus, error) {
+	return server.RecordingStatus{Room: room}, nil
+}
+
+func (m *mockRecorder) Join(room string, userID string, body io.Reader) ([]byte, error) {
+	return m.joinBody, m.joinErr
+}
+
 func mesh() (network server.NetworkConfig) {
 	network.Type = server.NetworkTypeMesh
 	return
@@ -52,15 +106,15 @@ func mesh() (network server.NetworkConfig) {
 const prometheusAccessToken = "prom1234"
 
 func prom() server.PrometheusConfig {
-	return server.PrometheusConfig{prometheusAccessToken}
+	return server.PrometheusConfig{AccessToken: prometheusAccessToken}
 }
 
 func Test_routeIndex(t *testing.T) {
 	mrm := NewMockRoomManager()
 	trk := newMockTracksManager()
-	prom := server.PrometheusConfig{"test1234"}
+	prom := server.PrometheusConfig{AccessToken: "test1234"}
 	defer mrm.close()
-	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, prom)
+	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, server.NewMemoryRoomStore(time.Hour), server.NewAnonymousAuthenticator([]byte(jwtSecret)), prom, server.AdminConfig{}, newMockRecorder(), nil, nil, nil)
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest("GET", "/test", nil)
 
@@ -74,7 +128,7 @@ func Test_routeIndex_noBaseURL(t *testing.T) {
 	mrm := NewMockRoomManager()
 	trk := newMockTracksManager()
 	defer mrm.close()
-	mux := server.NewMux(loggerFactory, "", "v0.0.0", mesh(), iceServers, mrm, trk, prom())
+	mux := server.NewMux(loggerFactory, "", "v0.0.0", mesh(), iceServers, mrm, trk, server.NewMemoryRoomStore(time.Hour), server.NewAnonymousAuthenticator([]byte(jwtSecret)), prom(), server.AdminConfig{}, newMockRecorder(), nil, nil, nil)
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest("GET", "/", nil)
 
@@ -88,7 +142,7 @@ func Test_routeNewCall_name(t *testing.T) {
 	mrm := NewMockRoomManager()
 	trk := newMockTracksManager()
 	defer mrm.close()
-	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, prom())
+	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, server.NewMemoryRoomStore(time.Hour), server.NewAnonymousAuthenticator([]byte(jwtSecret)), prom(), server.AdminConfig{}, newMockRecorder(), nil, nil, nil)
 	w := httptest.NewRecorder()
 	reader := strings.NewReader("call=my room")
 	r := httptest.NewRequest("POST", "/test/call", reader)
@@ -104,7 +158,7 @@ func Test_routeNewCall_random(t *testing.T) {
 	mrm := NewMockRoomManager()
 	trk := newMockTracksManager()
 	defer mrm.close()
-	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, prom())
+	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, server.NewMemoryRoomStore(time.Hour), server.NewAnonymousAuthenticator([]byte(jwtSecret)), prom(), server.AdminConfig{}, newMockRecorder(), nil, nil, nil)
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest("POST", "/test/call", nil)
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -123,7 +177,7 @@ func Test_routeCall(t *testing.T) {
 	iceServers := []server.ICEServer{{
 		URLs: []string{"stun:"},
 	}}
-	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, prom())
+	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, server.NewMemoryRoomStore(time.Hour), server.NewAnonymousAuthenticator([]byte(jwtSecret)), prom(), server.AdminConfig{}, newMockRecorder(), nil, nil, nil)
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest("GET", "/test/call/abc", nil)
 	mux.ServeHTTP(w, r)
@@ -134,11 +188,62 @@ func Test_routeCall(t *testing.T) {
 	assert.Regexp(t, "id=\"userId\" value=\"[^\"]", w.Body.String())
 }
 
+func Test_routeCall_unauthorized(t *testing.T) {
+	mrm := NewMockRoomManager()
+	trk := newMockTracksManager()
+	defer mrm.close()
+	auth, err := server.NewProxyAuthenticator(server.AuthConfigProxy{
+		TrustedProxies: []string{"192.0.2.1"},
+	})
+	require.NoError(t, err)
+	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, server.NewMemoryRoomStore(time.Hour), auth, prom(), server.AdminConfig{}, newMockRecorder(), nil, nil, nil)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/test/call/abc", nil)
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/test/call/abc", nil)
+	r.Header.Set("X-Forwarded-User", "user1")
+	r.Header.Set("X-Forwarded-Preferred-Username", "User One")
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Regexp(t, "User One", w.Body.String())
+}
+
+func Test_routeCall_forbidden(t *testing.T) {
+	mrm := NewMockRoomManager()
+	trk := newMockTracksManager()
+	defer mrm.close()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	auth, err := server.NewJWTAuthenticator(server.AuthConfigJWT{}, encodePublicKey(t, &key.PublicKey))
+	require.NoError(t, err)
+	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, server.NewMemoryRoomStore(time.Hour), auth, prom(), server.AdminConfig{}, newMockRecorder(), nil, nil, nil)
+	token := signToken(t, jwt.SigningMethodES256, key, jwt.MapClaims{
+		"sub":   "user1",
+		"rooms": []string{"abc"},
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/test/call/def", nil)
+	r.AddCookie(&http.Cookie{Name: "jwt", Value: token})
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/test/call/abc", nil)
+	r.AddCookie(&http.Cookie{Name: "jwt", Value: token})
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
 func Test_manifest(t *testing.T) {
 	mrm := NewMockRoomManager()
 	trk := newMockTracksManager()
 	defer mrm.close()
-	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, prom())
+	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, server.NewMemoryRoomStore(time.Hour), server.NewAnonymousAuthenticator([]byte(jwtSecret)), prom(), server.AdminConfig{}, newMockRecorder(), nil, nil, nil)
 	w := httptest.NewRecorder()
 	reader := strings.NewReader("call=my room")
 	r := httptest.NewRequest("GET", "/test/manifest.json", reader)
@@ -153,7 +258,7 @@ func Test_Metrics(t *testing.T) {
 	mrm := NewMockRoomManager()
 	trk := newMockTracksManager()
 	defer mrm.close()
-	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, prom())
+	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, server.NewMemoryRoomStore(time.Hour), server.NewAnonymousAuthenticator([]byte(jwtSecret)), prom(), server.AdminConfig{}, newMockRecorder(), nil, nil, nil)
 
 	for _, testCase := range []struct {
 		statusCode    int
@@ -178,3 +283,102 @@ func Test_Metrics(t *testing.T) {
 		})
 	}
 }
+
+func Test_routeJoinRoom(t *testing.T) {
+	mrm := NewMockRoomManager()
+	trk := newMockTracksManager()
+	defer mrm.close()
+	recorder := newMockRecorder()
+	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, server.NewMemoryRoomStore(time.Hour), server.NewAnonymousAuthenticator([]byte(jwtSecret)), prom(), server.AdminConfig{}, recorder, nil, nil, nil)
+
+	recorder.joinBody = []byte(`{"url":"test"}`)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/test/api/sessions/my-room/join/user1", nil)
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"url":"test"}`, w.Body.String())
+
+	recorder.joinErr = fmt.Errorf("Not recording")
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/test/api/sessions/my-room/join/user1", nil)
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func Test_routeICEServers(t *testing.T) {
+	mrm := NewMockRoomManager()
+	trk := newMockTracksManager()
+	defer mrm.close()
+	auth, err := server.NewProxyAuthenticator(server.AuthConfigProxy{
+		TrustedProxies: []string{"192.0.2.1"},
+	})
+	require.NoError(t, err)
+	iceServers := []server.ICEServer{{
+		URLs:     []string{"turn:"},
+		AuthType: server.AuthTypeSecret,
+	}}
+	iceServers[0].AuthSecret.Secret = "sec"
+	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, server.NewMemoryRoomStore(time.Hour), auth, prom(), server.AdminConfig{}, newMockRecorder(), nil, nil, nil)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/test/api/ice-servers", nil)
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/test/api/ice-servers", nil)
+	r.Header.Set("X-Forwarded-User", "user1")
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var body struct {
+		ICEServers []server.ICEAuthServer `json:"iceServers"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Equal(t, 1, len(body.ICEServers))
+	assert.Equal(t, []string{"turn:"}, body.ICEServers[0].URLs)
+	assert.Regexp(t, "^[0-9]+:user1$", body.ICEServers[0].Username)
+	assert.NotEqual(t, "", body.ICEServers[0].Credential)
+}
+
+func Test_routeDrain(t *testing.T) {
+	mrm := NewMockRoomManager()
+	trk := newMockTracksManager()
+	defer mrm.close()
+	drainer := server.NewDrainer(loggerFactory)
+	admin := server.AdminConfig{AccessToken: "admin1234"}
+	mux := server.NewMux(loggerFactory, "/test", "v0.0.0", mesh(), iceServers, mrm, trk, server.NewMemoryRoomStore(time.Hour), server.NewAnonymousAuthenticator([]byte(jwtSecret)), prom(), admin, newMockRecorder(), nil, drainer, server.NewProbes(loggerFactory, server.DefaultProbeTimeout, server.HealthCheck{
+		Name:  "drain",
+		Check: drainer.HealthCheck,
+	}))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/test/probes/health", nil)
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/test/api/admin/drain", nil)
+	r.Header.Set("Authorization", "Bearer invalid")
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.False(t, drainer.IsDraining())
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/test/api/admin/drain", nil)
+	r.Header.Set("Authorization", "Bearer admin1234")
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.True(t, drainer.IsDraining())
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/test/probes/health", nil)
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/test/call/new-room", nil)
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
@@ -1,13 +1,16 @@
 package server
 
-import "github.com/pion/logging"
+import (
+	"fmt"
 
+	"github.com/peer-calls/peer-calls/server/logger"
+	"github.com/pion/logging"
+)
+
+// pionLogger writes the messages of a pion subsystem to a logger named
+// pion:<subsystem>. Trace messages are written at the debug level.
 type pionLogger struct {
-	traceLogger Logger
-	debugLogger Logger
-	infoLogger  Logger
-	warnLogger  Logger
-	errorLogger Logger
+	log Logger
 }
 
 type PionLoggerFactory struct {
@@ -20,41 +23,56 @@ func NewPionLoggerFactory(loggerFactory LoggerFactory) *PionLoggerFactory {
 
 func (p PionLoggerFactory) NewLogger(subsystem string) logging.LeveledLogger {
 	return &pionLogger{
-		traceLogger: p.loggerFactory.GetLogger("pion:" + subsystem + ":trace"),
-		debugLogger: p.loggerFactory.GetLogger("pion:" + subsystem + ":debug"),
-		infoLogger:  p.loggerFactory.GetLogger("pion:" + subsystem + ":info"),
-		warnLogger:  p.loggerFactory.GetLogger("pion:" + subsystem + ":warn"),
-		errorLogger: p.loggerFactory.GetLogger("pion:" + subsystem + ":error"),
+		log: p.loggerFactory.GetLogger("pion:" + subsystem),
+	}
+}
+
+func (p *pionLogger) logf(level logger.Level, format string, args ...interface{}) {
+	if !p.log.IsEnabled(level) {
+		return
+	}
+
+	message := fmt.Sprintf(format, args...)
+
+	switch level {
+	case logger.LevelDebug:
+		p.log.Debug(message, nil)
+	case logger.LevelInfo:
+		p.log.Info(message, nil)
+	case logger.LevelWarn:
+		p.log.Warn(message, nil)
+	default:
+		p.log.Error(message, nil)
 	}
 }
 
 func (p *pionLogger) Trace(msg string) {
-	p.traceLogger.Println(msg)
+	p.log.Debug(msg, nil)
 }
 func (p *pionLogger) Tracef(format string, args ...interface{}) {
-	p.traceLogger.Printf(format, args...)
+	p.logf(logger.LevelDebug, format, args...)
 }
 func (p *pionLogger) Debug(msg string) {
-	p.debugLogger.Println(msg)
+	p.log.Debug(msg, nil)
 }
 func (p *pionLogger) Debugf(format string, args ...interface{}) {
-	p.debugLogger.Printf(format, args...)
+	p.logf(logger.LevelDebug, format, args...)
 }
 func (p *pionLogger) Info(msg string) {
-	p.infoLogger.Println(msg)
+	p.log.Info(msg, nil)
 }
 func (p *pionLogger) Infof(format string, args ...interface{}) {
-	p.infoLogger.Printf(format, args...)
+	p.logf(logger.LevelInfo, format, args...)
 }
 func (p *pionLogger) Warn(msg string) {
-	p.warnLogger.Println(msg)
+	p.log.Warn(msg, nil)
 }
 func (p *pionLogger) Warnf(format string, args ...interface{}) {
-	p.warnLogger.Printf(format, args...)
+	p.logf(logger.LevelWarn, format, args...)
 }
 func (p *pionLogger) Error(msg string) {
-	p.errorLogger.Println(msg)
+	p.log.Error(msg, nil)
 }
 func (p *pionLogger) Errorf(format string, args ...interface{}) {
-	p.errorLogger.Printf(format, args...)
+	p.logf(logger.LevelError, format, args...)
 }
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultProbeTimeout is the time each health check has to complete.
+const DefaultProbeTimeout = time.Second
+
+const (
+	ProbeStatusOK    = "ok"
+	ProbeStatusError = "error"
+)
+
+// HealthCheck checks a dependency of the server. Check returns an error when
+// the dependency is not available.
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// HealthCheckResult is the result of a single HealthCheck.
+type HealthCheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// LatencyMs is the time the check took in milliseconds.
+	LatencyMs float64 `json:"latencyMs"`
+	// Err is only logged because the probes are not authenticated and errors
+	// can contain the addresses of dependencies.
+	Err error `json:"-"`
+}
+
+// ProbeResult is the response of the readiness probe. Status is ok only when
+// all checks are ok.
+type ProbeResult struct {
+	Status string              `json:"status"`
+	Checks []HealthCheckResult `json:"checks"`
+}
+
+// Probes serves the liveness and readiness probes. The liveness probe only
+// tells that the server is able to respond, so that instances are not
+// restarted when a dependency is down, and the readiness probe runs all
+// health checks.
+type Probes struct {
+	log     Logger
+	checks  []HealthCheck
+	timeout time.Duration
+}
+
+func NewProbes(loggerFactory LoggerFactory, timeout time.Duration, checks ...HealthCheck) *Probes {
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+	return &Probes{
+		log:     loggerFactory.GetLogger("probes"),
+		checks:  checks,
+		timeout: timeout,
+	}
+}
+
+// Check runs all health checks concurrently.
+func (p *Probes) Check(ctx context.Context) ProbeResult {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	result := ProbeResult{
+		Status: ProbeStatusOK,
+		Checks: make([]HealthCheckResult, len(p.checks)),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(p.checks))
+	for i, check := range p.checks {
+		go func(i int, check HealthCheck) {
+			defer wg.Done()
+			result.Checks[i] = p.runHealthCheck(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, check := range result.Checks {
+		if check.Status != ProbeStatusOK {
+			result.Status = ProbeStatusError
+		}
+	}
+
+	return result
+}
+
+func (p *Probes) runHealthCheck(ctx context.Context, check HealthCheck) HealthCheckResult {
+	start := time.Now()
+	err := check.Check(ctx)
+	latency := time.Since(start)
+
+	result := HealthCheckResult{
+		Name:      check.Name,
+		Status:    ProbeStatusOK,
+		LatencyMs: float64(latency) / float64(time.Millisecond),
+	}
+	if err != nil {
+		result.Status = ProbeStatusError
+		result.Err = err
+		p.log.Warn("Health check failed", Fields{
+			"check":     check.Name,
+			"latencyMs": result.LatencyMs,
+			"error":     err.Error(),
+		})
+	}
+	return result
+}
+
+// ServeLiveness responds with the ok status.
+func (p *Probes) ServeLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ProbeResult{
+		Status: ProbeStatusOK,
+		Checks: []HealthCheckResult{},
+	})
+}
+
+// ServeReadiness responds with the results of the health checks, and the
+// service unavailable status code when any of the checks failed.
+func (p *Probes) ServeReadiness(w http.ResponseWriter, r *http.Request) {
+	result := p.Check(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if result.Status == ProbeStatusOK {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,101 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/peer-calls/peer-calls/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func okCheck(ctx context.Context) error {
+	return nil
+}
+
+func TestProbes_readiness(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	failing := true
+	probes := server.NewProbes(loggerFactory, server.DefaultProbeTimeout, server.HealthCheck{
+		Name:  "ok",
+		Check: okCheck,
+	}, server.HealthCheck{
+		Name: "failing",
+		Check: func(ctx context.Context) error {
+			if failing {
+				return errors.New("Not available")
+			}
+			return nil
+		},
+	})
+
+	serve := func() (int, server.ProbeResult) {
+		w := httptest.NewRecorder()
+		probes.ServeReadiness(w, httptest.NewRequest("GET", "/probes/health", nil))
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		assert.NotContains(t, w.Body.String(), "Not available", "errors are not exposed")
+		var result server.ProbeResult
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		return w.Code, result
+	}
+
+	code, result := serve()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, server.ProbeStatusError, result.Status)
+	require.Equal(t, 2, len(result.Checks))
+	assert.Equal(t, "ok", result.Checks[0].Name)
+	assert.Equal(t, server.ProbeStatusOK, result.Checks[0].Status)
+	assert.Equal(t, "failing", result.Checks[1].Name)
+	assert.Equal(t, server.ProbeStatusError, result.Checks[1].Status)
+
+	failing = false
+	code, result = serve()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, server.ProbeStatusOK, result.Status)
+}
+
+func TestProbes_timeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	probes := server.NewProbes(loggerFactory, 10*time.Millisecond, server.HealthCheck{
+		Name: "slow",
+		Check: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+
+	result := probes.Check(context.Background())
+	assert.Equal(t, server.ProbeStatusError, result.Status)
+	require.Equal(t, 1, len(result.Checks))
+	assert.Equal(t, context.DeadlineExceeded, result.Checks[0].Err)
+	assert.GreaterOrEqual(t, result.Checks[0].LatencyMs, float64(10))
+}
+
+func TestProbes_liveness(t *testing.T) {
+	probes := server.NewProbes(loggerFactory, server.DefaultProbeTimeout, server.HealthCheck{
+		Name: "failing",
+		Check: func(ctx context.Context) error {
+			return errors.New("Not available")
+		},
+	})
+
+	w := httptest.NewRecorder()
+	probes.ServeLiveness(w, httptest.NewRequest("GET", "/probes/liveness", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"ok","checks":[]}`, w.Body.String())
+}
+
+func TestWebRTCTransportFactory_HealthCheck(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	factory := server.NewWebRTCTransportFactory(loggerFactory, iceServers, server.NetworkConfigSFU{})
+	assert.NoError(t, factory.HealthCheck(context.Background()))
+}
@@ -83,42 +83,50 @@ var prometheusWebRTCTracksDuration = promauto.NewHistogram(prometheus.HistogramO
 	Buckets: []float64{1, 60, 5 * 60, 15 * 60, 30 * 60, 45 * 60, 60 * 60, 120 * 60},
 })
 
-var prometheusRTCPPacketsReceived = promauto.NewGauge(prometheus.GaugeOpts{
+// Values of the network label of the RTP and RTCP counters, which tells
+// whether the packets were exchanged with clients over WebRTC or with other
+// server instances over the relay.
+const (
+	metricsNetworkWebRTC = "webrtc"
+	metricsNetworkRelay  = "relay"
+)
+
+var prometheusRTCPPacketsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "rtcp_packets_received_total",
 	Help: "Total number of received RTCP packets",
-})
+}, []string{"network"})
 
-// var prometheusRTCPPacketsReceivedBytes = promauto.NewGauge(prometheus.GaugeOpts{
+// var prometheusRTCPPacketsReceivedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
 // 	Name: "rtcp_packets_received_bytes_total",
 // 	Help: "Total number of received RTCP bytes",
-// })
+// }, []string{"network"})
 
-var prometheusRTCPPacketsSent = promauto.NewGauge(prometheus.GaugeOpts{
+var prometheusRTCPPacketsSent = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "rtcp_packets_sent_total",
 	Help: "Total number of sent RTCP packets",
-})
+}, []string{"network"})
 
-// var prometheusRTCPPacketsSentBytes = promauto.NewGauge(prometheus.GaugeOpts{
+// var prometheusRTCPPacketsSentBytes = promauto.NewCounterVec(prometheus.CounterOpts{
 // 	Name: "rtcp_packets_sent_bytes_total",
 // 	Help: "Total number of sent RTCP bytes",
-// })
+// }, []string{"network"})
 
-var prometheusRTPPacketsReceived = promauto.NewGauge(prometheus.GaugeOpts{
+var prometheusRTPPacketsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "rtp_packets_received_total",
 	Help: "Total number of received RTP packets",
-})
+}, []string{"network"})
 
-var prometheusRTPPacketsReceivedBytes = promauto.NewGauge(prometheus.GaugeOpts{
+var prometheusRTPPacketsReceivedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "rtp_packets_received_bytes_total",
 	Help: "Total number of received RTP bytes",
-})
+}, []string{"network"})
 
-var prometheusRTPPacketsSent = promauto.NewGauge(prometheus.GaugeOpts{
+var prometheusRTPPacketsSent = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "rtp_packets_sent_total",
 	Help: "Total number of sent RTP packets",
-})
+}, []string{"network"})
 
-var prometheusRTPPacketsSentBytes = promauto.NewGauge(prometheus.GaugeOpts{
+var prometheusRTPPacketsSentBytes = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "rtp_packets_sent_bytes_total",
 	Help: "Total number of sent RTP bytes",
-})
+}, []string{"network"})
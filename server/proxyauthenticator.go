@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// ProxyAuthenticator trusts the user set in a header by a reverse proxy which
+// authenticates users, for example oauth2-proxy. Requests which do not come
+// from one of the trusted proxies are rejected, so at least one trusted
+// proxy must be configured.
+type ProxyAuthenticator struct {
+	userHeader     string
+	nicknameHeader string
+	trustedProxies []*net.IPNet
+}
+
+var _ Authenticator = &ProxyAuthenticator{}
+
+func NewProxyAuthenticator(config AuthConfigProxy) (*ProxyAuthenticator, error) {
+	if len(config.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("No trusted proxies configured")
+	}
+
+	a := &ProxyAuthenticator{
+		userHeader:     config.UserHeader,
+		nicknameHeader: config.NicknameHeader,
+	}
+
+	if a.userHeader == "" {
+		a.userHeader = "X-Forwarded-User"
+	}
+	if a.nicknameHeader == "" {
+		a.nicknameHeader = "X-Forwarded-Preferred-Username"
+	}
+
+	for _, cidr := range config.TrustedProxies {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("Error parsing trusted proxy: %s", cidr)
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+		a.trustedProxies = append(a.trustedProxies, ipNet)
+	}
+
+	return a, nil
+}
+
+func (a *ProxyAuthenticator) trusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range a.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticate returns the user from the user header. The nickname header
+// is optional and the user is used as the nickname when it is not set.
+func (a *ProxyAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	if !a.trusted(r) {
+		return Identity{}, fmt.Errorf("Request from untrusted proxy %s: %w", r.RemoteAddr, ErrUnauthorized)
+	}
+
+	userID := r.Header.Get(a.userHeader)
+	if userID == "" {
+		return Identity{}, fmt.Errorf("Missing header %s: %w", a.userHeader, ErrNoTokenFound)
+	}
+
+	nickname := r.Header.Get(a.nicknameHeader)
+	if nickname == "" {
+		nickname = userID
+	}
+
+	return Identity{
+		UserID:   userID,
+		Nickname: nickname,
+	}, nil
+}
+
+// Login always fails because users are authenticated by the proxy.
+func (a *ProxyAuthenticator) Login(w http.ResponseWriter, r *http.Request) (Identity, error) {
+	return Identity{}, ErrUnauthorized
+}
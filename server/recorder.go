@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"io"
+)
+
+// RecordingStatus describes the recording of a room.
+type RecordingStatus struct {
+	Room      string `json:"room"`
+	Recording bool   `json:"recording"`
+	// URL is the address of the recording, when provided by the recorder.
+	URL string `json:"url,omitempty"`
+	// Files are the paths of the recorded files, when recording locally.
+	Files []string `json:"files,omitempty"`
+}
+
+// Recorder starts and stops recordings of rooms.
+type Recorder interface {
+	Start(room string) (RecordingStatus, error)
+	Stop(room string) (RecordingStatus, error)
+	Status(room string) (RecordingStatus, error)
+	// Join adds a user to the recording of a room. The body is sent by the
+	// client and the returned bytes are sent back to it.
+	Join(room string, userID string, body io.Reader) ([]byte, error)
+}
+
+// NewRecorder creates the Recorder selected in config. When the type is not
+// set, rooms are recorded locally when using the SFU, and by the recording
+// service otherwise.
+func NewRecorder(
+	loggerFactory LoggerFactory,
+	config RecordConfig,
+	serviceURL string,
+	networkType NetworkType,
+	tracks TracksManager,
+) (Recorder, error) {
+	recordType := config.Type
+	if recordType == "" {
+		recordType = RecordTypeHTTP
+		if networkType == NetworkTypeSFU {
+			recordType = RecordTypeLocal
+		}
+	}
+
+	log := loggerFactory.GetLogger("recorder")
+
+	switch recordType {
+	case RecordTypeLocal:
+		if networkType != NetworkTypeSFU {
+			return nil, fmt.Errorf("Local recording is only supported with network type: %s", NetworkTypeSFU)
+		}
+		log.Info("Using local recorder", Fields{"dir": config.Dir})
+		return NewLocalRecorder(loggerFactory, tracks, config), nil
+	case RecordTypeHTTP:
+		log.Info("Using HTTP recorder", Fields{"url": serviceURL})
+		return NewHTTPRecorder(serviceURL), nil
+	default:
+		return nil, fmt.Errorf("Unknown record type: %s", recordType)
+	}
+}
+
+// handleRecordMessage starts or stops the recording of a room in response to
+// the record websocket message. Only the moderator of the room can do
+// this. The result is broadcast to everyone in the room, and the recording
+// URL, if any, is sent to the user who started the recording.
+func handleRecordMessage(
+	log Logger,
+	recorder Recorder,
+	adapter Adapter,
+	roomStore RoomStore,
+	deserializer Deserializer,
+	message Message,
+	room string,
+	clientID string,
+	identity Identity,
+) error {
+	recordFailed := func() error {
+		return adapter.Broadcast(NewMessage("record_callback", room, RecordCallbackPayload{
+			Successful: false,
+		}))
+	}
+
+	var payload RecordPayload
+	if err := deserializer.DeserializePayload(message, &payload); err != nil {
+		return err
+	}
+
+	status := payload.RecordStatus
+
+	if recorder == nil || roomStore == nil {
+		log.Warn("Recording is not enabled", nil)
+		return recordFailed()
+	}
+
+	info, err := roomStore.Get(room)
+	if err != nil {
+		log.Error("Error retrieving room", Fields{"error": err})
+		return recordFailed()
+	}
+
+	if !isModerator(identity, info) {
+		log.Warn("Only the room creator can record", nil)
+		return recordFailed()
+	}
+
+	var recording RecordingStatus
+	if status {
+		recording, err = recorder.Start(room)
+	} else {
+		recording, err = recorder.Stop(room)
+	}
+	if err != nil {
+		log.Error("Error changing record status", Fields{
+			"recordStatus": status,
+			"error":        err,
+		})
+		return recordFailed()
+	}
+
+	if err := roomStore.SetRecording(room, status); err != nil {
+		log.Error("Error saving record status", Fields{"error": err})
+	}
+
+	if recording.URL != "" {
+		err = adapter.Emit(clientID, NewMessage("stream_url", room, StreamURLPayload{
+			Successful: "1",
+			StreamURL:  recording.URL,
+		}))
+		if err != nil {
+			log.Error("Error sending stream_url", Fields{"error": err})
+		}
+	}
+
+	return adapter.Broadcast(NewMessage("record_callback", room, RecordCallbackPayload{
+		Successful:   true,
+		RecordStatus: status,
+		Files:        recording.Files,
+	}))
+}
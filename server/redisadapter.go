@@ -2,12 +2,17 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
 	"sync"
 
 	"github.com/go-redis/redis/v7"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type JSONMessage struct {
@@ -19,6 +24,15 @@ type Doner interface {
 	Done()
 }
 
+// redisMessage is published to redis. It carries the trace context beside
+// the message, which is serialized with the adapter's Serializer. The trace
+// context continues the trace of the message on the instances which receive
+// it, and is only set for messages sent with a traced context.
+type redisMessage struct {
+	Message      string                 `json:"message"`
+	TraceContext propagation.MapCarrier `json:"traceContext,omitempty"`
+}
+
 type RedisAdapter struct {
 	log          Logger
 	serializer   Serializer
@@ -66,7 +80,9 @@ func NewRedisAdapter(
 	var byteSerializer ByteSerializer
 
 	adapter := RedisAdapter{
-		log:          loggerFactory.GetLogger("redis"),
+		log: loggerFactory.GetLogger("redis").WithFields(Fields{
+			"room": room,
+		}),
 		serializer:   byteSerializer,
 		deserializer: byteSerializer,
 		clients:      map[string]ClientWriter{},
@@ -89,12 +105,12 @@ func NewRedisAdapter(
 
 func (a *RedisAdapter) Add(client ClientWriter) (err error) {
 	clientID := client.ID()
-	a.log.Printf("Add clientID: %s to room: %s", clientID, a.room)
+	a.log.Debug("Add client", Fields{"clientId": clientID})
 	a.clientsMu.Lock()
 	err = a.Broadcast(NewMessageRoomJoin(a.room, clientID, client.Metadata()))
 	if err == nil {
 		a.clients[clientID] = client
-		a.log.Printf("Add clientID: %s to room: %s done", clientID, a.room)
+		a.log.Debug("Add client done", Fields{"clientId": clientID})
 	}
 	a.clientsMu.Unlock()
 	return
@@ -119,14 +135,20 @@ func (a *RedisAdapter) removeAll() (err error) {
 }
 
 func (a *RedisAdapter) remove(clientID string) (err error) {
-	a.log.Printf("Remove clientID: %s from room: %s", clientID, a.room)
+	a.log.Debug("Remove client", Fields{"clientId": clientID})
 	// can only remove clients connected to this adapter
 	if err = a.pubRedis.HDel(a.keys.roomClients, clientID).Err(); err != nil {
-		a.log.Printf("Error deleting clientID from all clients: %s", err)
+		a.log.Error("Error deleting client from all clients", Fields{
+			"clientId": clientID,
+			"error":    err,
+		})
 	}
 	delete(a.clients, clientID)
 	err = a.Broadcast(NewMessageRoomLeave(a.room, clientID))
-	a.log.Printf("Remove clientID: %s from room: %s done (err: %s)", clientID, a.room, err)
+	a.log.Debug("Remove client done", Fields{
+		"clientId": clientID,
+		"error":    err,
+	})
 	return
 }
 
@@ -137,24 +159,28 @@ func (a *RedisAdapter) Metadata(clientID string) (metadata string, ok bool) {
 
 func (a *RedisAdapter) SetMetadata(clientID string, metadata string) (ok bool) {
 	_, err := a.pubRedis.HSet(a.keys.roomClients, clientID, metadata).Result()
-	a.log.Printf("SetMetadata for clientID: %s, metadata: %s (err: %s)", clientID, metadata, err)
+	a.log.Debug("SetMetadata", Fields{
+		"clientId": clientID,
+		"metadata": metadata,
+		"error":    err,
+	})
 	return err == nil
 }
 
 // Returns IDs of all known clients connected to this room
 func (a *RedisAdapter) Clients() (map[string]string, error) {
-	a.log.Printf("Clients")
+	a.log.Debug("Clients", nil)
 
 	r := a.pubRedis.HGetAll(a.keys.roomClients)
 	allClients, err := r.Result()
 
 	if err != nil {
 		err = fmt.Errorf("Error retrieving clients in room: %s, reason: %w", a.room, err)
-		a.log.Printf("Error retrieving clients in room: %s, reason: %s", a.room, err)
+		a.log.Error("Error retrieving clients in room", Fields{"error": err})
 		return allClients, err
 	}
 
-	a.log.Printf("Clients size: %d", len(allClients))
+	a.log.Debug("Clients done", Fields{"clients": len(allClients)})
 	return allClients, nil
 }
 
@@ -168,12 +194,34 @@ func (a *RedisAdapter) handleMessage(
 	pattern string,
 	channel string,
 	message string,
-) error {
-	msg, err := a.deserializer.Deserialize([]byte(message))
+) (err error) {
+	var rm redisMessage
+	if err := json.Unmarshal([]byte(message), &rm); err != nil {
+		return fmt.Errorf("RedisAdapter.handleMessage error decoding redis message: %w", err)
+	}
+	msg, err := a.deserializer.Deserialize([]byte(rm.Message))
 	if err != nil {
 		return fmt.Errorf("RedisAdapter.handleMessage error deserializing redis subscription: %w", err)
 	}
-	a.log.Printf("RedisAdapter.handleMessage pattern: %s, channel: %s, type: %s", pattern, channel, msg.Type)
+
+	if len(rm.TraceContext) > 0 {
+		ctx := otel.GetTextMapPropagator().Extract(context.Background(), rm.TraceContext)
+		ctx, span := startSpan(ctx, "RedisAdapter.handleMessage", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+			attribute.String("room", a.room),
+			attribute.String("channel", channel),
+			attribute.String("type", msg.Type),
+		))
+		defer func() {
+			endSpan(span, err)
+		}()
+		msg = msg.WithContext(ctx)
+	}
+
+	a.log.Debug("RedisAdapter.handleMessage", Fields{
+		"pattern": pattern,
+		"channel": channel,
+		"type":    msg.Type,
+	})
 	switch {
 	case channel == a.keys.roomChannel:
 		// localBroadcast to all clients
@@ -210,14 +258,17 @@ func (a *RedisAdapter) handleMessage(
 		err = a.localEmit(clientID, msg)
 		a.clientsMu.RUnlock()
 	}
-	a.log.Printf("RedisAdapter.handleMessage done (err: %s)", err)
+	a.log.Debug("RedisAdapter.handleMessage done", Fields{"error": err})
 	return err
 }
 
 // Reads from subscribed keys and dispatches relevant messages to
 // client websockets. This method blocks until the context is closed.
 func (a *RedisAdapter) subscribe(ctx context.Context, ready func()) error {
-	a.log.Println("Subscribe", a.keys.roomChannel, a.keys.clientPattern)
+	a.log.Debug("Subscribe", Fields{
+		"channel": a.keys.roomChannel,
+		"pattern": a.keys.clientPattern,
+	})
 	pubsub := a.subRedis.PSubscribe(a.keys.roomChannel, a.keys.clientPattern)
 	defer pubsub.Close()
 
@@ -237,12 +288,12 @@ func (a *RedisAdapter) subscribe(ctx context.Context, ready func()) error {
 			case *redis.Message:
 				err := a.handleMessage(msg.Pattern, msg.Channel, msg.Payload)
 				if err != nil {
-					a.log.Printf("Error handling message: %s", err)
+					a.log.Error("Error handling message", Fields{"error": err})
 				}
 			}
 		case <-ctx.Done():
 			err := ctx.Err()
-			a.log.Println("Subscribe done", err)
+			a.log.Debug("Subscribe done", Fields{"error": err})
 			return err
 		}
 	}
@@ -283,22 +334,47 @@ func (a *RedisAdapter) Close() error {
 	return firstError(errs...)
 }
 
-func (a *RedisAdapter) publish(channel string, msg Message) error {
+// publish publishes msg to channel. Messages sent with a traced context are
+// published in a producer span.
+func (a *RedisAdapter) publish(channel string, msg Message) (err error) {
 	data, err := a.serializer.Serialize(msg)
 	if err != nil {
 		return fmt.Errorf("RedisAdapter.publish - error serializing message: %w", err)
 	}
+	rm := redisMessage{Message: string(data)}
+
+	if parent := msg.Context(); trace.SpanContextFromContext(parent).IsValid() {
+		ctx, span := startSpan(parent, "RedisAdapter.publish", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+			attribute.String("room", a.room),
+			attribute.String("channel", channel),
+			attribute.String("type", msg.Type),
+		))
+		defer func() {
+			endSpan(span, err)
+		}()
+
+		rm.TraceContext = propagation.MapCarrier{}
+		otel.GetTextMapPropagator().Inject(ctx, rm.TraceContext)
+	}
+
+	data, err = json.Marshal(rm)
+	if err != nil {
+		return fmt.Errorf("RedisAdapter.publish - error encoding redis message: %w", err)
+	}
 	return a.pubRedis.Publish(channel, string(data)).Err()
 }
 
 func (a *RedisAdapter) Broadcast(msg Message) error {
 	channel := a.keys.roomChannel
-	a.log.Printf("RedisAdapter.Broadcast type: %s to %s", msg.Type, channel)
+	a.log.Debug("RedisAdapter.Broadcast", Fields{
+		"type":    msg.Type,
+		"channel": channel,
+	})
 	return a.publish(channel, msg)
 }
 
 func (a *RedisAdapter) localBroadcast(msg Message) (err error) {
-	a.log.Printf("RedisAdapter.localBroadcast in room %s of message type: %s", a.room, msg.Type)
+	a.log.Debug("RedisAdapter.localBroadcast", Fields{"type": msg.Type})
 	for clientID := range a.clients {
 		if emitErr := a.localEmit(clientID, msg); emitErr != nil && err == nil {
 			err = emitErr
@@ -309,16 +385,19 @@ func (a *RedisAdapter) localBroadcast(msg Message) (err error) {
 
 func (a *RedisAdapter) Emit(clientID string, msg Message) error {
 	channel := getClientChannelName(a.prefix, a.room, clientID)
-	a.log.Printf("Emit clientID: %s, type: %s to %s", clientID, msg.Type, channel)
-	data, err := a.serializer.Serialize(msg)
-	if err != nil {
-		return fmt.Errorf("RedisAdapter.Emit - error serializing message: %w", err)
-	}
-	return a.pubRedis.Publish(channel, string(data)).Err()
+	a.log.Debug("RedisAdapter.Emit", Fields{
+		"clientId": clientID,
+		"type":     msg.Type,
+		"channel":  channel,
+	})
+	return a.publish(channel, msg)
 }
 
 func (a *RedisAdapter) localEmit(clientID string, msg Message) error {
-	a.log.Printf("RedisAdapter.localEmit clientID: %s, type: %s", clientID, msg.Type)
+	a.log.Debug("RedisAdapter.localEmit", Fields{
+		"clientId": clientID,
+		"type":     msg.Type,
+	})
 	client, ok := a.clients[clientID]
 	if !ok {
 		return fmt.Errorf("RedisAdapter.localEmit in room: %s - no local clientID: %s", a.room, clientID)
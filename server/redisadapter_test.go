@@ -5,10 +5,14 @@ import (
 	"errors"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-redis/redis/v7"
 	"github.com/peer-calls/peer-calls/server"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.uber.org/goleak"
 )
 
@@ -105,3 +109,42 @@ func TestRedisAdapter_add_remove_client(t *testing.T) {
 	cancel()
 	wg.Wait()
 }
+
+func TestRedisAdapter_tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer setGlobalTracing(provider, propagation.TraceContext{})()
+
+	pub, sub, stop := configureRedis(t)
+	defer stop()
+	adapter := server.NewRedisAdapter(loggerFactory, pub, sub, "peercalls", room)
+	defer adapter.Close()
+
+	mockWriter := NewMockWriter()
+	client := server.NewClient(mockWriter)
+	assert.Nil(t, adapter.Add(client))
+	assert.Equal(t, serialize(t, server.NewMessageRoomJoin(room, client.ID(), "")), <-mockWriter.out)
+
+	ctx, span := provider.Tracer("test").Start(context.Background(), "test")
+	msg := server.NewMessage("test", room, "payload")
+	assert.Nil(t, adapter.Emit(client.ID(), msg.WithContext(ctx)))
+	span.End()
+	assert.Equal(t, serialize(t, msg), <-mockWriter.out, "trace context is not sent to clients")
+
+	// the consumer span ends after the message has been written.
+	assert.Eventually(t, func() bool {
+		return len(recorder.Ended()) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+
+	publish, consume := spans["RedisAdapter.publish"], spans["RedisAdapter.handleMessage"]
+	if assert.NotNil(t, publish) && assert.NotNil(t, consume) {
+		assert.Equal(t, span.SpanContext().SpanID(), publish.Parent().SpanID())
+		assert.Equal(t, publish.SpanContext().SpanID(), consume.Parent().SpanID())
+		assert.Equal(t, span.SpanContext().TraceID(), consume.SpanContext().TraceID())
+	}
+}
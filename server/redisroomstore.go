@@ -0,0 +1,189 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+const (
+	redisRoomCreatorID    = "creatorId"
+	redisRoomRecording    = "recording"
+	redisRoomPasswordHash = "passwordHash"
+	redisRoomLocked       = "locked"
+	redisRoomLobby        = "lobby"
+)
+
+// redisSetRoomField does not create rooms which do not exist or have
+// expired.
+var redisSetRoomField = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+if tonumber(ARGV[3]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+// RedisRoomStore keeps rooms in a Redis hash per room so that all instances
+// agree on the room creator and recording status. Expiry is handled by Redis.
+type RedisRoomStore struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+var _ RoomStore = &RedisRoomStore{}
+
+func NewRedisRoomStore(client *redis.Client, prefix string, ttl time.Duration) *RedisRoomStore {
+	return &RedisRoomStore{
+		client: client,
+		prefix: prefix,
+		ttl:    ttl,
+	}
+}
+
+func getRoomInfoName(prefix string, room string) string {
+	// TODO escape room name, what if it has ":" in the name?
+	return prefix + ":room:" + room + ":info"
+}
+
+func getRoomBanName(prefix string, room string, id string) string {
+	// TODO escape room name, what if it has ":" in the name?
+	return prefix + ":room:" + room + ":ban:" + id
+}
+
+func (s *RedisRoomStore) expire(pipe redis.Pipeliner, key string) {
+	if s.ttl > 0 {
+		pipe.PExpire(key, s.ttl)
+	}
+}
+
+func (s *RedisRoomStore) Create(room string, creatorID string) (RoomInfo, bool, error) {
+	key := getRoomInfoName(s.prefix, room)
+
+	var created *redis.BoolCmd
+	var values *redis.StringStringMapCmd
+
+	_, err := s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		created = pipe.HSetNX(key, redisRoomCreatorID, creatorID)
+		s.expire(pipe, key)
+		values = pipe.HGetAll(key)
+		return nil
+	})
+	if err != nil {
+		return RoomInfo{}, false, fmt.Errorf("Error creating room: %w", err)
+	}
+
+	return newRedisRoomInfo(room, values.Val()), created.Val(), nil
+}
+
+func (s *RedisRoomStore) Get(room string) (RoomInfo, error) {
+	values, err := s.client.HGetAll(getRoomInfoName(s.prefix, room)).Result()
+	if err != nil {
+		return RoomInfo{}, fmt.Errorf("Error retrieving room: %w", err)
+	}
+
+	if len(values) == 0 {
+		return RoomInfo{}, ErrRoomNotFound
+	}
+
+	return newRedisRoomInfo(room, values), nil
+}
+
+func (s *RedisRoomStore) setField(room string, field string, value string) error {
+	key := getRoomInfoName(s.prefix, room)
+	ok, err := redisSetRoomField.Run(s.client, []string{key}, field, value, s.ttl.Milliseconds()).Int()
+	if err != nil {
+		return fmt.Errorf("Error setting room %s: %w", field, err)
+	}
+
+	if ok == 0 {
+		return ErrRoomNotFound
+	}
+
+	return nil
+}
+
+func (s *RedisRoomStore) SetRecording(room string, recording bool) error {
+	return s.setField(room, redisRoomRecording, redisBool(recording))
+}
+
+func (s *RedisRoomStore) SetPassword(room string, passwordHash string) error {
+	return s.setField(room, redisRoomPasswordHash, passwordHash)
+}
+
+func (s *RedisRoomStore) SetLocked(room string, locked bool) error {
+	return s.setField(room, redisRoomLocked, redisBool(locked))
+}
+
+func (s *RedisRoomStore) SetLobby(room string, lobby bool) error {
+	return s.setField(room, redisRoomLobby, redisBool(lobby))
+}
+
+func (s *RedisRoomStore) SetCreator(room string, creatorID string) error {
+	return s.setField(room, redisRoomCreatorID, creatorID)
+}
+
+func (s *RedisRoomStore) Ban(room string, id string, duration time.Duration) error {
+	err := s.client.Set(getRoomBanName(s.prefix, room, id), "1", duration).Err()
+	if err != nil {
+		return fmt.Errorf("Error banning %s from room: %w", id, err)
+	}
+	return nil
+}
+
+func (s *RedisRoomStore) Banned(room string, id string) (bool, error) {
+	count, err := s.client.Exists(getRoomBanName(s.prefix, room, id)).Result()
+	if err != nil {
+		return false, fmt.Errorf("Error checking ban: %w", err)
+	}
+	return count > 0, nil
+}
+
+func (s *RedisRoomStore) Touch(room string) error {
+	if s.ttl <= 0 {
+		return nil
+	}
+
+	ok, err := s.client.PExpire(getRoomInfoName(s.prefix, room), s.ttl).Result()
+	if err != nil {
+		return fmt.Errorf("Error touching room: %w", err)
+	}
+
+	if !ok {
+		return ErrRoomNotFound
+	}
+
+	return nil
+}
+
+func (s *RedisRoomStore) Remove(room string) error {
+	return s.client.Del(getRoomInfoName(s.prefix, room)).Err()
+}
+
+// Close does nothing because the client is owned by the AdapterFactory.
+func (s *RedisRoomStore) Close() error {
+	return nil
+}
+
+func redisBool(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
+
+func newRedisRoomInfo(room string, values map[string]string) RoomInfo {
+	return RoomInfo{
+		Room:         room,
+		CreatorID:    values[redisRoomCreatorID],
+		Recording:    values[redisRoomRecording] == "1",
+		PasswordHash: values[redisRoomPasswordHash],
+		Locked:       values[redisRoomLocked] == "1",
+		Lobby:        values[redisRoomLobby] == "1",
+	}
+}
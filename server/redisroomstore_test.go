@@ -0,0 +1,96 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/peer-calls/peer-calls/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestRedisRoomStore(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	pub, _, stop := configureRedis(t)
+	defer stop()
+
+	s1 := server.NewRedisRoomStore(pub, "peercalls", time.Minute)
+	s2 := server.NewRedisRoomStore(pub, "peercalls", time.Minute)
+	require.NoError(t, s1.Remove(room))
+	defer s1.Remove(room)
+
+	_, err := s1.Get(room)
+	assert.Equal(t, server.ErrRoomNotFound, err)
+	assert.Equal(t, server.ErrRoomNotFound, s1.SetRecording(room, true))
+	assert.Equal(t, server.ErrRoomNotFound, s1.Touch(room))
+
+	info, created, err := s1.Create(room, "user1")
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, server.RoomInfo{Room: room, CreatorID: "user1"}, info)
+
+	info, created, err = s2.Create(room, "user2")
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, "user1", info.CreatorID)
+
+	require.NoError(t, s2.SetRecording(room, true))
+	info, err = s1.Get(room)
+	require.NoError(t, err)
+	assert.Equal(t, server.RoomInfo{Room: room, CreatorID: "user1", Recording: true}, info)
+	require.NoError(t, s1.Touch(room))
+
+	require.NoError(t, s2.SetPassword(room, "hash"))
+	require.NoError(t, s2.SetLocked(room, true))
+	require.NoError(t, s2.SetLobby(room, true))
+	require.NoError(t, s2.SetCreator(room, "user2"))
+	info, err = s1.Get(room)
+	require.NoError(t, err)
+	assert.Equal(t, server.RoomInfo{
+		Room:         room,
+		CreatorID:    "user2",
+		Recording:    true,
+		PasswordHash: "hash",
+		Locked:       true,
+		Lobby:        true,
+	}, info)
+
+	require.NoError(t, s2.Remove(room))
+	_, err = s1.Get(room)
+	assert.Equal(t, server.ErrRoomNotFound, err)
+}
+
+func TestRedisRoomStore_expire(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	pub, _, stop := configureRedis(t)
+	defer stop()
+
+	s := server.NewRedisRoomStore(pub, "peercalls", 50*time.Millisecond)
+	defer s.Remove(room)
+
+	_, _, err := s.Create(room, "user1")
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = s.Get(room)
+	assert.Equal(t, server.ErrRoomNotFound, err)
+}
+
+func TestRedisRoomStore_ban(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	pub, _, stop := configureRedis(t)
+	defer stop()
+
+	s := server.NewRedisRoomStore(pub, "peercalls", time.Minute)
+
+	require.NoError(t, s.Ban(room, "user1", 50*time.Millisecond))
+	banned, err := s.Banned(room, "user1")
+	require.NoError(t, err)
+	assert.True(t, banned)
+
+	time.Sleep(100 * time.Millisecond)
+	banned, err = s.Banned(room, "user1")
+	require.NoError(t, err)
+	assert.False(t, banned)
+}
@@ -0,0 +1,468 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultRelayInterval is how often instances announce the rooms they have
+// clients in, look for other instances in the same rooms and resend the
+// lists of relayed tracks.
+const DefaultRelayInterval = 2 * time.Second
+
+const (
+	relayPacketVersion = 1
+	// relayMACSize is the size of the truncated HMAC-SHA256 appended to relay
+	// packets.
+	relayMACSize = 16
+	// relayMaxPacketSize is the maximum size of a UDP datagram.
+	relayMaxPacketSize = 65535
+)
+
+var (
+	ErrInvalidRelayPacket = errors.New("Invalid relay packet")
+	ErrInvalidRelayMAC    = errors.New("Invalid relay packet MAC")
+	ErrRelaySecretMissing = errors.New("Relay secret is required")
+)
+
+// relayPacket is a datagram exchanged between instances. Each datagram
+// contains the address of the sending instance and the room it relates to.
+type relayPacket struct {
+	packetType relayPacketType
+	addr       string
+	room       string
+	payload    []byte
+}
+
+func encodeRelayPacket(secret []byte, packet relayPacket) ([]byte, error) {
+	if len(packet.addr) > 255 || len(packet.room) > 65535 {
+		return nil, ErrInvalidRelayPacket
+	}
+
+	data := make([]byte, 0, 5+len(packet.addr)+len(packet.room)+len(packet.payload)+relayMACSize)
+	data = append(data, relayPacketVersion, byte(packet.packetType), byte(len(packet.addr)))
+	data = append(data, packet.addr...)
+	data = append(data, byte(len(packet.room)>>8), byte(len(packet.room)))
+	data = append(data, packet.room...)
+	data = append(data, packet.payload...)
+
+	if len(secret) > 0 {
+		data = append(data, relayMAC(secret, data)...)
+	}
+
+	return data, nil
+}
+
+// decodeRelayPacket decodes a datagram. The payload is copied so the data
+// can be reused.
+func decodeRelayPacket(secret []byte, data []byte) (packet relayPacket, err error) {
+	if len(secret) > 0 {
+		if len(data) < relayMACSize {
+			return packet, ErrInvalidRelayPacket
+		}
+		mac := data[len(data)-relayMACSize:]
+		data = data[:len(data)-relayMACSize]
+		if !hmac.Equal(mac, relayMAC(secret, data)) {
+			return packet, ErrInvalidRelayMAC
+		}
+	}
+
+	if len(data) < 3 || data[0] != relayPacketVersion {
+		return packet, ErrInvalidRelayPacket
+	}
+	packet.packetType = relayPacketType(data[1])
+
+	addrLen := int(data[2])
+	data = data[3:]
+	if len(data) < addrLen+2 {
+		return packet, ErrInvalidRelayPacket
+	}
+	packet.addr = string(data[:addrLen])
+	data = data[addrLen:]
+
+	roomLen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < roomLen {
+		return packet, ErrInvalidRelayPacket
+	}
+	packet.room = string(data[:roomLen])
+
+	packet.payload = append([]byte(nil), data[roomLen:]...)
+	return packet, nil
+}
+
+func relayMAC(secret []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	_, _ = h.Write(data)
+	return h.Sum(nil)[:relayMACSize]
+}
+
+// Relay relays the tracks of rooms to other server instances which have
+// clients in the same rooms. Instances find each other through
+// RelayDiscovery and exchange packets over UDP. Every instance relays the
+// tracks of its own clients to all other instances in the room, so the
+// instances of a room form a full mesh.
+type Relay struct {
+	loggerFactory LoggerFactory
+	log           Logger
+	conn          net.PacketConn
+	addr          string
+	secret        []byte
+	discovery     RelayDiscovery
+	interval      time.Duration
+
+	mu     sync.Mutex
+	closed bool
+	rooms  map[string]*relayRoom
+
+	readDone chan struct{}
+}
+
+type relayRoom struct {
+	manager *RoomPeersManager
+	// transports are keyed by the address of the other instance.
+	transports map[string]*RelayTransport
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// ListenRelay listens for packets from other instances on the configured
+// bind address.
+func ListenRelay(loggerFactory LoggerFactory, discovery RelayDiscovery, config NetworkConfigSFURelay) (*Relay, error) {
+	if config.Secret == "" {
+		return nil, ErrRelaySecretMissing
+	}
+
+	conn, err := net.ListenPacket("udp", config.BindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Error listening for relay packets: %w", err)
+	}
+	return NewRelay(loggerFactory, conn, discovery, config)
+}
+
+// NewRelay creates a relay which uses conn to exchange packets with other
+// instances. Other instances send packets to config.AdvertiseAddr, or to the
+// local address of conn when it is empty. A secret is required because the
+// address and room of packets are not authenticated otherwise, and any host
+// which can send datagrams to conn could inject packets into rooms.
+func NewRelay(loggerFactory LoggerFactory, conn net.PacketConn, discovery RelayDiscovery, config NetworkConfigSFURelay) (*Relay, error) {
+	if config.Secret == "" {
+		return nil, ErrRelaySecretMissing
+	}
+
+	addr := config.AdvertiseAddr
+	if addr == "" {
+		addr = conn.LocalAddr().String()
+	}
+
+	interval := config.Interval
+	if interval <= 0 {
+		interval = DefaultRelayInterval
+	}
+
+	r := &Relay{
+		loggerFactory: loggerFactory,
+		log:           loggerFactory.GetLogger("relay"),
+		conn:          conn,
+		addr:          addr,
+		secret:        []byte(config.Secret),
+		discovery:     discovery,
+		interval:      interval,
+		rooms:         map[string]*relayRoom{},
+		readDone:      make(chan struct{}),
+	}
+
+	r.log.Info("Relaying tracks", Fields{
+		"localAddr": conn.LocalAddr().String(),
+		"addr":      addr,
+	})
+
+	go r.read()
+	return r, nil
+}
+
+// Addr returns the address other instances send packets to.
+func (r *Relay) Addr() string {
+	return r.addr
+}
+
+// Join starts relaying the tracks of room to the other instances with
+// clients in the room. When the room is still being left by a previous
+// manager, relaying starts after the previous manager has left.
+func (r *Relay) Join(room string, manager *RoomPeersManager) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	var previous <-chan struct{}
+
+	if rr, ok := r.rooms[room]; ok {
+		if rr.manager == manager {
+			r.log.Debug("Relay already joined room", Fields{"room": room})
+			return
+		}
+
+		delete(r.rooms, room)
+		close(rr.stop)
+		previous = rr.done
+	}
+
+	rr := &relayRoom{
+		manager:    manager,
+		transports: map[string]*RelayTransport{},
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	r.rooms[room] = rr
+
+	r.log.Info("Joining room", Fields{"room": room})
+	go r.run(room, rr, previous)
+}
+
+// Leave stops relaying the tracks of room after the last client of this
+// instance has left. It returns after the relay transports have been closed.
+func (r *Relay) Leave(room string, manager *RoomPeersManager) {
+	r.mu.Lock()
+	rr, ok := r.rooms[room]
+	if !ok || rr.manager != manager {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.rooms, room)
+	r.mu.Unlock()
+
+	r.log.Info("Leaving room", Fields{"room": room})
+	close(rr.stop)
+	<-rr.done
+}
+
+// Close leaves all rooms and stops listening for packets.
+func (r *Relay) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	rooms := r.rooms
+	r.rooms = map[string]*relayRoom{}
+	r.mu.Unlock()
+
+	for _, rr := range rooms {
+		close(rr.stop)
+		<-rr.done
+	}
+
+	err := r.conn.Close()
+	<-r.readDone
+	return err
+}
+
+func (r *Relay) run(room string, rr *relayRoom, previous <-chan struct{}) {
+	defer close(rr.done)
+
+	if previous != nil {
+		// Wait for the previous manager to unregister, otherwise it could
+		// remove the registration of this one.
+		<-previous
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.sync(room, rr)
+
+		select {
+		case <-ticker.C:
+		case <-rr.stop:
+			r.leave(room, rr)
+			return
+		}
+	}
+}
+
+// sync renews the registration of this instance in the room, adds relay
+// transports for new instances and removes the transports of instances which
+// have left.
+func (r *Relay) sync(room string, rr *relayRoom) {
+	if err := r.discovery.Register(room, r.addr, 3*r.interval); err != nil {
+		r.log.Error("Error registering in room", Fields{
+			"room":  room,
+			"error": err,
+		})
+	}
+
+	addrs, err := r.discovery.Nodes(room)
+	if err != nil {
+		r.log.Error("Error finding instances in room", Fields{
+			"room":  room,
+			"error": err,
+		})
+		return
+	}
+
+	nodes := map[string]struct{}{}
+	for _, addr := range addrs {
+		if addr != r.addr {
+			nodes[addr] = struct{}{}
+		}
+	}
+
+	var added, removed, existing []*RelayTransport
+
+	r.mu.Lock()
+	for addr := range nodes {
+		if transport, ok := rr.transports[addr]; ok {
+			existing = append(existing, transport)
+			continue
+		}
+
+		transport, err := r.newTransport(room, addr)
+		if err != nil {
+			r.log.Error("Error creating relay transport for room", Fields{
+				"room":  room,
+				"error": err,
+			})
+			continue
+		}
+		rr.transports[addr] = transport
+		added = append(added, transport)
+	}
+	for addr, transport := range rr.transports {
+		if _, ok := nodes[addr]; !ok {
+			delete(rr.transports, addr)
+			removed = append(removed, transport)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, transport := range added {
+		r.log.Info("Relaying room", Fields{
+			"room":     room,
+			"clientId": transport.ClientID(),
+		})
+		rr.manager.Add(transport)
+	}
+
+	for _, transport := range removed {
+		r.log.Info("Instance left room", Fields{
+			"room":     room,
+			"clientId": transport.ClientID(),
+		})
+		r.closeTransport(rr, transport)
+	}
+
+	for _, transport := range existing {
+		if err := transport.sendTracks(); err != nil {
+			r.log.Error("Error sending relayed tracks", Fields{
+				"room":     room,
+				"clientId": transport.ClientID(),
+				"error":    err,
+			})
+		}
+	}
+}
+
+func (r *Relay) leave(room string, rr *relayRoom) {
+	r.mu.Lock()
+	transports := rr.transports
+	rr.transports = map[string]*RelayTransport{}
+	r.mu.Unlock()
+
+	for _, transport := range transports {
+		r.closeTransport(rr, transport)
+	}
+
+	if err := r.discovery.Unregister(room, r.addr); err != nil {
+		r.log.Error("Error unregistering from room", Fields{
+			"room":  room,
+			"error": err,
+		})
+	}
+}
+
+func (r *Relay) closeTransport(rr *relayRoom, transport *RelayTransport) {
+	if err := transport.Close(); err != nil {
+		r.log.Error("Error closing relay transport", Fields{
+			"clientId": transport.ClientID(),
+			"error":    err,
+		})
+	}
+	rr.manager.Remove(transport.ClientID())
+}
+
+func (r *Relay) newTransport(room string, addr string) (*RelayTransport, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving relay address: %s: %w", addr, err)
+	}
+
+	send := func(packetType relayPacketType, payload []byte) error {
+		data, err := encodeRelayPacket(r.secret, relayPacket{
+			packetType: packetType,
+			addr:       r.addr,
+			room:       room,
+			payload:    payload,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = r.conn.WriteTo(data, udpAddr)
+		return err
+	}
+
+	return newRelayTransport(r.loggerFactory, addr, send), nil
+}
+
+func (r *Relay) read() {
+	defer close(r.readDone)
+
+	buf := make([]byte, relayMaxPacketSize)
+
+	for {
+		n, _, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			r.mu.Lock()
+			closed := r.closed
+			r.mu.Unlock()
+			if closed {
+				return
+			}
+			r.log.Error("Error reading relay packet", Fields{"error": err})
+			continue
+		}
+
+		packet, err := decodeRelayPacket(r.secret, buf[:n])
+		if err != nil {
+			r.log.Warn("Error decoding relay packet", Fields{"error": err})
+			continue
+		}
+
+		r.mu.Lock()
+		var transport *RelayTransport
+		if rr, ok := r.rooms[packet.room]; ok {
+			transport = rr.transports[packet.addr]
+		}
+		r.mu.Unlock()
+
+		if transport == nil {
+			// the other instance has not been discovered yet
+			continue
+		}
+
+		if !transport.enqueue(packet.packetType, packet.payload) {
+			r.log.Debug("Relay queue full, dropping packet", Fields{
+				"room":       packet.room,
+				"clientId":   transport.ClientID(),
+				"packetType": packet.packetType,
+			})
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package server_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peer-calls/peer-calls/server"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// fakeTransport is the transport of a client which publishes the tracks
+// sent to its channels and records the packets written to it.
+type fakeTransport struct {
+	clientID string
+
+	trackEventsCh chan server.TrackEvent
+	rtpCh         chan *rtp.Packet
+	rtcpCh        chan rtcp.Packet
+	messagesCh    chan webrtc.DataChannelMessage
+
+	addedTracks   chan server.TrackInfo
+	removedTracks chan uint32
+	writtenRTP    chan *rtp.Packet
+	writtenRTCP   chan rtcp.Packet
+
+	mu           sync.Mutex
+	localTracks  map[uint32]server.TrackInfo
+	remoteTracks map[uint32]server.TrackInfo
+}
+
+var _ server.Transport = &fakeTransport{}
+
+func newFakeTransport(clientID string) *fakeTransport {
+	return &fakeTransport{
+		clientID:      clientID,
+		trackEventsCh: make(chan server.TrackEvent),
+		rtpCh:         make(chan *rtp.Packet),
+		rtcpCh:        make(chan rtcp.Packet),
+		messagesCh:    make(chan webrtc.DataChannelMessage),
+		addedTracks:   make(chan server.TrackInfo, 10),
+		removedTracks: make(chan uint32, 10),
+		writtenRTP:    make(chan *rtp.Packet, 10),
+		writtenRTCP:   make(chan rtcp.Packet, 10),
+		localTracks:   map[uint32]server.TrackInfo{},
+		remoteTracks:  map[uint32]server.TrackInfo{},
+	}
+}
+
+// publish publishes a track like a client which adds it to the peer
+// connection.
+func (f *fakeTransport) publish(track server.TrackInfo) {
+	f.mu.Lock()
+	f.remoteTracks[track.SSRC] = track
+	f.mu.Unlock()
+	f.trackEventsCh <- server.TrackEvent{
+		TrackInfo: track,
+		Type:      server.TrackEventTypeAdd,
+	}
+}
+
+func (f *fakeTransport) unpublish(track server.TrackInfo) {
+	f.mu.Lock()
+	delete(f.remoteTracks, track.SSRC)
+	f.mu.Unlock()
+	f.trackEventsCh <- server.TrackEvent{
+		TrackInfo: track,
+		Type:      server.TrackEventTypeRemove,
+	}
+}
+
+func (f *fakeTransport) ClientID() string { return f.clientID }
+
+func (f *fakeTransport) WriteRTCP(packets []rtcp.Packet) error {
+	for _, packet := range packets {
+		f.writtenRTCP <- packet
+	}
+	return nil
+}
+
+func (f *fakeTransport) WriteRTP(packet *rtp.Packet) (int, error) {
+	f.writtenRTP <- packet
+	return packet.MarshalSize(), nil
+}
+
+func (f *fakeTransport) WriteTrackRTP(trackSSRC uint32, packet *rtp.Packet) (int, error) {
+	return f.WriteRTP(packet)
+}
+
+func (f *fakeTransport) AddTrack(clientID string, track server.TrackInfo) error {
+	f.mu.Lock()
+	f.localTracks[track.SSRC] = track
+	f.mu.Unlock()
+	f.addedTracks <- track
+	return nil
+}
+
+func (f *fakeTransport) RemoveTrack(ssrc uint32) error {
+	f.mu.Lock()
+	delete(f.localTracks, ssrc)
+	f.mu.Unlock()
+	f.removedTracks <- ssrc
+	return nil
+}
+
+func (f *fakeTransport) PauseTrack(ssrc uint32) error                    { return nil }
+func (f *fakeTransport) ResumeTrack(ssrc uint32) error                   { return nil }
+func (f *fakeTransport) SendMessage(msg webrtc.DataChannelMessage) error { return nil }
+
+func (f *fakeTransport) RemoteTracks() []server.TrackInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return trackInfoList(f.remoteTracks)
+}
+
+func (f *fakeTransport) LocalTracks() []server.TrackInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return trackInfoList(f.localTracks)
+}
+
+func trackInfoList(tracks map[uint32]server.TrackInfo) []server.TrackInfo {
+	list := []server.TrackInfo{}
+	for _, track := range tracks {
+		list = append(list, track)
+	}
+	return list
+}
+
+func (f *fakeTransport) TrackEventsChannel() <-chan server.TrackEvent { return f.trackEventsCh }
+func (f *fakeTransport) RTPChannel() <-chan *rtp.Packet               { return f.rtpCh }
+func (f *fakeTransport) RTCPChannel() <-chan rtcp.Packet              { return f.rtcpCh }
+
+func (f *fakeTransport) MessagesChannel() <-chan webrtc.DataChannelMessage {
+	return f.messagesCh
+}
+
+func (f *fakeTransport) Close() {
+	close(f.trackEventsCh)
+	close(f.rtpCh)
+	close(f.rtcpCh)
+	close(f.messagesCh)
+}
+
+func newTestRelay(t *testing.T, discovery server.RelayDiscovery, secret string) *server.Relay {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	relay, err := server.NewRelay(loggerFactory, conn, discovery, server.NetworkConfigSFURelay{
+		Secret:   secret,
+		Interval: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	return relay
+}
+
+func newTestRoomPeersManager() *server.RoomPeersManager {
+	jitterHandler := server.NewJitterHandler(
+		loggerFactory.GetLogger("jitter"),
+		loggerFactory.GetLogger("nack"),
+		false,
+	)
+	return server.NewRoomPeersManager("test-room", loggerFactory, jitterHandler)
+}
+
+func TestRelay(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	discovery := server.NewMemoryRelayDiscovery()
+	relay1 := newTestRelay(t, discovery, "secret")
+	defer relay1.Close()
+	relay2 := newTestRelay(t, discovery, "secret")
+	defer relay2.Close()
+
+	manager1 := newTestRoomPeersManager()
+	manager2 := newTestRoomPeersManager()
+
+	client1 := newFakeTransport("client1")
+	manager1.Add(client1)
+	defer client1.Close()
+	client2 := newFakeTransport("client2")
+	manager2.Add(client2)
+	defer client2.Close()
+
+	relay1.Join(room, manager1)
+	relay2.Join(room, manager2)
+
+	track := server.TrackInfo{
+		PayloadType: 111,
+		SSRC:        123,
+		ID:          "track1",
+		Label:       "stream1",
+		Kind:        webrtc.RTPCodecTypeAudio,
+	}
+	client1.publish(track)
+
+	select {
+	case added := <-client2.addedTracks:
+		assert.Equal(t, track, added)
+	case <-time.After(timeout):
+		require.Fail(t, "timed out waiting for relayed track")
+	}
+
+	metadata, ok := manager2.GetTracksMetadata("client2")
+	require.True(t, ok)
+	require.Equal(t, 1, len(metadata))
+	assert.Equal(t, "client1", metadata[0].UserID)
+	assert.Equal(t, "stream1", metadata[0].StreamID)
+
+	client1.rtpCh <- &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    111,
+			SSRC:           123,
+			SequenceNumber: 10,
+			Timestamp:      1000,
+		},
+		Payload: []byte{1, 2, 3},
+	}
+
+	select {
+	case packet := <-client2.writtenRTP:
+		assert.Equal(t, uint32(123), packet.SSRC)
+		assert.Equal(t, uint16(10), packet.SequenceNumber)
+		assert.Equal(t, []byte{1, 2, 3}, packet.Payload)
+	case <-time.After(timeout):
+		require.Fail(t, "timed out waiting for relayed RTP packet")
+	}
+
+	client2.rtcpCh <- &rtcp.PictureLossIndication{MediaSSRC: 123}
+
+	select {
+	case packet := <-client1.writtenRTCP:
+		pli, ok := packet.(*rtcp.PictureLossIndication)
+		require.True(t, ok, "unexpected RTCP packet: %T", packet)
+		assert.Equal(t, uint32(123), pli.MediaSSRC)
+	case <-time.After(timeout):
+		require.Fail(t, "timed out waiting for relayed PLI")
+	}
+
+	client1.unpublish(track)
+
+	select {
+	case ssrc := <-client2.removedTracks:
+		assert.Equal(t, uint32(123), ssrc)
+	case <-time.After(timeout):
+		require.Fail(t, "timed out waiting for relayed track removal")
+	}
+
+	client1.publish(track)
+	<-client2.addedTracks
+
+	relay1.Leave(room, manager1)
+
+	select {
+	case ssrc := <-client2.removedTracks:
+		assert.Equal(t, uint32(123), ssrc, "tracks are removed when an instance leaves")
+	case <-time.After(timeout):
+		require.Fail(t, "timed out waiting for track removal after leaving")
+	}
+
+	relay2.Leave(room, manager2)
+	nodes, err := discovery.Nodes(room)
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, nodes)
+}
+
+func TestRelay_invalidSecret(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	discovery := server.NewMemoryRelayDiscovery()
+	relay1 := newTestRelay(t, discovery, "secret")
+	defer relay1.Close()
+	relay2 := newTestRelay(t, discovery, "other")
+	defer relay2.Close()
+
+	manager1 := newTestRoomPeersManager()
+	manager2 := newTestRoomPeersManager()
+
+	client1 := newFakeTransport("client1")
+	manager1.Add(client1)
+	defer client1.Close()
+	client2 := newFakeTransport("client2")
+	manager2.Add(client2)
+	defer client2.Close()
+
+	relay1.Join(room, manager1)
+	defer relay1.Leave(room, manager1)
+	relay2.Join(room, manager2)
+	defer relay2.Leave(room, manager2)
+
+	client1.publish(server.TrackInfo{SSRC: 123, Kind: webrtc.RTPCodecTypeAudio})
+
+	select {
+	case track := <-client2.addedTracks:
+		assert.Fail(t, "track relayed with invalid secret", "track: %+v", track)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRelay_joinBeforeLeave(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	discovery := server.NewMemoryRelayDiscovery()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	// The registration is not renewed during the test.
+	relay, err := server.NewRelay(loggerFactory, conn, discovery, server.NetworkConfigSFURelay{
+		Secret:   "secret",
+		Interval: time.Hour,
+	})
+	require.NoError(t, err)
+	defer relay.Close()
+
+	manager1 := newTestRoomPeersManager()
+	manager2 := newTestRoomPeersManager()
+
+	// The room is joined by a new manager before the previous manager of the
+	// room has left, like when a client joins right after the last one left.
+	relay.Join(room, manager1)
+	relay.Join(room, manager2)
+	relay.Leave(room, manager1)
+
+	assert.Eventually(t, func() bool {
+		nodes, err := discovery.Nodes(room)
+		return err == nil && len(nodes) == 1
+	}, timeout, 10*time.Millisecond, "manager2 registers after manager1 has unregistered")
+
+	relay.Leave(room, manager2)
+	nodes, err := discovery.Nodes(room)
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, nodes)
+}
+
+func TestNewRelay_secretRequired(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = server.NewRelay(loggerFactory, conn, server.NewMemoryRelayDiscovery(), server.NetworkConfigSFURelay{})
+	assert.Equal(t, server.ErrRelaySecretMissing, err)
+}
+
+func TestMemoryRelayDiscovery(t *testing.T) {
+	discovery := server.NewMemoryRelayDiscovery()
+
+	require.NoError(t, discovery.Register(room, "a:1", time.Minute))
+	require.NoError(t, discovery.Register(room, "b:1", time.Minute))
+	require.NoError(t, discovery.Register(room, "c:1", -time.Second))
+	require.NoError(t, discovery.Register("other", "d:1", time.Minute))
+
+	nodes, err := discovery.Nodes(room)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a:1", "b:1"}, nodes)
+
+	require.NoError(t, discovery.Unregister(room, "a:1"))
+	nodes, err = discovery.Nodes(room)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b:1"}, nodes)
+}
+
+func TestRedisRelayDiscovery(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	pub, _, stop := configureRedis(t)
+	defer stop()
+
+	discovery := server.NewRedisRelayDiscovery(pub, "peercalls")
+	defer discovery.Unregister(room, "a:1")
+	defer discovery.Unregister(room, "b:1")
+
+	require.NoError(t, discovery.Register(room, "a:1", time.Minute))
+	require.NoError(t, discovery.Register(room, "b:1", time.Minute))
+	require.NoError(t, discovery.Register(room, "c:1", time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+
+	nodes, err := discovery.Nodes(room)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a:1", "b:1"}, nodes)
+
+	require.NoError(t, discovery.Unregister(room, "a:1"))
+	nodes, err = discovery.Nodes(room)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b:1"}, nodes)
+}
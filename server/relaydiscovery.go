@@ -0,0 +1,155 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// RelayDiscovery keeps track of the server instances which have clients in
+// each room, so that they can relay tracks to each other. Instances are
+// identified by the address they receive relay packets on.
+type RelayDiscovery interface {
+	// Register announces that the instance with addr has clients in room. The
+	// registration expires after ttl unless it is renewed, so that instances
+	// which stop without leaving their rooms are eventually removed.
+	Register(room string, addr string, ttl time.Duration) error
+	Unregister(room string, addr string) error
+	// Nodes returns the addresses of all instances registered in room.
+	Nodes(room string) ([]string, error)
+}
+
+// MemoryRelayDiscovery keeps registrations in memory. It can only be used by
+// relays in the same process, for example in tests.
+type MemoryRelayDiscovery struct {
+	now func() time.Time
+
+	mu sync.Mutex
+	// rooms contains the expiry times of instances keyed by room and address.
+	rooms map[string]map[string]time.Time
+}
+
+var _ RelayDiscovery = &MemoryRelayDiscovery{}
+
+func NewMemoryRelayDiscovery() *MemoryRelayDiscovery {
+	return &MemoryRelayDiscovery{
+		now:   time.Now,
+		rooms: map[string]map[string]time.Time{},
+	}
+}
+
+func (d *MemoryRelayDiscovery) Register(room string, addr string, ttl time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	nodes, ok := d.rooms[room]
+	if !ok {
+		nodes = map[string]time.Time{}
+		d.rooms[room] = nodes
+	}
+	nodes[addr] = d.now().Add(ttl)
+	return nil
+}
+
+func (d *MemoryRelayDiscovery) Unregister(room string, addr string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.rooms[room], addr)
+	if len(d.rooms[room]) == 0 {
+		delete(d.rooms, room)
+	}
+	return nil
+}
+
+func (d *MemoryRelayDiscovery) Nodes(room string) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	addrs := []string{}
+	for addr, expires := range d.rooms[room] {
+		if now.Before(expires) {
+			addrs = append(addrs, addr)
+		} else {
+			delete(d.rooms[room], addr)
+		}
+	}
+	return addrs, nil
+}
+
+// redisRegisterRelay adds an instance to the sorted set of a room, removes
+// expired instances and makes sure the set does not expire before the
+// instance.
+var redisRegisterRelay = redis.NewScript(`
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[3])
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[4]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[4])
+end
+return 1
+`)
+
+// RedisRelayDiscovery keeps the instances of each room in a Redis sorted set
+// scored by the expiry time of their registration.
+type RedisRelayDiscovery struct {
+	client *redis.Client
+	prefix string
+}
+
+var _ RelayDiscovery = &RedisRelayDiscovery{}
+
+func NewRedisRelayDiscovery(client *redis.Client, prefix string) *RedisRelayDiscovery {
+	return &RedisRelayDiscovery{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func getRoomNodesName(prefix string, room string) string {
+	// TODO escape room name, what if it has ":" in the name?
+	return prefix + ":room:" + room + ":nodes"
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (d *RedisRelayDiscovery) Register(room string, addr string, ttl time.Duration) error {
+	now := time.Now()
+
+	err := redisRegisterRelay.Run(
+		d.client,
+		[]string{getRoomNodesName(d.prefix, room)},
+		unixMilli(now.Add(ttl)),
+		addr,
+		unixMilli(now),
+		ttl.Milliseconds(),
+	).Err()
+	if err != nil {
+		return fmt.Errorf("Error registering relay: %w", err)
+	}
+	return nil
+}
+
+func (d *RedisRelayDiscovery) Unregister(room string, addr string) error {
+	err := d.client.ZRem(getRoomNodesName(d.prefix, room), addr).Err()
+	if err != nil {
+		return fmt.Errorf("Error unregistering relay: %w", err)
+	}
+	return nil
+}
+
+func (d *RedisRelayDiscovery) Nodes(room string) ([]string, error) {
+	addrs, err := d.client.ZRangeByScore(getRoomNodesName(d.prefix, room), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(unixMilli(time.Now()), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Error finding relays: %w", err)
+	}
+	return addrs, nil
+}
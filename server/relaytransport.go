@@ -0,0 +1,570 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/peer-calls/peer-calls/server/logger"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+type relayPacketType uint8
+
+const (
+	relayPacketTypeRTP relayPacketType = iota + 1
+	relayPacketTypeRTCP
+	// relayPacketTypeTracks contains all tracks forwarded to the other
+	// instance. It is sent whenever the tracks change and periodically, so that
+	// lost packets do not leave tracks behind.
+	relayPacketTypeTracks
+	relayPacketTypeMessage
+)
+
+// relayTransportQueueSize is the number of packets received from the other
+// instance which can be queued for a transport. Packets are dropped when the
+// queue is full so that a room which is slow to read its packets does not
+// stall the other rooms.
+const relayTransportQueueSize = 256
+
+type relayQueuedPacket struct {
+	packetType relayPacketType
+	payload    []byte
+}
+
+// relayTrack is a track forwarded to another instance.
+type relayTrack struct {
+	ClientID    string              `json:"clientId"`
+	PayloadType uint8               `json:"payloadType"`
+	SSRC        uint32              `json:"ssrc"`
+	ID          string              `json:"id"`
+	Label       string              `json:"label"`
+	Kind        webrtc.RTPCodecType `json:"kind"`
+}
+
+func (r relayTrack) trackInfo() TrackInfo {
+	return TrackInfo{
+		PayloadType: r.PayloadType,
+		SSRC:        r.SSRC,
+		ID:          r.ID,
+		Label:       r.Label,
+		Kind:        r.Kind,
+	}
+}
+
+type relayLocalTrack struct {
+	clientID  string
+	trackInfo TrackInfo
+	munger    *RTPMunger
+}
+
+// RelayTransport forwards the tracks published in a room to another server
+// instance, and receives the tracks published on that instance. It is added
+// to the RoomPeersManager of the room like the transport of a client, and
+// exchanges RTP, RTCP, track lists and data channel messages with the other
+// instance through a Relay.
+type RelayTransport struct {
+	log     Logger
+	rtpLog  Logger
+	rtcpLog Logger
+
+	clientID string
+	send     func(packetType relayPacketType, payload []byte) error
+
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	closed  bool
+	closeCh chan struct{}
+
+	localTracks  map[uint32]relayLocalTrack
+	remoteTracks map[uint32]relayTrack
+	// localTrackSSRCBySource contains the SSRCs of local tracks keyed by the
+	// SSRCs of other sources forwarded through them, like simulcast layers.
+	localTrackSSRCBySource map[uint32]uint32
+
+	// queue contains the packets received from the other instance. They are
+	// handled by the goroutine of the transport.
+	queue chan relayQueuedPacket
+
+	trackEventsCh chan TrackEvent
+	rtpCh         chan *rtp.Packet
+	rtcpCh        chan rtcp.Packet
+	messagesCh    chan webrtc.DataChannelMessage
+}
+
+var _ Transport = &RelayTransport{}
+
+// newRelayTransport creates a transport for the instance with addr. Packets
+// for the other instance are written with send.
+func newRelayTransport(
+	loggerFactory LoggerFactory,
+	addr string,
+	send func(packetType relayPacketType, payload []byte) error,
+) *RelayTransport {
+	clientID := "relay:" + addr
+	fields := Fields{"clientId": clientID}
+
+	t := &RelayTransport{
+		log:     loggerFactory.GetLogger("relaytransport").WithFields(fields),
+		rtpLog:  loggerFactory.GetLogger("rtp").WithFields(fields),
+		rtcpLog: loggerFactory.GetLogger("rtcp").WithFields(fields),
+
+		clientID: clientID,
+		send:     send,
+
+		closeCh: make(chan struct{}),
+
+		localTracks:            map[uint32]relayLocalTrack{},
+		remoteTracks:           map[uint32]relayTrack{},
+		localTrackSSRCBySource: map[uint32]uint32{},
+
+		queue: make(chan relayQueuedPacket, relayTransportQueueSize),
+
+		trackEventsCh: make(chan TrackEvent),
+		rtpCh:         make(chan *rtp.Packet),
+		rtcpCh:        make(chan rtcp.Packet),
+		messagesCh:    make(chan webrtc.DataChannelMessage),
+	}
+
+	t.wg.Add(1)
+	go t.processQueue()
+
+	return t
+}
+
+func (t *RelayTransport) ClientID() string {
+	return t.clientID
+}
+
+func (t *RelayTransport) WriteRTCP(packets []rtcp.Packet) error {
+	if t.rtcpLog.IsEnabled(logger.LevelDebug) {
+		t.rtcpLog.Debug("WriteRTCP", Fields{"packets": fmt.Sprint(packets)})
+	}
+	data, err := rtcp.Marshal(packets)
+	if err != nil {
+		return fmt.Errorf("Error marshalling RTCP packets: %w", err)
+	}
+	err = t.send(relayPacketTypeRTCP, data)
+	if err == nil {
+		prometheusRTCPPacketsSent.WithLabelValues(metricsNetworkRelay).Inc()
+	}
+	return err
+}
+
+// WriteRTP writes a packet to the local track added for the packet's SSRC.
+// Packets from other sources previously written using WriteTrackRTP, for
+// example retransmissions, are written to the same local track.
+func (t *RelayTransport) WriteRTP(packet *rtp.Packet) (int, error) {
+	t.mu.Lock()
+	trackSSRC, ok := t.localTrackSSRCBySource[packet.SSRC]
+	t.mu.Unlock()
+
+	if !ok {
+		trackSSRC = packet.SSRC
+	}
+
+	return t.WriteTrackRTP(trackSSRC, packet)
+}
+
+// WriteTrackRTP writes a packet to the local track added for trackSSRC.
+// Packets from other sources, like simulcast layers, are rewritten so that
+// the other instance receives a single continuous track with trackSSRC.
+func (t *RelayTransport) WriteTrackRTP(trackSSRC uint32, packet *rtp.Packet) (int, error) {
+	if t.rtpLog.IsEnabled(logger.LevelDebug) {
+		t.rtpLog.Debug("WriteRTP", Fields{"packet": packet.String()})
+	}
+
+	t.mu.Lock()
+	lt, ok := t.localTracks[trackSSRC]
+	if !ok {
+		t.mu.Unlock()
+		return 0, fmt.Errorf("Track not found: %d", trackSSRC)
+	}
+
+	if packet.SSRC != trackSSRC {
+		t.localTrackSSRCBySource[packet.SSRC] = trackSSRC
+	}
+
+	munged, ok := lt.munger.MungeRetransmission(packet)
+	if !ok {
+		munged, ok = lt.munger.Munge(packet)
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		// track is paused
+		return 0, nil
+	}
+
+	data, err := munged.Marshal()
+	if err != nil {
+		return 0, fmt.Errorf("Error marshalling RTP packet: %w", err)
+	}
+
+	if err := t.send(relayPacketTypeRTP, data); err != nil {
+		return 0, err
+	}
+
+	prometheusRTPPacketsSent.WithLabelValues(metricsNetworkRelay).Inc()
+	prometheusRTPPacketsSentBytes.WithLabelValues(metricsNetworkRelay).Add(float64(len(data)))
+	return len(data), nil
+}
+
+// PauseTrack stops forwarding packets to the local track until ResumeTrack
+// is called.
+func (t *RelayTransport) PauseTrack(ssrc uint32) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lt, ok := t.localTracks[ssrc]
+	if !ok {
+		return fmt.Errorf("Track not found: %d", ssrc)
+	}
+
+	lt.munger.Pause()
+	return nil
+}
+
+// ResumeTrack resumes forwarding packets to a paused local track.
+func (t *RelayTransport) ResumeTrack(ssrc uint32) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lt, ok := t.localTracks[ssrc]
+	if !ok {
+		return fmt.Errorf("Track not found: %d", ssrc)
+	}
+
+	lt.munger.Resume()
+	return nil
+}
+
+// AddTrack adds a local track for forwarding the track published by
+// clientID to the other instance. The local track keeps the SSRC of the
+// remote track.
+func (t *RelayTransport) AddTrack(clientID string, track TrackInfo) error {
+	t.mu.Lock()
+	t.localTracks[track.SSRC] = relayLocalTrack{
+		clientID:  clientID,
+		trackInfo: track,
+		munger:    NewRTPMunger(track.SSRC, relayClockRate(track.Kind)),
+	}
+	t.mu.Unlock()
+
+	return t.sendTracks()
+}
+
+func (t *RelayTransport) RemoveTrack(ssrc uint32) error {
+	t.mu.Lock()
+	if _, ok := t.localTracks[ssrc]; !ok {
+		t.mu.Unlock()
+		return fmt.Errorf("Track not found: %d", ssrc)
+	}
+
+	delete(t.localTracks, ssrc)
+	for sourceSSRC, trackSSRC := range t.localTrackSSRCBySource {
+		if trackSSRC == ssrc {
+			delete(t.localTrackSSRCBySource, sourceSSRC)
+		}
+	}
+	t.mu.Unlock()
+
+	return t.sendTracks()
+}
+
+// relayClockRate returns the clock rate of the codecs registered by
+// RegisterCodecs.
+func relayClockRate(kind webrtc.RTPCodecType) uint32 {
+	if kind == webrtc.RTPCodecTypeAudio {
+		return 48000
+	}
+	return 90000
+}
+
+// sendTracks sends the list of local tracks to the other instance.
+func (t *RelayTransport) sendTracks() error {
+	t.mu.Lock()
+	tracks := make([]relayTrack, 0, len(t.localTracks))
+	for _, lt := range t.localTracks {
+		tracks = append(tracks, relayTrack{
+			ClientID:    lt.clientID,
+			PayloadType: lt.trackInfo.PayloadType,
+			SSRC:        lt.trackInfo.SSRC,
+			ID:          lt.trackInfo.ID,
+			Label:       lt.trackInfo.Label,
+			Kind:        lt.trackInfo.Kind,
+		})
+	}
+	t.mu.Unlock()
+
+	data, err := json.Marshal(tracks)
+	if err != nil {
+		return fmt.Errorf("Error marshalling relay tracks: %w", err)
+	}
+	return t.send(relayPacketTypeTracks, data)
+}
+
+// SendMessage sends a data channel message to the other instance, which
+// broadcasts it to its clients.
+func (t *RelayTransport) SendMessage(msg webrtc.DataChannelMessage) error {
+	data := make([]byte, 1+len(msg.Data))
+	if msg.IsString {
+		data[0] = 1
+	}
+	copy(data[1:], msg.Data)
+	return t.send(relayPacketTypeMessage, data)
+}
+
+// RemoteTracks returns the tracks received from the other instance.
+func (t *RelayTransport) RemoteTracks() []TrackInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]TrackInfo, 0, len(t.remoteTracks))
+	for _, track := range t.remoteTracks {
+		list = append(list, track.trackInfo())
+	}
+	return list
+}
+
+// LocalTracks returns the tracks forwarded to the other instance.
+func (t *RelayTransport) LocalTracks() []TrackInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]TrackInfo, 0, len(t.localTracks))
+	for _, lt := range t.localTracks {
+		list = append(list, lt.trackInfo)
+	}
+	return list
+}
+
+func (t *RelayTransport) TrackEventsChannel() <-chan TrackEvent {
+	return t.trackEventsCh
+}
+
+func (t *RelayTransport) RTPChannel() <-chan *rtp.Packet {
+	return t.rtpCh
+}
+
+func (t *RelayTransport) RTCPChannel() <-chan rtcp.Packet {
+	return t.rtcpCh
+}
+
+func (t *RelayTransport) MessagesChannel() <-chan webrtc.DataChannelMessage {
+	return t.messagesCh
+}
+
+// enqueue queues a packet received from the other instance without
+// blocking. It returns false when the packet was dropped because the queue is
+// full.
+func (t *RelayTransport) enqueue(packetType relayPacketType, payload []byte) bool {
+	select {
+	case t.queue <- relayQueuedPacket{packetType, payload}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *RelayTransport) processQueue() {
+	defer t.wg.Done()
+
+	for {
+		select {
+		case packet := <-t.queue:
+			if err := t.handle(packet.packetType, packet.payload); err != nil {
+				t.log.Error("Error handling relay packet", Fields{"error": err})
+			}
+		case <-t.closeCh:
+			return
+		}
+	}
+}
+
+// handle handles a packet received from the other instance. It blocks until
+// the packet has been read from the transport's channels or the transport is
+// closed.
+func (t *RelayTransport) handle(packetType relayPacketType, payload []byte) error {
+	switch packetType {
+	case relayPacketTypeRTP:
+		return t.handleRTP(payload)
+	case relayPacketTypeRTCP:
+		return t.handleRTCP(payload)
+	case relayPacketTypeTracks:
+		return t.handleTracks(payload)
+	case relayPacketTypeMessage:
+		if len(payload) == 0 {
+			return fmt.Errorf("Empty relay message")
+		}
+		msg := webrtc.DataChannelMessage{
+			IsString: payload[0] == 1,
+			Data:     payload[1:],
+		}
+		select {
+		case t.messagesCh <- msg:
+		case <-t.closeCh:
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown relay packet type: %d", packetType)
+	}
+}
+
+func (t *RelayTransport) handleRTP(payload []byte) error {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(payload); err != nil {
+		return fmt.Errorf("Error unmarshalling RTP packet: %w", err)
+	}
+
+	t.mu.Lock()
+	_, ok := t.remoteTracks[packet.SSRC]
+	t.mu.Unlock()
+
+	if !ok {
+		// the list of tracks has not been received yet
+		return nil
+	}
+
+	prometheusRTPPacketsReceived.WithLabelValues(metricsNetworkRelay).Inc()
+	prometheusRTPPacketsReceivedBytes.WithLabelValues(metricsNetworkRelay).Add(float64(len(payload)))
+	if t.rtpLog.IsEnabled(logger.LevelDebug) {
+		t.rtpLog.Debug("ReadRTP", Fields{"packet": packet.String()})
+	}
+
+	select {
+	case t.rtpCh <- packet:
+	case <-t.closeCh:
+	}
+	return nil
+}
+
+// handleRTCP handles feedback for the local tracks. Only the sequence numbers
+// in NACKs need to be translated because the local tracks keep the SSRCs of
+// the remote tracks.
+func (t *RelayTransport) handleRTCP(payload []byte) error {
+	packets, err := rtcp.Unmarshal(payload)
+	if err != nil {
+		return fmt.Errorf("Error unmarshalling RTCP packets: %w", err)
+	}
+
+	for _, packet := range packets {
+		if t.rtcpLog.IsEnabled(logger.LevelDebug) {
+			t.rtcpLog.Debug("ReadRTCP", Fields{"packet": fmt.Sprint(packet)})
+		}
+		prometheusRTCPPacketsReceived.WithLabelValues(metricsNetworkRelay).Inc()
+
+		unmunged := []rtcp.Packet{packet}
+		if nack, ok := packet.(*rtcp.TransportLayerNack); ok {
+			t.mu.Lock()
+			lt, ok := t.localTracks[nack.MediaSSRC]
+			t.mu.Unlock()
+			if ok {
+				unmunged = unmungeRTCP(nack, nack.MediaSSRC, lt.munger)
+			}
+		}
+
+		for _, packet := range unmunged {
+			select {
+			case t.rtcpCh <- packet:
+			case <-t.closeCh:
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// handleTracks compares the tracks forwarded by the other instance with the
+// tracks received before and emits events for added and removed tracks.
+func (t *RelayTransport) handleTracks(payload []byte) error {
+	var tracks []relayTrack
+	if err := json.Unmarshal(payload, &tracks); err != nil {
+		return fmt.Errorf("Error unmarshalling relay tracks: %w", err)
+	}
+
+	events := []TrackEvent{}
+
+	t.mu.Lock()
+	received := make(map[uint32]relayTrack, len(tracks))
+	for _, track := range tracks {
+		received[track.SSRC] = track
+		if _, ok := t.remoteTracks[track.SSRC]; !ok {
+			t.remoteTracks[track.SSRC] = track
+			events = append(events, TrackEvent{
+				TrackInfo: track.trackInfo(),
+				Type:      TrackEventTypeAdd,
+				ClientID:  track.ClientID,
+			})
+		}
+	}
+	for ssrc, track := range t.remoteTracks {
+		if _, ok := received[ssrc]; !ok {
+			delete(t.remoteTracks, ssrc)
+			events = append(events, TrackEvent{
+				TrackInfo: track.trackInfo(),
+				Type:      TrackEventTypeRemove,
+				ClientID:  track.ClientID,
+			})
+		}
+	}
+	t.mu.Unlock()
+
+	for _, event := range events {
+		t.log.Debug("Relayed track event", Fields{
+			"type":          event.Type,
+			"ssrc":          event.SSRC,
+			"trackClientId": event.ClientID,
+		})
+		select {
+		case t.trackEventsCh <- event:
+		case <-t.closeCh:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Close removes the tracks received from the other instance and closes the
+// channels. An empty list of tracks is sent to the other instance so that it
+// removes the forwarded tracks without waiting for this instance to leave the
+// room.
+func (t *RelayTransport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.closeCh)
+	t.localTracks = map[uint32]relayLocalTrack{}
+	t.mu.Unlock()
+
+	err := t.sendTracks()
+
+	// do not close channels before the queue is no longer processed
+	t.wg.Wait()
+
+	t.mu.Lock()
+	remoteTracks := t.remoteTracks
+	t.remoteTracks = map[uint32]relayTrack{}
+	t.mu.Unlock()
+
+	for _, track := range remoteTracks {
+		t.trackEventsCh <- TrackEvent{
+			TrackInfo: track.trackInfo(),
+			Type:      TrackEventTypeRemove,
+			ClientID:  track.ClientID,
+		}
+	}
+
+	close(t.trackEventsCh)
+	close(t.rtpCh)
+	close(t.rtcpCh)
+	close(t.messagesCh)
+	return err
+}
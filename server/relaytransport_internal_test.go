@@ -0,0 +1,53 @@
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/peer-calls/peer-calls/server/logger"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestRelayTransport_enqueue_doesNotBlock(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	loggerFactory := logger.NewFactoryFromEnv("PEERCALLS_", os.Stdout)
+	transport := newRelayTransport(loggerFactory, "127.0.0.1:3002", func(relayPacketType, []byte) error {
+		return nil
+	})
+	// the track events are read by the room, but its RTP packets are not.
+	go func() {
+		for range transport.TrackEventsChannel() {
+		}
+	}()
+
+	require.NoError(t, transport.handleTracks([]byte(`[{"ssrc":1000,"kind":1}]`)))
+
+	packet := rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 1000}}
+	payload, err := packet.Marshal()
+	require.NoError(t, err)
+
+	done := make(chan bool, 1)
+	go func() {
+		dropped := false
+		for i := 0; i < relayTransportQueueSize+10; i++ {
+			if !transport.enqueue(relayPacketTypeRTP, payload) {
+				dropped = true
+			}
+		}
+		done <- dropped
+	}()
+
+	select {
+	case dropped := <-done:
+		assert.True(t, dropped, "packets dropped when the queue is full")
+	case <-time.After(time.Second):
+		assert.Fail(t, "enqueue blocked by a transport which is not read")
+	}
+
+	assert.NoError(t, transport.Close())
+}
@@ -96,3 +96,16 @@ func (r *TrackBitrateEstimators) Remove(ssrc uint32) {
 
 	delete(r.estimators, ssrc)
 }
+
+// Bitrate returns the lowest estimate of the receivers of a track, or false
+// when no receiver has sent an estimate for it.
+func (r *TrackBitrateEstimators) Bitrate(ssrc uint32) (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	estimator, ok := r.estimators[ssrc]
+	if !ok || estimator.bitrate == math.MaxUint64 {
+		return 0, false
+	}
+	return estimator.bitrate, true
+}
@@ -38,13 +38,13 @@ func (tr *Renderer) Render(h PageHandler) http.HandlerFunc {
 		}
 		template, ok := tr.templates.Get(templateName)
 		if !ok {
-			tr.log.Println("Template not found:", templateName)
+			tr.log.Error("Template not found", Fields{"template": templateName})
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
 		if err != nil {
-			tr.log.Println("An error occurred:", err)
+			tr.log.Error("An error occurred", Fields{"error": err})
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 
@@ -56,10 +56,13 @@ func (tr *Renderer) Render(h PageHandler) http.HandlerFunc {
 
 		buf := tr.bufPool.Get()
 		defer tr.bufPool.Put(buf)
-		tr.log.Println("Rendering template:", templateName)
+		tr.log.Debug("Rendering template", Fields{"template": templateName})
 		err = template.Execute(buf, dataMap)
 		if err != nil {
-			tr.log.Println("Error rendering template", templateName, err)
+			tr.log.Error("Error rendering template", Fields{
+				"template": templateName,
+				"error":    err,
+			})
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// DefaultResumeTimeout is the time clients have to resume their session after
+// their websocket connection drops when no timeout is configured.
+const DefaultResumeTimeout = 30 * time.Second
+
+// resumableClientBufferSize is the maximum number of messages kept for a
+// client while it is reconnecting. The session ends when more messages are
+// written, because the client could not continue without them.
+const resumableClientBufferSize = 256
+
+var (
+	ErrSessionNotFound    = errors.New("Session not found")
+	ErrSessionActive      = errors.New("Session is active")
+	ErrInvalidResumeToken = errors.New("Invalid resume token")
+	ErrResumeBufferFull   = errors.New("Resume buffer full")
+)
+
+// ResumableSessions keeps the sessions of clients whose websocket connection
+// dropped, so that they can reconnect with a resume token and continue where
+// they left off. The client stays in the room while it is reconnecting.
+type ResumableSessions struct {
+	log     Logger
+	timeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*resumableSession
+}
+
+func NewResumableSessions(loggerFactory LoggerFactory, timeout time.Duration) *ResumableSessions {
+	return &ResumableSessions{
+		log:      loggerFactory.GetLogger("sessions"),
+		timeout:  timeout,
+		sessions: map[string]*resumableSession{},
+	}
+}
+
+// Timeout returns the time clients have to resume their session.
+func (s *ResumableSessions) Timeout() time.Duration {
+	return s.timeout
+}
+
+type resumableSession struct {
+	room     string
+	clientID string
+	userID   string
+	token    string
+
+	client   *resumableClient
+	adapter  Adapter
+	messages chan Message
+	// version of the protocol negotiated with the client, which is updated
+	// when the client resumes the session.
+	version *protocolVersion
+	// teardown removes the client from the room and closes the messages
+	// channel. It is called once, when the session ends.
+	teardown func()
+
+	suspended bool
+	timer     *time.Timer
+}
+
+func (r *resumableSession) key() string {
+	return r.room + "/" + r.clientID
+}
+
+// add registers a new session. A suspended session of the same client is
+// ended because the client did not resume it.
+func (s *ResumableSessions) add(session *resumableSession) {
+	s.mu.Lock()
+	session.token = NewUUIDBase62()
+	old, ok := s.sessions[session.key()]
+	if ok && old.suspended {
+		old.timer.Stop()
+	} else {
+		ok = false
+	}
+	s.sessions[session.key()] = session
+	s.mu.Unlock()
+
+	if ok {
+		s.log.Info("Ending suspended session because a new one was started", Fields{
+			"room":     old.room,
+			"clientId": old.clientID,
+		})
+		old.teardown()
+	}
+}
+
+// resume returns the suspended session of a client and issues a new resume
+// token for it.
+func (s *ResumableSessions) resume(room, clientID, userID, token string) (*resumableSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[room+"/"+clientID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if subtle.ConstantTimeCompare([]byte(session.token), []byte(token)) != 1 ||
+		session.userID != userID {
+		return nil, ErrInvalidResumeToken
+	}
+	if !session.suspended {
+		return nil, ErrSessionActive
+	}
+	if !session.client.resumable() {
+		// the session is being ended, see resumableClient.Write.
+		return nil, ErrResumeBufferFull
+	}
+
+	session.suspended = false
+	session.timer.Stop()
+	session.token = NewUUIDBase62()
+	return session, nil
+}
+
+// suspend keeps the session until the client resumes it or the timeout
+// expires. It returns false when the session cannot be resumed.
+func (s *ResumableSessions) suspend(session *resumableSession) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timeout <= 0 || s.sessions[session.key()] != session {
+		return false
+	}
+
+	if !session.client.detach() {
+		s.log.Warn("Session cannot be resumed because messages were lost", Fields{
+			"room":     session.room,
+			"clientId": session.clientID,
+		})
+		return false
+	}
+	session.suspended = true
+	session.timer = time.AfterFunc(s.timeout, func() {
+		s.expire(session)
+	})
+	return true
+}
+
+// expire ends a suspended session.
+func (s *ResumableSessions) expire(session *resumableSession) {
+	s.mu.Lock()
+	if s.sessions[session.key()] != session || !session.suspended {
+		s.mu.Unlock()
+		return
+	}
+	session.timer.Stop()
+	delete(s.sessions, session.key())
+	s.mu.Unlock()
+
+	s.log.Info("Session expired", Fields{
+		"room":     session.room,
+		"clientId": session.clientID,
+	})
+	session.teardown()
+}
+
+// remove forgets an active session which has ended.
+func (s *ResumableSessions) remove(session *resumableSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sessions[session.key()] == session {
+		delete(s.sessions, session.key())
+	}
+}
+
+// token returns the current resume token of a session.
+func (s *ResumableSessions) token(session *resumableSession) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return session.token
+}
+
+// resumableClient is added to the room adapter instead of the websocket
+// client when sessions can be resumed, so that the client does not leave the
+// room while it is reconnecting. Messages written while the client is
+// reconnecting are buffered and sent after it resumes the session.
+type resumableClient struct {
+	log Logger
+	id  string
+	// end is called when a suspended client is disconnected, for example when
+	// it is kicked, or when its buffer is full.
+	end func()
+
+	// writeMu keeps the messages in order. It is held while writing to the
+	// connection, which can block, so mu is not held while writing.
+	writeMu sync.Mutex
+
+	mu         sync.Mutex
+	client     ClientWriter
+	disconnect func(status websocket.StatusCode, reason string)
+	metadata   string
+	buffer     []Message
+	// overflowed is set when a message could not be buffered. The session
+	// cannot be resumed after that.
+	overflowed bool
+}
+
+var _ ClientWriter = &resumableClient{}
+
+func (c *resumableClient) ID() string {
+	return c.id
+}
+
+func (c *resumableClient) Metadata() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.metadata
+}
+
+func (c *resumableClient) SetMetadata(metadata string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metadata = metadata
+}
+
+// Write writes the message to the current connection. Messages which cannot
+// be written are buffered because the connection might have dropped. When the
+// buffer is full the session is ended instead of dropping messages.
+func (c *resumableClient) Write(message Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.mu.Lock()
+	client := c.client
+	c.mu.Unlock()
+
+	if client != nil && client.Write(message) == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.overflowed {
+		return fmt.Errorf("Error writing %s message: %w", message.Type, ErrResumeBufferFull)
+	}
+
+	if len(c.buffer) == resumableClientBufferSize {
+		c.log.Warn("Resume buffer full, ending session", Fields{"type": message.Type})
+		c.overflowed = true
+		c.buffer = nil
+		if c.client == nil {
+			// the session is suspended. It is ended asynchronously because
+			// the adapter might be locked while the message is written.
+			go c.end()
+		}
+		return fmt.Errorf("Error writing %s message: %w", message.Type, ErrResumeBufferFull)
+	}
+
+	c.buffer = append(c.buffer, message)
+	return nil
+}
+
+// Disconnect closes the current connection, or ends the session when the
+// client is reconnecting.
+func (c *resumableClient) Disconnect(status websocket.StatusCode, reason string) {
+	c.mu.Lock()
+	disconnect := c.disconnect
+	c.mu.Unlock()
+
+	if disconnect == nil {
+		c.end()
+		return
+	}
+	disconnect(status, reason)
+}
+
+func (c *resumableClient) attach(client ClientWriter, disconnect func(status websocket.StatusCode, reason string)) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.mu.Lock()
+	c.client = client
+	c.disconnect = disconnect
+	buffer := c.buffer
+	c.buffer = nil
+	c.mu.Unlock()
+
+	for i, message := range buffer {
+		if err := client.Write(message); err != nil {
+			c.mu.Lock()
+			// nothing else is buffered while writeMu is held.
+			c.buffer = buffer[i:]
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+// resumable returns false when messages were lost.
+func (c *resumableClient) resumable() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.overflowed
+}
+
+// detach forgets the current connection. It returns false when the session
+// cannot be resumed because messages were lost.
+func (c *resumableClient) detach() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.client = nil
+	c.disconnect = nil
+	return !c.overflowed
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/peer-calls/peer-calls/server/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingClient blocks writes until unblock is closed, like a websocket
+// connection whose peer does not read.
+type blockingClient struct {
+	writing chan struct{}
+	unblock chan struct{}
+}
+
+func (c *blockingClient) ID() string                  { return "client1" }
+func (c *blockingClient) Metadata() string            { return "" }
+func (c *blockingClient) SetMetadata(metadata string) {}
+
+func (c *blockingClient) Write(message Message) error {
+	c.writing <- struct{}{}
+	<-c.unblock
+	return nil
+}
+
+func newTestResumableClient(end func()) *resumableClient {
+	return &resumableClient{
+		log: logger.NewFactoryFromEnv("PEERCALLS_", os.Stdout).GetLogger("sessions"),
+		id:  "client1",
+		end: end,
+	}
+}
+
+func TestResumableClient_Write_doesNotBlockMetadata(t *testing.T) {
+	client := &blockingClient{
+		writing: make(chan struct{}, 1),
+		unblock: make(chan struct{}),
+	}
+	c := newTestResumableClient(func() {})
+	c.attach(client, nil)
+	c.SetMetadata("metadata")
+
+	written := make(chan error, 1)
+	go func() {
+		written <- c.Write(NewMessage("test", "room1", nil))
+	}()
+	<-client.writing
+
+	metadata := make(chan string, 1)
+	go func() {
+		metadata <- c.Metadata()
+	}()
+
+	select {
+	case value := <-metadata:
+		assert.Equal(t, "metadata", value)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Metadata blocked by Write")
+	}
+
+	close(client.unblock)
+	assert.NoError(t, <-written)
+}
+
+func TestResumableClient_Write_bufferFull(t *testing.T) {
+	ended := make(chan struct{})
+	c := newTestResumableClient(func() {
+		close(ended)
+	})
+	require.True(t, c.detach())
+
+	for i := 0; i < resumableClientBufferSize; i++ {
+		require.NoError(t, c.Write(NewMessage("test", "room1", i)))
+	}
+
+	err := c.Write(NewMessage("signal", "room1", nil))
+	assert.True(t, errors.Is(err, ErrResumeBufferFull), "expected ErrResumeBufferFull, got: %s", err)
+
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		assert.Fail(t, "session not ended when buffer was full")
+	}
+
+	assert.False(t, c.resumable())
+	assert.False(t, c.detach())
+}
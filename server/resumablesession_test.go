@@ -0,0 +1,206 @@
+package server_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peer-calls/peer-calls/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"nhooyr.io/websocket"
+)
+
+// setupResumeServer creates a server which echoes messages through the room
+// adapter, and replies to version messages with the protocol version of the
+// subscription. A value is sent to ended when a subscription ends.
+func setupResumeServer(t *testing.T, resumeTimeout time.Duration) (url string, ended <-chan string, cleanup func()) {
+	newAdapter := server.NewAdapterFactory(loggerFactory, server.StoreConfig{})
+	rooms := server.NewAdapterRoomManager(newAdapter.NewAdapter)
+	sessions := server.NewResumableSessions(loggerFactory, resumeTimeout)
+	wss := server.NewWSS(loggerFactory, rooms, nil, nil, sessions, nil)
+
+	endedCh := make(chan string, 10)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sub, err := wss.Subscribe(w, r)
+		if err != nil {
+			return
+		}
+		if sub.Resumed {
+			for range sub.Messages {
+			}
+			return
+		}
+		for msg := range sub.Messages {
+			if msg.Type == "version" {
+				msg = server.NewMessage("version", msg.Room, sub.Version())
+			}
+			_ = sub.Adapter.Emit(sub.ClientID, msg)
+		}
+		endedCh <- sub.ClientID
+	}))
+
+	url = "ws" + strings.TrimPrefix(s.URL, "http") + "/ws/" + room + "/"
+	return url, endedCh, func() {
+		s.Close()
+		newAdapter.Close()
+	}
+}
+
+// dialDroppable dials a websocket connection and returns a function which
+// closes the underlying TCP connection without a close handshake, like a
+// load balancer which cuts idle connections.
+func dialDroppable(t *testing.T, ctx context.Context, url string) (ws *websocket.Conn, drop func()) {
+	t.Helper()
+	var conn net.Conn
+	var dialer net.Dialer
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				c, err := dialer.DialContext(ctx, network, addr)
+				conn = c
+				return c, err
+			},
+		},
+	}
+	ws, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{HTTPClient: client})
+	require.NoError(t, err)
+	return ws, func() {
+		conn.Close()
+		// releases the resources of the client, the close frame cannot be sent
+		_ = ws.Close(websocket.StatusNormalClosure, "")
+	}
+}
+
+func readResumeToken(t *testing.T, ctx context.Context, ws *websocket.Conn) string {
+	t.Helper()
+	msg := readWSType(t, ctx, ws, "resume_token")
+	payload, ok := msg.Payload.(map[string]interface{})
+	require.True(t, ok, "unexpected payload: %#v", msg.Payload)
+	token, _ := payload["resumeToken"].(string)
+	require.NotEqual(t, "", token)
+	return token
+}
+
+func assertNotEnded(t *testing.T, ended <-chan string) {
+	t.Helper()
+	select {
+	case clientID := <-ended:
+		t.Errorf("subscription of %s ended", clientID)
+	default:
+	}
+}
+
+func TestWSS_resume(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	url, ended, cleanup := setupResumeServer(t, 5*time.Second)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	other := mustDialWS(t, ctx, url+"client2")
+	defer other.Close(websocket.StatusNormalClosure, "")
+	readResumeToken(t, ctx, other)
+
+	ws, drop := dialDroppable(t, ctx, url+"client1")
+	readResumeToken(t, ctx, ws)
+	readWSType(t, ctx, other, server.MessageTypeRoomJoin)
+	drop()
+
+	ws, _, err := websocket.Dial(ctx, url+"client1?resume_token=invalid", nil)
+	require.NoError(t, err)
+	readResumeToken(t, ctx, ws)
+	assert.Equal(t, "client1", <-ended, "suspended session ends when a new one is started")
+	ws.Close(websocket.StatusNormalClosure, "")
+	assert.Equal(t, "client1", <-ended)
+	readWSType(t, ctx, other, server.MessageTypeRoomLeave)
+	readWSType(t, ctx, other, server.MessageTypeRoomJoin)
+	readWSType(t, ctx, other, server.MessageTypeRoomLeave)
+
+	ws, drop = dialDroppable(t, ctx, url+"client1")
+	token := readResumeToken(t, ctx, ws)
+	readWSType(t, ctx, other, server.MessageTypeRoomJoin)
+	drop()
+
+	ws, _, err = websocket.Dial(ctx, url+"client1?resume_token="+token, nil)
+	require.NoError(t, err)
+	defer ws.Close(websocket.StatusNormalClosure, "")
+	assert.NotEqual(t, token, readResumeToken(t, ctx, ws))
+	assertEcho(t, ctx, ws)
+	assertNotEnded(t, ended)
+
+	// the other client did not see client1 leave or join the room
+	mustWriteWS(t, ctx, other, server.NewMessage("echo", room, nil))
+	assert.Equal(t, "echo", mustReadWS(t, ctx, other).Type)
+
+	ws.Close(websocket.StatusNormalClosure, "")
+	assert.Equal(t, "client1", <-ended)
+	other.Close(websocket.StatusNormalClosure, "")
+	assert.Equal(t, "client2", <-ended)
+}
+
+func TestWSS_resume_version(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	url, ended, cleanup := setupResumeServer(t, 5*time.Second)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ws, drop := dialDroppable(t, ctx, url+"client1")
+	token := readResumeToken(t, ctx, ws)
+	mustWriteWS(t, ctx, ws, server.NewMessage("version", room, nil))
+	assert.Equal(t, float64(server.ProtocolVersion1), readWSType(t, ctx, ws, "version").Payload)
+	drop()
+
+	ws = mustDialWSVersion(t, ctx, url+"client1?resume_token="+token, server.ProtocolVersion2)
+	defer ws.Close(websocket.StatusNormalClosure, "")
+	readResumeToken(t, ctx, ws)
+	mustWriteWS(t, ctx, ws, server.NewMessage("version", room, nil))
+	assert.Equal(t, float64(server.ProtocolVersion2), readWSType(t, ctx, ws, "version").Payload)
+	assertNotEnded(t, ended)
+
+	ws.Close(websocket.StatusNormalClosure, "")
+	assert.Equal(t, "client1", <-ended)
+}
+
+func TestWSS_resume_timeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	url, ended, cleanup := setupResumeServer(t, 100*time.Millisecond)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ws, drop := dialDroppable(t, ctx, url+"client1")
+	token := readResumeToken(t, ctx, ws)
+	drop()
+
+	assert.Equal(t, "client1", <-ended)
+
+	ws, _, err := websocket.Dial(ctx, url+"client1?resume_token="+token, nil)
+	require.NoError(t, err)
+	defer ws.Close(websocket.StatusNormalClosure, "")
+	readResumeToken(t, ctx, ws)
+	assertEcho(t, ctx, ws)
+	ws.Close(websocket.StatusNormalClosure, "")
+	assert.Equal(t, "client1", <-ended)
+}
+
+func TestWSS_resume_normalClosure(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	url, ended, cleanup := setupResumeServer(t, 5*time.Second)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ws := mustDialWS(t, ctx, url+"client1")
+	readResumeToken(t, ctx, ws)
+	ws.Close(websocket.StatusNormalClosure, "")
+
+	assert.Equal(t, "client1", <-ended, "sessions closed by the client are not resumable")
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"sort"
 	"sync"
 )
 
@@ -52,3 +53,14 @@ func (r *AdapterRoomManager) Exit(room string) {
 	}
 	r.roomsMu.Unlock()
 }
+
+func (r *AdapterRoomManager) Rooms() []string {
+	r.roomsMu.RLock()
+	rooms := make([]string, 0, len(r.rooms))
+	for room := range r.rooms {
+		rooms = append(rooms, room)
+	}
+	r.roomsMu.RUnlock()
+	sort.Strings(rooms)
+	return rooms
+}
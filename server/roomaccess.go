@@ -0,0 +1,676 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"nhooyr.io/websocket"
+)
+
+const (
+	roomPasswordTimeout = time.Minute
+	roomLobbyTimeout    = 10 * time.Minute
+	roomKickBanDuration = 10 * time.Minute
+)
+
+// Messages sent by moderators to other clients through the Adapter. They are
+// handled by the server instance the client is connected to and are never
+// written to the websocket.
+const (
+	messageTypeKick              = "ws_kick"
+	messageTypeEndMeeting        = "ws_end_meeting"
+	messageTypeModeratorTransfer = "ws_moderator_transfer"
+)
+
+var errConnectionClosed = errors.New("Connection closed")
+
+// AccessDeniedError is returned when a client is not allowed to join a
+// room. The websocket connection is closed with Status and Reason.
+type AccessDeniedError struct {
+	Status websocket.StatusCode
+	Reason string
+}
+
+func (e *AccessDeniedError) Error() string {
+	return fmt.Sprintf("Access denied: %s", e.Reason)
+}
+
+func accessDenied(status websocket.StatusCode, reason string) error {
+	return &AccessDeniedError{Status: status, Reason: reason}
+}
+
+// RoomAccess decides who can join a room. The creator of a room can always
+// join. Everyone else is rejected when the room is locked, must send the
+// password when the room has one, and has to wait in the lobby until the
+// creator admits them when the lobby is enabled.
+//
+// Waiting clients are added to a separate lobby adapter so that the creator
+// can admit them from any server instance.
+//
+// The creator is the moderator of the room and can kick participants, ask
+// them to mute, end the meeting and make another user the moderator.
+type RoomAccess struct {
+	log       Logger
+	rooms     RoomManager
+	roomStore RoomStore
+	// deserializer decodes the payloads of the messages read from clients.
+	deserializer Deserializer
+}
+
+func NewRoomAccess(loggerFactory LoggerFactory, rooms RoomManager, roomStore RoomStore) *RoomAccess {
+	return &RoomAccess{
+		log:       loggerFactory.GetLogger("roomaccess"),
+		rooms:     rooms,
+		roomStore: roomStore,
+
+		deserializer: ByteSerializer{},
+	}
+}
+
+// lobbyRoomName cannot clash with real rooms because room names never
+// contain a slash.
+func lobbyRoomName(room string) string {
+	return room + "/lobby"
+}
+
+func hashRoomPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("Error hashing room password: %w", err)
+	}
+	return string(hash), nil
+}
+
+func checkRoomPassword(passwordHash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)) == nil
+}
+
+// isModerator returns true for the creator of the room and users with the
+// moderator role. Viewers can never moderate a room.
+func isModerator(identity Identity, info RoomInfo) bool {
+	switch identity.Role() {
+	case RoleModerator:
+		return true
+	case RoleViewer:
+		return false
+	default:
+		return identity.UserID != "" && identity.UserID == info.CreatorID
+	}
+}
+
+// Admit blocks until the client is allowed to join the room and returns an
+// AccessDeniedError when it is not. Messages received while waiting are
+// consumed.
+func (a *RoomAccess) Admit(
+	ctx context.Context,
+	adapter Adapter,
+	client ClientWriter,
+	messages <-chan Message,
+	room string,
+	identity Identity,
+) error {
+	info, err := a.roomStore.Get(room)
+	if errors.Is(err, ErrRoomNotFound) {
+		return nil
+	}
+	if err != nil {
+		a.log.Error("Error retrieving room", Fields{
+			"room":     room,
+			"clientId": client.ID(),
+			"error":    err,
+		})
+		return accessDenied(websocket.StatusInternalError, "Error retrieving room")
+	}
+
+	if isModerator(identity, info) {
+		return nil
+	}
+
+	for _, id := range []string{client.ID(), identity.UserID} {
+		if id == "" {
+			continue
+		}
+		banned, err := a.roomStore.Banned(room, id)
+		if err != nil {
+			a.log.Error("Error checking ban in room", Fields{
+				"room":     room,
+				"clientId": client.ID(),
+				"error":    err,
+			})
+			return accessDenied(websocket.StatusInternalError, "Error retrieving room")
+		}
+		if banned {
+			return accessDenied(websocket.StatusPolicyViolation, "Kicked from room")
+		}
+	}
+
+	if info.Locked {
+		return accessDenied(websocket.StatusPolicyViolation, "Room is locked")
+	}
+
+	if info.PasswordHash != "" {
+		if err := a.waitForPassword(ctx, client, messages, room, info.PasswordHash); err != nil {
+			return err
+		}
+	}
+
+	if info.Lobby {
+		return a.waitInLobby(ctx, adapter, client, messages, room)
+	}
+
+	return nil
+}
+
+func (a *RoomAccess) waitForPassword(
+	ctx context.Context,
+	client ClientWriter,
+	messages <-chan Message,
+	room string,
+	passwordHash string,
+) error {
+	if err := client.Write(NewMessage("password_required", room, nil)); err != nil {
+		return fmt.Errorf("Error sending password_required: %w", err)
+	}
+
+	timer := time.NewTimer(roomPasswordTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return errConnectionClosed
+			}
+			if message.Type != "password" {
+				continue
+			}
+
+			var payload PasswordPayload
+			if err := a.deserializer.DeserializePayload(message, &payload); err != nil {
+				return accessDenied(websocket.StatusPolicyViolation, "Invalid password")
+			}
+			if !checkRoomPassword(passwordHash, payload.Password) {
+				return accessDenied(websocket.StatusPolicyViolation, "Invalid password")
+			}
+			return nil
+		case <-timer.C:
+			return accessDenied(websocket.StatusPolicyViolation, "Timed out waiting for password")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// lobbyClient receives the decision of the room creator. Other messages
+// sent to the lobby are not forwarded to the waiting client.
+type lobbyClient struct {
+	ClientWriter
+	decision chan bool
+}
+
+func (c *lobbyClient) Write(message Message) error {
+	var admitted bool
+	switch message.Type {
+	case "lobby_admit":
+		admitted = true
+	case "lobby_deny":
+		admitted = false
+	default:
+		return nil
+	}
+
+	select {
+	case c.decision <- admitted:
+	default:
+	}
+	return nil
+}
+
+func (a *RoomAccess) waitInLobby(
+	ctx context.Context,
+	adapter Adapter,
+	client ClientWriter,
+	messages <-chan Message,
+	room string,
+) error {
+	clientID := client.ID()
+	lobbyRoom := lobbyRoomName(room)
+	log := a.log.WithFields(Fields{
+		"room":     room,
+		"clientId": clientID,
+	})
+
+	lobby := a.rooms.Enter(lobbyRoom)
+	defer a.rooms.Exit(lobbyRoom)
+
+	waiting := &lobbyClient{
+		ClientWriter: client,
+		decision:     make(chan bool, 1),
+	}
+	if err := lobby.Add(waiting); err != nil {
+		return fmt.Errorf("Error adding client to lobby: %w", err)
+	}
+	defer func() {
+		if err := lobby.Remove(clientID); err != nil {
+			log.Error("Error removing client from lobby", Fields{"error": err})
+		}
+	}()
+
+	if err := client.Write(NewMessage("lobby_waiting", room, nil)); err != nil {
+		return fmt.Errorf("Error sending lobby_waiting: %w", err)
+	}
+
+	announce := func(nickname string) {
+		err := adapter.Broadcast(NewMessage("lobby_request", room, LobbyRequestPayload{
+			ClientID: clientID,
+			Nickname: nickname,
+		}))
+		if err != nil {
+			log.Error("Error broadcasting lobby_request", Fields{"error": err})
+		}
+	}
+
+	log.Info("Waiting in lobby", nil)
+	announce("")
+
+	timer := time.NewTimer(roomLobbyTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return errConnectionClosed
+			}
+			if message.Type != "lobby_join" {
+				continue
+			}
+
+			var payload LobbyJoinPayload
+			if err := a.deserializer.DeserializePayload(message, &payload); err != nil {
+				log.Warn("Ignoring lobby_join", Fields{"error": err})
+				continue
+			}
+			lobby.SetMetadata(clientID, payload.Nickname)
+			announce(payload.Nickname)
+		case admitted := <-waiting.decision:
+			if !admitted {
+				return accessDenied(websocket.StatusPolicyViolation, "Denied by room creator")
+			}
+			log.Info("Admitted to room", nil)
+			return client.Write(NewMessage("lobby_admitted", room, nil))
+		case <-timer.C:
+			return accessDenied(websocket.StatusTryAgainLater, "Timed out waiting in lobby")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// HandleMessage handles the messages the room creator uses to control access
+// to the room. It returns false for all other messages.
+func (a *RoomAccess) HandleMessage(
+	adapter Adapter,
+	message Message,
+	room string,
+	clientID string,
+	identity Identity,
+) (bool, error) {
+	var handle func(adapter Adapter, message Message, room string, clientID string) error
+
+	switch message.Type {
+	case "room_settings":
+		handle = a.handleSettings
+	case "lobby_admit", "lobby_deny":
+		handle = a.handleLobbyDecision
+	case "lobby_list":
+		handle = a.handleLobbyList
+	case "kick":
+		handle = a.handleKick
+	case "mute_request":
+		handle = a.handleMuteRequest
+	case "end_meeting":
+		handle = a.handleEndMeeting
+	case "moderator_transfer":
+		handle = a.handleModeratorTransfer
+	default:
+		return false, nil
+	}
+
+	info, err := a.roomStore.Get(room)
+	if err != nil || !isModerator(identity, info) {
+		a.log.Warn("Only the moderator can send message", Fields{
+			"room":     room,
+			"clientId": clientID,
+			"type":     message.Type,
+		})
+		return true, adapter.Emit(clientID, NewMessage(message.Type, room, ResultPayload{
+			Successful: false,
+		}))
+	}
+
+	return true, handle(adapter, message, room, clientID)
+}
+
+func (a *RoomAccess) handleSettings(adapter Adapter, message Message, room string, clientID string) error {
+	var payload RoomSettingsPayload
+	if err := a.deserializer.DeserializePayload(message, &payload); err != nil {
+		return err
+	}
+
+	if payload.Password != nil {
+		var passwordHash string
+		if *payload.Password != "" {
+			var err error
+			if passwordHash, err = hashRoomPassword(*payload.Password); err != nil {
+				return err
+			}
+		}
+		if err := a.roomStore.SetPassword(room, passwordHash); err != nil {
+			return fmt.Errorf("Error setting room password: %w", err)
+		}
+	}
+
+	if payload.Locked != nil {
+		if err := a.roomStore.SetLocked(room, *payload.Locked); err != nil {
+			return fmt.Errorf("Error locking room: %w", err)
+		}
+	}
+
+	if payload.Lobby != nil {
+		if err := a.roomStore.SetLobby(room, *payload.Lobby); err != nil {
+			return fmt.Errorf("Error setting room lobby: %w", err)
+		}
+	}
+
+	info, err := a.roomStore.Get(room)
+	if err != nil {
+		return fmt.Errorf("Error retrieving room: %w", err)
+	}
+
+	a.log.Info("Room settings changed", Fields{
+		"room":     room,
+		"clientId": clientID,
+		"locked":   info.Locked,
+		"lobby":    info.Lobby,
+		"password": info.PasswordHash != "",
+	})
+
+	return adapter.Broadcast(NewMessage("room_settings", room, RoomSettingsChangedPayload{
+		Successful: true,
+		Locked:     info.Locked,
+		Lobby:      info.Lobby,
+		Password:   info.PasswordHash != "",
+	}))
+}
+
+func (a *RoomAccess) handleLobbyDecision(adapter Adapter, message Message, room string, clientID string) error {
+	var payload ClientPayload
+	if err := a.deserializer.DeserializePayload(message, &payload); err != nil {
+		return err
+	}
+
+	waitingClientID := payload.ClientID
+
+	lobbyRoom := lobbyRoomName(room)
+	lobby := a.rooms.Enter(lobbyRoom)
+	defer a.rooms.Exit(lobbyRoom)
+
+	a.log.Info("Lobby decision", Fields{
+		"room":           room,
+		"clientId":       clientID,
+		"type":           message.Type,
+		"targetClientId": waitingClientID,
+	})
+
+	if err := lobby.Emit(waitingClientID, NewMessage(message.Type, room, nil)); err != nil {
+		return fmt.Errorf("Error sending %s to client %s: %w", message.Type, waitingClientID, err)
+	}
+
+	return nil
+}
+
+func (a *RoomAccess) handleLobbyList(adapter Adapter, message Message, room string, clientID string) error {
+	lobbyRoom := lobbyRoomName(room)
+	lobby := a.rooms.Enter(lobbyRoom)
+	defer a.rooms.Exit(lobbyRoom)
+
+	clients, err := lobby.Clients()
+	if err != nil {
+		return fmt.Errorf("Error retrieving lobby clients: %w", err)
+	}
+
+	return adapter.Emit(clientID, NewMessage("lobby_list", room, LobbyListPayload{
+		Successful: true,
+		Clients:    clients,
+	}))
+}
+
+// emitToTarget sends a message to targetClientID and reports the result to
+// the moderator.
+func (a *RoomAccess) emitToTarget(
+	adapter Adapter,
+	message Message,
+	room string,
+	clientID string,
+	targetClientID string,
+	msg Message,
+) error {
+	log := a.log.WithFields(Fields{
+		"room":           room,
+		"clientId":       clientID,
+		"targetClientId": targetClientID,
+	})
+	log.Info("Moderator message", Fields{"type": message.Type})
+
+	successful := true
+	if err := adapter.Emit(targetClientID, msg); err != nil {
+		log.Error("Error sending message to client", Fields{
+			"type":  msg.Type,
+			"error": err,
+		})
+		successful = false
+	}
+
+	return adapter.Emit(clientID, NewMessage(message.Type, room, ResultPayload{
+		Successful: successful,
+		ClientID:   targetClientID,
+	}))
+}
+
+func (a *RoomAccess) handleKick(adapter Adapter, message Message, room string, clientID string) error {
+	var payload ClientPayload
+	if err := a.deserializer.DeserializePayload(message, &payload); err != nil {
+		return err
+	}
+
+	return a.emitToTarget(adapter, message, room, clientID, payload.ClientID, NewMessage(messageTypeKick, room, nil))
+}
+
+func (a *RoomAccess) handleMuteRequest(adapter Adapter, message Message, room string, clientID string) error {
+	var payload MuteRequestPayload
+	if err := a.deserializer.DeserializePayload(message, &payload); err != nil {
+		return err
+	}
+
+	return a.emitToTarget(adapter, message, room, clientID, payload.ClientID, NewMessage("mute_request", room, MuteRequestedPayload{
+		Kind: payload.Kind,
+	}))
+}
+
+// handleModeratorTransfer asks the target to become the moderator. Only the
+// target knows its user ID, so the target reports the result to the
+// moderator.
+func (a *RoomAccess) handleModeratorTransfer(adapter Adapter, message Message, room string, clientID string) error {
+	var payload ClientPayload
+	if err := a.deserializer.DeserializePayload(message, &payload); err != nil {
+		return err
+	}
+
+	log := a.log.WithFields(Fields{
+		"room":           room,
+		"clientId":       clientID,
+		"targetClientId": payload.ClientID,
+	})
+	log.Info("Moderator message", Fields{"type": message.Type})
+
+	err := adapter.Emit(payload.ClientID, NewMessage(messageTypeModeratorTransfer, room, ClientPayload{
+		ClientID: clientID,
+	}))
+	if err == nil {
+		return nil
+	}
+
+	log.Error("Error sending message to client", Fields{
+		"type":  messageTypeModeratorTransfer,
+		"error": err,
+	})
+
+	return adapter.Emit(clientID, NewMessage(message.Type, room, ResultPayload{
+		Successful: false,
+		ClientID:   payload.ClientID,
+	}))
+}
+
+func (a *RoomAccess) handleEndMeeting(adapter Adapter, message Message, room string, clientID string) error {
+	a.log.Info("Ending meeting", Fields{
+		"room":     room,
+		"clientId": clientID,
+	})
+
+	if err := adapter.Broadcast(NewMessage(messageTypeEndMeeting, room, nil)); err != nil {
+		return fmt.Errorf("Error broadcasting end of meeting: %w", err)
+	}
+
+	if err := a.roomStore.Remove(room); err != nil {
+		return fmt.Errorf("Error removing room: %w", err)
+	}
+
+	return nil
+}
+
+// roomClient handles the moderator messages sent to an admitted client.
+type roomClient struct {
+	ClientWriter
+	log        Logger
+	access     *RoomAccess
+	adapter    Adapter
+	room       string
+	userID     string
+	disconnect func(status websocket.StatusCode, reason string)
+}
+
+// NewClient wraps a client before it is added to the room adapter. The
+// disconnect function closes the websocket connection.
+func (a *RoomAccess) NewClient(
+	client ClientWriter,
+	adapter Adapter,
+	room string,
+	userID string,
+	disconnect func(status websocket.StatusCode, reason string),
+) ClientWriter {
+	return &roomClient{
+		ClientWriter: client,
+		log: a.log.WithFields(Fields{
+			"room":     room,
+			"clientId": client.ID(),
+		}),
+		access:     a,
+		adapter:    adapter,
+		room:       room,
+		userID:     userID,
+		disconnect: disconnect,
+	}
+}
+
+// Write is called by the adapter while it holds a lock, so anything which
+// might use the adapter or block is done in a goroutine.
+func (c *roomClient) Write(message Message) error {
+	switch message.Type {
+	case messageTypeKick:
+		go c.kick()
+		return nil
+	case messageTypeEndMeeting:
+		go func() {
+			if err := c.ClientWriter.Write(NewMessage("meeting_ended", c.room, nil)); err != nil {
+				c.log.Error("Error sending meeting_ended", Fields{"error": err})
+			}
+			c.disconnect(websocket.StatusNormalClosure, "Meeting ended")
+		}()
+		return nil
+	case messageTypeModeratorTransfer:
+		var payload ClientPayload
+		if err := c.access.deserializer.DeserializePayload(message, &payload); err != nil {
+			return err
+		}
+		go c.becomeModerator(payload.ClientID)
+		return nil
+	default:
+		return c.ClientWriter.Write(message)
+	}
+}
+
+func (c *roomClient) kick() {
+	clientID := c.ID()
+	c.log.Info("Kicked from room", nil)
+
+	for _, id := range []string{clientID, c.userID} {
+		if id == "" {
+			continue
+		}
+		if err := c.access.roomStore.Ban(c.room, id, roomKickBanDuration); err != nil {
+			c.log.Error("Error banning client", Fields{
+				"bannedId": id,
+				"error":    err,
+			})
+		}
+	}
+
+	c.disconnect(websocket.StatusPolicyViolation, "Kicked from room")
+}
+
+// becomeModerator makes the user of this client the moderator of the room
+// and reports the result to the moderator with moderatorClientID.
+func (c *roomClient) becomeModerator(moderatorClientID string) {
+	successful := c.setModerator()
+
+	err := c.adapter.Emit(moderatorClientID, NewMessage("moderator_transfer", c.room, ResultPayload{
+		Successful: successful,
+		ClientID:   c.ID(),
+	}))
+	if err != nil {
+		c.log.Error("Error sending moderator_transfer", Fields{
+			"targetClientId": moderatorClientID,
+			"error":          err,
+		})
+	}
+}
+
+func (c *roomClient) setModerator() bool {
+	clientID := c.ID()
+
+	if c.userID == "" {
+		c.log.Warn("Cannot make anonymous user moderator of room", nil)
+		return false
+	}
+
+	if err := c.access.roomStore.SetCreator(c.room, c.userID); err != nil {
+		c.log.Error("Error changing moderator of room", Fields{"error": err})
+		return false
+	}
+
+	c.log.Info("New moderator of room", nil)
+
+	err := c.adapter.Broadcast(NewMessage("moderator_changed", c.room, ModeratorChangedPayload{
+		ClientID:  clientID,
+		CreatorID: c.userID,
+	}))
+	if err != nil {
+		c.log.Error("Error broadcasting moderator_changed", Fields{"error": err})
+	}
+
+	return true
+}
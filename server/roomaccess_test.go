@@ -0,0 +1,414 @@
+package server_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/peer-calls/peer-calls/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"nhooyr.io/websocket"
+)
+
+const jwtSecret = "test-jwt-secret"
+
+const creatorID = "creator"
+
+func setupAccessServer(t *testing.T) (store *server.MemoryRoomStore, url string, cleanup func()) {
+	return setupAccessServerWithAuth(t, server.NewAnonymousAuthenticator([]byte(jwtSecret)))
+}
+
+func setupAccessServerWithAuth(t *testing.T, auth server.Authenticator) (store *server.MemoryRoomStore, url string, cleanup func()) {
+	newAdapter := server.NewAdapterFactory(loggerFactory, server.StoreConfig{})
+	rooms := server.NewAdapterRoomManager(newAdapter.NewAdapter)
+	store = server.NewMemoryRoomStore(time.Hour)
+	wss := server.NewWSS(loggerFactory, rooms, auth, server.NewRoomAccess(loggerFactory, rooms, store), nil, nil)
+
+	// echo messages back so that tests can verify a client has been admitted
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sub, err := wss.Subscribe(w, r)
+		if err != nil {
+			return
+		}
+		for msg := range sub.Messages {
+			_ = sub.Adapter.Emit(sub.ClientID, msg)
+		}
+	}))
+
+	_, _, err := store.Create(room, creatorID)
+	require.NoError(t, err)
+
+	url = "ws" + strings.TrimPrefix(s.URL, "http") + "/ws/" + room + "/"
+	return store, url, func() {
+		s.Close()
+		newAdapter.Close()
+	}
+}
+
+func dialAsUser(t *testing.T, ctx context.Context, url string, userID string) *websocket.Conn {
+	t.Helper()
+	return dialWithClaims(t, ctx, url, jwt.MapClaims{
+		"user_id": userID,
+	})
+}
+
+func dialWithClaims(t *testing.T, ctx context.Context, url string, claims jwt.MapClaims) *websocket.Conn {
+	t.Helper()
+	return dialWithToken(t, ctx, url, signToken(t, jwt.SigningMethodHS256, []byte(jwtSecret), claims))
+}
+
+func dialWithToken(t *testing.T, ctx context.Context, url string, token string) *websocket.Conn {
+	t.Helper()
+	header := http.Header{}
+	header.Set("Cookie", "jwt="+token)
+	ws, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		HTTPHeader: header,
+	})
+	require.NoError(t, err)
+	return ws
+}
+
+// readWSType skips messages until one of type typ is received.
+func readWSType(t *testing.T, ctx context.Context, ws *websocket.Conn, typ string) server.Message {
+	t.Helper()
+	for {
+		msg := mustReadWS(t, ctx, ws)
+		if msg.Type == typ {
+			return msg
+		}
+	}
+}
+
+func assertClosed(t *testing.T, ctx context.Context, ws *websocket.Conn, status websocket.StatusCode) {
+	t.Helper()
+	for {
+		_, _, err := ws.Read(ctx)
+		if err != nil {
+			assert.Equal(t, status, websocket.CloseStatus(err), "unexpected error: %s", err)
+			return
+		}
+	}
+}
+
+func assertEcho(t *testing.T, ctx context.Context, ws *websocket.Conn) {
+	t.Helper()
+	mustWriteWS(t, ctx, ws, server.NewMessage("echo", room, nil))
+	readWSType(t, ctx, ws, "echo")
+}
+
+func TestRoomAccess_open(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	_, url, cleanup := setupAccessServer(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ws := mustDialWS(t, ctx, url+"client1")
+	defer ws.Close(websocket.StatusNormalClosure, "")
+	assertEcho(t, ctx, ws)
+}
+
+func TestRoomAccess_locked(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	_, url, cleanup := setupAccessServer(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	creator := dialAsUser(t, ctx, url+"creator1", creatorID)
+	defer creator.Close(websocket.StatusNormalClosure, "")
+
+	mustWriteWS(t, ctx, creator, server.NewMessage("room_settings", room, map[string]interface{}{
+		"locked": true,
+	}))
+	msg := readWSType(t, ctx, creator, "room_settings")
+	assert.Equal(t, map[string]interface{}{
+		"successful": true,
+		"locked":     true,
+		"lobby":      false,
+		"password":   false,
+	}, msg.Payload)
+
+	ws := dialAsUser(t, ctx, url+"client1", "user1")
+	assertClosed(t, ctx, ws, websocket.StatusPolicyViolation)
+
+	creator2 := dialAsUser(t, ctx, url+"creator2", creatorID)
+	defer creator2.Close(websocket.StatusNormalClosure, "")
+	assertEcho(t, ctx, creator2)
+}
+
+func TestRoomAccess_settingsNotCreator(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	store, url, cleanup := setupAccessServer(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ws := dialAsUser(t, ctx, url+"client1", "user1")
+	defer ws.Close(websocket.StatusNormalClosure, "")
+
+	mustWriteWS(t, ctx, ws, server.NewMessage("room_settings", room, map[string]interface{}{
+		"locked": true,
+	}))
+	msg := readWSType(t, ctx, ws, "room_settings")
+	assert.Equal(t, map[string]interface{}{"successful": false}, msg.Payload)
+
+	info, err := store.Get(room)
+	require.NoError(t, err)
+	assert.False(t, info.Locked)
+}
+
+func TestRoomAccess_password(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	store, url, cleanup := setupAccessServer(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	creator := dialAsUser(t, ctx, url+"creator1", creatorID)
+	defer creator.Close(websocket.StatusNormalClosure, "")
+
+	mustWriteWS(t, ctx, creator, server.NewMessage("room_settings", room, map[string]interface{}{
+		"password": "secret",
+	}))
+	readWSType(t, ctx, creator, "room_settings")
+
+	info, err := store.Get(room)
+	require.NoError(t, err)
+	assert.NotEqual(t, "", info.PasswordHash)
+	assert.NotEqual(t, "secret", info.PasswordHash, "password should be hashed")
+
+	ws1 := mustDialWS(t, ctx, url+"client1")
+	readWSType(t, ctx, ws1, "password_required")
+	mustWriteWS(t, ctx, ws1, server.NewMessage("password", room, map[string]interface{}{
+		"password": "invalid",
+	}))
+	assertClosed(t, ctx, ws1, websocket.StatusPolicyViolation)
+
+	ws2 := mustDialWS(t, ctx, url+"client2")
+	defer ws2.Close(websocket.StatusNormalClosure, "")
+	readWSType(t, ctx, ws2, "password_required")
+	mustWriteWS(t, ctx, ws2, server.NewMessage("password", room, map[string]interface{}{
+		"password": "secret",
+	}))
+	assertEcho(t, ctx, ws2)
+}
+
+func TestRoomAccess_lobby(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	_, url, cleanup := setupAccessServer(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	creator := dialAsUser(t, ctx, url+"creator1", creatorID)
+	defer creator.Close(websocket.StatusNormalClosure, "")
+
+	mustWriteWS(t, ctx, creator, server.NewMessage("room_settings", room, map[string]interface{}{
+		"lobby": true,
+	}))
+	readWSType(t, ctx, creator, "room_settings")
+
+	ws1 := mustDialWS(t, ctx, url+"client1")
+	defer ws1.Close(websocket.StatusNormalClosure, "")
+	readWSType(t, ctx, ws1, "lobby_waiting")
+	mustWriteWS(t, ctx, ws1, server.NewMessage("lobby_join", room, map[string]interface{}{
+		"nickname": "john",
+	}))
+
+	msg := readWSType(t, ctx, creator, "lobby_request")
+	for msg.Payload.(map[string]interface{})["nickname"] != "john" {
+		msg = readWSType(t, ctx, creator, "lobby_request")
+	}
+	assert.Equal(t, "client1", msg.Payload.(map[string]interface{})["clientId"])
+
+	mustWriteWS(t, ctx, creator, server.NewMessage("lobby_list", room, nil))
+	msg = readWSType(t, ctx, creator, "lobby_list")
+	assert.Equal(t, map[string]interface{}{"client1": "john"}, msg.Payload.(map[string]interface{})["clients"])
+
+	mustWriteWS(t, ctx, creator, server.NewMessage("lobby_admit", room, map[string]interface{}{
+		"clientId": "client1",
+	}))
+	readWSType(t, ctx, ws1, "lobby_admitted")
+	assertEcho(t, ctx, ws1)
+
+	ws2 := mustDialWS(t, ctx, url+"client2")
+	readWSType(t, ctx, ws2, "lobby_waiting")
+	readWSType(t, ctx, creator, "lobby_request")
+	mustWriteWS(t, ctx, creator, server.NewMessage("lobby_deny", room, map[string]interface{}{
+		"clientId": "client2",
+	}))
+	assertClosed(t, ctx, ws2, websocket.StatusPolicyViolation)
+}
+
+func TestRoomAccess_kick(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	_, url, cleanup := setupAccessServer(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	creator := dialAsUser(t, ctx, url+"creator1", creatorID)
+	defer creator.Close(websocket.StatusNormalClosure, "")
+	ws1 := dialAsUser(t, ctx, url+"client1", "user1")
+	assertEcho(t, ctx, ws1)
+
+	mustWriteWS(t, ctx, ws1, server.NewMessage("kick", room, map[string]interface{}{
+		"clientId": "creator1",
+	}))
+	msg := readWSType(t, ctx, ws1, "kick")
+	assert.Equal(t, map[string]interface{}{"successful": false}, msg.Payload)
+
+	mustWriteWS(t, ctx, creator, server.NewMessage("kick", room, map[string]interface{}{
+		"clientId": "client1",
+	}))
+	msg = readWSType(t, ctx, creator, "kick")
+	assert.Equal(t, map[string]interface{}{"successful": true, "clientId": "client1"}, msg.Payload)
+	assertClosed(t, ctx, ws1, websocket.StatusPolicyViolation)
+
+	ws2 := dialAsUser(t, ctx, url+"client2", "user1")
+	assertClosed(t, ctx, ws2, websocket.StatusPolicyViolation)
+}
+
+func TestRoomAccess_muteRequest(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	_, url, cleanup := setupAccessServer(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	creator := dialAsUser(t, ctx, url+"creator1", creatorID)
+	defer creator.Close(websocket.StatusNormalClosure, "")
+	ws1 := dialAsUser(t, ctx, url+"client1", "user1")
+	defer ws1.Close(websocket.StatusNormalClosure, "")
+	assertEcho(t, ctx, ws1)
+
+	mustWriteWS(t, ctx, creator, server.NewMessage("mute_request", room, map[string]interface{}{
+		"clientId": "client1",
+		"kind":     "audio",
+	}))
+	msg := readWSType(t, ctx, ws1, "mute_request")
+	assert.Equal(t, map[string]interface{}{"kind": "audio"}, msg.Payload)
+}
+
+func TestRoomAccess_moderatorTransfer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	store, url, cleanup := setupAccessServer(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	creator := dialAsUser(t, ctx, url+"creator1", creatorID)
+	defer creator.Close(websocket.StatusNormalClosure, "")
+	ws1 := dialAsUser(t, ctx, url+"client1", "user1")
+	defer ws1.Close(websocket.StatusNormalClosure, "")
+	assertEcho(t, ctx, ws1)
+
+	mustWriteWS(t, ctx, creator, server.NewMessage("moderator_transfer", room, map[string]interface{}{
+		"clientId": "client1",
+	}))
+	msg := readWSType(t, ctx, creator, "moderator_changed")
+	assert.Equal(t, map[string]interface{}{"clientId": "client1", "creatorId": "user1"}, msg.Payload)
+	msg = readWSType(t, ctx, creator, "moderator_transfer")
+	assert.Equal(t, map[string]interface{}{"successful": true, "clientId": "client1"}, msg.Payload)
+
+	info, err := store.Get(room)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", info.CreatorID)
+
+	mustWriteWS(t, ctx, creator, server.NewMessage("room_settings", room, map[string]interface{}{
+		"locked": true,
+	}))
+	msg = readWSType(t, ctx, creator, "room_settings")
+	assert.Equal(t, map[string]interface{}{"successful": false}, msg.Payload)
+}
+
+func TestRoomAccess_moderatorTransfer_anonymous(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	store, url, cleanup := setupAccessServer(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	creator := dialAsUser(t, ctx, url+"creator1", creatorID)
+	defer creator.Close(websocket.StatusNormalClosure, "")
+	ws1 := mustDialWS(t, ctx, url+"client1")
+	defer ws1.Close(websocket.StatusNormalClosure, "")
+	assertEcho(t, ctx, ws1)
+
+	mustWriteWS(t, ctx, creator, server.NewMessage("moderator_transfer", room, map[string]interface{}{
+		"clientId": "client1",
+	}))
+	msg := readWSType(t, ctx, creator, "moderator_transfer")
+	assert.Equal(t, map[string]interface{}{"successful": false, "clientId": "client1"}, msg.Payload)
+
+	info, err := store.Get(room)
+	require.NoError(t, err)
+	assert.Equal(t, creatorID, info.CreatorID)
+}
+
+func TestRoomAccess_endMeeting(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	store, url, cleanup := setupAccessServer(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	creator := dialAsUser(t, ctx, url+"creator1", creatorID)
+	ws1 := dialAsUser(t, ctx, url+"client1", "user1")
+	assertEcho(t, ctx, ws1)
+
+	mustWriteWS(t, ctx, creator, server.NewMessage("end_meeting", room, nil))
+
+	for _, ws := range []*websocket.Conn{creator, ws1} {
+		readWSType(t, ctx, ws, "meeting_ended")
+		assertClosed(t, ctx, ws, websocket.StatusNormalClosure)
+	}
+
+	_, err := store.Get(room)
+	assert.Equal(t, server.ErrRoomNotFound, err)
+}
+
+func TestRoomAccess_moderatorRole(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	auth, err := server.NewJWTAuthenticator(server.AuthConfigJWT{
+		UserClaim: "user_id",
+	}, encodePublicKey(t, &key.PublicKey))
+	require.NoError(t, err)
+	store, url, cleanup := setupAccessServerWithAuth(t, auth)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	require.NoError(t, store.SetLocked(room, true))
+
+	viewer := dialWithToken(t, ctx, url+"viewer1", signToken(t, jwt.SigningMethodES256, key, jwt.MapClaims{
+		"user_id": creatorID,
+		"role":    "viewer",
+	}))
+	assertClosed(t, ctx, viewer, websocket.StatusPolicyViolation)
+
+	moderator := dialWithToken(t, ctx, url+"moderator1", signToken(t, jwt.SigningMethodES256, key, jwt.MapClaims{
+		"user_id": "user1",
+		"role":    "moderator",
+	}))
+	defer moderator.Close(websocket.StatusNormalClosure, "")
+	assertEcho(t, ctx, moderator)
+
+	mustWriteWS(t, ctx, moderator, server.NewMessage("room_settings", room, map[string]interface{}{
+		"locked": false,
+	}))
+	msg := readWSType(t, ctx, moderator, "room_settings")
+	assert.Equal(t, true, msg.Payload.(map[string]interface{})["successful"])
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAffinityLeaseTTL is the time an instance keeps a room after its last
+// client has left when no TTL is configured.
+const DefaultAffinityLeaseTTL = 30 * time.Second
+
+// affinityForwardedHeader is set on requests proxied to the owner of a room.
+// Forwarded requests are always served by the instance which receives them,
+// so that requests are not proxied in a loop while the owner changes.
+const affinityForwardedHeader = "X-Peercalls-Affinity-Forwarded"
+
+// RoomAffinity pins each room to the instance which claims it first, and
+// proxies or redirects requests for the rooms owned by other instances to
+// their owner. The owner renews the lease of a room while it has clients.
+type RoomAffinity struct {
+	log    Logger
+	leases RoomLeases
+	node   string
+	mode   AffinityMode
+	ttl    time.Duration
+
+	mu sync.Mutex
+	// rooms contains the number of clients in the rooms with clients on this
+	// instance.
+	rooms   map[string]*affinityRoom
+	proxies map[string]*httputil.ReverseProxy
+}
+
+type affinityRoom struct {
+	count int
+	stop  chan struct{}
+}
+
+func NewRoomAffinity(loggerFactory LoggerFactory, leases RoomLeases, config NetworkConfigSFUAffinity) (*RoomAffinity, error) {
+	u, err := url.Parse(config.AdvertiseURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("Invalid affinity advertise URL: %q", config.AdvertiseURL)
+	}
+
+	mode := config.Mode
+	switch mode {
+	case "":
+		mode = AffinityModeProxy
+	case AffinityModeProxy, AffinityModeRedirect:
+	default:
+		return nil, fmt.Errorf("Unknown affinity mode: %s", mode)
+	}
+
+	ttl := config.LeaseTTL
+	if ttl <= 0 {
+		ttl = DefaultAffinityLeaseTTL
+	}
+
+	log := loggerFactory.GetLogger("affinity")
+	node := strings.TrimSuffix(u.String(), "/")
+	log.Info("Using room affinity", Fields{
+		"mode": mode,
+		"node": node,
+	})
+
+	return &RoomAffinity{
+		log:     log,
+		leases:  leases,
+		node:    node,
+		mode:    mode,
+		ttl:     ttl,
+		rooms:   map[string]*affinityRoom{},
+		proxies: map[string]*httputil.ReverseProxy{},
+	}, nil
+}
+
+// Owner returns the URL of the instance which owns room. The room is claimed
+// by this instance when no instance owns it.
+func (a *RoomAffinity) Owner(room string) (string, error) {
+	return a.leases.Claim(room, a.node, a.ttl)
+}
+
+// Handler serves requests for rooms owned by this instance with next, and
+// proxies or redirects the requests for rooms owned by other instances. The
+// room of a request is returned by getRoom. Requests are served by this
+// instance when the owner cannot be determined.
+func (a *RoomAffinity) Handler(getRoom func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		room := getRoom(r)
+
+		if room == "" || r.Header.Get(affinityForwardedHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		owner, err := a.Owner(room)
+		if err != nil {
+			a.log.Error("Error finding owner of room", Fields{
+				"room":  room,
+				"error": err,
+			})
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if owner == a.node {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch a.mode {
+		case AffinityModeRedirect:
+			a.log.Debug("Redirecting request for room", Fields{
+				"room":  room,
+				"owner": owner,
+			})
+			http.Redirect(w, r, owner+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		default:
+			proxy, err := a.proxy(owner)
+			if err != nil {
+				a.log.Error("Error proxying request for room", Fields{
+					"room":  room,
+					"owner": owner,
+					"error": err,
+				})
+				next.ServeHTTP(w, r)
+				return
+			}
+			a.log.Debug("Proxying request for room", Fields{
+				"room":  room,
+				"owner": owner,
+			})
+			proxy.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (a *RoomAffinity) proxy(owner string) (*httputil.ReverseProxy, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if proxy, ok := a.proxies[owner]; ok {
+		return proxy, nil
+	}
+
+	target, err := url.Parse(owner)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid owner URL: %q: %w", owner, err)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Header.Set(affinityForwardedHeader, a.node)
+	}
+	a.proxies[owner] = proxy
+	return proxy, nil
+}
+
+// RoomManager returns a RoomManager which renews the leases of rooms while
+// clients are in them.
+func (a *RoomAffinity) RoomManager(rooms RoomManager) RoomManager {
+	return &affinityRoomManager{
+		RoomManager: rooms,
+		affinity:    a,
+	}
+}
+
+func (a *RoomAffinity) enter(room string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ar, ok := a.rooms[room]
+	if !ok {
+		ar = &affinityRoom{
+			stop: make(chan struct{}),
+		}
+		a.rooms[room] = ar
+		go a.renew(room, ar.stop)
+	}
+	ar.count++
+}
+
+func (a *RoomAffinity) exit(room string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ar, ok := a.rooms[room]
+	if !ok {
+		return
+	}
+
+	ar.count--
+	if ar.count == 0 {
+		delete(a.rooms, room)
+		close(ar.stop)
+	}
+}
+
+// renew renews the lease of a room until stop is closed. The lease expires
+// after the TTL once the last client has left.
+func (a *RoomAffinity) renew(room string, stop <-chan struct{}) {
+	ticker := time.NewTicker(a.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		owner, err := a.Owner(room)
+		if err != nil {
+			a.log.Error("Error renewing lease of room", Fields{
+				"room":  room,
+				"error": err,
+			})
+		} else if owner != a.node {
+			a.log.Warn("Room with clients on this instance is owned by another instance", Fields{
+				"room":  room,
+				"owner": owner,
+			})
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+type affinityRoomManager struct {
+	RoomManager
+	affinity *RoomAffinity
+}
+
+func (m *affinityRoomManager) Enter(room string) Adapter {
+	m.affinity.enter(room)
+	return m.RoomManager.Enter(room)
+}
+
+func (m *affinityRoomManager) Exit(room string) {
+	m.RoomManager.Exit(room)
+	m.affinity.exit(room)
+}
@@ -0,0 +1,217 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peer-calls/peer-calls/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"nhooyr.io/websocket"
+)
+
+func TestMemoryRoomLeases(t *testing.T) {
+	leases := server.NewMemoryRoomLeases()
+
+	owner, err := leases.Claim(room, "a", 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "a", owner)
+
+	owner, err = leases.Claim(room, "b", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "a", owner)
+
+	owner, err = leases.Claim("other", "b", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "b", owner)
+
+	time.Sleep(100 * time.Millisecond)
+
+	owner, err = leases.Claim(room, "b", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "b", owner, "expired lease")
+}
+
+func TestRedisRoomLeases(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	pub, _, stop := configureRedis(t)
+	defer stop()
+	defer pub.Del("peercalls:room:" + room + ":lease")
+
+	leases := server.NewRedisRoomLeases(pub, "peercalls")
+
+	owner, err := leases.Claim(room, "a", 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "a", owner)
+
+	owner, err = leases.Claim(room, "b", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "a", owner)
+
+	time.Sleep(100 * time.Millisecond)
+
+	owner, err = leases.Claim(room, "b", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "b", owner, "expired lease")
+}
+
+// newAffinityServer creates a server which responds with its name and
+// echoes websocket messages for rooms it owns.
+func newAffinityServer(
+	t *testing.T,
+	leases server.RoomLeases,
+	name string,
+	mode server.AffinityMode,
+) (*httptest.Server, *server.RoomAffinity) {
+	s := httptest.NewUnstartedServer(nil)
+
+	affinity, err := server.NewRoomAffinity(loggerFactory, leases, server.NetworkConfigSFUAffinity{
+		AdvertiseURL: "http://" + s.Listener.Addr().String(),
+		Mode:         mode,
+		LeaseTTL:     time.Minute,
+	})
+	require.NoError(t, err)
+
+	s.Config.Handler = affinity.Handler(func(r *http.Request) string {
+		return path.Base(path.Dir(r.URL.Path))
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "" {
+			fmt.Fprint(w, name)
+			return
+		}
+
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close(websocket.StatusNormalClosure, "")
+		_, data, err := c.Read(r.Context())
+		if err != nil {
+			return
+		}
+		_ = c.Write(r.Context(), websocket.MessageText, append([]byte(name+": "), data...))
+	}))
+	s.Start()
+
+	return s, affinity
+}
+
+func getBody(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	t.Helper()
+	res, err := client.Get(url)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(body)
+}
+
+func TestRoomAffinity_proxy(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	leases := server.NewMemoryRoomLeases()
+
+	s1, _ := newAffinityServer(t, leases, "node1", server.AffinityModeProxy)
+	defer s1.Close()
+	s2, _ := newAffinityServer(t, leases, "node2", server.AffinityModeProxy)
+	defer s2.Close()
+
+	client := &http.Client{}
+	defer client.CloseIdleConnections()
+
+	_, body := getBody(t, client, s1.URL+"/ws/room1/client1")
+	assert.Equal(t, "node1", body)
+	_, body = getBody(t, client, s2.URL+"/ws/room1/client2")
+	assert.Equal(t, "node1", body, "request proxied to the owner of the room")
+	_, body = getBody(t, client, s2.URL+"/ws/room2/client2")
+	assert.Equal(t, "node2", body)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s2.URL, "http")+"/ws/room1/client2", nil)
+	require.NoError(t, err)
+	defer ws.Close(websocket.StatusNormalClosure, "")
+	require.NoError(t, ws.Write(ctx, websocket.MessageText, []byte("hello")))
+	_, data, err := ws.Read(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "node1: hello", string(data), "websocket proxied to the owner of the room")
+	ws.Close(websocket.StatusNormalClosure, "")
+}
+
+func TestRoomAffinity_redirect(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	leases := server.NewMemoryRoomLeases()
+
+	s1, _ := newAffinityServer(t, leases, "node1", server.AffinityModeRedirect)
+	defer s1.Close()
+	s2, _ := newAffinityServer(t, leases, "node2", server.AffinityModeRedirect)
+	defer s2.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	_, body := getBody(t, client, s1.URL+"/call/room1/")
+	assert.Equal(t, "node1", body)
+
+	res, _ := getBody(t, client, s2.URL+"/call/room1/?a=b")
+	assert.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+	assert.Equal(t, s1.URL+"/call/room1/?a=b", res.Header.Get("Location"))
+}
+
+func TestRoomAffinity_RoomManager(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	leases := server.NewMemoryRoomLeases()
+
+	newAffinity := func(node string) *server.RoomAffinity {
+		affinity, err := server.NewRoomAffinity(loggerFactory, leases, server.NetworkConfigSFUAffinity{
+			AdvertiseURL: node,
+			LeaseTTL:     60 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		return affinity
+	}
+	affinity1 := newAffinity("http://node1")
+	affinity2 := newAffinity("http://node2")
+
+	newAdapter := server.NewAdapterFactory(loggerFactory, server.StoreConfig{})
+	defer newAdapter.Close()
+	rooms := affinity1.RoomManager(server.NewAdapterRoomManager(newAdapter.NewAdapter))
+
+	rooms.Enter(room)
+	time.Sleep(200 * time.Millisecond)
+
+	owner, err := affinity2.Owner(room)
+	require.NoError(t, err)
+	assert.Equal(t, "http://node1", owner, "lease renewed while clients are in the room")
+
+	rooms.Exit(room)
+	time.Sleep(200 * time.Millisecond)
+
+	owner, err = affinity2.Owner(room)
+	require.NoError(t, err)
+	assert.Equal(t, "http://node2", owner, "lease expired after the last client left")
+}
+
+func TestNewRoomAffinity_invalid(t *testing.T) {
+	_, err := server.NewRoomAffinity(loggerFactory, server.NewMemoryRoomLeases(), server.NetworkConfigSFUAffinity{
+		AdvertiseURL: "10.0.0.1:3000",
+	})
+	assert.Error(t, err)
+
+	_, err = server.NewRoomAffinity(loggerFactory, server.NewMemoryRoomLeases(), server.NetworkConfigSFUAffinity{
+		AdvertiseURL: "http://10.0.0.1:3000",
+		Mode:         "invalid",
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// RoomLeases assigns rooms to server instances. A lease expires unless its
+// owner renews it, so rooms of instances which stop are eventually assigned
+// to other instances.
+type RoomLeases interface {
+	// Claim returns the instance which owns room. The room is assigned to node
+	// for ttl when it has no owner, and the lease is renewed when node already
+	// owns the room.
+	Claim(room string, node string, ttl time.Duration) (owner string, err error)
+}
+
+type memoryRoomLease struct {
+	owner   string
+	expires time.Time
+}
+
+// MemoryRoomLeases keeps leases in memory. It can only be used by instances
+// in the same process, for example in tests.
+type MemoryRoomLeases struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	leases map[string]memoryRoomLease
+}
+
+var _ RoomLeases = &MemoryRoomLeases{}
+
+func NewMemoryRoomLeases() *MemoryRoomLeases {
+	return &MemoryRoomLeases{
+		now:    time.Now,
+		leases: map[string]memoryRoomLease{},
+	}
+}
+
+func (l *MemoryRoomLeases) Claim(room string, node string, ttl time.Duration) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	for key, lease := range l.leases {
+		if !now.Before(lease.expires) {
+			delete(l.leases, key)
+		}
+	}
+
+	lease, ok := l.leases[room]
+	if ok && lease.owner != node {
+		return lease.owner, nil
+	}
+
+	l.leases[room] = memoryRoomLease{
+		owner:   node,
+		expires: now.Add(ttl),
+	}
+	return node, nil
+}
+
+// redisClaimRoom sets the owner of a room unless another instance owns it,
+// and returns the owner.
+var redisClaimRoom = redis.NewScript(`
+local owner = redis.call("GET", KEYS[1])
+if owner == false or owner == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return ARGV[1]
+end
+return owner
+`)
+
+// RedisRoomLeases keeps the owner of each room in a Redis key which expires
+// with the lease.
+type RedisRoomLeases struct {
+	client *redis.Client
+	prefix string
+}
+
+var _ RoomLeases = &RedisRoomLeases{}
+
+func NewRedisRoomLeases(client *redis.Client, prefix string) *RedisRoomLeases {
+	return &RedisRoomLeases{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func getRoomLeaseName(prefix string, room string) string {
+	// TODO escape room name, what if it has ":" in the name?
+	return prefix + ":room:" + room + ":lease"
+}
+
+func (l *RedisRoomLeases) Claim(room string, node string, ttl time.Duration) (string, error) {
+	owner, err := redisClaimRoom.Run(
+		l.client,
+		[]string{getRoomLeaseName(l.prefix, room)},
+		node,
+		ttl.Milliseconds(),
+	).Text()
+	if err != nil {
+		return "", fmt.Errorf("Error claiming room: %w", err)
+	}
+	return owner, nil
+}
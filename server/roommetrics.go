@@ -0,0 +1,210 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultRoomMetricsMaxRooms is the number of rooms exported by the
+	// RoomMetricsCollector when no limit is configured.
+	DefaultRoomMetricsMaxRooms = 100
+	// DefaultRoomMetricsMaxTracks is the number of tracks exported by the
+	// RoomMetricsCollector when no limit is configured.
+	DefaultRoomMetricsMaxTracks = 1000
+)
+
+var (
+	roomParticipantsDesc = prometheus.NewDesc(
+		"room_participants",
+		"Number of participants in a room",
+		[]string{"room"}, nil,
+	)
+	roomTrackLabels      = []string{"room", "publisher", "ssrc", "kind"}
+	roomTrackBitrateDesc = prometheus.NewDesc(
+		"room_track_bitrate_bits_per_second",
+		"Bitrate a track is received at",
+		roomTrackLabels, nil,
+	)
+	roomTrackPacketsDesc = prometheus.NewDesc(
+		"room_track_rtp_packets_received_total",
+		"Total number of received RTP packets of a track",
+		roomTrackLabels, nil,
+	)
+	roomTrackBytesDesc = prometheus.NewDesc(
+		"room_track_rtp_packets_received_bytes_total",
+		"Total number of received RTP bytes of a track",
+		roomTrackLabels, nil,
+	)
+	roomTrackFractionLostDesc = prometheus.NewDesc(
+		"room_track_fraction_lost",
+		"Highest fraction of packets lost reported by the subscribers of a track",
+		roomTrackLabels, nil,
+	)
+	roomTrackNackPacketsDesc = prometheus.NewDesc(
+		"room_track_nack_packets_total",
+		"Total number of packets of a track requested by NACKs",
+		roomTrackLabels, nil,
+	)
+	roomTrackRetransmittedPacketsDesc = prometheus.NewDesc(
+		"room_track_retransmitted_packets_total",
+		"Total number of packets of a track resent from the jitter buffer",
+		roomTrackLabels, nil,
+	)
+	roomTrackEstimatedBitrateDesc = prometheus.NewDesc(
+		"room_track_estimated_bitrate_bits_per_second",
+		"REMB estimate of the subscribers of a track",
+		roomTrackLabels, nil,
+	)
+	roomMetricsSkippedRoomsDesc = prometheus.NewDesc(
+		"room_metrics_skipped_rooms",
+		"Number of rooms not exported because of the room limit",
+		nil, nil,
+	)
+	roomMetricsSkippedTracksDesc = prometheus.NewDesc(
+		"room_metrics_skipped_tracks",
+		"Number of tracks not exported because of the track limit",
+		nil, nil,
+	)
+)
+
+// RoomMetricsCollector is a prometheus collector which exports the number of
+// participants in each room and the statistics of the tracks published in
+// them. The metrics of the rooms with the most participants are exported
+// first, and rooms and tracks above the configured limits are skipped so
+// that a server with many rooms does not create too many time series.
+type RoomMetricsCollector struct {
+	log       Logger
+	rooms     RoomManager
+	tracks    TracksManager
+	maxRooms  int
+	maxTracks int
+}
+
+var _ prometheus.Collector = &RoomMetricsCollector{}
+
+func NewRoomMetricsCollector(
+	loggerFactory LoggerFactory,
+	rooms RoomManager,
+	tracks TracksManager,
+	config RoomMetricsConfig,
+) *RoomMetricsCollector {
+	maxRooms := config.MaxRooms
+	if maxRooms <= 0 {
+		maxRooms = DefaultRoomMetricsMaxRooms
+	}
+
+	maxTracks := config.MaxTracks
+	if maxTracks <= 0 {
+		maxTracks = DefaultRoomMetricsMaxTracks
+	}
+
+	return &RoomMetricsCollector{
+		log:       loggerFactory.GetLogger("roommetrics"),
+		rooms:     rooms,
+		tracks:    tracks,
+		maxRooms:  maxRooms,
+		maxTracks: maxTracks,
+	}
+}
+
+func (c *RoomMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- roomParticipantsDesc
+	ch <- roomTrackBitrateDesc
+	ch <- roomTrackPacketsDesc
+	ch <- roomTrackBytesDesc
+	ch <- roomTrackFractionLostDesc
+	ch <- roomTrackNackPacketsDesc
+	ch <- roomTrackRetransmittedPacketsDesc
+	ch <- roomTrackEstimatedBitrateDesc
+	ch <- roomMetricsSkippedRoomsDesc
+	ch <- roomMetricsSkippedTracksDesc
+}
+
+type roomParticipants struct {
+	room         string
+	participants int
+}
+
+func (c *RoomMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	rooms := c.participants()
+
+	skippedRooms := 0
+	if len(rooms) > c.maxRooms {
+		skippedRooms = len(rooms) - c.maxRooms
+		rooms = rooms[:c.maxRooms]
+	}
+
+	skippedTracks := 0
+	exportedTracks := 0
+
+	for _, room := range rooms {
+		ch <- prometheus.MustNewConstMetric(roomParticipantsDesc, prometheus.GaugeValue, float64(room.participants), room.room)
+
+		stats, _ := c.tracks.Stats(room.room)
+		for _, track := range stats.Tracks {
+			if exportedTracks == c.maxTracks {
+				skippedTracks++
+				continue
+			}
+			exportedTracks++
+
+			labels := []string{room.room, track.Publisher, strconv.FormatUint(uint64(track.SSRC), 10), track.Kind}
+
+			ch <- prometheus.MustNewConstMetric(roomTrackBitrateDesc, prometheus.GaugeValue, float64(track.Bitrate), labels...)
+			ch <- prometheus.MustNewConstMetric(roomTrackPacketsDesc, prometheus.CounterValue, float64(track.Packets), labels...)
+			ch <- prometheus.MustNewConstMetric(roomTrackBytesDesc, prometheus.CounterValue, float64(track.Bytes), labels...)
+			ch <- prometheus.MustNewConstMetric(roomTrackFractionLostDesc, prometheus.GaugeValue, track.FractionLost, labels...)
+			ch <- prometheus.MustNewConstMetric(roomTrackNackPacketsDesc, prometheus.CounterValue, float64(track.NackPackets), labels...)
+			ch <- prometheus.MustNewConstMetric(roomTrackRetransmittedPacketsDesc, prometheus.CounterValue, float64(track.RetransmittedPackets), labels...)
+			if track.EstimatedBitrate > 0 {
+				ch <- prometheus.MustNewConstMetric(roomTrackEstimatedBitrateDesc, prometheus.GaugeValue, float64(track.EstimatedBitrate), labels...)
+			}
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(roomMetricsSkippedRoomsDesc, prometheus.GaugeValue, float64(skippedRooms))
+	ch <- prometheus.MustNewConstMetric(roomMetricsSkippedTracksDesc, prometheus.GaugeValue, float64(skippedTracks))
+}
+
+// participants returns the rooms with clients on this instance sorted by the
+// number of participants in descending order.
+func (c *RoomMetricsCollector) participants() []roomParticipants {
+	rooms := []roomParticipants{}
+
+	for _, room := range c.rooms.Rooms() {
+		// skip the lobbies of rooms.
+		if strings.Contains(room, "/") {
+			continue
+		}
+
+		adapter := c.rooms.Enter(room)
+		clients, err := adapter.Clients()
+		c.rooms.Exit(room)
+
+		if err != nil {
+			c.log.Error("Error retrieving participants of room", Fields{
+				"room":  room,
+				"error": err,
+			})
+			continue
+		}
+
+		rooms = append(rooms, roomParticipants{
+			room:         room,
+			participants: len(clients),
+		})
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		if rooms[i].participants != rooms[j].participants {
+			return rooms[i].participants > rooms[j].participants
+		}
+		return rooms[i].room < rooms[j].room
+	})
+
+	return rooms
+}
@@ -0,0 +1,229 @@
+package server_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peer-calls/peer-calls/server"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type statsTracksManager struct {
+	*mockTracksManager
+	stats map[string][]server.TrackStats
+}
+
+func (m *statsTracksManager) Stats(room string) (server.RoomStats, bool) {
+	tracks, ok := m.stats[room]
+	return server.RoomStats{Tracks: tracks}, ok
+}
+
+func TestRoomMetricsCollector(t *testing.T) {
+	rooms := server.NewAdapterRoomManager(func(room string) server.Adapter {
+		return server.NewMemoryAdapter(room)
+	})
+
+	join := func(room string, clientID string) {
+		adapter := rooms.Enter(room)
+		require.NoError(t, adapter.Add(server.NewClientWithID(NewMockWriter(), clientID)))
+	}
+
+	join("small", "client1")
+	join("large", "client2")
+	join("large", "client3")
+
+	tracks := &statsTracksManager{
+		mockTracksManager: newMockTracksManager(),
+		stats: map[string][]server.TrackStats{
+			"large": {{
+				SSRC:                 1,
+				Kind:                 "audio",
+				Publisher:            "client2",
+				Bitrate:              32000,
+				Packets:              100,
+				Bytes:                4000,
+				FractionLost:         0.25,
+				NackPackets:          3,
+				RetransmittedPackets: 2,
+			}, {
+				SSRC:             2,
+				Kind:             "video",
+				Publisher:        "client2",
+				EstimatedBitrate: 500000,
+			}},
+			"small": {{
+				SSRC:      3,
+				Kind:      "audio",
+				Publisher: "client1",
+			}},
+		},
+	}
+
+	collector := server.NewRoomMetricsCollector(loggerFactory, rooms, tracks, server.RoomMetricsConfig{
+		MaxRooms:  1,
+		MaxTracks: 1,
+	})
+
+	expected := `
+# HELP room_metrics_skipped_rooms Number of rooms not exported because of the room limit
+# TYPE room_metrics_skipped_rooms gauge
+room_metrics_skipped_rooms 1
+# HELP room_metrics_skipped_tracks Number of tracks not exported because of the track limit
+# TYPE room_metrics_skipped_tracks gauge
+room_metrics_skipped_tracks 1
+# HELP room_participants Number of participants in a room
+# TYPE room_participants gauge
+room_participants{room="large"} 2
+# HELP room_track_bitrate_bits_per_second Bitrate a track is received at
+# TYPE room_track_bitrate_bits_per_second gauge
+room_track_bitrate_bits_per_second{kind="audio",publisher="client2",room="large",ssrc="1"} 32000
+# HELP room_track_fraction_lost Highest fraction of packets lost reported by the subscribers of a track
+# TYPE room_track_fraction_lost gauge
+room_track_fraction_lost{kind="audio",publisher="client2",room="large",ssrc="1"} 0.25
+# HELP room_track_nack_packets_total Total number of packets of a track requested by NACKs
+# TYPE room_track_nack_packets_total counter
+room_track_nack_packets_total{kind="audio",publisher="client2",room="large",ssrc="1"} 3
+# HELP room_track_retransmitted_packets_total Total number of packets of a track resent from the jitter buffer
+# TYPE room_track_retransmitted_packets_total counter
+room_track_retransmitted_packets_total{kind="audio",publisher="client2",room="large",ssrc="1"} 2
+# HELP room_track_rtp_packets_received_bytes_total Total number of received RTP bytes of a track
+# TYPE room_track_rtp_packets_received_bytes_total counter
+room_track_rtp_packets_received_bytes_total{kind="audio",publisher="client2",room="large",ssrc="1"} 4000
+# HELP room_track_rtp_packets_received_total Total number of received RTP packets of a track
+# TYPE room_track_rtp_packets_received_total counter
+room_track_rtp_packets_received_total{kind="audio",publisher="client2",room="large",ssrc="1"} 100
+`
+
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+
+	collector = server.NewRoomMetricsCollector(loggerFactory, rooms, tracks, server.RoomMetricsConfig{})
+	// 2 rooms, 3 tracks with 6 metrics each, the estimate of a video track and
+	// the skipped series.
+	assert.Equal(t, 2+3*6+1+2, testutil.CollectAndCount(collector))
+}
+
+// ntpMiddle returns the middle 32 bits of the NTP timestamp of t, which
+// receiver reports use for the time of the last sender report.
+func ntpMiddle(t time.Time) uint32 {
+	seconds := uint64(t.Unix()) + 2208988800
+	fraction := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	return uint32((seconds<<32 | fraction) >> 16)
+}
+
+func TestRoomPeersManager_Stats(t *testing.T) {
+	manager := newTestRoomPeersManager()
+	defer manager.Close()
+
+	client1 := newFakeTransport("client1")
+	manager.Add(client1)
+	defer client1.Close()
+	client2 := newFakeTransport("client2")
+	manager.Add(client2)
+	defer client2.Close()
+
+	track := server.TrackInfo{
+		PayloadType: 111,
+		SSRC:        123,
+		ID:          "track1",
+		Label:       "stream1",
+		Kind:        webrtc.RTPCodecTypeAudio,
+	}
+	client1.publish(track)
+
+	select {
+	case <-client2.addedTracks:
+	case <-time.After(timeout):
+		require.Fail(t, "timed out waiting for track")
+	}
+
+	packet := &rtp.Packet{
+		Header: rtp.Header{
+			Version:     2,
+			PayloadType: 111,
+			SSRC:        123,
+		},
+		Payload: []byte{1, 2, 3},
+	}
+	client1.rtpCh <- packet
+	select {
+	case <-client2.writtenRTP:
+	case <-time.After(timeout):
+		require.Fail(t, "timed out waiting for RTP packet")
+	}
+
+	client2.rtcpCh <- &rtcp.ReceiverReport{
+		Reports: []rtcp.ReceptionReport{{
+			SSRC:         123,
+			FractionLost: 64,
+			Jitter:       10,
+			// the sender report was received 100ms ago and the report was sent
+			// 50ms after it, so the round trip took 50ms.
+			LastSenderReport: ntpMiddle(time.Now().Add(-100 * time.Millisecond)),
+			Delay:            65536 / 20,
+		}},
+	}
+	client2.rtcpCh <- &rtcp.TransportLayerNack{
+		MediaSSRC: 123,
+		Nacks:     []rtcp.NackPair{{PacketID: 10, LostPackets: 0b11}},
+	}
+	client2.rtcpCh <- &rtcp.PictureLossIndication{
+		MediaSSRC: 123,
+	}
+	client2.rtcpCh <- &rtcp.ReceiverEstimatedMaximumBitrate{
+		Bitrate: 100000,
+		SSRCs:   []uint32{123},
+	}
+
+	// RTCP packets are handled in order, so the stats have been updated once
+	// the PLI and REMB have been forwarded to the publisher.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-client1.writtenRTCP:
+		case <-time.After(timeout):
+			require.Fail(t, "timed out waiting for RTCP packets")
+		}
+	}
+
+	size := packet.MarshalSize()
+
+	stats := manager.Stats()
+
+	assert.Equal(t, []server.TrackStats{{
+		SSRC:             123,
+		Kind:             "audio",
+		Publisher:        "client1",
+		Packets:          1,
+		Bytes:            uint64(size),
+		FractionLost:     0.25,
+		Jitter:           10,
+		PLIs:             1,
+		NackPackets:      3,
+		EstimatedBitrate: 100000,
+	}}, stats.Tracks)
+
+	require.Equal(t, 2, len(stats.Transports))
+	assert.InDelta(t, 50, stats.Transports[1].RTT, 20)
+	stats.Transports[1].RTT = 0
+
+	assert.Equal(t, []server.TransportStats{{
+		ClientID:        "client1",
+		PacketsReceived: 1,
+		BytesReceived:   uint64(size),
+		PLIsSent:        1,
+	}, {
+		ClientID:         "client2",
+		PacketsSent:      1,
+		BytesSent:        uint64(size),
+		FractionLost:     0.25,
+		Jitter:           10,
+		NacksReceived:    1,
+		PLIsReceived:     1,
+		EstimatedBitrate: 100000,
+	}}, stats.Transports)
+}
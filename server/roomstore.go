@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRoomNotFound is returned by a RoomStore when a room has not been created
+// or has expired.
+var ErrRoomNotFound = errors.New("Room not found")
+
+// RoomInfo is the state of a room shared by all server instances.
+type RoomInfo struct {
+	Room      string `json:"room"`
+	CreatorID string `json:"creatorId"`
+	Recording bool   `json:"recording"`
+	// PasswordHash is the bcrypt hash of the room password. Rooms without a
+	// password can be joined by anyone who knows the room name.
+	PasswordHash string `json:"-"`
+	// Locked rooms cannot be joined by anyone other than the creator.
+	Locked bool `json:"locked"`
+	// Lobby makes new clients wait until they are admitted by the creator.
+	Lobby bool `json:"lobby"`
+}
+
+// RoomStore keeps track of created rooms. Rooms expire when they have not
+// been touched for the TTL configured in StoreConfig, so that rooms which
+// were abandoned without everyone leaving are eventually removed.
+type RoomStore interface {
+	// Create creates the room unless it already exists. It returns the
+	// current state of the room and whether it was created by this call.
+	Create(room string, creatorID string) (info RoomInfo, created bool, err error)
+	// Get returns ErrRoomNotFound when the room does not exist.
+	Get(room string) (RoomInfo, error)
+	SetRecording(room string, recording bool) error
+	// SetPassword sets the password hash. An empty hash removes the password.
+	SetPassword(room string, passwordHash string) error
+	SetLocked(room string, locked bool) error
+	SetLobby(room string, lobby bool) error
+	// SetCreator makes another user the moderator of the room.
+	SetCreator(room string, creatorID string) error
+	// Ban prevents a user or client from joining the room for duration. Bans
+	// do not expire with the room.
+	Ban(room string, id string, duration time.Duration) error
+	Banned(room string, id string) (bool, error)
+	// Touch extends the expiry of the room.
+	Touch(room string) error
+	Remove(room string) error
+	Close() error
+}
+
+// handleCreateRoomMessage makes the user the creator of the room unless it
+// has already been created. The current creator is sent back to the client.
+func handleCreateRoomMessage(
+	log Logger,
+	roomStore RoomStore,
+	adapter Adapter,
+	room string,
+	clientID string,
+	userID string,
+) error {
+	if roomStore == nil {
+		return fmt.Errorf("[%s] Ignoring create_room because rooms are not tracked", clientID)
+	}
+
+	var info RoomInfo
+	var created bool
+	var err error
+
+	if userID == "" {
+		// anonymous users cannot create rooms, but can see who created it
+		info, err = roomStore.Get(room)
+		if errors.Is(err, ErrRoomNotFound) {
+			err = nil
+		}
+	} else {
+		info, created, err = roomStore.Create(room, userID)
+	}
+	if err != nil {
+		return fmt.Errorf("[%s] Error creating room: %w", clientID, err)
+	}
+
+	successful := "0"
+	if created {
+		log.Info("Room created", Fields{"userId": userID})
+		successful = "1"
+	}
+
+	return adapter.Emit(clientID, NewMessage("room_created", room, RoomCreatedPayload{
+		Successful: successful,
+		CreatorID:  info.CreatorID,
+	}))
+}
+
+// touchRoom extends the expiry of a room which is still in use and returns
+// its current state.
+func touchRoom(log Logger, roomStore RoomStore, room string) RoomInfo {
+	if roomStore == nil {
+		return RoomInfo{Room: room}
+	}
+
+	if err := roomStore.Touch(room); err != nil && !errors.Is(err, ErrRoomNotFound) {
+		log.Error("Error touching room", Fields{"error": err})
+	}
+
+	info, err := roomStore.Get(room)
+	if err != nil {
+		return RoomInfo{Room: room}
+	}
+
+	return info
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// mungerHistorySize is the number of forwarded packets for which the
+// sequence number mapping is remembered, so that NACKs can be translated
+// and retransmissions can be rewritten.
+const mungerHistorySize = 1024
+
+type mungerHistoryEntry struct {
+	valid      bool
+	sourceSSRC uint32
+	sourceSN   uint16
+	sn         uint16
+}
+
+// RTPMunger rewrites the packets forwarded to a single local track of a
+// subscriber. It owns the outgoing SSRC, sequence numbers and timestamps, so
+// the forwarded track can be paused and resumed, switched between different
+// sources (for example simulcast layers) and have packets dropped, without
+// the subscriber seeing gaps in sequence numbers or timestamp jumps.
+type RTPMunger struct {
+	mu sync.Mutex
+
+	ssrc      uint32
+	clockRate uint32
+
+	initialized bool
+	paused      bool
+
+	sourceSSRC uint32
+	snOffset   uint16
+	tsOffset   uint32
+
+	lastSN   uint16
+	lastTS   uint32
+	lastTime time.Time
+
+	// history is indexed by outgoing sequence number
+	history [mungerHistorySize]mungerHistoryEntry
+	// sourceHistory is indexed by source sequence number
+	sourceHistory [mungerHistorySize]mungerHistoryEntry
+}
+
+// NewRTPMunger creates a new munger which writes packets with ssrc. The
+// clockRate of the codec is used to advance timestamps when the source
+// changes or the track is resumed.
+func NewRTPMunger(ssrc uint32, clockRate uint32) *RTPMunger {
+	return &RTPMunger{
+		ssrc:      ssrc,
+		clockRate: clockRate,
+	}
+}
+
+// SSRC returns the outgoing SSRC.
+func (m *RTPMunger) SSRC() uint32 {
+	return m.ssrc
+}
+
+// Pause stops forwarding packets until Resume is called.
+func (m *RTPMunger) Pause() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.paused = true
+}
+
+// Resume resumes forwarding packets. The first packet after resuming will
+// continue the sequence numbers from the last packet sent before the pause.
+func (m *RTPMunger) Resume() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.paused {
+		m.paused = false
+		// force the offsets to be recalculated on next packet
+		m.sourceSSRC = 0
+	}
+}
+
+// Paused returns true when the munger has been paused.
+func (m *RTPMunger) Paused() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.paused
+}
+
+// Munge rewrites a packet to be sent to the subscriber. It returns false when
+// the track is paused. When the packet comes from a different source than
+// the previous packet, the sequence numbers and timestamps continue from the
+// last packet sent.
+func (m *RTPMunger) Munge(packet *rtp.Packet) (*rtp.Packet, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.paused {
+		return nil, false
+	}
+
+	now := time.Now()
+
+	if !m.initialized {
+		m.initialized = true
+		m.sourceSSRC = packet.SSRC
+		m.lastSN = packet.SequenceNumber - 1
+		m.lastTS = packet.Timestamp
+		m.lastTime = now
+	} else if packet.SSRC != m.sourceSSRC {
+		// advance the timestamp by the wall clock time elapsed since the last
+		// packet so that the subscriber's jitter calculations are not affected.
+		elapsed := uint32(now.Sub(m.lastTime).Seconds() * float64(m.clockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+
+		m.sourceSSRC = packet.SSRC
+		m.snOffset = packet.SequenceNumber - (m.lastSN + 1)
+		m.tsOffset = packet.Timestamp - (m.lastTS + elapsed)
+	}
+
+	munged := m.munge(packet, packet.SequenceNumber-m.snOffset)
+
+	if isNewerSequenceNumber(munged.SequenceNumber, m.lastSN) {
+		m.lastSN = munged.SequenceNumber
+		m.lastTS = munged.Timestamp
+		m.lastTime = now
+	}
+
+	entry := mungerHistoryEntry{
+		valid:      true,
+		sourceSSRC: packet.SSRC,
+		sourceSN:   packet.SequenceNumber,
+		sn:         munged.SequenceNumber,
+	}
+	m.history[munged.SequenceNumber%mungerHistorySize] = entry
+	m.sourceHistory[packet.SequenceNumber%mungerHistorySize] = entry
+
+	return munged, true
+}
+
+// Drop skips a packet from the current source which will not be forwarded
+// to the subscriber, so that the following packets do not leave a gap in
+// sequence numbers. Only the latest packet received from the source can be
+// dropped.
+func (m *RTPMunger) Drop(packet *rtp.Packet) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.initialized || m.paused || packet.SSRC != m.sourceSSRC {
+		return
+	}
+
+	if packet.SequenceNumber-m.snOffset == m.lastSN+1 {
+		m.snOffset++
+	}
+}
+
+// MungeRetransmission rewrites a packet retransmitted because of a NACK. It
+// returns false if the packet was never forwarded to the subscriber.
+func (m *RTPMunger) MungeRetransmission(packet *rtp.Packet) (*rtp.Packet, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.sourceHistory[packet.SequenceNumber%mungerHistorySize]
+	if !entry.valid || entry.sourceSSRC != packet.SSRC || entry.sourceSN != packet.SequenceNumber {
+		return nil, false
+	}
+
+	return m.munge(packet, entry.sn), true
+}
+
+func (m *RTPMunger) munge(packet *rtp.Packet, sn uint16) *rtp.Packet {
+	munged := &rtp.Packet{
+		Header:  packet.Header,
+		Payload: packet.Payload,
+	}
+	munged.SSRC = m.ssrc
+	munged.SequenceNumber = sn
+	munged.Timestamp = packet.Timestamp - m.tsOffset
+	return munged
+}
+
+// Unmunge translates an outgoing sequence number, for example from a NACK,
+// back to the source SSRC and sequence number.
+func (m *RTPMunger) Unmunge(sn uint16) (sourceSSRC uint32, sourceSN uint16, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.history[sn%mungerHistorySize]
+	if !entry.valid || entry.sn != sn {
+		return 0, 0, false
+	}
+
+	return entry.sourceSSRC, entry.sourceSN, true
+}
+
+// isNewerSequenceNumber returns true when sn a comes after sn b, taking
+// wraparound into account.
+func isNewerSequenceNumber(a, b uint16) bool {
+	return a != b && a-b < 0x8000
+}
+
+// newSSRC generates a random non-zero SSRC for a local track.
+func newSSRC() uint32 {
+	var b [4]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		if ssrc := binary.BigEndian.Uint32(b[:]); ssrc != 0 {
+			return ssrc
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRTPPacket(ssrc uint32, sn uint16, ts uint32) *rtp.Packet {
+	packet := &rtp.Packet{}
+	packet.SSRC = ssrc
+	packet.SequenceNumber = sn
+	packet.Timestamp = ts
+	return packet
+}
+
+func mustMunge(t *testing.T, m *RTPMunger, packet *rtp.Packet) *rtp.Packet {
+	t.Helper()
+	munged, ok := m.Munge(packet)
+	require.True(t, ok, "expected packet to be munged")
+	return munged
+}
+
+func TestRTPMunger_Munge(t *testing.T) {
+	m := NewRTPMunger(100, videoClock)
+
+	p1 := mustMunge(t, m, newRTPPacket(1, 10, 1000))
+	p2 := mustMunge(t, m, newRTPPacket(1, 11, 2000))
+
+	assert.Equal(t, uint32(100), p1.SSRC)
+	assert.Equal(t, uint16(10), p1.SequenceNumber)
+	assert.Equal(t, uint32(1000), p1.Timestamp)
+	assert.Equal(t, uint16(11), p2.SequenceNumber)
+	assert.Equal(t, uint32(2000), p2.Timestamp)
+}
+
+func TestRTPMunger_switchSource(t *testing.T) {
+	m := NewRTPMunger(100, videoClock)
+
+	mustMunge(t, m, newRTPPacket(1, 100, 1000))
+	p2 := mustMunge(t, m, newRTPPacket(1, 101, 2000))
+
+	p3 := mustMunge(t, m, newRTPPacket(2, 5000, 90000))
+	assert.Equal(t, uint32(100), p3.SSRC)
+	assert.Equal(t, uint16(102), p3.SequenceNumber)
+	assert.True(t, p3.Timestamp > p2.Timestamp)
+
+	p4 := mustMunge(t, m, newRTPPacket(2, 5001, 90100))
+	assert.Equal(t, uint16(103), p4.SequenceNumber)
+	assert.Equal(t, p3.Timestamp+100, p4.Timestamp)
+
+	ssrc, sn, ok := m.Unmunge(103)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(2), ssrc)
+	assert.Equal(t, uint16(5001), sn)
+
+	ssrc, sn, ok = m.Unmunge(101)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(1), ssrc)
+	assert.Equal(t, uint16(101), sn)
+
+	_, _, ok = m.Unmunge(104)
+	assert.False(t, ok, "packets not sent yet cannot be translated")
+}
+
+func TestRTPMunger_wraparound(t *testing.T) {
+	m := NewRTPMunger(100, videoClock)
+
+	mustMunge(t, m, newRTPPacket(1, 65535, 1000))
+	p := mustMunge(t, m, newRTPPacket(2, 10, 1000))
+	assert.Equal(t, uint16(0), p.SequenceNumber)
+
+	ssrc, sn, ok := m.Unmunge(0)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(2), ssrc)
+	assert.Equal(t, uint16(10), sn)
+}
+
+func TestRTPMunger_PauseResume(t *testing.T) {
+	m := NewRTPMunger(100, videoClock)
+
+	mustMunge(t, m, newRTPPacket(1, 10, 1000))
+
+	m.Pause()
+	assert.True(t, m.Paused())
+	_, ok := m.Munge(newRTPPacket(1, 11, 2000))
+	assert.False(t, ok)
+	_, ok = m.Munge(newRTPPacket(1, 12, 3000))
+	assert.False(t, ok)
+
+	m.Resume()
+	assert.False(t, m.Paused())
+	p := mustMunge(t, m, newRTPPacket(1, 500, 90000))
+	assert.Equal(t, uint16(11), p.SequenceNumber, "should continue after the last packet sent")
+}
+
+func TestRTPMunger_Drop(t *testing.T) {
+	m := NewRTPMunger(100, videoClock)
+
+	mustMunge(t, m, newRTPPacket(1, 10, 1000))
+	m.Drop(newRTPPacket(1, 11, 1000))
+	p := mustMunge(t, m, newRTPPacket(1, 12, 2000))
+	assert.Equal(t, uint16(11), p.SequenceNumber)
+
+	ssrc, sn, ok := m.Unmunge(11)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(1), ssrc)
+	assert.Equal(t, uint16(12), sn)
+}
+
+func TestRTPMunger_MungeRetransmission(t *testing.T) {
+	m := NewRTPMunger(100, videoClock)
+
+	mustMunge(t, m, newRTPPacket(1, 10, 1000))
+	mustMunge(t, m, newRTPPacket(2, 50, 5000))
+
+	p, ok := m.MungeRetransmission(newRTPPacket(1, 10, 1000))
+	require.True(t, ok)
+	assert.Equal(t, uint32(100), p.SSRC)
+	assert.Equal(t, uint16(10), p.SequenceNumber)
+
+	_, ok = m.MungeRetransmission(newRTPPacket(1, 11, 1000))
+	assert.False(t, ok, "packet was never forwarded")
+}
+
+func TestUnmungeRTCP_nack(t *testing.T) {
+	m := NewRTPMunger(100, videoClock)
+
+	mustMunge(t, m, newRTPPacket(1, 10, 1000))
+	mustMunge(t, m, newRTPPacket(1, 11, 1000))
+	mustMunge(t, m, newRTPPacket(2, 500, 1000))
+
+	packets := unmungeRTCP(&rtcp.TransportLayerNack{
+		SenderSSRC: 7,
+		MediaSSRC:  100,
+		Nacks:      []rtcp.NackPair{CreateNackPair([]uint16{11, 12})},
+	}, 1, m)
+
+	nacks := map[uint32][]uint16{}
+	for _, packet := range packets {
+		nack, ok := packet.(*rtcp.TransportLayerNack)
+		require.True(t, ok)
+		assert.Equal(t, uint32(7), nack.SenderSSRC)
+		for _, nackPair := range nack.Nacks {
+			nacks[nack.MediaSSRC] = append(nacks[nack.MediaSSRC], nackPair.PacketList()...)
+		}
+	}
+
+	assert.Equal(t, map[uint32][]uint16{
+		1: {11},
+		2: {500},
+	}, nacks)
+}
+
+func TestUnmungeRTCP_remb(t *testing.T) {
+	m := NewRTPMunger(100, videoClock)
+
+	packets := unmungeRTCP(&rtcp.ReceiverEstimatedMaximumBitrate{
+		Bitrate: 1000,
+		SSRCs:   []uint32{100, 200},
+	}, 1, m)
+	require.Len(t, packets, 1)
+	assert.Equal(t, []uint32{1}, packets[0].(*rtcp.ReceiverEstimatedMaximumBitrate).SSRCs)
+
+	packets = unmungeRTCP(&rtcp.ReceiverEstimatedMaximumBitrate{
+		Bitrate: 1000,
+		SSRCs:   []uint32{200},
+	}, 1, m)
+	assert.Len(t, packets, 0, "REMB for other local tracks should be ignored")
+}
@@ -1,12 +1,15 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/pion/webrtc/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const IOSH264Fmtp = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"
@@ -26,12 +29,14 @@ func NewSFUHandler(
 	iceServers []ICEServer,
 	sfuConfig NetworkConfigSFU,
 	tracksManager TracksManager,
+	roomStore RoomStore,
+	recorder Recorder,
 ) *SFU {
 	log := loggerFactory.GetLogger("sfu")
 
 	webRTCTransportFactory := NewWebRTCTransportFactory(loggerFactory, iceServers, sfuConfig)
 
-	return &SFU{loggerFactory, log, wss, tracksManager, webRTCTransportFactory}
+	return &SFU{loggerFactory, log, wss, tracksManager, webRTCTransportFactory, roomStore, recorder, sfuConfig.StatsInterval}
 }
 
 type SFU struct {
@@ -41,35 +46,66 @@ type SFU struct {
 	tracksManager TracksManager
 
 	webRTCTransportFactory *WebRTCTransportFactory
+
+	roomStore     RoomStore
+	recorder      Recorder
+	statsInterval time.Duration
 }
 
 func (sfu *SFU) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	sub, err := sfu.wss.Subscribe(w, r)
 	if err != nil {
-		sfu.log.Printf("Error accepting websocket connection: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		sfu.log.Warn("Error accepting websocket connection", Fields{"error": err})
+		return
+	}
+
+	if sub.Resumed {
+		// the messages are handled by the SocketHandler of the original
+		// subscription, wait until this connection is closed.
+		for range sub.Messages {
+		}
 		return
 	}
 
 	socketHandler := NewSocketHandler(
+		sub.Context,
 		sfu.loggerFactory,
 		sfu.tracksManager,
 		sfu.webRTCTransportFactory,
 		sub.ClientID,
 		sub.Room,
 		sub.Adapter,
+		sub.Identity,
+		sub.Deserializer,
+		sfu.roomStore,
+		sfu.recorder,
+		sfu.statsInterval,
 	)
 
 	for message := range sub.Messages {
 		err := socketHandler.HandleMessage(message)
 		if err != nil {
-			sfu.log.Printf("[%s] Error handling websocket message: %s", sub.ClientID, err)
+			sfu.log.Error("Error handling websocket message", Fields{
+				"room":     sub.Room,
+				"clientId": sub.ClientID,
+				"type":     message.Type,
+				"error":    err,
+			})
+			if err := replyError(sub.Adapter, sub.Room, sub.ClientID, sub.Version(), err); err != nil {
+				sfu.log.Error("Error sending error message", Fields{
+					"room":     sub.Room,
+					"clientId": sub.ClientID,
+					"error":    err,
+				})
+			}
 		}
 	}
 	socketHandler.Cleanup()
 }
 
 type SocketHandler struct {
+	// ctx carries the trace of the websocket connection.
+	ctx                    context.Context
 	loggerFactory          LoggerFactory
 	log                    Logger
 	tracksManager          TracksManager
@@ -79,25 +115,47 @@ type SocketHandler struct {
 	clientID               string
 	room                   string
 
+	identity     Identity
+	deserializer Deserializer
+	roomStore    RoomStore
+	recorder     Recorder
+	// statsInterval is how often the moderator receives the stats message.
+	statsInterval time.Duration
+
 	mu sync.Mutex
 }
 
 func NewSocketHandler(
+	ctx context.Context,
 	loggerFactory LoggerFactory,
 	tracksManager TracksManager,
 	webRTCTransportFactory *WebRTCTransportFactory,
 	clientID string,
 	room string,
 	adapter Adapter,
+	identity Identity,
+	deserializer Deserializer,
+	roomStore RoomStore,
+	recorder Recorder,
+	statsInterval time.Duration,
 ) *SocketHandler {
 	return &SocketHandler{
-		loggerFactory:          loggerFactory,
-		log:                    loggerFactory.GetLogger("sfu"),
+		ctx:           ctx,
+		loggerFactory: loggerFactory,
+		log: loggerFactory.GetLogger("sfu").WithFields(Fields{
+			"room":     room,
+			"clientId": clientID,
+		}),
 		tracksManager:          tracksManager,
 		webRTCTransportFactory: webRTCTransportFactory,
 		clientID:               clientID,
 		room:                   room,
 		adapter:                adapter,
+		identity:               identity,
+		deserializer:           deserializer,
+		roomStore:              roomStore,
+		recorder:               recorder,
+		statsInterval:          statsInterval,
 	}
 }
 
@@ -112,34 +170,42 @@ func (sh *SocketHandler) HandleMessage(message Message) error {
 		return sh.handleReady(message)
 	case "signal":
 		return sh.handleSignal(message)
+	case "create_room":
+		return sh.handleCreateRoom(message)
+	case "record":
+		return sh.handleRecord(message)
+	case "mute":
+		return sh.handleMute(message)
+	case "ice_servers":
+		return handleICEServersMessage(sh.adapter, sh.webRTCTransportFactory.iceServers, sh.room, sh.clientID, sh.identity)
 	case "ping":
 		return nil
 	}
 
-	return fmt.Errorf("Unhandled event: %s", message.Type)
+	return newUnknownTypeError(message)
 }
 
 func (sh *SocketHandler) Cleanup() {
 	if sh.webRTCTransport != nil {
 		if err := sh.webRTCTransport.Close(); err != nil {
-			sh.log.Printf("[%s] cleanup: error in webRTCTransport.Close: %s", sh.clientID, err)
+			sh.log.Error("Error closing WebRTC transport during cleanup", Fields{"error": err})
 		}
 	}
 
 	err := sh.adapter.Broadcast(
-		NewMessage("hangUp", sh.room, map[string]string{
-			"userId": sh.clientID,
+		NewMessage("hangUp", sh.room, HangUpPayload{
+			UserID: sh.clientID,
 		}),
 	)
 	if err != nil {
-		sh.log.Printf("[%s] cleanup: error broadcasting hangUp: %s", sh.clientID, err)
+		sh.log.Error("Error broadcasting hangUp during cleanup", Fields{"error": err})
 	}
 }
 
 func (sh *SocketHandler) handleHangUp(event Message) error {
 	clientID := sh.clientID
 
-	sh.log.Printf("[%s] hangUp event", clientID)
+	sh.log.Info("hangUp event", nil)
 
 	if sh.webRTCTransport != nil {
 		closeErr := sh.webRTCTransport.Close()
@@ -151,11 +217,19 @@ func (sh *SocketHandler) handleHangUp(event Message) error {
 	return nil
 }
 
-func (sh *SocketHandler) handleReady(message Message) error {
+func (sh *SocketHandler) handleReady(message Message) (err error) {
 	adapter := sh.adapter
 	room := sh.room
 	clientID := sh.clientID
 
+	ctx, span := startSpan(sh.ctx, "SocketHandler.handleReady", trace.WithAttributes(
+		attribute.String("room", room),
+		attribute.String("clientId", clientID),
+	))
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	initiator := localPeerID
 	if !serverIsInitiator {
 		initiator = clientID
@@ -163,19 +237,18 @@ func (sh *SocketHandler) handleReady(message Message) error {
 
 	start := time.Now()
 
-	sh.log.Printf("[%s] Initiator: %s", clientID, initiator)
+	sh.log.Info("Ready", Fields{"initiator": initiator})
 
 	if sh.webRTCTransport != nil {
 		return fmt.Errorf("Unexpected ready event in room %s - already have a webrtc transport", room)
 	}
 
-	// FIXME check for errors
-	payload, ok := message.Payload.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("Ready message payload is of wrong type: %T", message.Payload)
+	var payload ReadyPayload
+	if err := sh.deserializer.DeserializePayload(message, &payload); err != nil {
+		return err
 	}
 
-	adapter.SetMetadata(clientID, payload["nickname"].(string))
+	adapter.SetMetadata(clientID, payload.Nickname)
 
 	clients, err := getReadyClients(adapter)
 	if err != nil {
@@ -183,17 +256,18 @@ func (sh *SocketHandler) handleReady(message Message) error {
 	}
 
 	err = adapter.Broadcast(
-		NewMessage("users", room, map[string]interface{}{
-			"initiator": initiator,
-			"peerIds":   []string{localPeerID},
-			"nicknames": clients,
-		}),
+		NewMessage("users", room, UsersPayload{
+			Initiator:    initiator,
+			PeerIDs:      []string{localPeerID},
+			Nicknames:    clients,
+			RecordStatus: touchRoom(sh.log, sh.roomStore, room).Recording,
+		}).WithContext(ctx),
 	)
 	if err != nil {
 		return fmt.Errorf("Error broadcasting users message: %s", err)
 	}
 
-	webRTCTransport, err := sh.webRTCTransportFactory.NewWebRTCTransport(clientID)
+	webRTCTransport, err := sh.webRTCTransportFactory.NewWebRTCTransport(ctx, clientID, sh.identity.Role() == RoleViewer)
 	if err != nil {
 		return fmt.Errorf("Error creating new WebRTCTransport: %w", err)
 	}
@@ -203,24 +277,117 @@ func (sh *SocketHandler) handleReady(message Message) error {
 	prometheusWebRTCConnActive.Inc()
 
 	sh.tracksManager.Add(room, webRTCTransport)
-	go sh.processLocalSignals(message, webRTCTransport.SignalChannel(), start)
+	go sh.processLocalSignals(ctx, message, webRTCTransport.SignalChannel(), start)
+	if sh.statsInterval > 0 {
+		go sh.sendStats(webRTCTransport.CloseChannel())
+	}
 	return nil
 }
 
+// sendStats periodically sends the statistics of the transports and tracks
+// in the room to the client while it is the moderator, until done is closed.
+func (sh *SocketHandler) sendStats(done <-chan struct{}) {
+	ticker := time.NewTicker(sh.statsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := sh.roomStore.Get(sh.room)
+		if err != nil || !isModerator(sh.identity, info) {
+			continue
+		}
+
+		stats, ok := sh.tracksManager.Stats(sh.room)
+		if !ok {
+			continue
+		}
+
+		if err := sh.adapter.Emit(sh.clientID, NewMessage("stats", sh.room, stats)); err != nil {
+			sh.log.Error("Error sending stats", Fields{"error": err})
+		}
+	}
+}
+
 func (sh *SocketHandler) handleSignal(message Message) error {
-	payload, ok := message.Payload.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("[%s] Ignoring signal because it is of unexpected type: %T", sh.clientID, payload)
+	var payload SignalPayload
+	if err := sh.deserializer.DeserializePayload(message, &payload); err != nil {
+		return err
 	}
 
 	if sh.webRTCTransport == nil {
 		return fmt.Errorf("[%s] Ignoring signal '%v' because webRTCTransport is not initialized", sh.clientID, payload)
 	}
 
-	return sh.webRTCTransport.Signal(payload)
+	return sh.webRTCTransport.Signal(NewPayloadFromSignal(payload))
+}
+
+func (sh *SocketHandler) handleCreateRoom(message Message) error {
+	return handleCreateRoomMessage(sh.log, sh.roomStore, sh.adapter, sh.room, sh.clientID, sh.identity.UserID)
+}
+
+func (sh *SocketHandler) handleRecord(message Message) error {
+	return handleRecordMessage(sh.log, sh.recorder, sh.adapter, sh.roomStore, sh.deserializer, message, sh.room, sh.clientID, sh.identity)
+}
+
+// handleMute stops or resumes forwarding the audio or video of a participant
+// at the server. Only the moderator can do this, and everyone in the room is
+// told about the change.
+func (sh *SocketHandler) handleMute(message Message) error {
+	var payload MutePayload
+	if err := sh.deserializer.DeserializePayload(message, &payload); err != nil {
+		return err
+	}
+
+	targetClientID := payload.ClientID
+	muted := payload.Muted
+
+	muteFailed := func() error {
+		return sh.adapter.Emit(sh.clientID, NewMessage("mute", sh.room, ResultPayload{
+			Successful: false,
+			ClientID:   targetClientID,
+		}))
+	}
+
+	info, err := sh.roomStore.Get(sh.room)
+	if err != nil || !isModerator(sh.identity, info) {
+		sh.log.Warn("Only the moderator can mute", nil)
+		return muteFailed()
+	}
+
+	kind := webrtc.NewRTPCodecType(payload.Kind)
+
+	if err := sh.tracksManager.Mute(sh.room, targetClientID, kind, muted); err != nil {
+		sh.log.Error("Error changing mute", Fields{
+			"targetClientId": targetClientID,
+			"muted":          muted,
+			"error":          err,
+		})
+		return muteFailed()
+	}
+
+	err = sh.adapter.Emit(sh.clientID, NewMessage("mute", sh.room, ResultPayload{
+		Successful: true,
+		ClientID:   targetClientID,
+	}))
+	if err != nil {
+		sh.log.Error("Error sending mute response", Fields{"error": err})
+	}
+
+	return sh.adapter.Broadcast(NewMessage("mute_changed", sh.room, MutePayload{
+		ClientID: targetClientID,
+		Kind:     kind.String(),
+		Muted:    muted,
+	}))
 }
 
-func (sh *SocketHandler) processLocalSignals(message Message, signals <-chan Payload, startTime time.Time) {
+// processLocalSignals sends the signals of the server's peer connection to
+// the client. The messages are sent in the trace of ctx.
+func (sh *SocketHandler) processLocalSignals(ctx context.Context, message Message, signals <-chan Payload, startTime time.Time) {
 	room := sh.room
 	adapter := sh.adapter
 	clientID := sh.clientID
@@ -231,15 +398,15 @@ func (sh *SocketHandler) processLocalSignals(message Message, signals <-chan Pay
 				err := adapter.Emit(clientID, NewMessage("metadata", room, MetadataPayload{
 					UserID:   localPeerID,
 					Metadata: metadata,
-				}))
+				}).WithContext(ctx))
 				if err != nil {
-					sh.log.Printf("[%s] Error sending metadata: %s", clientID, err)
+					sh.log.Error("Error sending metadata", Fields{"error": err})
 				}
 			}
 		}
-		err := adapter.Emit(clientID, NewMessage("signal", room, signal))
+		err := adapter.Emit(clientID, NewMessage("signal", room, signal).WithContext(ctx))
 		if err != nil {
-			sh.log.Printf("[%s] Error sending local signal: %s", clientID, err)
+			sh.log.Error("Error sending local signal", Fields{"error": err})
 			// TODO abort connection
 		}
 	}
@@ -250,15 +417,15 @@ func (sh *SocketHandler) processLocalSignals(message Message, signals <-chan Pay
 	sh.mu.Lock()
 	defer sh.mu.Unlock()
 	sh.webRTCTransport = nil
-	sh.log.Printf("[%s] Peer connection closed, emitting hangUp event", clientID)
+	sh.log.Info("Peer connection closed, emitting hangUp event", nil)
 	adapter.SetMetadata(clientID, "")
 
 	err := sh.adapter.Broadcast(
-		NewMessage("hangUp", room, map[string]string{
-			"userId": sh.clientID,
+		NewMessage("hangUp", room, HangUpPayload{
+			UserID: sh.clientID,
 		}),
 	)
 	if err != nil {
-		sh.log.Printf("[%s] Error broadcasting hangUp: %s", sh.clientID, err)
+		sh.log.Error("Error broadcasting hangUp", Fields{"error": err})
 	}
 }
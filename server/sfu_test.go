@@ -19,12 +19,18 @@ import (
 )
 
 func setupSFUServer(rooms server.RoomManager, jitterBufferEnabled bool) (s *httptest.Server, url string) {
+	return setupSFUServerWithStore(rooms, jitterBufferEnabled, server.NewMemoryRoomStore(time.Hour))
+}
+
+func setupSFUServerWithStore(rooms server.RoomManager, jitterBufferEnabled bool, roomStore server.RoomStore) (s *httptest.Server, url string) {
 	handler := server.NewSFUHandler(
 		loggerFactory,
-		server.NewWSS(loggerFactory, rooms),
+		server.NewWSS(loggerFactory, rooms, server.NewAnonymousAuthenticator([]byte(jwtSecret)), nil, nil, nil),
 		[]server.ICEServer{},
 		server.NetworkConfigSFU{},
-		server.NewMemoryTracksManager(loggerFactory, jitterBufferEnabled),
+		server.NewMemoryTracksManager(loggerFactory, jitterBufferEnabled, nil),
+		roomStore,
+		nil,
 	)
 	s = httptest.NewServer(handler)
 	url = "ws" + strings.TrimPrefix(s.URL, "http") + "/ws/"
@@ -74,9 +80,10 @@ func startSignalling(t *testing.T, wsClient *server.Client, wsRecvCh <-chan serv
 	go func() {
 		for msg := range wsRecvCh {
 			if msg.Type == "signal" {
-				payload, ok := msg.Payload.(map[string]interface{})
-				require.True(t, ok, "invalid signal msg payload type")
-				err := signaller.Signal(payload)
+				var payload server.SignalPayload
+				err := server.ByteSerializer{}.DeserializePayload(msg, &payload)
+				require.NoError(t, err, "invalid signal msg payload: %w", err)
+				err = signaller.Signal(payload)
 				require.NoError(t, err, "error in receiving signal payload: %w", err)
 			}
 		}
@@ -125,11 +132,14 @@ func createPeerConnection(t *testing.T, ctx context.Context, url string, clientI
 	require.Nil(t, err, "error creating peer connection")
 
 	signaller, err = server.NewSignaller(
+		ctx,
 		loggerFactory,
 		false,
+		false,
 		pc,
 		clientID,
 		"__SERVER__",
+		0,
 	)
 	require.Nil(t, err, "error creating signaller")
 
@@ -260,3 +270,93 @@ func TestSFU_OnTrack(t *testing.T) {
 	wait(t, ctx, signaller2.NegotiationDone())
 	log.Println("Negotiation (3) done ======================================================")
 }
+
+func TestSFU_mute(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	newAdapter := server.NewAdapterFactory(loggerFactory, server.StoreConfig{})
+	defer newAdapter.Close()
+	rooms := server.NewAdapterRoomManager(newAdapter.NewAdapter)
+	store := server.NewMemoryRoomStore(time.Hour)
+	_, _, err := store.Create(roomName, creatorID)
+	require.NoError(t, err)
+	srv, wsBaseURL := setupSFUServerWithStore(rooms, false, store)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	pc, _, cleanup := createPeerConnection(t, ctx, wsBaseURL+roomName+"/"+clientID2, clientID2)
+	defer cleanup()
+	waitPeerConnected(t, ctx, pc)
+
+	other := mustDialWS(t, ctx, wsBaseURL+roomName+"/other")
+	defer other.Close(websocket.StatusNormalClosure, "")
+	mustWriteWS(t, ctx, other, server.NewMessage("mute", roomName, map[string]interface{}{
+		"clientId": clientID2,
+		"kind":     "video",
+		"muted":    true,
+	}))
+	msg := readWSType(t, ctx, other, "mute")
+	assert.Equal(t, map[string]interface{}{
+		"successful": false,
+		"clientId":   clientID2,
+	}, msg.Payload)
+
+	moderator := dialAsUser(t, ctx, wsBaseURL+roomName+"/"+clientID, creatorID)
+	defer moderator.Close(websocket.StatusNormalClosure, "")
+	mustWriteWS(t, ctx, moderator, server.NewMessage("mute", roomName, map[string]interface{}{
+		"clientId": clientID2,
+		"kind":     "video",
+		"muted":    true,
+	}))
+	msg = readWSType(t, ctx, moderator, "mute")
+	assert.Equal(t, map[string]interface{}{
+		"successful": true,
+		"clientId":   clientID2,
+	}, msg.Payload)
+
+	msg = readWSType(t, ctx, other, "mute_changed")
+	assert.Equal(t, map[string]interface{}{
+		"clientId": clientID2,
+		"kind":     "video",
+		"muted":    true,
+	}, msg.Payload)
+}
+
+func TestSFU_invalidMessage(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	newAdapter := server.NewAdapterFactory(loggerFactory, server.StoreConfig{})
+	defer newAdapter.Close()
+	rooms := server.NewAdapterRoomManager(newAdapter.NewAdapter)
+	srv, wsBaseURL := setupSFUServer(rooms, false)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ws := mustDialWSVersion(t, ctx, wsBaseURL+roomName+"/"+clientID, server.ProtocolVersion)
+	defer ws.Close(websocket.StatusNormalClosure, "")
+
+	mustWriteWS(t, ctx, ws, server.NewMessage("ready", roomName, "nickname"))
+	msg := readWSType(t, ctx, ws, server.MessageTypeError)
+	payload, ok := msg.Payload.(map[string]interface{})
+	require.True(t, ok, "unexpected payload type: %T", msg.Payload)
+	assert.Equal(t, "ready", payload["type"])
+	assert.Equal(t, server.ErrorCodeInvalidPayload, payload["code"])
+
+	mustWriteWS(t, ctx, ws, server.NewMessage("signal", roomName, map[string]interface{}{
+		"userId": "__SERVER__",
+		"signal": map[string]interface{}{"unknown": true},
+	}))
+	msg = readWSType(t, ctx, ws, server.MessageTypeError)
+	payload, ok = msg.Payload.(map[string]interface{})
+	require.True(t, ok, "unexpected payload type: %T", msg.Payload)
+	assert.Equal(t, "signal", payload["type"])
+	assert.Equal(t, server.ErrorCodeInvalidPayload, payload["code"])
+
+	mustWriteWS(t, ctx, ws, server.NewMessage("unknown", roomName, nil))
+	msg = readWSType(t, ctx, ws, server.MessageTypeError)
+	assert.Equal(t, map[string]interface{}{
+		"type":    "unknown",
+		"code":    server.ErrorCodeUnknownType,
+		"message": "Unhandled event: unknown",
+	}, msg.Payload)
+}
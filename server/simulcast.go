@@ -0,0 +1,461 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Pion v2 binds a single SSRC to each transceiver, so the simulcast layers of
+// a video track arrive as separate remote tracks which share the same stream
+// label and track ID (Plan B ssrc-group:SIM, or the same MediaStreamTrack
+// added to multiple transceivers with different encoding parameters). The
+// SFU groups these tracks into a SimulcastTrack and forwards only one layer
+// to each subscriber.
+
+// simulcastUpgradeInterval is the minimum time between a layer switch and
+// switching to a higher layer, so that a subscriber does not oscillate
+// between two layers.
+const simulcastUpgradeInterval = 5 * time.Second
+
+// simulcastUpgradeHeadroom is the factor by which the subscriber's bitrate
+// estimate must exceed the bitrate of a higher layer before switching to it.
+const simulcastUpgradeHeadroom = 1.15
+
+// simulcastMaxFractionLost is the fraction of lost packets (out of 256, as
+// reported in RTCP receiver reports) above which a subscriber is switched to
+// a lower layer regardless of its bitrate estimate.
+const simulcastMaxFractionLost = 26
+
+// bitrateWindow is the window over which layer bitrates are measured.
+const bitrateWindow = time.Second
+
+type simulcastTrackKey struct {
+	clientID string
+	label    string
+	id       string
+}
+
+func newSimulcastTrackKey(clientID string, trackInfo TrackInfo) simulcastTrackKey {
+	return simulcastTrackKey{clientID, trackInfo.Label, trackInfo.ID}
+}
+
+// bitrateMeter measures the bitrate of a single layer.
+type bitrateMeter struct {
+	windowStart time.Time
+	windowBytes uint64
+	bitrate     uint64
+}
+
+func (b *bitrateMeter) record(now time.Time, bytes int) {
+	if b.windowStart.IsZero() {
+		b.windowStart = now
+	}
+
+	b.windowBytes += uint64(bytes)
+
+	elapsed := now.Sub(b.windowStart)
+	if elapsed >= bitrateWindow {
+		b.bitrate = uint64(float64(b.windowBytes*8) / elapsed.Seconds())
+		b.windowStart = now
+		b.windowBytes = 0
+	}
+}
+
+type simulcastLayer struct {
+	ssrc    uint32
+	bitrate bitrateMeter
+}
+
+type simulcastSubscriber struct {
+	// currentSSRC is the layer currently being forwarded, or 0 when no layer
+	// has been selected yet.
+	currentSSRC uint32
+	// targetSSRC is the layer to switch to at the next keyframe.
+	targetSSRC   uint32
+	lastSwitch   time.Time
+	estimate     uint64
+	fractionLost uint8
+}
+
+// SimulcastTrack tracks the simulcast layers of a single published video
+// track and selects the layer to forward to each subscriber based on the
+// subscriber's REMB estimate and reported packet loss. Subscribers receive
+// all layers through a single local track with the SSRC of the first layer,
+// and layer switches happen on keyframes. The RTPMunger of the local track
+// rewrites sequence numbers and timestamps so that the track appears
+// continuous.
+type SimulcastTrack struct {
+	mu sync.Mutex
+
+	clientID  string
+	trackInfo TrackInfo
+	// layers are kept in the order they were added, which for Plan B
+	// ssrc-group:SIM is from the lowest to the highest layer.
+	layers      []*simulcastLayer
+	subscribers map[string]*simulcastSubscriber
+}
+
+func NewSimulcastTrack(clientID string, trackInfo TrackInfo) *SimulcastTrack {
+	return &SimulcastTrack{
+		clientID:    clientID,
+		trackInfo:   trackInfo,
+		layers:      []*simulcastLayer{{ssrc: trackInfo.SSRC}},
+		subscribers: map[string]*simulcastSubscriber{},
+	}
+}
+
+// ClientID returns the clientID of the publisher.
+func (s *SimulcastTrack) ClientID() string {
+	return s.clientID
+}
+
+// TrackInfo returns the info of the track as seen by subscribers.
+func (s *SimulcastTrack) TrackInfo() TrackInfo {
+	return s.trackInfo
+}
+
+// SSRC returns the SSRC of the track as seen by subscribers.
+func (s *SimulcastTrack) SSRC() uint32 {
+	return s.trackInfo.SSRC
+}
+
+// LayerSSRCs returns the SSRCs of all layers.
+func (s *SimulcastTrack) LayerSSRCs() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ssrcs := make([]uint32, 0, len(s.layers))
+	for _, layer := range s.layers {
+		ssrcs = append(ssrcs, layer.ssrc)
+	}
+	return ssrcs
+}
+
+func (s *SimulcastTrack) AddLayer(ssrc uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, layer := range s.layers {
+		if layer.ssrc == ssrc {
+			return
+		}
+	}
+
+	s.layers = append(s.layers, &simulcastLayer{ssrc: ssrc})
+}
+
+// RemoveLayer removes a layer and returns the number of remaining layers.
+// Subscribers receiving the removed layer are switched to another one.
+func (s *SimulcastTrack) RemoveLayer(ssrc uint32) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, layer := range s.layers {
+		if layer.ssrc == ssrc {
+			s.layers = append(s.layers[:i], s.layers[i+1:]...)
+			break
+		}
+	}
+
+	if len(s.layers) == 0 {
+		return 0
+	}
+
+	for _, sub := range s.subscribers {
+		if sub.currentSSRC == ssrc {
+			sub.currentSSRC = 0
+		}
+		if sub.targetSSRC == ssrc || sub.targetSSRC == 0 {
+			sub.targetSSRC = s.selectLayer(sub, time.Now())
+		}
+	}
+
+	return len(s.layers)
+}
+
+func (s *SimulcastTrack) AddSubscriber(clientID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.subscribers[clientID]; ok {
+		return
+	}
+
+	sub := &simulcastSubscriber{}
+
+	if len(s.layers) == 1 {
+		// no need to wait for a keyframe when there is nothing to switch
+		// between.
+		sub.currentSSRC = s.layers[0].ssrc
+	}
+	sub.targetSSRC = s.layers[0].ssrc
+
+	s.subscribers[clientID] = sub
+}
+
+func (s *SimulcastTrack) RemoveSubscriber(clientID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.subscribers, clientID)
+}
+
+// Record measures the bitrate of the layer the packet belongs to. It should
+// be called once for every packet received from the publisher.
+func (s *SimulcastTrack) Record(packet *rtp.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if layer := s.layer(packet.SSRC); layer != nil {
+		layer.bitrate.record(time.Now(), packet.MarshalSize())
+	}
+}
+
+func (s *SimulcastTrack) layer(ssrc uint32) *simulcastLayer {
+	for _, layer := range s.layers {
+		if layer.ssrc == ssrc {
+			return layer
+		}
+	}
+	return nil
+}
+
+// Forward returns true when the packet should be forwarded to the
+// subscriber, and false if the packet belongs to a layer the subscriber
+// does not receive.
+func (s *SimulcastTrack) Forward(clientID string, packet *rtp.Packet) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscribers[clientID]
+	if !ok {
+		return false
+	}
+
+	if packet.SSRC != sub.currentSSRC {
+		if packet.SSRC != sub.targetSSRC || !isVP8Keyframe(packet.Payload) {
+			return false
+		}
+
+		if sub.currentSSRC != 0 {
+			// the initial layer selection should not delay upgrades
+			sub.lastSwitch = time.Now()
+		}
+		sub.currentSSRC = packet.SSRC
+	}
+
+	return true
+}
+
+// CurrentSSRC returns the layer currently forwarded to the subscriber, or
+// the layer it is about to switch to.
+func (s *SimulcastTrack) CurrentSSRC(clientID string) (uint32, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscribers[clientID]
+	if !ok {
+		return 0, false
+	}
+
+	if sub.currentSSRC == 0 {
+		return sub.targetSSRC, true
+	}
+
+	return sub.currentSSRC, true
+}
+
+// SetEstimate updates the subscriber's REMB estimate. When this results in a
+// layer switch, the SSRC of the new layer is returned so that a keyframe can
+// be requested from the publisher.
+func (s *SimulcastTrack) SetEstimate(clientID string, bitrate uint64) (keyframeSSRC uint32, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscribers[clientID]
+	if !ok {
+		return 0, false
+	}
+
+	sub.estimate = bitrate
+	return s.updateTarget(sub)
+}
+
+// SetFractionLost updates the packet loss reported by the subscriber. When
+// this results in a layer switch, the SSRC of the new layer is returned so
+// that a keyframe can be requested from the publisher.
+func (s *SimulcastTrack) SetFractionLost(clientID string, fractionLost uint8) (keyframeSSRC uint32, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscribers[clientID]
+	if !ok {
+		return 0, false
+	}
+
+	sub.fractionLost = fractionLost
+	return s.updateTarget(sub)
+}
+
+// SelectHighestLayer targets the layer with the highest bitrate for a
+// subscriber which does not send any estimates, like a recorder. The SSRC of
+// the new layer is returned when a keyframe needs to be requested.
+func (s *SimulcastTrack) SelectHighestLayer(clientID string) (keyframeSSRC uint32, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscribers[clientID]
+	if !ok {
+		return 0, false
+	}
+
+	layers := s.sortedLayers()
+	target := layers[len(layers)-1].ssrc
+	if target == sub.targetSSRC {
+		return 0, false
+	}
+
+	sub.targetSSRC = target
+	return target, target != sub.currentSSRC
+}
+
+// MaxEstimate returns the highest REMB estimate of all subscribers. This is
+// the bitrate the publisher should be allowed to send at, because the lower
+// layers will be forwarded to subscribers with lower estimates.
+func (s *SimulcastTrack) MaxEstimate() (estimate uint64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range s.subscribers {
+		if sub.estimate > estimate {
+			estimate = sub.estimate
+			ok = true
+		}
+	}
+
+	return estimate, ok
+}
+
+func (s *SimulcastTrack) updateTarget(sub *simulcastSubscriber) (uint32, bool) {
+	target := s.selectLayer(sub, time.Now())
+	if target == sub.targetSSRC {
+		return 0, false
+	}
+
+	sub.targetSSRC = target
+	if target == sub.currentSSRC {
+		// switching back before the switch has taken place
+		return 0, false
+	}
+
+	return target, true
+}
+
+// sortedLayers returns layers ordered from the lowest to the highest
+// bitrate. Layers with the same (or unknown) bitrate keep their original
+// order.
+func (s *SimulcastTrack) sortedLayers() []*simulcastLayer {
+	layers := append([]*simulcastLayer{}, s.layers...)
+	sort.SliceStable(layers, func(i, j int) bool {
+		return layers[i].bitrate.bitrate < layers[j].bitrate.bitrate
+	})
+	return layers
+}
+
+func (s *SimulcastTrack) selectLayer(sub *simulcastSubscriber, now time.Time) uint32 {
+	layers := s.sortedLayers()
+
+	currentIndex := -1
+	for i, layer := range layers {
+		if layer.ssrc == sub.currentSSRC {
+			currentIndex = i
+			break
+		}
+	}
+
+	if sub.estimate == 0 {
+		// no estimate yet, stay on the current layer or start with the lowest
+		if currentIndex >= 0 {
+			return layers[currentIndex].ssrc
+		}
+		return layers[0].ssrc
+	}
+
+	index := 0
+	for i, layer := range layers {
+		bitrate := layer.bitrate.bitrate
+		if i > currentIndex {
+			bitrate = uint64(float64(bitrate) * simulcastUpgradeHeadroom)
+		}
+		if bitrate <= sub.estimate {
+			index = i
+		}
+	}
+
+	if sub.fractionLost > simulcastMaxFractionLost && currentIndex >= 0 && index >= currentIndex {
+		index = currentIndex - 1
+		if index < 0 {
+			index = 0
+		}
+	}
+
+	if index > currentIndex && currentIndex >= 0 && now.Sub(sub.lastSwitch) < simulcastUpgradeInterval {
+		index = currentIndex
+	}
+
+	return layers[index].ssrc
+}
+
+// isVP8Keyframe checks whether the RTP payload contains the beginning of a
+// VP8 keyframe. See https://tools.ietf.org/html/rfc7741#section-4.2
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	// S bit (start of partition) must be set and PID must be 0
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return false
+	}
+
+	offset := 1
+
+	// X bit, extended control bits present
+	if payload[0]&0x80 != 0 {
+		if len(payload) < offset+1 {
+			return false
+		}
+		x := payload[offset]
+		offset++
+
+		// I bit, PictureID present
+		if x&0x80 != 0 {
+			if len(payload) < offset+1 {
+				return false
+			}
+			// M bit, 15 bit PictureID
+			if payload[offset]&0x80 != 0 {
+				offset++
+			}
+			offset++
+		}
+		// L bit, TL0PICIDX present
+		if x&0x40 != 0 {
+			offset++
+		}
+		// T or K bit, TID/KEYIDX present
+		if x&0x30 != 0 {
+			offset++
+		}
+	}
+
+	if len(payload) < offset+1 {
+		return false
+	}
+
+	// P bit of the VP8 payload header is 0 for keyframes
+	return payload[offset]&0x01 == 0
+}
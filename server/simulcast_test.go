@@ -0,0 +1,159 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var vp8Keyframe = []byte{0x10, 0x00}
+var vp8Interframe = []byte{0x10, 0x01}
+
+func newVP8Packet(ssrc uint32, sn uint16, ts uint32, payload []byte) *rtp.Packet {
+	packet := &rtp.Packet{Payload: payload}
+	packet.SSRC = ssrc
+	packet.SequenceNumber = sn
+	packet.Timestamp = ts
+	return packet
+}
+
+func TestIsVP8Keyframe(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		payload  []byte
+		keyframe bool
+	}{
+		{"empty", []byte{}, false},
+		{"keyframe", vp8Keyframe, true},
+		{"interframe", vp8Interframe, false},
+		{"not start of partition", []byte{0x00, 0x00}, false},
+		{"partition index set", []byte{0x11, 0x00}, false},
+		{"extended 7 bit picture id", []byte{0x90, 0x80, 0x12, 0x00}, true},
+		{"extended 15 bit picture id", []byte{0x90, 0x80, 0x81, 0x12, 0x01}, false},
+		{"extended all fields", []byte{0x90, 0xf0, 0x81, 0x12, 0x05, 0x20, 0x00}, true},
+		{"truncated", []byte{0x90, 0x80}, false},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.keyframe, isVP8Keyframe(testCase.payload))
+		})
+	}
+}
+
+func newTestSimulcastTrack() *SimulcastTrack {
+	s := NewSimulcastTrack("publisher", TrackInfo{
+		SSRC:  1,
+		ID:    "track",
+		Label: "stream",
+		Kind:  webrtc.RTPCodecTypeVideo,
+	})
+	s.AddLayer(2)
+	s.AddLayer(3)
+	return s
+}
+
+func setLayerBitrates(s *SimulcastTrack, bitrates ...uint64) {
+	for i, bitrate := range bitrates {
+		s.layers[i].bitrate.bitrate = bitrate
+	}
+}
+
+func TestSimulcastTrack_Forward_waitsForKeyframe(t *testing.T) {
+	s := newTestSimulcastTrack()
+	s.AddSubscriber("sub")
+
+	assert.False(t, s.Forward("sub", newVP8Packet(1, 1, 1, vp8Interframe)), "should wait for a keyframe before forwarding")
+	assert.False(t, s.Forward("sub", newVP8Packet(2, 1, 1, vp8Keyframe)), "should not forward a layer which was not selected")
+	assert.True(t, s.Forward("sub", newVP8Packet(1, 2, 1, vp8Keyframe)))
+	assert.True(t, s.Forward("sub", newVP8Packet(1, 3, 1, vp8Interframe)))
+	assert.False(t, s.Forward("other", newVP8Packet(1, 4, 1, vp8Interframe)), "unknown subscriber")
+}
+
+func TestSimulcastTrack_SetEstimate(t *testing.T) {
+	s := newTestSimulcastTrack()
+	setLayerBitrates(s, 150000, 500000, 1500000)
+	s.AddSubscriber("sub")
+
+	require.True(t, s.Forward("sub", newVP8Packet(1, 1, 1, vp8Keyframe)))
+
+	ssrc, ok := s.SetEstimate("sub", 1000000)
+	require.True(t, ok)
+	assert.Equal(t, uint32(2), ssrc)
+
+	current, _ := s.CurrentSSRC("sub")
+	assert.Equal(t, uint32(1), current, "should switch only on keyframe")
+
+	assert.False(t, s.Forward("sub", newVP8Packet(2, 100, 1, vp8Interframe)))
+	assert.True(t, s.Forward("sub", newVP8Packet(2, 101, 1, vp8Keyframe)))
+	assert.False(t, s.Forward("sub", newVP8Packet(1, 2, 1, vp8Interframe)), "should no longer forward the previous layer")
+
+	_, ok = s.SetEstimate("sub", 5000000)
+	assert.False(t, ok, "should not upgrade right after a switch")
+
+	s.subscribers["sub"].lastSwitch = time.Now().Add(-simulcastUpgradeInterval)
+	ssrc, ok = s.SetEstimate("sub", 5000000)
+	require.True(t, ok)
+	assert.Equal(t, uint32(3), ssrc)
+
+	ssrc, ok = s.SetEstimate("sub", 100000)
+	require.True(t, ok, "should cancel the upgrade")
+	assert.Equal(t, uint32(1), ssrc)
+}
+
+func TestSimulcastTrack_SetFractionLost(t *testing.T) {
+	s := newTestSimulcastTrack()
+	setLayerBitrates(s, 150000, 500000, 1500000)
+	s.AddSubscriber("sub")
+	s.subscribers["sub"].estimate = 5000000
+	s.subscribers["sub"].targetSSRC = 3
+
+	require.True(t, s.Forward("sub", newVP8Packet(3, 1, 1, vp8Keyframe)))
+
+	_, ok := s.SetFractionLost("sub", 10)
+	assert.False(t, ok)
+
+	ssrc, ok := s.SetFractionLost("sub", 128)
+	require.True(t, ok)
+	assert.Equal(t, uint32(2), ssrc)
+}
+
+func TestSimulcastTrack_RemoveLayer(t *testing.T) {
+	s := newTestSimulcastTrack()
+	s.AddSubscriber("sub")
+
+	require.True(t, s.Forward("sub", newVP8Packet(1, 1, 1, vp8Keyframe)))
+
+	assert.Equal(t, 2, s.RemoveLayer(1))
+	assert.Equal(t, []uint32{2, 3}, s.LayerSSRCs())
+	current, _ := s.CurrentSSRC("sub")
+	assert.Equal(t, uint32(2), current)
+	assert.True(t, s.Forward("sub", newVP8Packet(2, 50, 1, vp8Keyframe)))
+
+	assert.Equal(t, 1, s.RemoveLayer(2))
+	assert.Equal(t, 0, s.RemoveLayer(3))
+}
+
+func TestSimulcastTrack_singleLayer(t *testing.T) {
+	s := NewSimulcastTrack("publisher", TrackInfo{SSRC: 1, Kind: webrtc.RTPCodecTypeVideo})
+	s.AddSubscriber("sub")
+
+	assert.True(t, s.Forward("sub", newVP8Packet(1, 10, 20, vp8Interframe)), "should not wait for keyframe when there is only one layer")
+}
+
+func TestSimulcastTrack_MaxEstimate(t *testing.T) {
+	s := newTestSimulcastTrack()
+	s.AddSubscriber("sub1")
+	s.AddSubscriber("sub2")
+
+	_, ok := s.MaxEstimate()
+	assert.False(t, ok)
+
+	s.SetEstimate("sub1", 100)
+	s.SetEstimate("sub2", 200)
+	estimate, ok := s.MaxEstimate()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(200), estimate)
+}
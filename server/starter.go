@@ -1,18 +1,38 @@
 package server
 
 import (
+	"context"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 )
 
+// shutdownTimeout is the time to wait for requests in progress when the
+// server shuts down.
+const shutdownTimeout = 5 * time.Second
+
 type ServerParams struct {
 	TLSCertFile string
 	TLSKeyFile  string
+	// Drainer is drained before the server shuts down when set. The server
+	// also shuts down when draining is started some other way, for example by
+	// the admin endpoint.
+	Drainer *Drainer
+	// DrainTimeout is the time to wait for rooms to become empty.
+	DrainTimeout time.Duration
+	// Shutdown is called after the server has shut down when set, for example
+	// to export the remaining traces.
+	Shutdown func(ctx context.Context) error
 }
 
 type StartStopper struct {
 	server *http.Server
 	params ServerParams
+
+	stopOnce sync.Once
+	stopped  chan struct{}
+	stopErr  error
 }
 
 func NewStartStopper(params ServerParams, handler http.Handler) *StartStopper {
@@ -20,20 +40,70 @@ func NewStartStopper(params ServerParams, handler http.Handler) *StartStopper {
 		Handler: handler,
 	}
 	return &StartStopper{
-		server: server,
-		params: params,
+		server:  server,
+		params:  params,
+		stopped: make(chan struct{}),
 	}
 }
 
-func (s StartStopper) Start(l net.Listener) (err error) {
+// Start serves requests until the server is stopped. When the server is
+// stopped, Start returns http.ErrServerClosed after the shutdown has
+// completed.
+func (s *StartStopper) Start(l net.Listener) (err error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	if drainer := s.params.Drainer; drainer != nil {
+		go func() {
+			select {
+			case <-drainer.Draining():
+				s.Stop()
+			case <-done:
+			}
+		}()
+	}
+
 	if s.params.TLSCertFile != "" {
 		err = s.server.ServeTLS(l, s.params.TLSCertFile, s.params.TLSKeyFile)
 	} else {
 		err = s.server.Serve(l)
 	}
+
+	if err == http.ErrServerClosed {
+		<-s.stopped
+	}
 	return
 }
 
-func (s StartStopper) Stop() error {
-	return s.server.Close()
+// Stop drains the server and shuts it down gracefully. It is safe to call
+// Stop more than once.
+func (s *StartStopper) Stop() error {
+	s.stopOnce.Do(func() {
+		defer close(s.stopped)
+
+		if drainer := s.params.Drainer; drainer != nil {
+			drainer.Drain()
+			drainer.Wait(s.params.DrainTimeout)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		s.stopErr = s.server.Shutdown(ctx)
+		if s.stopErr != nil {
+			s.server.Close()
+		}
+
+		if shutdown := s.params.Shutdown; shutdown != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+
+			if err := shutdown(ctx); err != nil && s.stopErr == nil {
+				s.stopErr = err
+			}
+		}
+	})
+
+	<-s.stopped
+	return s.stopErr
 }
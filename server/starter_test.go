@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/peer-calls/peer-calls/server"
 	"github.com/stretchr/testify/require"
@@ -63,3 +64,26 @@ func TestServerStarter_HTTPS(t *testing.T) {
 	require.Nil(t, err, "error reading body")
 	require.Equal(t, []byte("hello"), body)
 }
+
+func TestServerStarter_drain(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", "0"))
+	require.Nil(t, err, "error listening")
+	drainer := server.NewDrainer(loggerFactory)
+	s := server.NewStartStopper(server.ServerParams{
+		Drainer:      drainer,
+		DrainTimeout: time.Second,
+	}, handler)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Start(l)
+	}()
+	drainer.Drain()
+	select {
+	case err := <-errCh:
+		require.Equal(t, http.ErrServerClosed, err)
+	case <-time.After(timeout):
+		require.Fail(t, "timed out waiting for server to stop after draining")
+	}
+	require.NoError(t, s.Stop())
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// DefaultTracingServiceName is the service name traces are exported with
+	// when none is configured.
+	DefaultTracingServiceName = "peer-calls"
+	// DefaultTracingSampleRatio samples all traces.
+	DefaultTracingSampleRatio = 1
+)
+
+const tracerName = "github.com/peer-calls/peer-calls/server"
+
+// ConfigureTracing sets up the global tracer provider to export traces to the
+// configured OTLP endpoint. Spans are not recorded when no endpoint is set.
+// The returned shutdown function flushes the spans which have not been
+// exported yet.
+func ConfigureTracing(loggerFactory LoggerFactory, c TracingConfig) (shutdown func(ctx context.Context) error, err error) {
+	shutdown = func(ctx context.Context) error { return nil }
+
+	if c.Endpoint == "" {
+		return shutdown, nil
+	}
+
+	log := loggerFactory.GetLogger("tracing")
+
+	opts, err := exporterOptions(c.Endpoint)
+	if err != nil {
+		return shutdown, fmt.Errorf("Error parsing tracing endpoint: %w", err)
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return shutdown, fmt.Errorf("Error creating OTLP exporter: %w", err)
+	}
+
+	res := resource.NewSchemaless(attribute.String("service.name", c.ServiceName))
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Error("Error exporting traces", Fields{"error": err})
+	}))
+
+	log.Info("Exporting traces", Fields{
+		"endpoint":    c.Endpoint,
+		"serviceName": c.ServiceName,
+		"sampleRatio": c.SampleRatio,
+	})
+
+	return provider.Shutdown, nil
+}
+
+// exporterOptions splits the endpoint URL into the host and path options of
+// the OTLP exporter. Traces are sent without TLS unless the scheme is https.
+func exporterOptions(endpoint string) ([]otlptracehttp.Option, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+
+	if u.Path != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+
+	if u.Scheme != "https" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	return opts, nil
+}
+
+// startSpan starts a span using the global tracer provider. The tracer is
+// looked up every time so that the provider can be replaced, for example in
+// tests.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// startRequestSpan starts a server span for r. The trace is continued when
+// the request has a traceparent header, or a traceparent query parameter
+// because browsers cannot set headers of websocket requests.
+func startRequestSpan(r *http.Request, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	carrier := propagation.HeaderCarrier(r.Header.Clone())
+	if value := r.URL.Query().Get("traceparent"); value != "" && carrier.Get("traceparent") == "" {
+		carrier.Set("traceparent", value)
+	}
+
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), carrier)
+
+	return startSpan(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// traceParent returns the traceparent header of the span in ctx, or an empty
+// string when tracing is disabled.
+func traceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// endSpan records err, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
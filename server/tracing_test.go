@@ -0,0 +1,151 @@
+package server_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/peer-calls/peer-calls/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// setGlobalTracing replaces the global tracer provider and propagator until
+// the returned function is called.
+func setGlobalTracing(provider trace.TracerProvider, propagator propagation.TextMapPropagator) (restore func()) {
+	prevProvider := otel.GetTracerProvider()
+	prevPropagator := otel.GetTextMapPropagator()
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+
+	return func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	}
+}
+
+func TestConfigureTracing_disabled(t *testing.T) {
+	provider := otel.GetTracerProvider()
+
+	shutdown, err := server.ConfigureTracing(loggerFactory, server.TracingConfig{})
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+	assert.Equal(t, provider, otel.GetTracerProvider(), "global provider unchanged")
+}
+
+func TestConfigureTracing(t *testing.T) {
+	requests := make(chan string, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- r.URL.Path:
+		default:
+		}
+	}))
+	defer collector.Close()
+
+	defer setGlobalTracing(otel.GetTracerProvider(), otel.GetTextMapPropagator())()
+
+	shutdown, err := server.ConfigureTracing(loggerFactory, server.TracingConfig{
+		Endpoint:    collector.URL,
+		ServiceName: server.DefaultTracingServiceName,
+		SampleRatio: 1,
+	})
+	require.NoError(t, err)
+
+	_, span := otel.Tracer("test").Start(context.Background(), "test")
+	span.End()
+
+	// the remaining spans are exported on shutdown.
+	require.NoError(t, shutdown(context.Background()))
+
+	select {
+	case path := <-requests:
+		assert.Equal(t, "/v1/traces", path)
+	case <-time.After(timeout):
+		require.Fail(t, "timed out waiting for traces")
+	}
+}
+
+func TestSFU_tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer setGlobalTracing(provider, propagation.TraceContext{})()
+
+	newAdapter := server.NewAdapterFactory(loggerFactory, server.StoreConfig{})
+	defer newAdapter.Close()
+	rooms := server.NewAdapterRoomManager(newAdapter.NewAdapter)
+	srv, wsBaseURL := setupSFUServer(rooms, false)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	traceParent := "00-" + traceID + "-00f067aa0ba902b7-01"
+
+	pc, _, cleanup := createPeerConnection(t, ctx, wsBaseURL+roomName+"/"+clientID+"?traceparent="+traceParent, clientID)
+	waitPeerConnected(t, ctx, pc)
+	require.NoError(t, cleanup())
+
+	spanNames := func() map[string]sdktrace.ReadOnlySpan {
+		spans := map[string]sdktrace.ReadOnlySpan{}
+		for _, span := range recorder.Ended() {
+			if span.SpanContext().TraceID().String() == traceID {
+				spans[span.Name()] = span
+			}
+		}
+		return spans
+	}
+
+	// the connect span ends after the server has noticed the peer connection
+	// was closed.
+	assert.Eventually(t, func() bool {
+		_, ok := spanNames()["WebRTCTransport.connect"]
+		return ok
+	}, timeout, 10*time.Millisecond)
+
+	spans := spanNames()
+	for _, name := range []string{
+		"WSS.Subscribe",
+		"WSS.subscribe",
+		"SocketHandler.handleReady",
+		"WebRTCTransport.connect",
+		"Negotiator.negotiate",
+		"Negotiator.createOffer",
+		"Signaller.handleRemoteAnswer",
+	} {
+		assert.Contains(t, spans, name)
+	}
+
+	if t.Failed() {
+		return
+	}
+
+	parentOf := func(name string) trace.SpanID {
+		return spans[name].Parent().SpanID()
+	}
+	spanID := func(name string) trace.SpanID {
+		return spans[name].SpanContext().SpanID()
+	}
+
+	assert.Equal(t, "00f067aa0ba902b7", parentOf("WSS.Subscribe").String(), "continues the trace of the page")
+	assert.Equal(t, spanID("WSS.Subscribe"), parentOf("SocketHandler.handleReady"))
+	assert.Equal(t, spanID("SocketHandler.handleReady"), parentOf("WebRTCTransport.connect"))
+	assert.Equal(t, spanID("WebRTCTransport.connect"), parentOf("Negotiator.negotiate"))
+	assert.Equal(t, spanID("WebRTCTransport.connect"), parentOf("Signaller.handleRemoteAnswer"))
+
+	var candidates int
+	for _, event := range spans["WebRTCTransport.connect"].Events() {
+		if event.Name == "Local ICE candidate" {
+			candidates++
+		}
+	}
+	assert.NotZero(t, candidates, "local ICE candidates recorded")
+}
@@ -2,9 +2,12 @@ package server
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v2"
 )
 
@@ -17,20 +20,59 @@ type TrackMetadata struct {
 	Kind     string `json:"kind"`
 }
 
+// TrackSink receives the tracks published in a room without being a WebRTC
+// peer, for example to record them. Packets of simulcast tracks are written
+// with the SSRC of the track they were added with.
+type TrackSink interface {
+	ID() string
+	AddTrack(clientID string, track TrackInfo) error
+	RemoveTrack(ssrc uint32) error
+	WriteTrackRTP(trackSSRC uint32, packet *rtp.Packet) error
+	Close() error
+}
+
+// TrackState describes a track of a transport.
+type TrackState struct {
+	SSRC        uint32 `json:"ssrc"`
+	PayloadType uint8  `json:"payloadType"`
+	ID          string `json:"id"`
+	Label       string `json:"label"`
+	Kind        string `json:"kind"`
+	Mid         string `json:"mid,omitempty"`
+	// Publisher is the client which published the track.
+	Publisher string `json:"publisher"`
+	// Muted is true when the packets of the track are not forwarded.
+	Muted bool `json:"muted"`
+}
+
+// TransportState describes a transport in a room. Local tracks are sent to
+// the client of the transport, and remote tracks are published by it.
+type TransportState struct {
+	ClientID string `json:"clientId"`
+	// Relay is true for transports to other server instances.
+	Relay        bool         `json:"relay"`
+	LocalTracks  []TrackState `json:"localTracks"`
+	RemoteTracks []TrackState `json:"remoteTracks"`
+}
+
 type MemoryTracksManager struct {
 	loggerFactory       LoggerFactory
 	log                 Logger
 	mu                  sync.RWMutex
 	roomPeersManager    map[string]*RoomPeersManager
 	jitterBufferEnabled bool
+	relay               *Relay
 }
 
-func NewMemoryTracksManager(loggerFactory LoggerFactory, jitterBufferEnabled bool) *MemoryTracksManager {
+// NewMemoryTracksManager creates a new tracks manager. The tracks of rooms
+// are relayed to other server instances when relay is not nil.
+func NewMemoryTracksManager(loggerFactory LoggerFactory, jitterBufferEnabled bool, relay *Relay) *MemoryTracksManager {
 	return &MemoryTracksManager{
 		loggerFactory:       loggerFactory,
 		log:                 loggerFactory.GetLogger("memorytracksmanager"),
 		roomPeersManager:    map[string]*RoomPeersManager{},
 		jitterBufferEnabled: jitterBufferEnabled,
+		relay:               relay,
 	}
 }
 
@@ -46,26 +88,100 @@ func (m *MemoryTracksManager) Add(room string, transport *WebRTCTransport) {
 			m.loggerFactory.GetLogger("nack"),
 			m.jitterBufferEnabled,
 		)
-		roomPeersManager = NewRoomPeersManager(m.loggerFactory, jitterHandler)
+		roomPeersManager = NewRoomPeersManager(room, m.loggerFactory, jitterHandler)
 		m.roomPeersManager[room] = roomPeersManager
+
+		if m.relay != nil {
+			m.relay.Join(room, roomPeersManager)
+		}
 	}
 
-	m.log.Printf("[%s] MemoryTrackManager.Add peer to room: %s", transport.ClientID(), room)
+	m.log.Debug("MemoryTrackManager.Add peer to room", Fields{
+		"room":     room,
+		"clientId": transport.ClientID(),
+	})
 	roomPeersManager.Add(transport)
 
 	go func() {
 		<-transport.CloseChannel()
-		m.mu.Lock()
-		defer m.mu.Unlock()
 
+		m.mu.Lock()
 		roomPeersManager.Remove(transport.ClientID())
 
-		if len(roomPeersManager.transports) == 0 {
+		empty := !roomPeersManager.hasClients()
+		if empty {
 			delete(m.roomPeersManager, room)
 		}
+		m.mu.Unlock()
+
+		if !empty {
+			return
+		}
+
+		// Leave waits for the relay to unregister from the store, so it is
+		// called without holding the lock.
+		if m.relay != nil {
+			m.relay.Leave(room, roomPeersManager)
+		}
+		roomPeersManager.Close()
 	}()
 }
 
+// AddSink adds a sink to a room which has at least one peer. The sink is
+// closed when the last peer leaves the room.
+func (m *MemoryTracksManager) AddSink(room string, sink TrackSink) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roomPeersManager, ok := m.roomPeersManager[room]
+	if !ok {
+		return fmt.Errorf("Room not found: %s", room)
+	}
+
+	m.log.Debug("MemoryTrackManager.AddSink to room", Fields{
+		"room":     room,
+		"clientId": sink.ID(),
+	})
+	roomPeersManager.AddSink(sink)
+	return nil
+}
+
+func (m *MemoryTracksManager) RemoveSink(room string, sinkID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roomPeersManager, ok := m.roomPeersManager[room]
+	if !ok {
+		return
+	}
+
+	m.log.Debug("MemoryTrackManager.RemoveSink from room", Fields{
+		"room":     room,
+		"clientId": sinkID,
+	})
+	roomPeersManager.RemoveSink(sinkID)
+}
+
+// Mute stops or resumes forwarding the tracks of kind published by clientID
+// in room.
+func (m *MemoryTracksManager) Mute(room string, clientID string, kind webrtc.RTPCodecType, muted bool) error {
+	m.mu.RLock()
+	roomPeersManager, ok := m.roomPeersManager[room]
+	m.mu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("Room not found: %s", room)
+	}
+
+	m.log.Debug("MemoryTrackManager.Mute", Fields{
+		"room":     room,
+		"clientId": clientID,
+		"kind":     kind.String(),
+		"muted":    muted,
+	})
+	return roomPeersManager.Mute(clientID, kind, muted)
+}
+
 func (m *MemoryTracksManager) GetTracksMetadata(room string, clientID string) (metadata []TrackMetadata, ok bool) {
 	roomPeersManager, ok := m.roomPeersManager[room]
 	if !ok {
@@ -74,66 +190,241 @@ func (m *MemoryTracksManager) GetTracksMetadata(room string, clientID string) (m
 	return roomPeersManager.GetTracksMetadata(clientID)
 }
 
+// Stats returns the statistics of the transports and tracks in room.
+func (m *MemoryTracksManager) Stats(room string) (RoomStats, bool) {
+	m.mu.RLock()
+	roomPeersManager, ok := m.roomPeersManager[room]
+	m.mu.RUnlock()
+
+	if !ok {
+		return RoomStats{}, false
+	}
+	return roomPeersManager.Stats(), true
+}
+
+// Transports returns the state of the transports in room.
+func (m *MemoryTracksManager) Transports(room string) ([]TransportState, bool) {
+	m.mu.RLock()
+	roomPeersManager, ok := m.roomPeersManager[room]
+	m.mu.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+	return roomPeersManager.Transports(), true
+}
+
 type RoomPeersManager struct {
 	loggerFactory LoggerFactory
 	log           Logger
 	mu            sync.RWMutex
 	// key is clientID
-	transports             map[string]*WebRTCTransport
+	transports map[string]Transport
+	// key is sink ID
+	sinks                  map[string]TrackSink
 	jitterHandler          JitterHandler
 	trackBitrateEstimators *TrackBitrateEstimators
 	clientIDBySSRC         map[uint32]string
+	// publishers contains the clients which published each track. They are
+	// different from clientIDBySSRC for tracks relayed from other instances.
+	publishers map[uint32]string
+	// simulcastTracks contains published video tracks, keyed by the SSRC of
+	// each of their layers.
+	simulcastTracks      map[uint32]*SimulcastTrack
+	simulcastTracksByKey map[simulcastTrackKey]*SimulcastTrack
+	trackKinds           map[uint32]webrtc.RTPCodecType
+	// muted contains the kinds of tracks which are not forwarded for each
+	// publisher.
+	muted map[mutedTrackKey]struct{}
+	// trackCounters contains the statistics of published tracks, keyed by
+	// SSRC.
+	trackCounters map[uint32]*trackCounters
+	// transportCounters contains the statistics of transports, keyed by
+	// clientID.
+	transportCounters map[string]*transportCounters
 }
 
-func NewRoomPeersManager(loggerFactory LoggerFactory, jitterHandler JitterHandler) *RoomPeersManager {
+type mutedTrackKey struct {
+	clientID string
+	kind     webrtc.RTPCodecType
+}
+
+func NewRoomPeersManager(room string, loggerFactory LoggerFactory, jitterHandler JitterHandler) *RoomPeersManager {
 	return &RoomPeersManager{
 		loggerFactory:          loggerFactory,
-		log:                    loggerFactory.GetLogger("roompeers"),
-		transports:             map[string]*WebRTCTransport{},
+		log:                    loggerFactory.GetLogger("roompeers").WithFields(Fields{"room": room}),
+		transports:             map[string]Transport{},
+		sinks:                  map[string]TrackSink{},
 		jitterHandler:          jitterHandler,
 		trackBitrateEstimators: NewTrackBitrateEstimators(),
 		clientIDBySSRC:         map[uint32]string{},
+		publishers:             map[uint32]string{},
+		simulcastTracks:        map[uint32]*SimulcastTrack{},
+		simulcastTracksByKey:   map[simulcastTrackKey]*SimulcastTrack{},
+		trackKinds:             map[uint32]webrtc.RTPCodecType{},
+		muted:                  map[mutedTrackKey]struct{}{},
+		trackCounters:          map[uint32]*trackCounters{},
+		transportCounters:      map[string]*transportCounters{},
+	}
+}
+
+// isRelay returns true for transports which relay tracks to another server
+// instance.
+func isRelay(transport Transport) bool {
+	_, ok := transport.(*RelayTransport)
+	return ok
+}
+
+// forwards returns true when the tracks and messages from one transport are
+// forwarded to another. Every instance relays the tracks of its own clients
+// to all other instances, so tracks received from a relay are not relayed
+// again.
+func forwards(from Transport, to Transport) bool {
+	return from != to && !(isRelay(from) && isRelay(to))
+}
+
+// hasClients returns true when there are transports other than relays in the
+// room.
+func (t *RoomPeersManager) hasClients() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, transport := range t.transports {
+		if !isRelay(transport) {
+			return true
+		}
 	}
+	return false
+}
+
+func (t *RoomPeersManager) addTrack(transport Transport, publisherID string, track TrackInfo) {
+	keyframeSSRCs := t.addTrackLocked(transport, publisherID, track)
+	t.requestKeyframes(transport.ClientID(), keyframeSSRCs)
 }
 
-func (t *RoomPeersManager) addTrack(clientID string, track TrackInfo) {
+// addTrackLocked adds the track to the other transports and sinks, and
+// returns the simulcast layers keyframes should be requested for.
+func (t *RoomPeersManager) addTrackLocked(transport Transport, publisherID string, track TrackInfo) (keyframeSSRCs []uint32) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	t.log.Printf("Add track (roomPeersManager) - clientID %s - track info %+v", clientID, track)
+	clientID := transport.ClientID()
+	t.log.Debug("Add track", Fields{
+		"clientId":    clientID,
+		"publisherId": publisherID,
+		"ssrc":        track.SSRC,
+		"kind":        track.Kind.String(),
+	})
 	t.clientIDBySSRC[track.SSRC] = clientID
+	t.publishers[track.SSRC] = publisherID
+	t.trackKinds[track.SSRC] = track.Kind
+	t.trackCounters[track.SSRC] = newTrackCounters()
+
+	var simulcastTrack *SimulcastTrack
+	if track.Kind == webrtc.RTPCodecTypeVideo {
+		key := newSimulcastTrackKey(clientID, track)
+		if existing, ok := t.simulcastTracksByKey[key]; ok {
+			t.log.Debug("Add simulcast layer", Fields{
+				"clientId":   clientID,
+				"ssrc":       track.SSRC,
+				"parentSsrc": existing.SSRC(),
+			})
+			existing.AddLayer(track.SSRC)
+			t.simulcastTracks[track.SSRC] = existing
+			// subscribers already have a track for this simulcast track
+			return nil
+		}
+
+		simulcastTrack = NewSimulcastTrack(clientID, track)
+		t.simulcastTracks[track.SSRC] = simulcastTrack
+		t.simulcastTracksByKey[key] = simulcastTrack
+	}
 
 	for otherClientID, otherTransport := range t.transports {
-		if otherClientID != clientID {
-			if err := otherTransport.AddTrack(track.PayloadType, track.SSRC, track.ID, track.Label); err != nil {
-				t.log.Printf("[%s] MemoryTracksManager.addTrack Error adding track: %s", otherClientID, err)
+		if forwards(transport, otherTransport) {
+			if simulcastTrack != nil {
+				keyframeSSRCs = append(keyframeSSRCs, addSimulcastSubscriber(simulcastTrack, otherClientID))
+			}
+			if err := otherTransport.AddTrack(publisherID, track); err != nil {
+				t.log.Error("Error adding track", Fields{
+					"clientId": otherClientID,
+					"error":    err,
+				})
 				continue
 			}
 		}
 	}
+
+	for _, sink := range t.sinks {
+		t.addSinkTrack(sink, publisherID, track, simulcastTrack)
+	}
+
+	return keyframeSSRCs
+}
+
+// addSimulcastSubscriber adds a subscriber to a simulcast track and returns
+// the layer it should receive first. A keyframe should be requested for it
+// because publishers send keyframes rarely unless they are asked to, and
+// the subscriber receives nothing until the next one.
+func addSimulcastSubscriber(simulcastTrack *SimulcastTrack, clientID string) uint32 {
+	simulcastTrack.AddSubscriber(clientID)
+	ssrc, _ := simulcastTrack.CurrentSSRC(clientID)
+	return ssrc
+}
+
+// requestKeyframes requests keyframes for the simulcast layers subscribers
+// were added to. It must be called without holding t.mu.
+func (t *RoomPeersManager) requestKeyframes(subscriberID string, ssrcs []uint32) {
+	for _, ssrc := range ssrcs {
+		if err := t.requestKeyframe(ssrc, 0); err != nil {
+			t.log.Error("Error requesting keyframe for new subscriber", Fields{
+				"clientId": subscriberID,
+				"error":    err,
+			})
+		}
+	}
 }
 
-func (t *RoomPeersManager) broadcast(clientID string, msg webrtc.DataChannelMessage) {
+// addSinkTrack adds a track to a sink. Sinks do not send any REMB, so they
+// receive the simulcast layer with the highest bitrate.
+func (t *RoomPeersManager) addSinkTrack(sink TrackSink, clientID string, track TrackInfo, simulcastTrack *SimulcastTrack) {
+	if simulcastTrack != nil {
+		simulcastTrack.AddSubscriber(sink.ID())
+		simulcastTrack.SelectHighestLayer(sink.ID())
+	}
+
+	if err := sink.AddTrack(clientID, track); err != nil {
+		t.log.Error("Error adding track to sink", Fields{
+			"clientId": sink.ID(),
+			"ssrc":     track.SSRC,
+			"error":    err,
+		})
+	}
+}
+
+func (t *RoomPeersManager) broadcast(transport Transport, msg webrtc.DataChannelMessage) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	t.log.Printf("Broadcast (roomPeersManager) - clientID %s", clientID)
+	clientID := transport.ClientID()
+	t.log.Debug("Broadcast", Fields{"clientId": clientID})
 	for otherClientID, otherPeerInRoom := range t.transports {
-		if otherClientID != clientID {
-			t.log.Printf("[%s] broadcast from %s", otherClientID, clientID)
-			tr := otherPeerInRoom.dataTransceiver
-			var err error
-			if msg.IsString {
-				err = tr.SendText(string(msg.Data))
-			} else {
-				err = tr.Send(msg.Data)
-			}
+		if forwards(transport, otherPeerInRoom) {
+			t.log.Debug("Broadcast to peer", Fields{
+				"clientId":       clientID,
+				"targetClientId": otherClientID,
+			})
+			err := otherPeerInRoom.SendMessage(msg)
 			if err != nil {
-				t.log.Printf("[%s] broadcast error: %s", otherClientID, err)
+				t.log.Error("Error broadcasting to peer", Fields{
+					"clientId":       clientID,
+					"targetClientId": otherClientID,
+					"error":          err,
+				})
 			}
 		}
 	}
 }
 
-func (t *RoomPeersManager) getTransportBySSRC(ssrc uint32) (transport *WebRTCTransport, ok bool) {
+func (t *RoomPeersManager) getTransportBySSRC(ssrc uint32) (transport Transport, ok bool) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
@@ -146,18 +437,20 @@ func (t *RoomPeersManager) getTransportBySSRC(ssrc uint32) (transport *WebRTCTra
 	return transport, ok
 }
 
-func (t *RoomPeersManager) Add(transport *WebRTCTransport) {
-	if transport != nil {
-		t.log.Printf("Add method (roomPeersManager) - clientID %s", transport.clientID)
-	}
+func (t *RoomPeersManager) Add(transport Transport) {
+	t.log.Debug("Add transport", Fields{"clientId": transport.ClientID()})
 
 	go func() {
 		for trackEvent := range transport.TrackEventsChannel() {
 			switch trackEvent.Type {
 			case TrackEventTypeAdd:
-				t.addTrack(transport.ClientID(), trackEvent.TrackInfo)
+				publisherID := trackEvent.ClientID
+				if publisherID == "" {
+					publisherID = transport.ClientID()
+				}
+				t.addTrack(transport, publisherID, trackEvent.TrackInfo)
 			case TrackEventTypeRemove:
-				t.removeTrack(transport.ClientID(), trackEvent.TrackInfo)
+				t.removeTrack(transport, trackEvent.TrackInfo)
 			}
 		}
 	}()
@@ -166,23 +459,76 @@ func (t *RoomPeersManager) Add(transport *WebRTCTransport) {
 		for packet := range transport.RTPChannel() {
 			rtcpPacket := t.jitterHandler.HandleRTP(packet)
 			if rtcpPacket != nil {
-				err := transport.WriteRTCP([]rtcp.Packet{rtcpPacket})
+				err := t.writeRTCP(transport, []rtcp.Packet{rtcpPacket})
 				if err != nil {
-					t.log.Printf("[%s] Error writing RTCP packet: %s: %s", transport.ClientID(), rtcpPacket, err)
+					t.log.Error("Error writing RTCP packet", Fields{
+						"clientId": transport.ClientID(),
+						"error":    err,
+					})
 				}
 			}
 
 			t.mu.Lock()
 
+			if counters, ok := t.trackCounters[packet.SSRC]; ok {
+				counters.recordRTP(packet)
+			}
+			if counters, ok := t.transportCounters[transport.ClientID()]; ok {
+				counters.packetsReceived++
+				counters.bytesReceived += uint64(packet.MarshalSize())
+			}
+
+			simulcastTrack, isSimulcast := t.simulcastTracks[packet.SSRC]
+			if isSimulcast {
+				simulcastTrack.Record(packet)
+			}
+
+			if t.mutedSSRC(packet.SSRC) {
+				t.mu.Unlock()
+				continue
+			}
+
 			for otherClientID, otherTransport := range t.transports {
-				if otherClientID != transport.ClientID() {
-					_, err := otherTransport.WriteRTP(packet)
+				if forwards(transport, otherTransport) {
+					var bytes int
+					var err error
+					if isSimulcast {
+						if !simulcastTrack.Forward(otherClientID, packet) {
+							continue
+						}
+						bytes, err = otherTransport.WriteTrackRTP(simulcastTrack.SSRC(), packet)
+					} else {
+						bytes, err = otherTransport.WriteRTP(packet)
+					}
 					if err != nil {
-						t.log.Printf("[%s] Error writing RTP packet for ssrc: %d: %s", otherClientID, packet.SSRC, err)
+						t.log.Error("Error writing RTP packet", Fields{
+							"clientId": otherClientID,
+							"ssrc":     packet.SSRC,
+							"error":    err,
+						})
+					} else {
+						t.recordSent(otherClientID, bytes)
 					}
 				}
 			}
 
+			for sinkID, sink := range t.sinks {
+				trackSSRC := packet.SSRC
+				if isSimulcast {
+					if !simulcastTrack.Forward(sinkID, packet) {
+						continue
+					}
+					trackSSRC = simulcastTrack.SSRC()
+				}
+				if err := sink.WriteTrackRTP(trackSSRC, packet); err != nil {
+					t.log.Error("Error writing RTP packet to sink", Fields{
+						"clientId": sinkID,
+						"ssrc":     packet.SSRC,
+						"error":    err,
+					})
+				}
+			}
+
 			t.mu.Unlock()
 		}
 	}()
@@ -192,36 +538,29 @@ func (t *RoomPeersManager) Add(transport *WebRTCTransport) {
 			var err error
 			switch packet := pkt.(type) {
 			case *rtcp.ReceiverEstimatedMaximumBitrate:
-				bitrate := t.trackBitrateEstimators.Estimate(transport.ClientID(), packet.SSRCs, packet.Bitrate)
-				packet.Bitrate = bitrate
-
-				transportsSet := map[Transport]struct{}{}
-				for _, ssrc := range packet.SSRCs {
-					sourceTransport, ok := t.getTransportBySSRC(ssrc)
-					if ok {
-						transportsSet[sourceTransport] = struct{}{}
-					}
-				}
-
-				for sourceTransport := range transportsSet {
-					rtcpErr := sourceTransport.WriteRTCP([]rtcp.Packet{pkt})
-					if err == nil && rtcpErr != nil {
-						err = rtcpErr
-					}
-				}
+				t.recordREMB(transport.ClientID(), packet.Bitrate)
+				err = t.handleREMB(transport, packet)
 			case *rtcp.PictureLossIndication:
-				sourceTransport, ok := t.getTransportBySSRC(packet.MediaSSRC)
-				if ok {
-					err = sourceTransport.WriteRTCP([]rtcp.Packet{pkt})
-				} else {
-					err = fmt.Errorf("Cannot find source transport for PictureLossIndication for track: %d", packet.MediaSSRC)
+				mediaSSRC := packet.MediaSSRC
+				if simulcastTrack, ok := t.getSimulcastTrack(mediaSSRC); ok {
+					mediaSSRC, _ = simulcastTrack.CurrentSSRC(transport.ClientID())
 				}
+				t.recordPLI(transport.ClientID(), mediaSSRC)
+				err = t.requestKeyframe(mediaSSRC, packet.SenderSSRC)
 			case *rtcp.TransportLayerNack:
 				foundRTPPackets, nack := t.jitterHandler.HandleNack(packet)
+				t.recordNack(transport.ClientID(), packet, foundRTPPackets)
 				for _, rtpPacket := range foundRTPPackets {
+					if t.isMutedSSRC(rtpPacket.SSRC) {
+						continue
+					}
 					_, err := transport.WriteRTP(rtpPacket)
 					if err != nil {
-						t.log.Printf("[%s] Error writing found RTP packet per NACK request for track: %d: %s", transport.ClientID(), rtpPacket.SSRC, err)
+						t.log.Error("Error writing found RTP packet per NACK request", Fields{
+							"clientId": transport.ClientID(),
+							"ssrc":     rtpPacket.SSRC,
+							"error":    err,
+						})
 					} else {
 						err = fmt.Errorf("Cannot find source transport for NACK for track: %d", packet.MediaSSRC)
 					}
@@ -229,17 +568,25 @@ func (t *RoomPeersManager) Add(transport *WebRTCTransport) {
 				if nack != nil {
 					sourceTransport, ok := t.getTransportBySSRC(packet.MediaSSRC)
 					if ok {
-						err = sourceTransport.WriteRTCP([]rtcp.Packet{nack})
+						err = t.writeRTCP(sourceTransport, []rtcp.Packet{nack})
 					}
 				}
-			case *rtcp.SourceDescription:
 			case *rtcp.ReceiverReport:
+				err = t.handleReceiverReport(transport, packet)
+			case *rtcp.SourceDescription:
 			case *rtcp.SenderReport:
 			default:
-				t.log.Printf("[%s] Got unhandled RTCP pkt for track: %d (%T)", transport.ClientID(), pkt.DestinationSSRC(), pkt)
+				t.log.Debug("Got unhandled RTCP packet", Fields{
+					"clientId": transport.ClientID(),
+					"ssrc":     pkt.DestinationSSRC(),
+					"type":     fmt.Sprintf("%T", pkt),
+				})
 			}
 			if err != nil {
-				t.log.Printf("[%s] addTrackToPeer error sending RTCP packet to source peer: %s", transport.ClientID(), err)
+				t.log.Error("Error sending RTCP packet to source peer", Fields{
+					"clientId": transport.ClientID(),
+					"error":    err,
+				})
 				// do not return early since the rtcp channel needs to be emptied
 			}
 		}
@@ -247,29 +594,45 @@ func (t *RoomPeersManager) Add(transport *WebRTCTransport) {
 
 	go func() {
 		for msg := range transport.MessagesChannel() {
-			t.broadcast(transport.ClientID(), msg)
+			t.broadcast(transport, msg)
 		}
 	}()
 
 	t.mu.Lock()
-	defer t.mu.Unlock()
+
+	var keyframeSSRCs []uint32
 
 	for existingClientID, existingTransport := range t.transports {
+		if !forwards(existingTransport, transport) {
+			continue
+		}
+
 		for _, track := range existingTransport.RemoteTracks() {
-			err := transport.AddTrack(track.PayloadType, track.SSRC, track.ID, track.Label)
+			if simulcastTrack, ok := t.simulcastTracks[track.SSRC]; ok {
+				if simulcastTrack.SSRC() != track.SSRC {
+					// other layers are forwarded through the first layer's track
+					continue
+				}
+				keyframeSSRCs = append(keyframeSSRCs, addSimulcastSubscriber(simulcastTrack, transport.ClientID()))
+			}
+
+			err := transport.AddTrack(t.publisher(track.SSRC, existingClientID), track)
 			if err != nil {
-				t.log.Printf(
-					"Error adding peer clientID: %s track to clientID: %s - reason: %s",
-					existingClientID,
-					transport.ClientID(),
-					err,
-				)
+				t.log.Error("Error adding peer track", Fields{
+					"clientId":       existingClientID,
+					"targetClientId": transport.ClientID(),
+					"error":          err,
+				})
 			}
 		}
 	}
 
 	t.transports[transport.ClientID()] = transport
+	t.transportCounters[transport.ClientID()] = &transportCounters{}
 
+	t.mu.Unlock()
+
+	t.requestKeyframes(transport.ClientID(), keyframeSSRCs)
 }
 
 // GetTracksMetadata retrieves remote track metadata for a specific peer
@@ -289,39 +652,600 @@ func (t *RoomPeersManager) GetTracksMetadata(clientID string) (m []TrackMetadata
 			Kind:     track.Kind.String(),
 			Mid:      track.Mid,
 			StreamID: track.Label,
-			UserID:   t.clientIDBySSRC[track.SSRC],
+			UserID:   t.publisher(track.SSRC, t.clientIDBySSRC[track.SSRC]),
 		}
-		t.log.Printf("[%s] GetTracksMetadata: %d %#v", clientID, track.SSRC, trackMetadata)
+		t.log.Debug("GetTracksMetadata", Fields{
+			"clientId": clientID,
+			"ssrc":     track.SSRC,
+			"userId":   trackMetadata.UserID,
+			"mid":      trackMetadata.Mid,
+		})
 		m = append(m, trackMetadata)
 	}
 
 	return m, true
 }
 
+// Transports returns the state of all transports sorted by client ID.
+func (t *RoomPeersManager) Transports() []TransportState {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	states := make([]TransportState, 0, len(t.transports))
+	for clientID, transport := range t.transports {
+		states = append(states, TransportState{
+			ClientID:     clientID,
+			Relay:        isRelay(transport),
+			LocalTracks:  t.trackStates(transport.LocalTracks(), ""),
+			RemoteTracks: t.trackStates(transport.RemoteTracks(), clientID),
+		})
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].ClientID < states[j].ClientID
+	})
+
+	return states
+}
+
+// TrackStats returns the statistics of the tracks published in the room
+// sorted by SSRC.
+func (t *RoomPeersManager) TrackStats() []TrackStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	stats := make([]TrackStats, 0, len(t.trackCounters))
+	for ssrc, counters := range t.trackCounters {
+		estimatedBitrate, _ := t.trackBitrateEstimators.Bitrate(ssrc)
+		if simulcastTrack, ok := t.simulcastTracks[ssrc]; ok && len(simulcastTrack.LayerSSRCs()) > 1 {
+			// estimates of simulcast tracks are used to select layers instead.
+			estimatedBitrate, _ = simulcastTrack.MaxEstimate()
+		}
+
+		stats = append(stats, TrackStats{
+			SSRC:                 ssrc,
+			Kind:                 t.trackKinds[ssrc].String(),
+			Publisher:            t.publisher(ssrc, t.clientIDBySSRC[ssrc]),
+			Bitrate:              counters.bitrate.bitrate,
+			Packets:              counters.packets,
+			Bytes:                counters.bytes,
+			FractionLost:         counters.maxFractionLost(),
+			Jitter:               counters.maxJitter(),
+			PLIs:                 counters.plis,
+			NackPackets:          counters.nackPackets,
+			RetransmittedPackets: counters.retransmittedPackets,
+			EstimatedBitrate:     estimatedBitrate,
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].SSRC < stats[j].SSRC
+	})
+
+	return stats
+}
+
+// TransportStats returns the statistics of all transports sorted by client
+// ID.
+func (t *RoomPeersManager) TransportStats() []TransportStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	stats := make([]TransportStats, 0, len(t.transportCounters))
+	for clientID, counters := range t.transportCounters {
+		stats = append(stats, counters.stats(clientID, isRelay(t.transports[clientID])))
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ClientID < stats[j].ClientID
+	})
+
+	return stats
+}
+
+// Stats returns the statistics of the transports and tracks in the room.
+func (t *RoomPeersManager) Stats() RoomStats {
+	return RoomStats{
+		Transports: t.TransportStats(),
+		Tracks:     t.TrackStats(),
+	}
+}
+
+// recordSent counts a packet sent to a transport. It must be called while
+// holding the lock.
+func (t *RoomPeersManager) recordSent(clientID string, bytes int) {
+	if bytes == 0 {
+		// the track is paused
+		return
+	}
+
+	if counters, ok := t.transportCounters[clientID]; ok {
+		counters.packetsSent++
+		counters.bytesSent += uint64(bytes)
+	}
+}
+
+// writeRTCP writes packets to a transport and counts the NACKs and PLIs
+// sent to it.
+func (t *RoomPeersManager) writeRTCP(transport Transport, packets []rtcp.Packet) error {
+	if err := transport.WriteRTCP(packets); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if counters, ok := t.transportCounters[transport.ClientID()]; ok {
+		counters.recordRTCPSent(packets)
+	}
+	return nil
+}
+
+func (t *RoomPeersManager) recordNack(clientID string, nack *rtcp.TransportLayerNack, retransmitted []*rtp.Packet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if counters, ok := t.transportCounters[clientID]; ok {
+		counters.nacksReceived++
+	}
+
+	for _, packet := range retransmitted {
+		t.recordSent(clientID, packet.MarshalSize())
+	}
+
+	counters, ok := t.trackCounters[nack.MediaSSRC]
+	if !ok {
+		return
+	}
+
+	for _, nackPair := range nack.Nacks {
+		counters.nackPackets += uint64(len(nackPair.PacketList()))
+	}
+	counters.retransmittedPackets += uint64(len(retransmitted))
+}
+
+func (t *RoomPeersManager) recordPLI(clientID string, ssrc uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if counters, ok := t.transportCounters[clientID]; ok {
+		counters.plisReceived++
+	}
+	if counters, ok := t.trackCounters[ssrc]; ok {
+		counters.plis++
+	}
+}
+
+func (t *RoomPeersManager) recordREMB(clientID string, bitrate uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if counters, ok := t.transportCounters[clientID]; ok {
+		counters.estimatedBitrate = bitrate
+	}
+}
+
+func (t *RoomPeersManager) recordReceiverReport(clientID string, packet *rtcp.ReceiverReport) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if counters, ok := t.transportCounters[clientID]; ok {
+		counters.recordReceiverReport(time.Now(), packet)
+	}
+
+	for _, report := range packet.Reports {
+		if counters, ok := t.trackCounters[report.SSRC]; ok {
+			counters.fractionLost[clientID] = report.FractionLost
+			counters.jitter[clientID] = report.Jitter
+		}
+	}
+}
+
+// trackStates must be called while holding the lock.
+func (t *RoomPeersManager) trackStates(tracks []TrackInfo, defaultClientID string) []TrackState {
+	states := make([]TrackState, 0, len(tracks))
+	for _, track := range tracks {
+		clientID := defaultClientID
+		if clientID == "" {
+			clientID = t.clientIDBySSRC[track.SSRC]
+		}
+		states = append(states, TrackState{
+			SSRC:        track.SSRC,
+			PayloadType: track.PayloadType,
+			ID:          track.ID,
+			Label:       track.Label,
+			Kind:        track.Kind.String(),
+			Mid:         track.Mid,
+			Publisher:   t.publisher(track.SSRC, clientID),
+			Muted:       t.mutedSSRC(track.SSRC),
+		})
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].SSRC < states[j].SSRC
+	})
+
+	return states
+}
+
+// publisher returns the client which published a track. It must be called
+// while holding the lock.
+func (t *RoomPeersManager) publisher(ssrc uint32, defaultClientID string) string {
+	if publisherID, ok := t.publishers[ssrc]; ok {
+		return publisherID
+	}
+	return defaultClientID
+}
+
 func (t *RoomPeersManager) Remove(clientID string) {
-	t.log.Printf("removePeer: %s", clientID)
+	t.log.Debug("removePeer", Fields{"clientId": clientID})
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
 	t.trackBitrateEstimators.RemoveReceiverEstimations(clientID)
+	for _, simulcastTrack := range t.simulcastTracksByKey {
+		simulcastTrack.RemoveSubscriber(clientID)
+	}
+	for key := range t.muted {
+		if key.clientID == clientID {
+			delete(t.muted, key)
+		}
+	}
+	for _, counters := range t.trackCounters {
+		counters.removeSubscriber(clientID)
+	}
+	delete(t.transportCounters, clientID)
 	delete(t.transports, clientID)
 }
 
-func (t *RoomPeersManager) removeTrack(clientID string, track TrackInfo) {
-	t.log.Printf("[%s] removeTrack ssrc: %d from other peers", clientID, track.SSRC)
+func (t *RoomPeersManager) removeTrack(transport Transport, track TrackInfo) {
+	clientID := transport.ClientID()
+	t.log.Debug("removeTrack from other peers", Fields{
+		"clientId": clientID,
+		"ssrc":     track.SSRC,
+	})
 
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
 	t.trackBitrateEstimators.Remove(track.SSRC)
+	t.jitterHandler.RemoveBuffer(track.SSRC)
+	delete(t.trackKinds, track.SSRC)
+	delete(t.trackCounters, track.SSRC)
+
+	trackSSRC := track.SSRC
+	if simulcastTrack, ok := t.simulcastTracks[track.SSRC]; ok {
+		delete(t.simulcastTracks, track.SSRC)
+
+		if simulcastTrack.RemoveLayer(track.SSRC) > 0 {
+			if track.SSRC != simulcastTrack.SSRC() {
+				delete(t.clientIDBySSRC, track.SSRC)
+				delete(t.publishers, track.SSRC)
+			}
+			// other layers are still being forwarded
+			return
+		}
+
+		delete(t.simulcastTracksByKey, newSimulcastTrackKey(clientID, simulcastTrack.TrackInfo()))
+		trackSSRC = simulcastTrack.SSRC()
+		delete(t.clientIDBySSRC, trackSSRC)
+		delete(t.publishers, trackSSRC)
+	}
+
 	delete(t.clientIDBySSRC, track.SSRC)
+	delete(t.publishers, track.SSRC)
 
-	for otherClientID, otherTransport := range t.transports {
-		if otherClientID != clientID {
-			err := otherTransport.RemoveTrack(track.SSRC)
+	for _, otherTransport := range t.transports {
+		if forwards(transport, otherTransport) {
+			err := otherTransport.RemoveTrack(trackSSRC)
+			if err != nil {
+				t.log.Error("Error removing track", Fields{
+					"clientId": clientID,
+					"error":    err,
+				})
+			}
+		}
+	}
+
+	for sinkID, sink := range t.sinks {
+		if err := sink.RemoveTrack(trackSSRC); err != nil {
+			t.log.Error("Error removing track from sink", Fields{
+				"clientId": sinkID,
+				"error":    err,
+			})
+		}
+	}
+}
+
+// AddSink adds a sink which will receive all tracks currently published in
+// the room, as well as any tracks published later. Keyframes are requested
+// for existing video tracks so the sink does not need to wait for one.
+func (t *RoomPeersManager) AddSink(sink TrackSink) {
+	t.mu.Lock()
+
+	keyframeSSRCs := []uint32{}
+
+	for clientID, transport := range t.transports {
+		for _, track := range transport.RemoteTracks() {
+			simulcastTrack, isSimulcast := t.simulcastTracks[track.SSRC]
+			if isSimulcast && simulcastTrack.SSRC() != track.SSRC {
+				continue
+			}
+
+			t.addSinkTrack(sink, t.publisher(track.SSRC, clientID), track, simulcastTrack)
+
+			if isSimulcast {
+				ssrc, _ := simulcastTrack.CurrentSSRC(sink.ID())
+				keyframeSSRCs = append(keyframeSSRCs, ssrc)
+			}
+		}
+	}
+
+	t.sinks[sink.ID()] = sink
+
+	t.mu.Unlock()
+
+	for _, ssrc := range keyframeSSRCs {
+		if err := t.requestKeyframe(ssrc, 0); err != nil {
+			t.log.Error("Error requesting keyframe for sink", Fields{
+				"clientId": sink.ID(),
+				"error":    err,
+			})
+		}
+	}
+}
+
+// RemoveSink removes and closes a sink.
+func (t *RoomPeersManager) RemoveSink(sinkID string) {
+	t.mu.Lock()
+	sink, ok := t.sinks[sinkID]
+	delete(t.sinks, sinkID)
+	for _, simulcastTrack := range t.simulcastTracksByKey {
+		simulcastTrack.RemoveSubscriber(sinkID)
+	}
+	t.mu.Unlock()
+
+	if ok {
+		t.closeSink(sink)
+	}
+}
+
+// Close closes all sinks. It should be called after the last peer has left
+// the room.
+func (t *RoomPeersManager) Close() {
+	t.mu.Lock()
+	sinks := t.sinks
+	t.sinks = map[string]TrackSink{}
+	t.mu.Unlock()
+
+	for _, sink := range sinks {
+		t.closeSink(sink)
+	}
+}
+
+func (t *RoomPeersManager) closeSink(sink TrackSink) {
+	if err := sink.Close(); err != nil {
+		t.log.Error("Error closing sink", Fields{
+			"clientId": sink.ID(),
+			"error":    err,
+		})
+	}
+}
+
+// Mute stops or resumes forwarding the tracks of kind published by clientID
+// to other peers and sinks. The subscribers' tracks are paused so that they
+// do not see a gap in sequence numbers when the tracks are unmuted, and
+// keyframes are requested when video is unmuted so that it resumes quickly.
+func (t *RoomPeersManager) Mute(clientID string, kind webrtc.RTPCodecType, muted bool) error {
+	t.mu.Lock()
+
+	transport, ok := t.transports[clientID]
+	if !ok {
+		t.mu.Unlock()
+		return fmt.Errorf("Client not found: %s", clientID)
+	}
+
+	key := mutedTrackKey{clientID, kind}
+	if muted {
+		t.muted[key] = struct{}{}
+	} else {
+		delete(t.muted, key)
+	}
+
+	keyframeSSRCs := []uint32{}
+
+	for _, track := range transport.RemoteTracks() {
+		if track.Kind != kind {
+			continue
+		}
+
+		if kind == webrtc.RTPCodecTypeVideo {
+			keyframeSSRCs = append(keyframeSSRCs, track.SSRC)
+		}
+
+		if simulcastTrack, ok := t.simulcastTracks[track.SSRC]; ok && simulcastTrack.SSRC() != track.SSRC {
+			// other layers are forwarded through the first layer's track
+			continue
+		}
+
+		for otherClientID, otherTransport := range t.transports {
+			if !forwards(transport, otherTransport) {
+				continue
+			}
+
+			var err error
+			if muted {
+				err = otherTransport.PauseTrack(track.SSRC)
+			} else {
+				err = otherTransport.ResumeTrack(track.SSRC)
+			}
 			if err != nil {
-				t.log.Printf("[%s] removeTrack error removing track: %s", clientID, err)
+				t.log.Error("Error changing mute of track", Fields{
+					"clientId": otherClientID,
+					"ssrc":     track.SSRC,
+					"muted":    muted,
+					"error":    err,
+				})
+			}
+		}
+	}
+
+	t.mu.Unlock()
+
+	if !muted {
+		for _, ssrc := range keyframeSSRCs {
+			if err := t.requestKeyframe(ssrc, 0); err != nil {
+				t.log.Error("Error requesting keyframe after unmute", Fields{
+					"clientId": clientID,
+					"error":    err,
+				})
 			}
 		}
 	}
+
+	return nil
+}
+
+// mutedSSRC returns true when packets from ssrc should not be forwarded. It
+// must be called while holding the lock.
+func (t *RoomPeersManager) mutedSSRC(ssrc uint32) bool {
+	clientID, ok := t.clientIDBySSRC[ssrc]
+	if !ok {
+		return false
+	}
+
+	_, muted := t.muted[mutedTrackKey{clientID, t.trackKinds[ssrc]}]
+	return muted
+}
+
+func (t *RoomPeersManager) isMutedSSRC(ssrc uint32) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.mutedSSRC(ssrc)
+}
+
+func (t *RoomPeersManager) getSimulcastTrack(ssrc uint32) (*SimulcastTrack, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	simulcastTrack, ok := t.simulcastTracks[ssrc]
+	return simulcastTrack, ok
+}
+
+func (t *RoomPeersManager) requestKeyframe(ssrc uint32, senderSSRC uint32) error {
+	sourceTransport, ok := t.getTransportBySSRC(ssrc)
+	if !ok {
+		return fmt.Errorf("Cannot find source transport for PictureLossIndication for track: %d", ssrc)
+	}
+
+	return t.writeRTCP(sourceTransport, []rtcp.Packet{&rtcp.PictureLossIndication{
+		MediaSSRC:  ssrc,
+		SenderSSRC: senderSSRC,
+	}})
+}
+
+// handleREMB uses the estimates for simulcast tracks to select the layer
+// forwarded to the subscriber, and forwards the lowest estimate of all
+// subscribers for the remaining tracks to their publishers.
+func (t *RoomPeersManager) handleREMB(transport Transport, packet *rtcp.ReceiverEstimatedMaximumBitrate) (err error) {
+	clientID := transport.ClientID()
+
+	ssrcs := make([]uint32, 0, len(packet.SSRCs))
+	simulcastTracks := map[*SimulcastTrack]struct{}{}
+
+	for _, ssrc := range packet.SSRCs {
+		simulcastTrack, ok := t.getSimulcastTrack(ssrc)
+		if !ok || len(simulcastTrack.LayerSSRCs()) < 2 {
+			ssrcs = append(ssrcs, ssrc)
+			continue
+		}
+
+		if keyframeSSRC, ok := simulcastTrack.SetEstimate(clientID, packet.Bitrate); ok {
+			t.log.Info("Switching simulcast track layer", Fields{
+				"clientId":  clientID,
+				"ssrc":      simulcastTrack.SSRC(),
+				"layerSsrc": keyframeSSRC,
+			})
+			if pliErr := t.requestKeyframe(keyframeSSRC, packet.SenderSSRC); pliErr != nil && err == nil {
+				err = pliErr
+			}
+		}
+
+		simulcastTracks[simulcastTrack] = struct{}{}
+	}
+
+	for simulcastTrack := range simulcastTracks {
+		bitrate, ok := simulcastTrack.MaxEstimate()
+		if !ok {
+			continue
+		}
+
+		layerSSRCs := simulcastTrack.LayerSSRCs()
+		sourceTransport, ok := t.getTransportBySSRC(layerSSRCs[0])
+		if !ok {
+			continue
+		}
+
+		rtcpErr := sourceTransport.WriteRTCP([]rtcp.Packet{&rtcp.ReceiverEstimatedMaximumBitrate{
+			SenderSSRC: packet.SenderSSRC,
+			Bitrate:    bitrate,
+			SSRCs:      layerSSRCs,
+		}})
+		if err == nil && rtcpErr != nil {
+			err = rtcpErr
+		}
+	}
+
+	if len(ssrcs) == 0 {
+		return err
+	}
+
+	packet.SSRCs = ssrcs
+	packet.Bitrate = t.trackBitrateEstimators.Estimate(clientID, ssrcs, packet.Bitrate)
+
+	transportsSet := map[Transport]struct{}{}
+	for _, ssrc := range ssrcs {
+		sourceTransport, ok := t.getTransportBySSRC(ssrc)
+		if ok {
+			transportsSet[sourceTransport] = struct{}{}
+		}
+	}
+
+	for sourceTransport := range transportsSet {
+		rtcpErr := sourceTransport.WriteRTCP([]rtcp.Packet{packet})
+		if err == nil && rtcpErr != nil {
+			err = rtcpErr
+		}
+	}
+
+	return err
+}
+
+// handleReceiverReport uses the packet loss reported for simulcast tracks to
+// select the layer forwarded to the subscriber.
+func (t *RoomPeersManager) handleReceiverReport(transport Transport, packet *rtcp.ReceiverReport) (err error) {
+	clientID := transport.ClientID()
+
+	t.recordReceiverReport(clientID, packet)
+
+	for _, report := range packet.Reports {
+		simulcastTrack, ok := t.getSimulcastTrack(report.SSRC)
+		if !ok {
+			continue
+		}
+
+		if keyframeSSRC, ok := simulcastTrack.SetFractionLost(clientID, report.FractionLost); ok {
+			t.log.Info("Switching simulcast track layer due to packet loss", Fields{
+				"clientId":  clientID,
+				"ssrc":      simulcastTrack.SSRC(),
+				"layerSsrc": keyframeSSRC,
+			})
+			if pliErr := t.requestKeyframe(keyframeSSRC, packet.SSRC); pliErr != nil && err == nil {
+				err = pliErr
+			}
+		}
+	}
+
+	return err
 }
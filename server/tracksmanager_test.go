@@ -0,0 +1,46 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/peer-calls/peer-calls/server"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoomPeersManager_simulcastKeyframe(t *testing.T) {
+	manager := newTestRoomPeersManager()
+	defer manager.Close()
+
+	client1 := newFakeTransport("client1")
+	manager.Add(client1)
+	defer client1.Close()
+
+	for _, ssrc := range []uint32{1000, 2000} {
+		client1.publish(server.TrackInfo{
+			PayloadType: 96,
+			SSRC:        ssrc,
+			ID:          "video1",
+			Label:       "stream1",
+			Kind:        webrtc.RTPCodecTypeVideo,
+		})
+	}
+
+	// the subscriber would not receive any video until the publisher sends
+	// the next keyframe on its own.
+	client2 := newFakeTransport("client2")
+	manager.Add(client2)
+	defer client2.Close()
+
+	select {
+	case packet := <-client1.writtenRTCP:
+		pli, ok := packet.(*rtcp.PictureLossIndication)
+		require.True(t, ok, "unexpected RTCP packet: %T", packet)
+		assert.Equal(t, uint32(1000), pli.MediaSSRC)
+	case <-time.After(timeout):
+		require.Fail(t, "timed out waiting for PLI")
+	}
+}
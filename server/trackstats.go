@@ -0,0 +1,226 @@
+package server
+
+import (
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// ntpEpochOffset is the number of seconds from the NTP epoch in 1900 to the
+// Unix epoch.
+const ntpEpochOffset = 2208988800
+
+// RoomStats contains the statistics of the transports in a room and the
+// tracks published in it.
+type RoomStats struct {
+	Transports []TransportStats `json:"transports"`
+	Tracks     []TrackStats     `json:"tracks"`
+}
+
+// TransportStats describes the packets exchanged with a transport. Packets
+// are received from the client as a publisher and sent to it as a
+// subscriber.
+type TransportStats struct {
+	ClientID string `json:"clientId"`
+	// Relay is true for transports to other server instances.
+	Relay           bool   `json:"relay"`
+	PacketsReceived uint64 `json:"packetsReceived"`
+	BytesReceived   uint64 `json:"bytesReceived"`
+	PacketsSent     uint64 `json:"packetsSent"`
+	BytesSent       uint64 `json:"bytesSent"`
+	// RTT is the round trip time in milliseconds calculated from the last
+	// receiver report of the client, or zero when it is not known.
+	RTT float64 `json:"rtt"`
+	// FractionLost is the highest fraction of packets lost, from 0 to 1, and
+	// Jitter the highest interarrival jitter, in RTP timestamp units, in the
+	// last receiver report of the client.
+	FractionLost float64 `json:"fractionLost"`
+	Jitter       uint32  `json:"jitter"`
+	// NacksReceived and PLIsReceived are the NACKs and PLIs the client sent
+	// for the tracks it receives, and NacksSent and PLIsSent those sent to it
+	// for the tracks it publishes.
+	NacksReceived uint64 `json:"nacksReceived"`
+	NacksSent     uint64 `json:"nacksSent"`
+	PLIsReceived  uint64 `json:"plisReceived"`
+	PLIsSent      uint64 `json:"plisSent"`
+	// EstimatedBitrate is the last REMB estimate of the client in bits per
+	// second.
+	EstimatedBitrate uint64 `json:"estimatedBitrate"`
+}
+
+// TrackStats describes the packets received for a track published in a room.
+type TrackStats struct {
+	SSRC      uint32 `json:"ssrc"`
+	Kind      string `json:"kind"`
+	Publisher string `json:"publisher"`
+	// Bitrate is the bitrate the track was received at in bits per second.
+	Bitrate uint64 `json:"bitrate"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+	// FractionLost is the highest fraction of packets lost reported by the
+	// subscribers of the track, from 0 to 1.
+	FractionLost float64 `json:"fractionLost"`
+	// Jitter is the highest interarrival jitter reported by the subscribers
+	// of the track in RTP timestamp units.
+	Jitter uint32 `json:"jitter"`
+	// PLIs is the number of keyframes subscribers requested.
+	PLIs uint64 `json:"plis"`
+	// NackPackets is the number of packets subscribers asked to be resent,
+	// and RetransmittedPackets the number of those found in the jitter
+	// buffer.
+	NackPackets          uint64 `json:"nackPackets"`
+	RetransmittedPackets uint64 `json:"retransmittedPackets"`
+	// EstimatedBitrate is the REMB estimate forwarded to the publisher in bits
+	// per second, or zero when the subscribers have not sent any estimates.
+	EstimatedBitrate uint64 `json:"estimatedBitrate"`
+}
+
+// trackCounters keeps the statistics of a single track. It is not safe for
+// concurrent use.
+type trackCounters struct {
+	bitrate              bitrateMeter
+	packets              uint64
+	bytes                uint64
+	nackPackets          uint64
+	retransmittedPackets uint64
+	plis                 uint64
+	// fractionLost and jitter contain the fraction of lost packets (out of
+	// 256) and jitter from the last receiver report of each subscriber.
+	fractionLost map[string]uint8
+	jitter       map[string]uint32
+}
+
+func newTrackCounters() *trackCounters {
+	return &trackCounters{
+		fractionLost: map[string]uint8{},
+		jitter:       map[string]uint32{},
+	}
+}
+
+func (c *trackCounters) recordRTP(packet *rtp.Packet) {
+	size := packet.MarshalSize()
+	c.bitrate.record(time.Now(), size)
+	c.packets++
+	c.bytes += uint64(size)
+}
+
+func (c *trackCounters) maxFractionLost() float64 {
+	var fractionLost uint8
+	for _, value := range c.fractionLost {
+		if value > fractionLost {
+			fractionLost = value
+		}
+	}
+	return float64(fractionLost) / 256
+}
+
+func (c *trackCounters) maxJitter() (jitter uint32) {
+	for _, value := range c.jitter {
+		if value > jitter {
+			jitter = value
+		}
+	}
+	return jitter
+}
+
+func (c *trackCounters) removeSubscriber(clientID string) {
+	delete(c.fractionLost, clientID)
+	delete(c.jitter, clientID)
+}
+
+// transportCounters keeps the statistics of a single transport. It is not
+// safe for concurrent use.
+type transportCounters struct {
+	packetsReceived  uint64
+	bytesReceived    uint64
+	packetsSent      uint64
+	bytesSent        uint64
+	rtt              time.Duration
+	fractionLost     uint8
+	jitter           uint32
+	nacksReceived    uint64
+	nacksSent        uint64
+	plisReceived     uint64
+	plisSent         uint64
+	estimatedBitrate uint64
+}
+
+// recordReceiverReport keeps the highest packet loss and jitter of the
+// reports, and the round trip time of the last report which has it.
+func (c *transportCounters) recordReceiverReport(now time.Time, packet *rtcp.ReceiverReport) {
+	var fractionLost uint8
+	var jitter uint32
+
+	for _, report := range packet.Reports {
+		if report.FractionLost > fractionLost {
+			fractionLost = report.FractionLost
+		}
+		if report.Jitter > jitter {
+			jitter = report.Jitter
+		}
+		if rtt, ok := roundTripTime(now, report); ok {
+			c.rtt = rtt
+		}
+	}
+
+	c.fractionLost = fractionLost
+	c.jitter = jitter
+}
+
+// recordRTCPSent counts the NACKs and PLIs sent to the transport.
+func (c *transportCounters) recordRTCPSent(packets []rtcp.Packet) {
+	for _, packet := range packets {
+		switch packet.(type) {
+		case *rtcp.TransportLayerNack:
+			c.nacksSent++
+		case *rtcp.PictureLossIndication:
+			c.plisSent++
+		}
+	}
+}
+
+func (c *transportCounters) stats(clientID string, relay bool) TransportStats {
+	return TransportStats{
+		ClientID:         clientID,
+		Relay:            relay,
+		PacketsReceived:  c.packetsReceived,
+		BytesReceived:    c.bytesReceived,
+		PacketsSent:      c.packetsSent,
+		BytesSent:        c.bytesSent,
+		RTT:              float64(c.rtt) / float64(time.Millisecond),
+		FractionLost:     float64(c.fractionLost) / 256,
+		Jitter:           c.jitter,
+		NacksReceived:    c.nacksReceived,
+		NacksSent:        c.nacksSent,
+		PLIsReceived:     c.plisReceived,
+		PLIsSent:         c.plisSent,
+		EstimatedBitrate: c.estimatedBitrate,
+	}
+}
+
+// ntpTime converts t to the 64 bit NTP timestamp format used in sender
+// reports.
+func ntpTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix()) + ntpEpochOffset
+	fraction := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// roundTripTime calculates the round trip time from a reception report
+// received at now. The report contains the middle 32 bits of the NTP
+// timestamp of the last sender report its sender received, and the delay
+// since then, both in units of 1/65536 seconds. It returns false when the
+// sender of the report has not received any sender reports.
+func roundTripTime(now time.Time, report rtcp.ReceptionReport) (time.Duration, bool) {
+	if report.LastSenderReport == 0 {
+		return 0, false
+	}
+
+	rtt := int32(uint32(ntpTime(now)>>16) - report.LastSenderReport - report.Delay)
+	if rtt < 0 {
+		return 0, false
+	}
+
+	return time.Duration(rtt) * time.Second / 65536, true
+}
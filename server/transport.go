@@ -3,13 +3,30 @@ package server
 import (
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
 )
 
+// Transport is a peer in a room which publishes and receives tracks, like a
+// WebRTC client or another server instance relaying the tracks of its
+// clients.
 type Transport interface {
+	ClientID() string
 	WriteRTCP([]rtcp.Packet) error
 	WriteRTP(*rtp.Packet) (int, error)
-	// TrackEventsChannel() <-chan TrackEvent
+	WriteTrackRTP(trackSSRC uint32, packet *rtp.Packet) (int, error)
+	// AddTrack adds a local track for forwarding the track published by
+	// clientID.
+	AddTrack(clientID string, track TrackInfo) error
+	RemoveTrack(ssrc uint32) error
+	PauseTrack(ssrc uint32) error
+	ResumeTrack(ssrc uint32) error
+	SendMessage(msg webrtc.DataChannelMessage) error
+	// RemoteTracks returns the tracks published through the transport.
+	RemoteTracks() []TrackInfo
+	// LocalTracks returns the tracks forwarded to the transport.
+	LocalTracks() []TrackInfo
+	TrackEventsChannel() <-chan TrackEvent
 	RTPChannel() <-chan *rtp.Packet
 	RTCPChannel() <-chan rtcp.Packet
-	// MessagesChannel() <-chan webrtc.DataChannelMessage
+	MessagesChannel() <-chan webrtc.DataChannelMessage
 }
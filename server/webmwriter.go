@@ -0,0 +1,364 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media/samplebuilder"
+)
+
+// EBML element IDs used for writing WebM files. See
+// https://www.matroska.org/technical/elements.html
+const (
+	ebmlIDHeader             = 0x1A45DFA3
+	ebmlIDVersion            = 0x4286
+	ebmlIDReadVersion        = 0x42F7
+	ebmlIDMaxIDLength        = 0x42F2
+	ebmlIDMaxSizeLength      = 0x42F3
+	ebmlIDDocType            = 0x4282
+	ebmlIDDocTypeVersion     = 0x4287
+	ebmlIDDocTypeReadVersion = 0x4285
+
+	webmIDSegment           = 0x18538067
+	webmIDInfo              = 0x1549A966
+	webmIDTimecodeScale     = 0x2AD7B1
+	webmIDMuxingApp         = 0x4D80
+	webmIDWritingApp        = 0x5741
+	webmIDTracks            = 0x1654AE6B
+	webmIDTrackEntry        = 0xAE
+	webmIDTrackNumber       = 0xD7
+	webmIDTrackUID          = 0x73C5
+	webmIDTrackType         = 0x83
+	webmIDCodecID           = 0x86
+	webmIDCodecPrivate      = 0x63A2
+	webmIDVideo             = 0xE0
+	webmIDPixelWidth        = 0xB0
+	webmIDPixelHeight       = 0xBA
+	webmIDAudio             = 0xE1
+	webmIDSamplingFrequency = 0xB5
+	webmIDChannels          = 0x9F
+	webmIDCluster           = 0x1F43B675
+	webmIDTimecode          = 0xE7
+	webmIDSimpleBlock       = 0xA3
+)
+
+const (
+	webmTrackTypeVideo = 1
+	webmTrackTypeAudio = 2
+
+	webmTrackNumber = 1
+	webmMuxingApp   = "peer-calls"
+
+	// webmMaxClusterDuration limits the duration of a cluster in milliseconds
+	// because block timecodes are relative to the cluster and stored as int16.
+	webmMaxClusterDuration = 10000
+
+	// webmMaxLate is the number of packets the sample builder keeps around
+	// while waiting for reordered packets.
+	webmMaxLate = 128
+
+	opusSampleRate = 48000
+	opusChannels   = 2
+)
+
+var ebmlUnknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// WebMWriter depacketizes an Opus or VP8 RTP stream and writes it into a WebM
+// file with a single track. The segment and clusters are written with an
+// unknown size so that the file can be written without seeking, the same way
+// browsers do when recording with MediaRecorder.
+type WebMWriter struct {
+	out           io.WriteCloser
+	kind          webrtc.RTPCodecType
+	clockRate     uint32
+	sampleBuilder *samplebuilder.SampleBuilder
+
+	headerWritten bool
+	lastTimestamp uint32
+	// elapsed is the duration since the first frame in clockRate units
+	elapsed uint64
+
+	clusterOpen     bool
+	clusterTimecode uint64
+}
+
+// NewWebMWriter creates a new writer for a track of kind. Audio tracks must
+// be Opus and video tracks VP8.
+func NewWebMWriter(out io.WriteCloser, kind webrtc.RTPCodecType) (*WebMWriter, error) {
+	w := &WebMWriter{
+		out:  out,
+		kind: kind,
+	}
+
+	switch kind {
+	case webrtc.RTPCodecTypeAudio:
+		w.clockRate = opusSampleRate
+		w.sampleBuilder = samplebuilder.New(
+			webmMaxLate,
+			&codecs.OpusPacket{},
+			samplebuilder.WithPartitionHeadChecker(&codecs.OpusPartitionHeadChecker{}),
+		)
+	case webrtc.RTPCodecTypeVideo:
+		w.clockRate = videoClock
+		w.sampleBuilder = samplebuilder.New(
+			webmMaxLate,
+			&codecs.VP8Packet{},
+			samplebuilder.WithPartitionHeadChecker(&codecs.VP8PartitionHeadChecker{}),
+		)
+	default:
+		return nil, fmt.Errorf("Unsupported track kind: %s", kind)
+	}
+
+	return w, nil
+}
+
+// WriteRTP adds a packet and writes all frames which have been completed.
+// Video frames are skipped until the first keyframe is received.
+func (w *WebMWriter) WriteRTP(packet *rtp.Packet) error {
+	w.sampleBuilder.Push(packet)
+
+	for {
+		sample, timestamp := w.sampleBuilder.PopWithTimestamp()
+		if sample == nil {
+			return nil
+		}
+
+		if err := w.writeFrame(sample.Data, timestamp); err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the underlying writer. Frames which have not been completed
+// are discarded.
+func (w *WebMWriter) Close() error {
+	return w.out.Close()
+}
+
+func (w *WebMWriter) writeFrame(frame []byte, timestamp uint32) error {
+	if len(frame) == 0 {
+		return nil
+	}
+
+	keyframe := true
+	if w.kind == webrtc.RTPCodecTypeVideo {
+		// See https://tools.ietf.org/html/rfc6386#section-9.1
+		keyframe = frame[0]&0x01 == 0
+	}
+
+	if !w.headerWritten {
+		if !keyframe {
+			return nil
+		}
+
+		if err := w.writeHeader(frame); err != nil {
+			return fmt.Errorf("Error writing WebM header: %w", err)
+		}
+
+		w.headerWritten = true
+		w.lastTimestamp = timestamp
+	}
+
+	if diff := int32(timestamp - w.lastTimestamp); diff > 0 {
+		w.elapsed += uint64(diff)
+		w.lastTimestamp = timestamp
+	}
+
+	timecode := w.elapsed * 1000 / uint64(w.clockRate)
+
+	newCluster := !w.clusterOpen ||
+		timecode-w.clusterTimecode > webmMaxClusterDuration ||
+		(keyframe && w.kind == webrtc.RTPCodecTypeVideo)
+
+	if newCluster {
+		cluster := concatBytes(
+			ebmlID(webmIDCluster),
+			ebmlUnknownSize,
+			ebmlUint(webmIDTimecode, timecode),
+		)
+		if _, err := w.out.Write(cluster); err != nil {
+			return fmt.Errorf("Error writing WebM cluster: %w", err)
+		}
+
+		w.clusterOpen = true
+		w.clusterTimecode = timecode
+	}
+
+	var flags byte
+	if keyframe {
+		flags = 0x80
+	}
+
+	block := make([]byte, 4, 4+len(frame))
+	block[0] = 0x80 | webmTrackNumber
+	binary.BigEndian.PutUint16(block[1:], uint16(timecode-w.clusterTimecode))
+	block[3] = flags
+	block = append(block, frame...)
+
+	if _, err := w.out.Write(ebmlElement(webmIDSimpleBlock, block)); err != nil {
+		return fmt.Errorf("Error writing WebM block: %w", err)
+	}
+
+	return nil
+}
+
+func (w *WebMWriter) writeHeader(frame []byte) error {
+	var track []byte
+
+	switch w.kind {
+	case webrtc.RTPCodecTypeVideo:
+		width, height, err := vp8FrameSize(frame)
+		if err != nil {
+			return err
+		}
+
+		track = ebmlElement(webmIDTrackEntry,
+			ebmlUint(webmIDTrackNumber, webmTrackNumber),
+			ebmlUint(webmIDTrackUID, webmTrackNumber),
+			ebmlUint(webmIDTrackType, webmTrackTypeVideo),
+			ebmlString(webmIDCodecID, "V_VP8"),
+			ebmlElement(webmIDVideo,
+				ebmlUint(webmIDPixelWidth, uint64(width)),
+				ebmlUint(webmIDPixelHeight, uint64(height)),
+			),
+		)
+	default:
+		track = ebmlElement(webmIDTrackEntry,
+			ebmlUint(webmIDTrackNumber, webmTrackNumber),
+			ebmlUint(webmIDTrackUID, webmTrackNumber),
+			ebmlUint(webmIDTrackType, webmTrackTypeAudio),
+			ebmlString(webmIDCodecID, "A_OPUS"),
+			ebmlElement(webmIDCodecPrivate, opusHead()),
+			ebmlElement(webmIDAudio,
+				ebmlFloat(webmIDSamplingFrequency, opusSampleRate),
+				ebmlUint(webmIDChannels, opusChannels),
+			),
+		)
+	}
+
+	header := concatBytes(
+		ebmlElement(ebmlIDHeader,
+			ebmlUint(ebmlIDVersion, 1),
+			ebmlUint(ebmlIDReadVersion, 1),
+			ebmlUint(ebmlIDMaxIDLength, 4),
+			ebmlUint(ebmlIDMaxSizeLength, 8),
+			ebmlString(ebmlIDDocType, "webm"),
+			ebmlUint(ebmlIDDocTypeVersion, 2),
+			ebmlUint(ebmlIDDocTypeReadVersion, 2),
+		),
+		ebmlID(webmIDSegment),
+		ebmlUnknownSize,
+		ebmlElement(webmIDInfo,
+			ebmlUint(webmIDTimecodeScale, 1000000),
+			ebmlString(webmIDMuxingApp, webmMuxingApp),
+			ebmlString(webmIDWritingApp, webmMuxingApp),
+		),
+		ebmlElement(webmIDTracks, track),
+	)
+
+	_, err := w.out.Write(header)
+	return err
+}
+
+// vp8FrameSize reads the dimensions from a VP8 keyframe. See
+// https://tools.ietf.org/html/rfc6386#section-9.1
+func vp8FrameSize(frame []byte) (width uint16, height uint16, err error) {
+	if len(frame) < 10 || frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+		return 0, 0, fmt.Errorf("Invalid VP8 keyframe header")
+	}
+
+	width = binary.LittleEndian.Uint16(frame[6:]) & 0x3fff
+	height = binary.LittleEndian.Uint16(frame[8:]) & 0x3fff
+	return width, height, nil
+}
+
+// opusHead creates the identification header used as CodecPrivate for Opus.
+// See https://tools.ietf.org/html/rfc7845#section-5.1
+func opusHead() []byte {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = opusChannels
+	binary.LittleEndian.PutUint16(head[10:], 0) // pre-skip
+	binary.LittleEndian.PutUint32(head[12:], opusSampleRate)
+	binary.LittleEndian.PutUint16(head[16:], 0) // output gain
+	head[18] = 0                                // channel mapping family
+	return head
+}
+
+func ebmlID(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+// ebmlSize encodes size as a variable length integer using the fewest bytes
+// possible. A value with all bits set is reserved for unknown sizes.
+func ebmlSize(size uint64) []byte {
+	length := uint(1)
+	for ; length < 8; length++ {
+		if size < 1<<(7*length)-1 {
+			break
+		}
+	}
+
+	value := size | 1<<(7*length)
+	b := make([]byte, length)
+	for i := int(length) - 1; i >= 0; i-- {
+		b[i] = byte(value)
+		value >>= 8
+	}
+	return b
+}
+
+func ebmlElement(id uint32, children ...[]byte) []byte {
+	data := concatBytes(children...)
+	return concatBytes(ebmlID(id), ebmlSize(uint64(len(data))), data)
+}
+
+func ebmlUint(id uint32, value uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], value)
+
+	i := 0
+	for i < 7 && b[i] == 0 {
+		i++
+	}
+
+	return ebmlElement(id, b[i:])
+}
+
+func ebmlFloat(id uint32, value float64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(value))
+	return ebmlElement(id, b[:])
+}
+
+func ebmlString(id uint32, value string) []byte {
+	return ebmlElement(id, []byte(value))
+}
+
+func concatBytes(slices ...[]byte) []byte {
+	size := 0
+	for _, s := range slices {
+		size += len(s)
+	}
+
+	result := make([]byte, 0, size)
+	for _, s := range slices {
+		result = append(result, s...)
+	}
+	return result
+}
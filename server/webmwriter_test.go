@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestEBMLSize(t *testing.T) {
+	for _, testCase := range []struct {
+		size    uint64
+		encoded []byte
+	}{
+		{0, []byte{0x80}},
+		{1, []byte{0x81}},
+		{126, []byte{0xFE}},
+		{127, []byte{0x40, 0x7F}},
+		{16382, []byte{0x7F, 0xFE}},
+		{16383, []byte{0x20, 0x3F, 0xFF}},
+	} {
+		assert.Equal(t, testCase.encoded, ebmlSize(testCase.size), "size: %d", testCase.size)
+	}
+}
+
+func TestEBMLUint(t *testing.T) {
+	assert.Equal(t, []byte{0xD7, 0x81, 0x01}, ebmlUint(webmIDTrackNumber, 1))
+	assert.Equal(t, []byte{0xB0, 0x82, 0x02, 0x80}, ebmlUint(webmIDPixelWidth, 640))
+	assert.Equal(t, []byte{0xE7, 0x81, 0x00}, ebmlUint(webmIDTimecode, 0))
+}
+
+func newRTPPayloadPacket(sn uint16, ts uint32, payload []byte) *rtp.Packet {
+	packet := &rtp.Packet{Payload: payload}
+	packet.SSRC = 1
+	packet.SequenceNumber = sn
+	packet.Timestamp = ts
+	packet.Marker = true
+	return packet
+}
+
+func newVP8Frame(keyframe bool) []byte {
+	if !keyframe {
+		return []byte{0x01, 0x00, 0x00, 0xAA}
+	}
+	// frame tag, start code, 640x480
+	return []byte{0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01}
+}
+
+func newSimpleBlock(timecode int16, keyframe bool, frame []byte) []byte {
+	var flags byte
+	if keyframe {
+		flags = 0x80
+	}
+	data := append([]byte{0x81, byte(timecode >> 8), byte(timecode), flags}, frame...)
+	return ebmlElement(webmIDSimpleBlock, data)
+}
+
+func TestWebMWriter_video(t *testing.T) {
+	out := &bufferCloser{}
+	w, err := NewWebMWriter(out, webrtc.RTPCodecTypeVideo)
+	require.NoError(t, err)
+
+	// VP8 payload descriptor with the start of partition bit set
+	descriptor := []byte{0x10}
+
+	packets := []*rtp.Packet{
+		newRTPPayloadPacket(1, 1000, append(descriptor, newVP8Frame(false)...)),
+		newRTPPayloadPacket(2, 4000, append(descriptor, newVP8Frame(true)...)),
+		newRTPPayloadPacket(3, 7000, append(descriptor, newVP8Frame(false)...)),
+		newRTPPayloadPacket(4, 10000, append(descriptor, newVP8Frame(false)...)),
+	}
+	for _, packet := range packets {
+		require.NoError(t, w.WriteRTP(packet))
+	}
+	require.NoError(t, w.Close())
+	assert.True(t, out.closed)
+
+	data := out.Bytes()
+	require.True(t, bytes.HasPrefix(data, ebmlID(ebmlIDHeader)))
+	assert.Contains(t, string(data), "V_VP8")
+	assert.True(t, bytes.Contains(data, ebmlUint(webmIDPixelWidth, 640)))
+	assert.True(t, bytes.Contains(data, ebmlUint(webmIDPixelHeight, 480)))
+
+	assert.True(t, bytes.Contains(data, newSimpleBlock(0, true, newVP8Frame(true))))
+	assert.True(t, bytes.Contains(data, newSimpleBlock(33, false, newVP8Frame(false))))
+	assert.Equal(t, 1, bytes.Count(data, ebmlID(webmIDCluster)))
+}
+
+func TestWebMWriter_audio(t *testing.T) {
+	out := &bufferCloser{}
+	w, err := NewWebMWriter(out, webrtc.RTPCodecTypeAudio)
+	require.NoError(t, err)
+
+	frame := []byte{0xfc, 0xff, 0xfe}
+	for i := 0; i < 4; i++ {
+		packet := newRTPPayloadPacket(uint16(100+i), uint32(i*960), frame)
+		require.NoError(t, w.WriteRTP(packet))
+	}
+
+	data := out.Bytes()
+	assert.Contains(t, string(data), "A_OPUS")
+	assert.True(t, bytes.Contains(data, opusHead()))
+	assert.True(t, bytes.Contains(data, newSimpleBlock(20, true, frame)))
+	assert.True(t, bytes.Contains(data, newSimpleBlock(40, true, frame)))
+}
+
+func TestWebMWriter_unsupportedKind(t *testing.T) {
+	_, err := NewWebMWriter(&bufferCloser{}, webrtc.RTPCodecType(0))
+	assert.Error(t, err)
+}
+
+func TestVP8FrameSize(t *testing.T) {
+	width, height, err := vp8FrameSize(newVP8Frame(true))
+	require.NoError(t, err)
+	assert.Equal(t, uint16(640), width)
+	assert.Equal(t, uint16(480), height)
+
+	_, _, err = vp8FrameSize(newVP8Frame(false))
+	assert.Error(t, err)
+}
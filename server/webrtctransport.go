@@ -1,14 +1,19 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"sync"
 	"time"
 
+	"github.com/peer-calls/peer-calls/server/logger"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type TrackInfo struct {
@@ -30,12 +35,17 @@ const (
 type TrackEvent struct {
 	TrackInfo
 	Type TrackEventType
+	// ClientID is the client which published the track. It is empty when the
+	// track was published by the transport's own client, and set for tracks
+	// relayed from other server instances.
+	ClientID string
 }
 
 type WebRTCTransportFactory struct {
-	loggerFactory LoggerFactory
-	iceServers    []ICEServer
-	webrtcAPI     *webrtc.API
+	loggerFactory         LoggerFactory
+	iceServers            []ICEServer
+	webrtcAPI             *webrtc.API
+	disconnectGracePeriod time.Duration
 }
 
 func NewWebRTCTransportFactory(
@@ -66,7 +76,20 @@ func NewWebRTCTransportFactory(
 		webrtc.WithSettingEngine(settingEngine),
 	)
 
-	return &WebRTCTransportFactory{loggerFactory, iceServers, api}
+	return &WebRTCTransportFactory{loggerFactory, iceServers, api, sfuConfig.DisconnectGracePeriod}
+}
+
+// HealthCheck creates and closes a peer connection to check that new
+// transports can be created.
+func (f *WebRTCTransportFactory) HealthCheck(ctx context.Context) error {
+	peerConnection, err := f.webrtcAPI.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return fmt.Errorf("Error creating peer connection: %w", err)
+	}
+	if err := peerConnection.Close(); err != nil {
+		return fmt.Errorf("Error closing peer connection: %w", err)
+	}
+	return nil
 }
 
 func RegisterCodecs(mediaEngine *webrtc.MediaEngine, jitterBufferEnabled bool) {
@@ -112,21 +135,32 @@ type WebRTCTransport struct {
 	rtcpLog Logger
 
 	clientID        string
+	receiveOnly     bool
 	peerConnection  *webrtc.PeerConnection
 	signaller       *Signaller
 	dataTransceiver *DataTransceiver
 
+	// connectSpan covers the negotiation and ICE until the first RTP packet is
+	// received or sent.
+	connectSpan     trace.Span
+	connectSpanOnce sync.Once
+
 	trackEventsCh chan TrackEvent
 	rtpCh         chan *rtp.Packet
 	rtcpCh        chan rtcp.Packet
 
 	localTracks  map[uint32]localTrackInfo
 	remoteTracks map[uint32]remoteTrackInfo
+	// localTrackSSRCBySource contains the SSRCs of local tracks keyed by the
+	// SSRCs of other sources forwarded through them, like simulcast layers.
+	localTrackSSRCBySource map[uint32]uint32
 }
 
 var _ Transport = &WebRTCTransport{}
 
-func (f WebRTCTransportFactory) NewWebRTCTransport(clientID string) (*WebRTCTransport, error) {
+// NewWebRTCTransport creates a new transport for a client. Receive only
+// clients cannot publish any tracks.
+func (f WebRTCTransportFactory) NewWebRTCTransport(ctx context.Context, clientID string, receiveOnly bool) (*WebRTCTransport, error) {
 	webrtcICEServers := []webrtc.ICEServer{}
 	for _, iceServer := range GetICEAuthServers(f.iceServers) {
 		var c webrtc.ICECredentialType
@@ -150,25 +184,47 @@ func (f WebRTCTransportFactory) NewWebRTCTransport(clientID string) (*WebRTCTran
 		return nil, err
 	}
 
-	return NewWebRTCTransport(f.loggerFactory, clientID, true, peerConnection)
+	return NewWebRTCTransport(ctx, f.loggerFactory, clientID, true, receiveOnly, peerConnection, f.disconnectGracePeriod)
 }
 
-func NewWebRTCTransport(loggerFactory LoggerFactory, clientID string, initiator bool, peerConnection *webrtc.PeerConnection) (*WebRTCTransport, error) {
+// NewWebRTCTransport creates a new transport. The peer connection is closed
+// when ICE does not reconnect within disconnectGracePeriod after a
+// disconnect. The spans of the connection are added to the trace in ctx.
+func NewWebRTCTransport(
+	ctx context.Context,
+	loggerFactory LoggerFactory,
+	clientID string,
+	initiator bool,
+	receiveOnly bool,
+	peerConnection *webrtc.PeerConnection,
+	disconnectGracePeriod time.Duration,
+) (*WebRTCTransport, error) {
+	ctx, connectSpan := startSpan(ctx, "WebRTCTransport.connect", trace.WithAttributes(
+		attribute.String("clientId", clientID),
+		attribute.Bool("receiveOnly", receiveOnly),
+	))
+
 	signaller, err := NewSignaller(
+		ctx,
 		loggerFactory,
 		initiator,
+		receiveOnly,
 		peerConnection,
 		localPeerID,
 		clientID,
+		disconnectGracePeriod,
 	)
 
-	log := loggerFactory.GetLogger("webrtctransport")
+	log := loggerFactory.GetLogger("webrtctransport").WithFields(Fields{
+		"clientId": clientID,
+	})
 
 	peerConnection.OnICEGatheringStateChange(func(state webrtc.ICEGathererState) {
-		log.Printf("[%s] ICE gathering state changed: %s", clientID, state)
+		log.Debug("ICE gathering state changed", Fields{"state": state.String()})
 	})
 
 	closePeer := func(reason error) error {
+		endSpan(connectSpan, reason)
 		err = peerConnection.Close()
 		if err != nil {
 			return fmt.Errorf("Error closing peer connection: %s. Close was called because: %w", err, reason)
@@ -192,8 +248,8 @@ func NewWebRTCTransport(loggerFactory LoggerFactory, clientID string, initiator
 		return nil, closePeer(fmt.Errorf("Error initializing signaller: %w", err))
 	}
 
-	rtpLog := loggerFactory.GetLogger("rtp")
-	rtcpLog := loggerFactory.GetLogger("rtcp")
+	rtpLog := loggerFactory.GetLogger("rtp").WithFields(Fields{"clientId": clientID})
+	rtcpLog := loggerFactory.GetLogger("rtcp").WithFields(Fields{"clientId": clientID})
 
 	transport := &WebRTCTransport{
 		log:     log,
@@ -201,22 +257,26 @@ func NewWebRTCTransport(loggerFactory LoggerFactory, clientID string, initiator
 		rtcpLog: rtcpLog,
 
 		clientID:        clientID,
+		receiveOnly:     receiveOnly,
 		signaller:       signaller,
 		peerConnection:  peerConnection,
 		dataTransceiver: dataTransceiver,
+		connectSpan:     connectSpan,
 
 		trackEventsCh: make(chan TrackEvent),
 		rtpCh:         make(chan *rtp.Packet),
 		rtcpCh:        make(chan rtcp.Packet),
 
-		localTracks:  map[uint32]localTrackInfo{},
-		remoteTracks: map[uint32]remoteTrackInfo{},
+		localTracks:            map[uint32]localTrackInfo{},
+		remoteTracks:           map[uint32]remoteTrackInfo{},
+		localTrackSSRCBySource: map[uint32]uint32{},
 	}
 	peerConnection.OnTrack(transport.handleTrack)
 
 	go func() {
 		// wait for peer connection to be closed
 		<-signaller.CloseChannel()
+		transport.endConnectSpan("")
 		// do not close channels before all writing goroutines exit
 		transport.wg.Wait()
 		transport.dataTransceiver.Close()
@@ -228,10 +288,45 @@ func NewWebRTCTransport(loggerFactory LoggerFactory, clientID string, initiator
 }
 
 type localTrackInfo struct {
-	trackInfo   TrackInfo
-	transceiver *webrtc.RTPTransceiver
-	sender      *webrtc.RTPSender
-	track       *webrtc.Track
+	trackInfo    TrackInfo
+	transceiver  *webrtc.RTPTransceiver
+	sender       *webrtc.RTPSender
+	track        *webrtc.Track
+	munger       *RTPMunger
+	senderReport *senderReportState
+}
+
+// senderReportInterval is the minimum time between the sender reports of a
+// local track. Subscribers include the time of the last sender report in
+// their receiver reports, which is used to calculate the round trip time.
+const senderReportInterval = time.Second
+
+// senderReportState counts the packets written to a local track for its
+// sender reports.
+type senderReportState struct {
+	lastSent time.Time
+	packets  uint32
+	octets   uint32
+}
+
+// record counts a packet written to a local track and returns a sender
+// report when one is due.
+func (s *senderReportState) record(now time.Time, packet *rtp.Packet) (*rtcp.SenderReport, bool) {
+	s.packets++
+	s.octets += uint32(len(packet.Payload))
+
+	if now.Sub(s.lastSent) < senderReportInterval {
+		return nil, false
+	}
+	s.lastSent = now
+
+	return &rtcp.SenderReport{
+		SSRC:        packet.SSRC,
+		NTPTime:     ntpTime(now),
+		RTPTime:     packet.Timestamp,
+		PacketCount: s.packets,
+		OctetCount:  s.octets,
+	}, true
 }
 
 type remoteTrackInfo struct {
@@ -241,6 +336,22 @@ type remoteTrackInfo struct {
 	track       *webrtc.Track
 }
 
+// endConnectSpan ends the connect span after the first RTP packet has been
+// received or sent in direction, or after the transport was closed when
+// direction is empty.
+func (p *WebRTCTransport) endConnectSpan(direction string) {
+	p.connectSpanOnce.Do(func() {
+		if direction == "" {
+			p.connectSpan.SetStatus(codes.Error, "Closed before the first RTP packet")
+		} else {
+			p.connectSpan.AddEvent("First RTP packet", trace.WithAttributes(
+				attribute.String("direction", direction),
+			))
+		}
+		p.connectSpan.End()
+	})
+}
+
 func (p *WebRTCTransport) Close() error {
 	return p.signaller.Close()
 }
@@ -250,10 +361,12 @@ func (p *WebRTCTransport) ClientID() string {
 }
 
 func (p *WebRTCTransport) WriteRTCP(packets []rtcp.Packet) error {
-	p.rtcpLog.Printf("[%s] WriteRTCP: %s", p.clientID, packets)
+	if p.rtcpLog.IsEnabled(logger.LevelDebug) {
+		p.rtcpLog.Debug("WriteRTCP", Fields{"packets": fmt.Sprint(packets)})
+	}
 	err := p.peerConnection.WriteRTCP(packets)
 	if err == nil {
-		prometheusRTCPPacketsSent.Inc()
+		prometheusRTCPPacketsSent.WithLabelValues(metricsNetworkWebRTC).Inc()
 	}
 	return err
 }
@@ -262,20 +375,52 @@ func (p *WebRTCTransport) CloseChannel() <-chan struct{} {
 	return p.signaller.CloseChannel()
 }
 
+// WriteRTP writes a packet to the local track added for the packet's SSRC.
+// Packets from other sources previously written using WriteTrackRTP, for
+// example retransmissions, are written to the same local track.
 func (p *WebRTCTransport) WriteRTP(packet *rtp.Packet) (bytes int, err error) {
-	p.rtpLog.Printf("[%s] WriteRTP: %s", p.clientID, packet)
+	p.mu.Lock()
+	trackSSRC, ok := p.localTrackSSRCBySource[packet.SSRC]
+	p.mu.Unlock()
+
+	if !ok {
+		trackSSRC = packet.SSRC
+	}
+
+	return p.WriteTrackRTP(trackSSRC, packet)
+}
+
+// WriteTrackRTP writes a packet to the local track added for trackSSRC. The
+// packet can come from a different source than the track, for example from
+// a different simulcast layer, and the local track's munger will rewrite it
+// so that the subscriber sees a continuous track.
+func (p *WebRTCTransport) WriteTrackRTP(trackSSRC uint32, packet *rtp.Packet) (bytes int, err error) {
+	if p.rtpLog.IsEnabled(logger.LevelDebug) {
+		p.rtpLog.Debug("WriteRTP", Fields{"packet": packet.String()})
+	}
 
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	pta, ok := p.localTracks[packet.SSRC]
+	pta, ok := p.localTracks[trackSSRC]
 	if !ok {
-		return 0, fmt.Errorf("Track not found: %d", packet.SSRC)
+		return 0, fmt.Errorf("Track not found: %d", trackSSRC)
 	}
-	if err != nil {
-		return 0, err
+
+	if packet.SSRC != trackSSRC {
+		p.localTrackSSRCBySource[packet.SSRC] = trackSSRC
+	}
+
+	munged, ok := pta.munger.MungeRetransmission(packet)
+	if !ok {
+		munged, ok = pta.munger.Munge(packet)
+	}
+	if !ok {
+		// track is paused
+		return 0, nil
 	}
-	err = pta.track.WriteRTP(packet)
+
+	err = pta.track.WriteRTP(munged)
 	if err == io.ErrClosedPipe {
 		// ErrClosedPipe means we don't have any subscribers, this is ok if no peers have connected yet
 		return 0, nil
@@ -284,9 +429,66 @@ func (p *WebRTCTransport) WriteRTP(packet *rtp.Packet) (bytes int, err error) {
 		return 0, err
 	}
 
-	prometheusRTPPacketsSent.Inc()
-	prometheusRTPPacketsSentBytes.Add(float64(packet.MarshalSize()))
-	return packet.MarshalSize(), nil
+	p.endConnectSpan("sent")
+
+	prometheusRTPPacketsSent.WithLabelValues(metricsNetworkWebRTC).Inc()
+	prometheusRTPPacketsSentBytes.WithLabelValues(metricsNetworkWebRTC).Add(float64(munged.MarshalSize()))
+
+	if report, ok := pta.senderReport.record(time.Now(), munged); ok {
+		if err := p.WriteRTCP([]rtcp.Packet{report}); err != nil {
+			p.log.Error("Error writing sender report for track", Fields{
+				"ssrc":  trackSSRC,
+				"error": err,
+			})
+		}
+	}
+
+	return munged.MarshalSize(), nil
+}
+
+// PauseTrack stops forwarding packets to the local track until ResumeTrack
+// is called.
+func (p *WebRTCTransport) PauseTrack(ssrc uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pta, ok := p.localTracks[ssrc]
+	if !ok {
+		return fmt.Errorf("Track not found: %d", ssrc)
+	}
+
+	pta.munger.Pause()
+	return nil
+}
+
+// ResumeTrack resumes forwarding packets to a paused local track.
+func (p *WebRTCTransport) ResumeTrack(ssrc uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pta, ok := p.localTracks[ssrc]
+	if !ok {
+		return fmt.Errorf("Track not found: %d", ssrc)
+	}
+
+	pta.munger.Resume()
+	return nil
+}
+
+// DropRTP skips a packet which will not be written to the local track, so
+// that the following packets do not leave a gap in sequence numbers.
+func (p *WebRTCTransport) DropRTP(packet *rtp.Packet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	trackSSRC, ok := p.localTrackSSRCBySource[packet.SSRC]
+	if !ok {
+		trackSSRC = packet.SSRC
+	}
+
+	if pta, ok := p.localTracks[trackSSRC]; ok {
+		pta.munger.Drop(packet)
+	}
 }
 
 func (p *WebRTCTransport) RemoveTrack(ssrc uint32) error {
@@ -306,11 +508,19 @@ func (p *WebRTCTransport) RemoveTrack(ssrc uint32) error {
 	p.signaller.Negotiate()
 
 	delete(p.localTracks, ssrc)
+	for sourceSSRC, trackSSRC := range p.localTrackSSRCBySource {
+		if trackSSRC == ssrc {
+			delete(p.localTrackSSRCBySource, sourceSSRC)
+		}
+	}
 	return nil
 }
 
-func (p *WebRTCTransport) AddTrack(payloadType uint8, ssrc uint32, id string, label string) error {
-	track, err := p.peerConnection.NewTrack(payloadType, ssrc, id, label)
+// AddTrack adds a local track for forwarding packets from the remote track.
+// The local track uses a different SSRC owned by its RTPMunger.
+func (p *WebRTCTransport) AddTrack(clientID string, remoteTrack TrackInfo) error {
+	ssrc := remoteTrack.SSRC
+	track, err := p.peerConnection.NewTrack(remoteTrack.PayloadType, newSSRC(), remoteTrack.ID, remoteTrack.Label)
 	if err != nil {
 		return err
 	}
@@ -319,6 +529,8 @@ func (p *WebRTCTransport) AddTrack(payloadType uint8, ssrc uint32, id string, la
 		return err
 	}
 
+	munger := NewRTPMunger(track.SSRC(), track.Codec().ClockRate)
+
 	if p.signaller.Initiator() {
 		p.signaller.Negotiate()
 	} else {
@@ -335,9 +547,13 @@ func (p *WebRTCTransport) AddTrack(payloadType uint8, ssrc uint32, id string, la
 				return
 			}
 			for _, rtcpPacket := range rtcpPackets {
-				p.rtcpLog.Printf("[%s] ReadRTCP: %s", p.clientID, rtcpPacket)
-				prometheusRTCPPacketsReceived.Inc()
-				p.rtcpCh <- rtcpPacket
+				if p.rtcpLog.IsEnabled(logger.LevelDebug) {
+					p.rtcpLog.Debug("ReadRTCP", Fields{"packet": fmt.Sprint(rtcpPacket)})
+				}
+				prometheusRTCPPacketsReceived.WithLabelValues(metricsNetworkWebRTC).Inc()
+				for _, unmunged := range unmungeRTCP(rtcpPacket, ssrc, munger) {
+					p.rtcpCh <- unmunged
+				}
 			}
 		}
 	}()
@@ -351,7 +567,7 @@ func (p *WebRTCTransport) AddTrack(payloadType uint8, ssrc uint32, id string, la
 	}
 
 	trackInfo := TrackInfo{
-		SSRC:        track.SSRC(),
+		SSRC:        ssrc,
 		PayloadType: track.PayloadType(),
 		ID:          track.ID(),
 		Label:       track.Label(),
@@ -360,10 +576,80 @@ func (p *WebRTCTransport) AddTrack(payloadType uint8, ssrc uint32, id string, la
 
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.localTracks[ssrc] = localTrackInfo{trackInfo, transceiver, sender, track}
+	p.localTracks[ssrc] = localTrackInfo{trackInfo, transceiver, sender, track, munger, &senderReportState{}}
 	return nil
 }
 
+// unmungeRTCP translates the SSRCs and sequence numbers in RTCP feedback for
+// a local track back to those of the sources forwarded through it, so that
+// the feedback can be sent to the publisher.
+func unmungeRTCP(packet rtcp.Packet, trackSSRC uint32, munger *RTPMunger) []rtcp.Packet {
+	mapSSRC := func(ssrc uint32) uint32 {
+		if ssrc == munger.SSRC() {
+			return trackSSRC
+		}
+		return ssrc
+	}
+
+	switch packet := packet.(type) {
+	case *rtcp.TransportLayerNack:
+		if packet.MediaSSRC != munger.SSRC() {
+			return []rtcp.Packet{packet}
+		}
+
+		sourceNacks := map[uint32][]rtcp.NackPair{}
+		for _, nackPair := range packet.Nacks {
+			sourceSNs := map[uint32][]uint16{}
+			for _, sn := range nackPair.PacketList() {
+				sourceSSRC, sourceSN, ok := munger.Unmunge(sn)
+				if !ok {
+					continue
+				}
+				sourceSNs[sourceSSRC] = append(sourceSNs[sourceSSRC], sourceSN)
+			}
+			for sourceSSRC, sns := range sourceSNs {
+				sourceNacks[sourceSSRC] = append(sourceNacks[sourceSSRC], CreateNackPair(sns))
+			}
+		}
+
+		packets := make([]rtcp.Packet, 0, len(sourceNacks))
+		for sourceSSRC, nackPairs := range sourceNacks {
+			packets = append(packets, &rtcp.TransportLayerNack{
+				SenderSSRC: packet.SenderSSRC,
+				MediaSSRC:  sourceSSRC,
+				Nacks:      nackPairs,
+			})
+		}
+		return packets
+	case *rtcp.PictureLossIndication:
+		packet.MediaSSRC = mapSSRC(packet.MediaSSRC)
+	case *rtcp.ReceiverEstimatedMaximumBitrate:
+		// the same compound RTCP packet is read by the senders of all SSRCs it
+		// refers to, so only keep the SSRC of this local track.
+		for _, ssrc := range packet.SSRCs {
+			if ssrc == munger.SSRC() {
+				packet.SSRCs = []uint32{trackSSRC}
+				return []rtcp.Packet{packet}
+			}
+		}
+		return nil
+	case *rtcp.ReceiverReport:
+		reports := make([]rtcp.ReceptionReport, 0, 1)
+		for _, report := range packet.Reports {
+			if report.SSRC == munger.SSRC() {
+				report.SSRC = trackSSRC
+				reports = append(reports, report)
+			}
+		}
+		if len(reports) == 0 {
+			return nil
+		}
+		packet.Reports = reports
+	}
+
+	return []rtcp.Packet{packet}
+}
+
 func (p *WebRTCTransport) addRemoteTrack(rti remoteTrackInfo) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -415,7 +701,18 @@ func (p *WebRTCTransport) handleTrack(track *webrtc.Track, receiver *webrtc.RTPR
 		Kind:        track.Kind(),
 	}
 
-	p.log.Printf("[%s] Remote track: %d", p.clientID, trackInfo.SSRC)
+	p.log.Info("Remote track", Fields{"ssrc": trackInfo.SSRC})
+
+	if p.receiveOnly {
+		p.log.Info("Ignoring remote track of receive only peer", Fields{"ssrc": trackInfo.SSRC})
+		if err := receiver.Stop(); err != nil {
+			p.log.Error("Error stopping receiver of track", Fields{
+				"ssrc":  trackInfo.SSRC,
+				"error": err,
+			})
+		}
+		return
+	}
 
 	start := time.Now()
 	prometheusWebRTCTracksTotal.Inc()
@@ -455,19 +752,25 @@ func (p *WebRTCTransport) handleTrack(track *webrtc.Track, receiver *webrtc.RTPR
 		for {
 			pkt, err := track.ReadRTP()
 			if err != nil {
-				p.log.Printf("[%s] Remote track has ended: %d: %s", p.clientID, trackInfo.SSRC, err)
+				p.log.Info("Remote track has ended", Fields{
+					"ssrc":  trackInfo.SSRC,
+					"error": err,
+				})
 				return
 			}
-			prometheusRTPPacketsReceived.Inc()
-			prometheusRTPPacketsReceivedBytes.Add(float64(pkt.MarshalSize()))
-			p.rtpLog.Printf("[%s] ReadRTP: %s", p.clientID, pkt)
+			p.endConnectSpan("received")
+			prometheusRTPPacketsReceived.WithLabelValues(metricsNetworkWebRTC).Inc()
+			prometheusRTPPacketsReceivedBytes.WithLabelValues(metricsNetworkWebRTC).Add(float64(pkt.MarshalSize()))
+			if p.rtpLog.IsEnabled(logger.LevelDebug) {
+				p.rtpLog.Debug("ReadRTP", Fields{"packet": pkt.String()})
+			}
 			p.rtpCh <- pkt
 		}
 	}()
 }
 
-func (p *WebRTCTransport) Signal(payload map[string]interface{}) error {
-	return p.signaller.Signal(payload)
+func (p *WebRTCTransport) Signal(payload Payload) error {
+	return p.signaller.HandleSignal(payload)
 }
 
 func (p *WebRTCTransport) SignalChannel() <-chan Payload {
@@ -489,3 +792,11 @@ func (p *WebRTCTransport) RTCPChannel() <-chan rtcp.Packet {
 func (p *WebRTCTransport) MessagesChannel() <-chan webrtc.DataChannelMessage {
 	return p.dataTransceiver.MessagesChannel()
 }
+
+// SendMessage sends a message to the client's data channel.
+func (p *WebRTCTransport) SendMessage(msg webrtc.DataChannelMessage) error {
+	if msg.IsString {
+		return p.dataTransceiver.SendText(string(msg.Data))
+	}
+	return p.dataTransceiver.Send(msg.Data)
+}
@@ -1,9 +1,12 @@
 package server
 
 import (
+	"context"
 	"sync"
 
 	"github.com/pion/webrtc/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type TransceiverRequest struct {
@@ -13,6 +16,10 @@ type TransceiverRequest struct {
 
 type Negotiator struct {
 	log Logger
+	// ctx carries the trace the negotiation spans are added to.
+	ctx context.Context
+	// span is the span of the negotiation in progress.
+	span trace.Span
 
 	initiator            bool
 	remotePeerID         string
@@ -28,6 +35,7 @@ type Negotiator struct {
 }
 
 func NewNegotiator(
+	ctx context.Context,
 	loggerFactory LoggerFactory,
 	initiator bool,
 	peerConnection *webrtc.PeerConnection,
@@ -36,7 +44,10 @@ func NewNegotiator(
 	onRequestNegotiation func(),
 ) *Negotiator {
 	n := &Negotiator{
-		log:                  loggerFactory.GetLogger("negotiator"),
+		log: loggerFactory.GetLogger("negotiator").WithFields(Fields{
+			"clientId": remotePeerID,
+		}),
+		ctx:                  ctx,
 		initiator:            initiator,
 		peerConnection:       peerConnection,
 		remotePeerID:         remotePeerID,
@@ -50,10 +61,13 @@ func NewNegotiator(
 
 func (n *Negotiator) AddTransceiverFromKind(t TransceiverRequest) {
 	n.mu.Lock()
-	n.log.Printf("[%s] Queued %s transceiver, direction: %s", n.remotePeerID, t.CodecType, t.Init.Direction)
+	n.log.Debug("Queued transceiver", Fields{
+		"kind":      t.CodecType.String(),
+		"direction": t.Init.Direction.String(),
+	})
 	n.queuedTransceiverRequests = append(n.queuedTransceiverRequests, t)
 	n.mu.Unlock()
-	n.log.Printf("[%s] Calling Negotiate because a %s transceiver was queued", n.remotePeerID, t.CodecType)
+	n.log.Debug("Calling Negotiate because a transceiver was queued", Fields{"kind": t.CodecType.String()})
 	n.Negotiate()
 }
 
@@ -78,17 +92,19 @@ func (n *Negotiator) Done() <-chan struct{} {
 func (n *Negotiator) handleSignalingStateChange(state webrtc.SignalingState) {
 	// TODO check if we need to have a check for first stable state
 	// like simple-peer has.
-	n.log.Printf("[%s] Signaling state change: %s", n.remotePeerID, state)
+	n.log.Debug("Signaling state change", Fields{"state": state.String()})
 
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
 	switch state {
 	case webrtc.SignalingStateClosed:
+		n.endNegotiationSpan()
 		n.closeDoneChannel()
 	case webrtc.SignalingStateStable:
+		n.endNegotiationSpan()
 		if n.queuedNegotiation {
-			n.log.Printf("[%s] Executing queued negotiation", n.remotePeerID)
+			n.log.Debug("Executing queued negotiation", nil)
 			n.queuedNegotiation = false
 			n.negotiate()
 		} else {
@@ -98,17 +114,17 @@ func (n *Negotiator) handleSignalingStateChange(state webrtc.SignalingState) {
 }
 
 func (n *Negotiator) Negotiate() (done <-chan struct{}) {
-	n.log.Printf("[%s] Negotiate", n.remotePeerID)
+	n.log.Debug("Negotiate", nil)
 
 	n.mu.Lock()
 	defer n.mu.Unlock()
 	if n.negotiationDone != nil {
-		n.log.Printf("[%s] Negotiate: already negotiating, queueing for later", n.remotePeerID)
+		n.log.Debug("Negotiate: already negotiating, queueing for later", nil)
 		n.queuedNegotiation = true
 		return
 	}
 
-	n.log.Printf("[%s] Negotiate: start", n.remotePeerID)
+	n.log.Debug("Negotiate: start", nil)
 	n.negotiationDone = make(chan struct{})
 
 	n.negotiate()
@@ -117,26 +133,50 @@ func (n *Negotiator) Negotiate() (done <-chan struct{}) {
 
 func (n *Negotiator) addQueuedTransceivers() {
 	for _, t := range n.queuedTransceiverRequests {
-		n.log.Printf("[%s] Adding queued %s transceiver, direction: %s", n.remotePeerID, t.CodecType, t.Init.Direction)
+		n.log.Debug("Adding queued transceiver", Fields{
+			"kind":      t.CodecType.String(),
+			"direction": t.Init.Direction.String(),
+		})
 		_, err := n.peerConnection.AddTransceiverFromKind(t.CodecType, t.Init)
 		if err != nil {
-			n.log.Printf("[%s] Error adding %s transceiver: %s", n.remotePeerID, err)
+			n.log.Error("Error adding transceiver", Fields{
+				"kind":  t.CodecType.String(),
+				"error": err,
+			})
 		}
 	}
 	n.queuedTransceiverRequests = []TransceiverRequest{}
 }
 
+// endNegotiationSpan ends the span of the negotiation in progress, if any.
+func (n *Negotiator) endNegotiationSpan() {
+	if n.span != nil {
+		n.span.End()
+		n.span = nil
+	}
+}
+
 func (n *Negotiator) negotiate() {
 	n.addQueuedTransceivers()
 
+	// the span ends when the signaling state becomes stable again, after the
+	// answer to the offer has been received.
+	n.endNegotiationSpan()
+	ctx, span := startSpan(n.ctx, "Negotiator.negotiate", trace.WithAttributes(
+		attribute.Bool("initiator", n.initiator),
+	))
+	n.span = span
+
 	if !n.initiator {
-		n.log.Printf("[%s] negotiate: requesting from initiator", n.remotePeerID)
+		n.log.Debug("negotiate: requesting from initiator", nil)
 		n.requestNegotiation()
 		return
 	}
 
-	n.log.Printf("[%s] negotiate: creating offer", n.remotePeerID)
+	n.log.Debug("negotiate: creating offer", nil)
+	_, offerSpan := startSpan(ctx, "Negotiator.createOffer")
 	offer, err := n.peerConnection.CreateOffer(nil)
+	endSpan(offerSpan, err)
 	n.onOffer(offer, err)
 }
 
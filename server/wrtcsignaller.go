@@ -1,22 +1,39 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// DefaultDisconnectGracePeriod is the time peers have to reconnect after ICE
+// disconnects when no grace period is configured.
+const DefaultDisconnectGracePeriod = 15 * time.Second
+
 type Signaller struct {
 	log    Logger
 	sdpLog Logger
+	// ctx carries the trace of the connection. ICE candidates and state
+	// changes are added to its span as events.
+	ctx context.Context
 
 	peerConnection *webrtc.PeerConnection
 	initiator      bool
+	receiveOnly    bool
 	localPeerID    string
 	remotePeerID   string
 	negotiator     *Negotiator
 
+	disconnectGracePeriod time.Duration
+	disconnectMu          sync.Mutex
+	disconnectTimer       *time.Timer
+
 	signalMu      sync.Mutex
 	closed        bool
 	signalChannel chan Payload
@@ -29,25 +46,34 @@ type Signaller struct {
 }
 
 func NewSignaller(
+	ctx context.Context,
 	loggerFactory LoggerFactory,
 	initiator bool,
+	receiveOnly bool,
 	peerConnection *webrtc.PeerConnection,
 	localPeerID string,
 	remotePeerID string,
+	disconnectGracePeriod time.Duration,
 ) (*Signaller, error) {
+	fields := Fields{"clientId": remotePeerID}
+
 	s := &Signaller{
-		log:             loggerFactory.GetLogger("signaller"),
-		sdpLog:          loggerFactory.GetLogger("sdp"),
-		initiator:       initiator,
-		peerConnection:  peerConnection,
-		localPeerID:     localPeerID,
-		remotePeerID:    remotePeerID,
-		signalChannel:   make(chan Payload),
-		closeChannel:    make(chan struct{}),
-		descriptionSent: make(chan struct{}),
+		log:                   loggerFactory.GetLogger("signaller").WithFields(fields),
+		sdpLog:                loggerFactory.GetLogger("sdp").WithFields(fields),
+		ctx:                   ctx,
+		initiator:             initiator,
+		receiveOnly:           receiveOnly,
+		peerConnection:        peerConnection,
+		localPeerID:           localPeerID,
+		remotePeerID:          remotePeerID,
+		disconnectGracePeriod: disconnectGracePeriod,
+		signalChannel:         make(chan Payload),
+		closeChannel:          make(chan struct{}),
+		descriptionSent:       make(chan struct{}),
 	}
 
 	negotiator := NewNegotiator(
+		ctx,
 		loggerFactory,
 		initiator,
 		peerConnection,
@@ -75,8 +101,11 @@ func (s *Signaller) SignalChannel() <-chan Payload {
 }
 
 func (s *Signaller) initialize() error {
-	if s.initiator {
-		s.log.Printf("[%s] NewSignaller: Initiator pre-add video transceiver", s.remotePeerID)
+	if s.initiator && s.receiveOnly {
+		s.log.Debug("NewSignaller: Initiator calling Negotiate() for receive only peer", nil)
+		s.negotiator.Negotiate()
+	} else if s.initiator {
+		s.log.Debug("NewSignaller: Initiator pre-add video transceiver", nil)
 		_, err := s.peerConnection.AddTransceiverFromKind(
 			webrtc.RTPCodecTypeVideo,
 			webrtc.RtpTransceiverInit{
@@ -84,11 +113,10 @@ func (s *Signaller) initialize() error {
 			},
 		)
 		if err != nil {
-			s.log.Printf("ERROR: %s", err)
 			return fmt.Errorf("[%s] NewSignaller: Error pre-adding video transceiver: %s", s.remotePeerID, err)
 		}
 
-		s.log.Printf("[%s] NewSignaller: Initiator pre-add audio transceiver", s.remotePeerID)
+		s.log.Debug("NewSignaller: Initiator pre-add audio transceiver", nil)
 		_, err = s.peerConnection.AddTransceiverFromKind(
 			webrtc.RTPCodecTypeAudio,
 			webrtc.RtpTransceiverInit{
@@ -99,7 +127,7 @@ func (s *Signaller) initialize() error {
 			return fmt.Errorf("[%s] NewSignaller: Error pre-adding audio transceiver: %s", s.remotePeerID, err)
 		}
 
-		s.log.Printf("[%s] NewSignaller: Initiator calling Negotiate()", s.remotePeerID)
+		s.log.Debug("NewSignaller: Initiator calling Negotiate()", nil)
 		s.negotiator.Negotiate()
 	}
 
@@ -111,13 +139,54 @@ func (s *Signaller) Initiator() bool {
 }
 
 func (s *Signaller) handleICEConnectionStateChange(connectionState webrtc.ICEConnectionState) {
-	s.log.Printf("[%s] Peer connection state changed: %s", s.remotePeerID, connectionState.String())
-	if connectionState == webrtc.ICEConnectionStateClosed ||
-		connectionState == webrtc.ICEConnectionStateDisconnected ||
-		connectionState == webrtc.ICEConnectionStateFailed {
+	s.log.Info("Peer connection state changed", Fields{"state": connectionState.String()})
+	trace.SpanFromContext(s.ctx).AddEvent("ICE connection state changed", trace.WithAttributes(
+		attribute.String("state", connectionState.String()),
+	))
+	switch connectionState {
+	case webrtc.ICEConnectionStateClosed:
+		s.Close()
+	case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed:
+		s.handleICEDisconnect()
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+		s.stopDisconnectTimer()
+	}
+}
+
+// handleICEDisconnect closes the peer connection if it does not reconnect
+// within the disconnect grace period, so that brief network changes do not end
+// the session. ICE is not restarted because pion v2 returns an error for every
+// offer with OfferOptions, so a connection which has failed cannot recover
+// and is closed when the grace period expires.
+func (s *Signaller) handleICEDisconnect() {
+	if s.disconnectGracePeriod <= 0 {
 		s.Close()
+		return
+	}
+
+	s.disconnectMu.Lock()
+	defer s.disconnectMu.Unlock()
+
+	if s.disconnectTimer != nil {
+		return
 	}
 
+	s.log.Info("Waiting for peer to reconnect", Fields{"gracePeriod": s.disconnectGracePeriod.String()})
+	s.disconnectTimer = time.AfterFunc(s.disconnectGracePeriod, func() {
+		s.log.Warn("Peer did not reconnect, closing peer connection", nil)
+		s.Close()
+	})
+}
+
+func (s *Signaller) stopDisconnectTimer() {
+	s.disconnectMu.Lock()
+	defer s.disconnectMu.Unlock()
+
+	if s.disconnectTimer != nil {
+		s.log.Info("Peer reconnected", nil)
+		s.disconnectTimer.Stop()
+		s.disconnectTimer = nil
+	}
 }
 
 func (s *Signaller) onSignal(payload Payload) {
@@ -144,6 +213,7 @@ func (s *Signaller) onSignal(payload Payload) {
 
 func (s *Signaller) Close() (err error) {
 	s.closeOnce.Do(func() {
+		s.stopDisconnectTimer()
 		close(s.closeChannel)
 
 		s.signalMu.Lock()
@@ -161,9 +231,9 @@ func (s *Signaller) Close() (err error) {
 func (s *Signaller) handleICECandidate(c *webrtc.ICECandidate) {
 	// wait until local description is set to prevent sending ice candidates
 	// before local offer is sent
-	s.log.Printf("[%s] Got ice candidate (waiting)", s.remotePeerID)
+	s.log.Debug("Got ice candidate (waiting)", nil)
 	<-s.descriptionSent
-	s.log.Printf("[%s] Got ice candidate (processing...)", s.remotePeerID)
+	s.log.Debug("Got ice candidate (processing...)", nil)
 
 	if c == nil {
 		return
@@ -176,35 +246,51 @@ func (s *Signaller) handleICECandidate(c *webrtc.ICECandidate) {
 		},
 	}
 
-	s.log.Printf("[%s] Got ice candidate from server peer: %s", s.remotePeerID, payload)
+	trace.SpanFromContext(s.ctx).AddEvent("Local ICE candidate", trace.WithAttributes(
+		attribute.String("candidate", c.String()),
+	))
+
+	s.log.Debug("Got ice candidate from server peer", Fields{"candidate": c.String()})
 	s.onSignal(payload)
 }
 
-func (s *Signaller) Signal(payload map[string]interface{}) error {
-	signalPayload, err := NewPayloadFromMap(payload)
-
-	if err != nil {
+func (s *Signaller) Signal(payload SignalPayload) error {
+	if err := payload.Validate(); err != nil {
 		return fmt.Errorf("Error constructing signal from payload: %s", err)
 	}
 
+	return s.HandleSignal(NewPayloadFromSignal(payload))
+}
+
+// HandleSignal handles a remote signal converted by NewPayloadFromSignal.
+func (s *Signaller) HandleSignal(signalPayload Payload) error {
 	switch signal := signalPayload.Signal.(type) {
 	case Candidate:
-		s.log.Printf("[%s] Remote signal.canidate: %v", s.remotePeerID, signal.Candidate.Candidate)
+		s.log.Debug("Remote signal.candidate", Fields{"candidate": signal.Candidate.Candidate})
 		if signal.Candidate.Candidate != "" {
+			trace.SpanFromContext(s.ctx).AddEvent("Remote ICE candidate", trace.WithAttributes(
+				attribute.String("candidate", signal.Candidate.Candidate),
+			))
 			return s.peerConnection.AddICECandidate(signal.Candidate)
 		}
 		return nil
 	case Renegotiate:
-		s.log.Printf("[%s] Remote signal.renegotiate", s.remotePeerID)
-		s.log.Printf("[%s] Calling signaller.Negotiate() because remote peer wanted to negotiate", s.remotePeerID)
+		s.log.Debug("Remote signal.renegotiate", nil)
+		s.log.Debug("Calling signaller.Negotiate() because remote peer wanted to negotiate", nil)
 		s.Negotiate()
 		return nil
 	case TransceiverRequestPayload:
-		s.log.Printf("[%s] Remote signal.transceiverRequest: %s", s.remotePeerID, signal.TransceiverRequest.Kind)
+		s.log.Debug("Remote signal.transceiverRequest", Fields{"kind": signal.TransceiverRequest.Kind.String()})
+		if s.receiveOnly {
+			return fmt.Errorf("[%s] Transceiver request rejected because peer is receive only", s.remotePeerID)
+		}
 		s.handleTransceiverRequest(signal)
 		return nil
 	case webrtc.SessionDescription:
-		s.sdpLog.Printf("[%s] Remote signal.type: %s, signal.sdp: %s", s.remotePeerID, signal.Type, signal.SDP)
+		s.sdpLog.Debug("Remote signal", Fields{
+			"type": signal.Type.String(),
+			"sdp":  signal.SDP,
+		})
 		return s.handleRemoteSDP(signal)
 	default:
 		return fmt.Errorf("[%s] Unexpected signal: %#v ", s.remotePeerID, signal)
@@ -212,7 +298,7 @@ func (s *Signaller) Signal(payload map[string]interface{}) error {
 }
 
 func (s *Signaller) handleTransceiverRequest(transceiverRequest TransceiverRequestPayload) {
-	s.log.Printf("[%s] handleTransceiverRequest: %v", s.remotePeerID, transceiverRequest)
+	s.log.Debug("handleTransceiverRequest", Fields{"kind": transceiverRequest.TransceiverRequest.Kind.String()})
 
 	codecType := transceiverRequest.TransceiverRequest.Kind
 
@@ -225,6 +311,14 @@ func (s *Signaller) handleTransceiverRequest(transceiverRequest TransceiverReque
 }
 
 func (s *Signaller) handleRemoteSDP(sessionDescription webrtc.SessionDescription) (err error) {
+	if current := s.peerConnection.CurrentRemoteDescription(); current != nil && isICERestart(*current, sessionDescription) {
+		// pion v2 keeps using the previous credentials of the remote peer, so
+		// its connectivity checks fail until the grace period expires.
+		s.log.Error("Remote peer restarted ICE, which is not supported", Fields{
+			"type": sessionDescription.Type.String(),
+		})
+	}
+
 	switch sessionDescription.Type {
 	case webrtc.SDPTypeOffer:
 		return s.handleRemoteOffer(sessionDescription)
@@ -235,7 +329,33 @@ func (s *Signaller) handleRemoteSDP(sessionDescription webrtc.SessionDescription
 	}
 }
 
+// isICERestart returns true when the ICE username fragment of next differs
+// from the one of current, which is how peers restart ICE.
+func isICERestart(current webrtc.SessionDescription, next webrtc.SessionDescription) bool {
+	currentUfrag := iceUfrag(current.SDP)
+	nextUfrag := iceUfrag(next.SDP)
+	return currentUfrag != "" && nextUfrag != "" && currentUfrag != nextUfrag
+}
+
+// iceUfrag returns the first ICE username fragment in sdp.
+func iceUfrag(sdp string) string {
+	const prefix = "a=ice-ufrag:"
+
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix)
+		}
+	}
+	return ""
+}
+
 func (s *Signaller) handleRemoteOffer(sessionDescription webrtc.SessionDescription) (err error) {
+	_, span := startSpan(s.ctx, "Signaller.handleRemoteOffer")
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	if err = s.peerConnection.SetRemoteDescription(sessionDescription); err != nil {
 		return fmt.Errorf("[%s] Error setting remote description: %w", s.remotePeerID, err)
 	}
@@ -247,7 +367,10 @@ func (s *Signaller) handleRemoteOffer(sessionDescription webrtc.SessionDescripti
 		return fmt.Errorf("[%s] Error setting local description: %w", s.remotePeerID, err)
 	}
 
-	s.sdpLog.Printf("[%s] Local signal.type: %s, signal.sdp: %s", s.remotePeerID, answer.Type, answer.SDP)
+	s.sdpLog.Debug("Local signal", Fields{
+		"type": answer.Type.String(),
+		"sdp":  answer.SDP,
+	})
 	s.onSignal(NewPayloadSDP(s.localPeerID, answer))
 
 	// allow ice candidates to be sent
@@ -256,22 +379,25 @@ func (s *Signaller) handleRemoteOffer(sessionDescription webrtc.SessionDescripti
 }
 
 func (s *Signaller) handleLocalRequestNegotiation() {
-	s.log.Printf("[%s] Sending renegotiation request to initiator", s.remotePeerID)
+	s.log.Debug("Sending renegotiation request to initiator", nil)
 	s.onSignal(NewPayloadRenegotiate(s.localPeerID))
 }
 
 func (s *Signaller) handleLocalOffer(offer webrtc.SessionDescription, err error) {
-	s.sdpLog.Printf("[%s] Local signal.type: %s, signal.sdp: %s", s.remotePeerID, offer.Type, offer.SDP)
+	s.sdpLog.Debug("Local signal", Fields{
+		"type": offer.Type.String(),
+		"sdp":  offer.SDP,
+	})
 	if err != nil {
-		s.log.Printf("[%s] Error creating local offer: %s", s.remotePeerID, err)
+		s.log.Error("Error creating local offer", Fields{"error": err})
 		// TODO abort connection
 		return
 	}
 
-	s.log.Printf("[%s] handle local offer setting local desc", s.remotePeerID)
+	s.log.Debug("handle local offer setting local desc", nil)
 	err = s.peerConnection.SetLocalDescription(offer)
 	if err != nil {
-		s.log.Printf("[%s] Error setting local description from local offer: %s", s.remotePeerID, err)
+		s.log.Error("Error setting local description from local offer", Fields{"error": err})
 		// TODO abort connection
 		return
 	}
@@ -293,7 +419,7 @@ func (s *Signaller) closeDescriptionSent() {
 // Sends a request for a new transceiver, only if the peer is not the initiator.
 func (s *Signaller) SendTransceiverRequest(kind webrtc.RTPCodecType, direction webrtc.RTPTransceiverDirection) {
 	if !s.initiator {
-		s.log.Printf("[%s] Sending transceiver request to initiator", s.remotePeerID)
+		s.log.Debug("Sending transceiver request to initiator", nil)
 		s.onSignal(NewTransceiverRequest(s.localPeerID, kind, direction))
 	}
 }
@@ -306,6 +432,11 @@ func (s *Signaller) Negotiate() <-chan struct{} {
 }
 
 func (s *Signaller) handleRemoteAnswer(sessionDescription webrtc.SessionDescription) (err error) {
+	_, span := startSpan(s.ctx, "Signaller.handleRemoteAnswer")
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	if err = s.peerConnection.SetRemoteDescription(sessionDescription); err != nil {
 		return fmt.Errorf("[%s] Error setting remote description: %w", s.remotePeerID, err)
 	}
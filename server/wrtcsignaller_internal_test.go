@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/peer-calls/peer-calls/server/logger"
+	"github.com/pion/webrtc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func newGracePeriodSignaller(t *testing.T, gracePeriod time.Duration) *Signaller {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	loggerFactory := logger.NewFactoryFromEnv("PEERCALLS_", os.Stdout)
+	signaller, err := NewSignaller(context.Background(), loggerFactory, false, false, pc, "client1", localPeerID, gracePeriod)
+	require.NoError(t, err)
+	return signaller
+}
+
+func isClosed(signaller *Signaller) bool {
+	select {
+	case <-signaller.CloseChannel():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSignaller_disconnectGracePeriod_timeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	signaller := newGracePeriodSignaller(t, 100*time.Millisecond)
+	defer signaller.Close()
+
+	signaller.handleICEConnectionStateChange(webrtc.ICEConnectionStateDisconnected)
+	assert.False(t, isClosed(signaller), "closed before grace period expired")
+
+	select {
+	case <-signaller.CloseChannel():
+	case <-time.After(time.Second):
+		assert.Fail(t, "not closed after grace period expired")
+	}
+}
+
+func TestSignaller_disconnectGracePeriod_reconnect(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	signaller := newGracePeriodSignaller(t, 100*time.Millisecond)
+	defer signaller.Close()
+
+	signaller.handleICEConnectionStateChange(webrtc.ICEConnectionStateFailed)
+	signaller.handleICEConnectionStateChange(webrtc.ICEConnectionStateConnected)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, isClosed(signaller), "closed after peer reconnected")
+}
+
+func TestSignaller_disconnectGracePeriod_disabled(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	signaller := newGracePeriodSignaller(t, 0)
+	defer signaller.Close()
+
+	signaller.handleICEConnectionStateChange(webrtc.ICEConnectionStateDisconnected)
+	assert.True(t, isClosed(signaller), "closed immediately without grace period")
+}
+
+func TestIsICERestart(t *testing.T) {
+	sdp := func(ufrag string) webrtc.SessionDescription {
+		return webrtc.SessionDescription{
+			Type: webrtc.SDPTypeAnswer,
+			SDP:  "v=0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=ice-ufrag:" + ufrag + "\r\na=ice-pwd:pwd\r\n",
+		}
+	}
+
+	assert.False(t, isICERestart(sdp("abc"), sdp("abc")))
+	assert.True(t, isICERestart(sdp("abc"), sdp("def")))
+	assert.False(t, isICERestart(sdp("abc"), webrtc.SessionDescription{SDP: "v=0\r\n"}))
+}
+
+// The signaller can restart ICE once pion supports it. pion v2 returns an
+// error for all offer options and ignores the ICE credentials of remote
+// descriptions after the first one.
+func TestPeerConnection_iceRestartUnsupported(t *testing.T) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer pc.Close()
+
+	_, err = pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	assert.Error(t, err, "pion supports ICE restarts now")
+}
@@ -0,0 +1,88 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/peer-calls/peer-calls/server"
+	"github.com/pion/webrtc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func newTestSignaller(t *testing.T, receiveOnly bool) (*webrtc.PeerConnection, *server.Signaller) {
+	t.Helper()
+	var mediaEngine webrtc.MediaEngine
+	server.RegisterCodecs(&mediaEngine, false)
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	signaller, err := server.NewSignaller(context.Background(), loggerFactory, true, receiveOnly, pc, "__SERVER__", clientID, 0)
+	require.NoError(t, err)
+	return pc, signaller
+}
+
+func transceiverRequest(kind string) server.SignalPayload {
+	return server.SignalPayload{
+		UserID: clientID,
+		Signal: server.SignalJSON{
+			TransceiverRequest: &server.TransceiverRequestSignal{
+				Kind: kind,
+			},
+		},
+	}
+}
+
+func TestSignaller_receiveOnly(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	pc, signaller := newTestSignaller(t, true)
+	defer signaller.Close()
+
+	assert.Equal(t, 0, len(pc.GetTransceivers()), "no transceivers pre-added for receive only peer")
+	assert.Error(t, signaller.Signal(transceiverRequest("video")))
+}
+
+func TestSignaller_transceiverRequest(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	pc, signaller := newTestSignaller(t, false)
+	defer signaller.Close()
+
+	assert.Equal(t, 2, len(pc.GetTransceivers()))
+	assert.NoError(t, signaller.Signal(transceiverRequest("video")))
+}
+
+func TestNewPayloadFromSignal_renegotiate(t *testing.T) {
+	msg := server.NewMessage("signal", "test-room", map[string]interface{}{
+		"userId": clientID,
+		"signal": map[string]interface{}{
+			"renegotiate": true,
+		},
+	})
+	var signal server.SignalPayload
+	require.NoError(t, server.ByteSerializer{}.DeserializePayload(msg, &signal))
+	payload := server.NewPayloadFromSignal(signal)
+	assert.Equal(t, server.Renegotiate{Renegotiate: true}, payload.Signal)
+}
+
+func TestSignalPayload_Validate(t *testing.T) {
+	var s server.ByteSerializer
+	for _, data := range []string{
+		`{"type":"signal","payload":{"signal":{"renegotiate":true}}}`,
+		`{"type":"signal","payload":{"userId":"a","signal":{}}}`,
+		`{"type":"signal","payload":{"userId":"a","signal":{"candidate":{"candidate":"c"}}}}`,
+		`{"type":"signal","payload":{"userId":"a","signal":{"candidate":"c"}}}`,
+		`{"type":"signal","payload":{"userId":"a","signal":{"transceiverRequest":{"kind":"screen"}}}}`,
+		`{"type":"signal","payload":{"userId":"a","signal":{"type":"rollback","sdp":""}}}`,
+	} {
+		msg, err := s.Deserialize([]byte(data))
+		require.NoError(t, err)
+		var payload server.SignalPayload
+		err = s.DeserializePayload(msg, &payload)
+		var protocolErr *server.ProtocolError
+		assert.True(t, errors.As(err, &protocolErr), "expected protocol error for: %s", data)
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/pion/webrtc/v2"
@@ -30,11 +31,22 @@ type Candidate struct {
 	Candidate webrtc.ICECandidateInit `json:"candidate"`
 }
 
+// Payload is the payload of the signal message.
 type Payload struct {
 	UserID string      `json:"userId"`
 	Signal interface{} `json:"signal"`
 }
 
+func (p Payload) Validate() error {
+	if p.UserID == "" {
+		return errors.New("UserID is required")
+	}
+	if p.Signal == nil {
+		return errors.New("Signal is required")
+	}
+	return nil
+}
+
 func NewPayloadSDP(userID string, sessionDescription webrtc.SessionDescription) Payload {
 	return Payload{
 		UserID: userID,
@@ -63,173 +75,104 @@ func NewTransceiverRequest(userID string, kind webrtc.RTPCodecType, direction we
 	}
 }
 
-func newCandidate(candidate interface{}) (c Candidate, err error) {
-	candidateMap, ok := candidate.(map[string]interface{})
-	if !ok {
-		err = fmt.Errorf("Expected candidate to be a map: %#v", candidate)
-		return
-	}
-
-	candidateValue, ok := candidateMap["candidate"]
-	if !ok {
-		err = fmt.Errorf("Expected candidate.candidate %#v", candidate)
-	}
-
-	candidateString, ok := candidateValue.(string)
-	if !ok {
-		err = fmt.Errorf("Expected candidate.candidate to be a string: %#v", candidate)
-		return
-	}
-	sdpMLineIndexValue, ok := candidateMap["sdpMLineIndex"]
-	if !ok {
-		err = fmt.Errorf("Expected candidate.sdpMLineIndex to exist: %#v", sdpMLineIndexValue)
-		return
-	}
-	sdpMLineIndex, ok := sdpMLineIndexValue.(float64)
-	if !ok {
-		err = fmt.Errorf("Expected candidate.sdpMLineIndex be float64: %T", sdpMLineIndexValue)
-		return
-	}
-
-	sdpMid, ok := candidateMap["sdpMid"].(string)
-	var sdpMidPtr *string
-	if ok {
-		sdpMidPtr = &sdpMid
+func newRenegotiate() Renegotiate {
+	return Renegotiate{
+		Renegotiate: true,
 	}
-
-	sdpMLineIndexUint16 := uint16(sdpMLineIndex)
-	c.Candidate.Candidate = candidateString
-	c.Candidate.SDPMLineIndex = &sdpMLineIndexUint16
-	c.Candidate.SDPMid = sdpMidPtr
-
-	return
 }
 
-func newTransceiverRequest(transceiverRequest interface{}) (r TransceiverRequestPayload, err error) {
-	transceiverRequestMap, ok := transceiverRequest.(map[string]interface{})
-	if !ok {
-		err = fmt.Errorf("Transceiver request is not a map: %#v", transceiverRequest)
-		return
-	}
-
-	kind, ok := transceiverRequestMap["kind"]
-	if !ok {
-		err = fmt.Errorf("Transceiver request kind not found: %#v", transceiverRequest)
-		return
-	}
-	kindString, ok := kind.(string)
-	if !ok {
-		err = fmt.Errorf("Transceiver request kind should be a string: %#v", transceiverRequest)
-		return
-	}
-
-	r.TransceiverRequest.Kind = webrtc.RTPCodecTypeVideo
-	if kindString == "audio" {
-		r.TransceiverRequest.Kind = webrtc.RTPCodecTypeAudio
-	}
-
-	if init, ok := transceiverRequestMap["init"]; ok {
-		initMap, ok := init.(map[string]interface{})
-		if !ok {
-			err = fmt.Errorf("Expectd init to be a map: %#v", transceiverRequest)
-		}
-
-		var transceiverInit webrtc.RtpTransceiverInit
-		for key, value := range initMap {
-			switch key {
-			case "direction":
-				switch value {
-				case "sendrecv":
-					transceiverInit.Direction = webrtc.RTPTransceiverDirectionSendrecv
-				case "sendonly":
-					transceiverInit.Direction = webrtc.RTPTransceiverDirectionSendonly
-				case "recvonly":
-					transceiverInit.Direction = webrtc.RTPTransceiverDirectionRecvonly
-				case "inactive":
-					transceiverInit.Direction = webrtc.RTPTransceiverDirectionInactive
-				}
-			}
-		}
-
-		r.TransceiverRequest.Init = &transceiverInit
-	}
+// SignalPayload is the payload of a signal message received from a client.
+type SignalPayload struct {
+	UserID string     `json:"userId"`
+	Signal SignalJSON `json:"signal"`
+}
 
-	return
+// SignalJSON is a signal received from a client. Only the fields of one kind
+// of signal are set. Signals which set more of them are handled in the order
+// of the fields.
+type SignalJSON struct {
+	Candidate          *webrtc.ICECandidateInit  `json:"candidate"`
+	Renegotiate        bool                      `json:"renegotiate"`
+	TransceiverRequest *TransceiverRequestSignal `json:"transceiverRequest"`
+	// Type and SDP are set for session descriptions.
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
 }
 
-func newRenegotiate() Renegotiate {
-	return Renegotiate{
-		Renegotiate: true,
-	}
+// TransceiverRequestSignal asks the server to add a transceiver for a kind of
+// track.
+type TransceiverRequestSignal struct {
+	Kind string `json:"kind"`
+	Init *struct {
+		Direction string `json:"direction"`
+	} `json:"init"`
 }
 
-func newSDP(sdpType interface{}, signal map[string]interface{}) (s webrtc.SessionDescription, err error) {
-	sdpTypeString, ok := sdpType.(string)
-	if !ok {
-		err = fmt.Errorf("Expected signal.type to be string: %#v", signal)
-		return
+func (p SignalPayload) Validate() error {
+	if p.UserID == "" {
+		return errors.New("UserID is required")
 	}
 
-	sdp, ok := signal["sdp"]
-	if !ok {
-		err = fmt.Errorf("Expected signal.sdp: %#v", signal)
-	}
+	signal := p.Signal
 
-	sdpString, ok := sdp.(string)
-	if !ok {
-		err = fmt.Errorf("Expected signal.sdp to be string: %#v", signal)
-		return
-	}
-	s.SDP = sdpString
-
-	switch sdpTypeString {
-	case "offer":
-		s.Type = webrtc.SDPTypeOffer
-	case "answer":
-		s.Type = webrtc.SDPTypeAnswer
-	case "pranswer":
-		err = fmt.Errorf("Handling of pranswer signal implemented")
-	case "rollback":
-		err = fmt.Errorf("Handling of rollback signal not implemented")
+	switch {
+	case signal.Candidate != nil:
+		if signal.Candidate.SDPMLineIndex == nil {
+			return errors.New("Candidate sdpMLineIndex is required")
+		}
+	case signal.Renegotiate:
+	case signal.TransceiverRequest != nil:
+		return validateKind(signal.TransceiverRequest.Kind)
+	case signal.Type != "":
+		switch signal.Type {
+		case "offer", "answer":
+		case "pranswer", "rollback":
+			return fmt.Errorf("Handling of %s signal not implemented", signal.Type)
+		default:
+			return fmt.Errorf("Unknown sdp type: %s", signal.Type)
+		}
 	default:
-		err = fmt.Errorf("Unknown sdp type: %s", sdpString)
+		return errors.New("Unexpected signal")
 	}
 
-	return
+	return nil
 }
 
-func NewPayloadFromMap(payload map[string]interface{}) (p Payload, err error) {
-	userID, ok := payload["userId"].(string)
-	if !ok {
-		err = fmt.Errorf("No userId property in payload: %#v", payload)
-		return
-	}
-	signal, ok := payload["signal"].(map[string]interface{})
-	if !ok {
-		err = fmt.Errorf("No signal property in payload: %#v", payload)
-		return
-	}
+// NewPayloadFromSignal converts the signal of a validated signal message to
+// one of the types of signals.
+func NewPayloadFromSignal(payload SignalPayload) Payload {
+	signal := payload.Signal
 
 	var value interface{}
 
-	if candidate, ok := signal["candidate"]; ok {
-		value, err = newCandidate(candidate)
-	} else if _, ok := signal["renegotiate"]; ok {
+	switch {
+	case signal.Candidate != nil:
+		value = Candidate{Candidate: *signal.Candidate}
+	case signal.Renegotiate:
 		value = newRenegotiate()
-	} else if transceiverRequest, ok := signal["transceiverRequest"]; ok {
-		value, err = newTransceiverRequest(transceiverRequest)
-	} else if sdpType, ok := signal["type"]; ok {
-		value, err = newSDP(sdpType, signal)
-	} else {
-		err = fmt.Errorf("Unexpected signal message: %#v", payload)
-		return
+	case signal.TransceiverRequest != nil:
+		var r TransceiverRequestPayload
+		r.TransceiverRequest.Kind = webrtc.NewRTPCodecType(signal.TransceiverRequest.Kind)
+		if init := signal.TransceiverRequest.Init; init != nil {
+			r.TransceiverRequest.Init = &webrtc.RtpTransceiverInit{
+				Direction: webrtc.NewRTPTransceiverDirection(init.Direction),
+			}
+		}
+		value = r
+	default:
+		// only offers and answers pass the validation.
+		sdpType := webrtc.SDPTypeOffer
+		if signal.Type == "answer" {
+			sdpType = webrtc.SDPTypeAnswer
+		}
+		value = webrtc.SessionDescription{
+			Type: sdpType,
+			SDP:  signal.SDP,
+		}
 	}
 
-	if err != nil {
-		return
+	return Payload{
+		UserID: payload.UserID,
+		Signal: value,
 	}
-
-	p.UserID = userID
-	p.Signal = value
-	return
 }
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 )
 
@@ -15,6 +16,10 @@ type Serializer interface {
 
 type Deserializer interface {
 	Deserialize([]byte) (Message, error)
+	// DeserializePayload decodes the payload of a message into v, and
+	// validates it when v is a Validator. A *ProtocolError is returned when
+	// the payload is invalid.
+	DeserializePayload(message Message, v interface{}) error
 }
 
 // Simple message is a container for web-socket messages.
@@ -26,12 +31,31 @@ type Message struct {
 	Room string `json:"room"`
 	// Payload content
 	Payload interface{} `json:"payload"`
+
+	// ctx carries the trace the message was sent in. It is not serialized.
+	ctx context.Context
 }
 
 func NewMessage(typ string, room string, payload interface{}) Message {
 	return Message{Type: typ, Room: room, Payload: payload}
 }
 
+// WithContext returns a copy of the message which carries the trace in ctx,
+// so that adapters can add the spans of delivering the message to it.
+func (m Message) WithContext(ctx context.Context) Message {
+	m.ctx = ctx
+	return m
+}
+
+// Context returns the context of the message, or the background context when
+// the message was sent without one.
+func (m Message) Context() context.Context {
+	if m.ctx != nil {
+		return m.ctx
+	}
+	return context.Background()
+}
+
 func NewMessageRoomJoin(room string, clientID string, metadata string) Message {
 	return NewMessage(MessageTypeRoomJoin, room, map[string]string{
 		"clientID": clientID,
@@ -45,6 +69,9 @@ func NewMessageRoomLeave(room string, clientID string) Message {
 
 type ByteSerializer struct{}
 
+var _ Serializer = ByteSerializer{}
+var _ Deserializer = ByteSerializer{}
+
 const uint64Size = uint64(8)
 
 func (s ByteSerializer) Serialize(m Message) ([]byte, error) {
@@ -55,3 +82,25 @@ func (s ByteSerializer) Deserialize(data []byte) (msg Message, err error) {
 	err = json.Unmarshal(data, &msg)
 	return
 }
+
+// DeserializePayload decodes the payload of a deserialized message into v.
+// The payload is encoded again so that the messages constructed by the
+// server, for example in tests, can be decoded too.
+func (s ByteSerializer) DeserializePayload(message Message, v interface{}) error {
+	data, err := json.Marshal(message.Payload)
+	if err != nil {
+		return newInvalidPayloadError(message, err)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return newInvalidPayloadError(message, err)
+	}
+
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return newInvalidPayloadError(message, err)
+		}
+	}
+
+	return nil
+}
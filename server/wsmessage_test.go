@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -45,3 +47,51 @@ func TestNewMessageRoomLeave(t *testing.T) {
 	assert.Equal(t, room, m1.Room)
 	assert.Equal(t, clientID, m1.Payload)
 }
+
+func TestMessage_WithContext(t *testing.T) {
+	type key struct{}
+	m1 := NewMessage("test-type", "test-room", "test-payload")
+	assert.Equal(t, context.Background(), m1.Context())
+
+	ctx := context.WithValue(context.Background(), key{}, "value")
+	m2 := m1.WithContext(ctx)
+	assert.Equal(t, ctx, m2.Context())
+	assert.Equal(t, context.Background(), m1.Context(), "original message unchanged")
+
+	var s ByteSerializer
+	data1, err := s.Serialize(m1)
+	assert.Nil(t, err)
+	data2, err := s.Serialize(m2)
+	assert.Nil(t, err)
+	assert.Equal(t, data1, data2, "context is not serialized")
+}
+
+func TestByteSerializer_DeserializePayload(t *testing.T) {
+	var s ByteSerializer
+
+	msg, err := s.Deserialize([]byte(`{"type":"mute","payload":{"clientId":"client1","kind":"audio","muted":true}}`))
+	assert.Nil(t, err)
+	var mute MutePayload
+	assert.Nil(t, s.DeserializePayload(msg, &mute))
+	assert.Equal(t, MutePayload{ClientID: "client1", Kind: "audio", Muted: true}, mute)
+
+	var protocolErr *ProtocolError
+
+	msg, err = s.Deserialize([]byte(`{"type":"mute","payload":{"clientId":"client1","muted":"yes"}}`))
+	assert.Nil(t, err)
+	err = s.DeserializePayload(msg, &MutePayload{})
+	assert.True(t, errors.As(err, &protocolErr), "wrong type: %s", err)
+	assert.Equal(t, ErrorCodeInvalidPayload, protocolErr.Code)
+	assert.Equal(t, "mute", protocolErr.Type)
+
+	msg, err = s.Deserialize([]byte(`{"type":"mute","payload":{"clientId":"client1","kind":"screen"}}`))
+	assert.Nil(t, err)
+	err = s.DeserializePayload(msg, &MutePayload{})
+	assert.True(t, errors.As(err, &protocolErr), "not valid: %s", err)
+
+	// messages which were not deserialized.
+	msg = NewMessage("ready", "room", map[string]interface{}{"nickname": "abc"})
+	var ready ReadyPayload
+	assert.Nil(t, s.DeserializePayload(msg, &ready))
+	assert.Equal(t, "abc", ready.Nickname)
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// Versions of the websocket protocol. Clients negotiate the version when they
+// connect by offering the websocket subprotocols of the versions they speak,
+// for example peer-calls.v2. Clients which do not offer any subprotocol speak
+// version 1.
+const (
+	// ProtocolVersion1 is the protocol of clients which do not negotiate a
+	// version. Invalid messages are only logged because these clients do not
+	// know the protocol_error message.
+	ProtocolVersion1 = 1
+	// ProtocolVersion2 replies to invalid messages with a protocol_error
+	// message.
+	ProtocolVersion2 = 2
+
+	// ProtocolVersion is the latest version of the protocol.
+	ProtocolVersion = ProtocolVersion2
+)
+
+const protocolSubprotocolPrefix = "peer-calls.v"
+
+// MessageTypeError is sent to clients which speak version 2 or later of the
+// protocol when a message they sent could not be handled. It is not called
+// error because event emitters throw when nothing listens to error events.
+const MessageTypeError = "protocol_error"
+
+const (
+	// ErrorCodeInvalidPayload means the payload of the message was malformed.
+	ErrorCodeInvalidPayload = "invalid_payload"
+	// ErrorCodeUnknownType means the server does not handle messages of this
+	// type.
+	ErrorCodeUnknownType = "unknown_type"
+)
+
+// ProtocolSubprotocol returns the websocket subprotocol of a protocol
+// version.
+func ProtocolSubprotocol(version int) string {
+	return protocolSubprotocolPrefix + strconv.Itoa(version)
+}
+
+// negotiateProtocol returns the latest version of the protocol supported by
+// both the client and the server, and the subprotocol the connection should
+// be accepted with. Clients which only offer versions this server does not
+// support are rejected.
+func negotiateProtocol(r *http.Request) (subprotocol string, version int, err error) {
+	var offered []string
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				offered = append(offered, token)
+			}
+		}
+	}
+
+	if len(offered) == 0 {
+		return "", ProtocolVersion1, nil
+	}
+
+	for _, token := range offered {
+		if !strings.HasPrefix(token, protocolSubprotocolPrefix) {
+			continue
+		}
+		v, err := strconv.Atoi(strings.TrimPrefix(token, protocolSubprotocolPrefix))
+		if err != nil || v < ProtocolVersion1 || v > ProtocolVersion {
+			continue
+		}
+		if v > version {
+			subprotocol = token
+			version = v
+		}
+	}
+
+	if version == 0 {
+		return "", 0, fmt.Errorf("Unsupported protocol versions: %s", strings.Join(offered, ", "))
+	}
+
+	return subprotocol, version, nil
+}
+
+// Validator is implemented by payloads which check their fields after they
+// have been decoded.
+type Validator interface {
+	Validate() error
+}
+
+// ProtocolError is returned when a client sends a message the server cannot
+// handle. The client is told about it with a protocol_error message.
+type ProtocolError struct {
+	// Code is one of the ErrorCode constants.
+	Code string
+	// Type is the type of the message.
+	Type string
+	Err  error
+}
+
+func newInvalidPayloadError(message Message, err error) *ProtocolError {
+	return &ProtocolError{
+		Code: ErrorCodeInvalidPayload,
+		Type: message.Type,
+		Err:  err,
+	}
+}
+
+func newUnknownTypeError(message Message) *ProtocolError {
+	return &ProtocolError{
+		Code: ErrorCodeUnknownType,
+		Type: message.Type,
+		Err:  fmt.Errorf("Unhandled event: %s", message.Type),
+	}
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("Invalid %s message: %s", e.Type, e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorPayload is the payload of the protocol_error message.
+type ErrorPayload struct {
+	// Type is the type of the message which could not be handled.
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// replyError sends a protocol_error message to the client when err is a
+// ProtocolError and the client speaks a version of the protocol which has
+// protocol_error messages.
+func replyError(adapter Adapter, room string, clientID string, version int, err error) error {
+	var protocolErr *ProtocolError
+	if version < ProtocolVersion2 || !errors.As(err, &protocolErr) {
+		return nil
+	}
+
+	return adapter.Emit(clientID, NewMessage(MessageTypeError, room, ErrorPayload{
+		Type:    protocolErr.Type,
+		Code:    protocolErr.Code,
+		Message: protocolErr.Err.Error(),
+	}))
+}
+
+// ReadyPayload is sent by clients which are ready to connect to the peers in
+// the room.
+type ReadyPayload struct {
+	Nickname string `json:"nickname"`
+}
+
+func (p ReadyPayload) Validate() error {
+	// clients without a nickname are not ready, see getReadyClients.
+	if p.Nickname == "" {
+		return errors.New("Nickname is required")
+	}
+	return nil
+}
+
+// UsersPayload is broadcast when a client is ready. It lists the peers the
+// client should connect to.
+type UsersPayload struct {
+	Initiator string   `json:"initiator"`
+	PeerIDs   []string `json:"peerIds"`
+	// Nicknames of the ready clients by their clientID.
+	Nicknames    map[string]string `json:"nicknames"`
+	RecordStatus bool              `json:"recordStatus"`
+}
+
+// HangUpPayload is broadcast when a client has left the call.
+type HangUpPayload struct {
+	UserID string `json:"userId"`
+}
+
+// RecordPayload starts or stops recording the room.
+type RecordPayload struct {
+	RecordStatus bool `json:"recordStatus"`
+}
+
+// ClientPayload is the payload of the messages the moderator sends about
+// another client, for example to kick it.
+type ClientPayload struct {
+	ClientID string `json:"clientId"`
+}
+
+func (p ClientPayload) Validate() error {
+	if p.ClientID == "" {
+		return errors.New("ClientID is required")
+	}
+	return nil
+}
+
+// MutePayload stops or resumes forwarding the tracks of a kind of another
+// client. It is broadcast as the mute_changed message after the change.
+type MutePayload struct {
+	ClientID string `json:"clientId"`
+	Kind     string `json:"kind"`
+	Muted    bool   `json:"muted"`
+}
+
+func (p MutePayload) Validate() error {
+	if p.ClientID == "" {
+		return errors.New("ClientID is required")
+	}
+	return validateKind(p.Kind)
+}
+
+// MuteRequestPayload asks another client to mute its tracks of a kind.
+type MuteRequestPayload struct {
+	ClientID string `json:"clientId"`
+	Kind     string `json:"kind"`
+}
+
+func (p MuteRequestPayload) Validate() error {
+	if p.ClientID == "" {
+		return errors.New("ClientID is required")
+	}
+	return validateKind(p.Kind)
+}
+
+func validateKind(kind string) error {
+	if webrtc.NewRTPCodecType(kind) == 0 {
+		return fmt.Errorf("Invalid kind of track: %q", kind)
+	}
+	return nil
+}
+
+// PasswordPayload is sent by clients joining a room with a password.
+type PasswordPayload struct {
+	Password string `json:"password"`
+}
+
+// LobbyJoinPayload is sent by clients waiting in the lobby to tell the
+// moderator who they are.
+type LobbyJoinPayload struct {
+	Nickname string `json:"nickname"`
+}
+
+// RoomSettingsPayload changes the settings of a room. Settings which are
+// not set are left unchanged.
+type RoomSettingsPayload struct {
+	// Password of the room, the password is removed when it is empty.
+	Password *string `json:"password"`
+	Locked   *bool   `json:"locked"`
+	Lobby    *bool   `json:"lobby"`
+}
+
+// RoomSettingsChangedPayload is broadcast when the moderator has changed the
+// settings of a room.
+type RoomSettingsChangedPayload struct {
+	Successful bool `json:"successful"`
+	Locked     bool `json:"locked"`
+	Lobby      bool `json:"lobby"`
+	// Password is true when the room has a password.
+	Password bool `json:"password"`
+}
+
+// ResultPayload tells a client whether the message it sent was handled.
+type ResultPayload struct {
+	Successful bool `json:"successful"`
+	// ClientID is the client the message was about, if any.
+	ClientID string `json:"clientId,omitempty"`
+}
+
+// LobbyRequestPayload is broadcast when a client is waiting in the lobby.
+type LobbyRequestPayload struct {
+	ClientID string `json:"clientId"`
+	Nickname string `json:"nickname"`
+}
+
+// LobbyListPayload lists the clients waiting in the lobby.
+type LobbyListPayload struct {
+	Successful bool `json:"successful"`
+	// Clients are the nicknames of the waiting clients by their clientID.
+	Clients map[string]string `json:"clients"`
+}
+
+// MuteRequestedPayload is sent to the client the moderator asked to mute its
+// tracks of a kind.
+type MuteRequestedPayload struct {
+	Kind string `json:"kind"`
+}
+
+// ModeratorChangedPayload is broadcast when another user has become the
+// moderator of the room.
+type ModeratorChangedPayload struct {
+	ClientID  string `json:"clientId"`
+	CreatorID string `json:"creatorId"`
+}
+
+// RecordCallbackPayload tells clients whether recording the room was started
+// or stopped.
+type RecordCallbackPayload struct {
+	Successful   bool `json:"successful"`
+	RecordStatus bool `json:"recordStatus"`
+	// Files are the paths of the recorded files, when recording locally.
+	Files []string `json:"files,omitempty"`
+}
+
+// StreamURLPayload is sent to the moderator when the recording of the room
+// is streamed.
+type StreamURLPayload struct {
+	// Successful is always "1", it is a string like in RoomCreatedPayload.
+	Successful string `json:"successful"`
+	StreamURL  string `json:"stream_url"`
+}
+
+// RoomCreatedPayload is the reply to the create_room message.
+type RoomCreatedPayload struct {
+	// Successful is "1" when the room was created, and "0" when it already
+	// existed.
+	Successful string `json:"successful"`
+	CreatorID  string `json:"creatorId"`
+}
+
+// ICEServersPayload lists the ICE servers the client should use.
+type ICEServersPayload struct {
+	ICEServers []ICEAuthServer `json:"iceServers"`
+}
+
+// ResumeTokenPayload is sent to clients which can resume their session when
+// their connection drops.
+type ResumeTokenPayload struct {
+	ResumeToken string `json:"resumeToken"`
+	// Timeout is the number of seconds the session is kept after the
+	// connection drops.
+	Timeout float64 `json:"timeout"`
+}
+
+// GoingAwayPayload asks clients to reconnect because the server is shutting
+// down.
+type GoingAwayPayload struct {
+	Reason    string `json:"reason"`
+	Reconnect bool   `json:"reconnect"`
+}
@@ -6,23 +6,45 @@ import (
 	"fmt"
 	"net/http"
 	"path"
+	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"nhooyr.io/websocket"
 )
 
 type WSS struct {
-	log   Logger
-	rooms RoomManager
+	log      Logger
+	rooms    RoomManager
+	auth     Authenticator
+	access   *RoomAccess
+	sessions *ResumableSessions
+	drainer  *Drainer
+	// deserializer decodes the payloads of the messages read from clients.
+	deserializer Deserializer
 }
 
+// NewWSS creates a new websocket server. All users are anonymous when auth is
+// nil, access to rooms is not restricted when access is nil, sessions cannot
+// be resumed when sessions is nil, and connections are not drained when
+// drainer is nil.
 func NewWSS(
 	loggerFactory LoggerFactory,
 	rooms RoomManager,
+	auth Authenticator,
+	access *RoomAccess,
+	sessions *ResumableSessions,
+	drainer *Drainer,
 ) *WSS {
 	return &WSS{
-		log:   loggerFactory.GetLogger("wss"),
-		rooms: rooms,
+		log:      loggerFactory.GetLogger("wss"),
+		rooms:    rooms,
+		auth:     auth,
+		access:   access,
+		sessions: sessions,
+		drainer:  drainer,
+
+		deserializer: ByteSerializer{},
 	}
 }
 
@@ -30,13 +52,153 @@ type Subscription struct {
 	Adapter  Adapter
 	ClientID string
 	Room     string
+	// UserID identifies the authenticated user, if any.
+	UserID   string
+	Identity Identity
 	Messages <-chan Message
+	// Resumed is true when the connection resumed an existing session. The
+	// messages of resumed sessions are delivered to the Messages channel of
+	// the original subscription, and the Messages channel of this subscription
+	// is closed without any messages when the connection closes.
+	Resumed bool
+	// Context carries the trace of the connection, and is done when the
+	// connection closes.
+	Context context.Context
+	// Deserializer decodes the payloads of the messages.
+	Deserializer Deserializer
+
+	version *protocolVersion
+}
+
+// Version returns the version of the protocol negotiated with the client. It
+// changes when the client resumes the session with a connection which
+// negotiated another version.
+func (s *Subscription) Version() int {
+	return s.version.get()
+}
+
+// protocolVersion is shared by the subscription and the resumable session of
+// a client, so that the version of the current connection is used to reply.
+type protocolVersion struct {
+	mu      sync.Mutex
+	version int
+}
+
+func newProtocolVersion(version int) *protocolVersion {
+	return &protocolVersion{version: version}
+}
+
+func (v *protocolVersion) get() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.version
+}
+
+func (v *protocolVersion) set(version int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.version = version
+}
+
+// wsConn is a single websocket connection of a client.
+type wsConn struct {
+	log    Logger
+	conn   *websocket.Conn
+	client *Client
+	room   string
+	start  time.Time
+	// version of the protocol negotiated with the client.
+	version int
+
+	closeOnce      sync.Once
+	closedByServer bool
+}
+
+func (c *wsConn) Close(status websocket.StatusCode, reason string) {
+	c.closeOnce.Do(func() {
+		c.closedByServer = true
+		c.log.Info("Closing websocket connection", Fields{"status": status})
+		err := c.conn.Close(status, reason)
+		if err != nil {
+			c.log.Error("Error closing websocket connection", Fields{"error": err})
+		}
+	})
 }
 
-func (wss *WSS) Subscribe(w http.ResponseWriter, r *http.Request) (*Subscription, error) {
-	var c *websocket.Conn
+// closed is called after the reader has exited. It closes the connection,
+// waits for the reader to exit, and reports whether the client dropped the
+// connection in a way that allows it to resume the session.
+func (c *wsConn) closed(msgChan <-chan Message) (resumable bool) {
+	err := c.client.Err()
+
+	switch {
+	case errors.Is(err, context.Canceled):
+	case websocket.CloseStatus(err) == websocket.StatusNormalClosure,
+		websocket.CloseStatus(err) == websocket.StatusGoingAway:
+	case err != nil:
+		c.log.Warn("Subscription error", Fields{"error": err})
+		resumable = true
+	}
+
+	c.closeOnce.Do(func() {
+		err := c.conn.Close(websocket.StatusNormalClosure, "")
+		if err != nil {
+			c.log.Error("Error closing websocket connection", Fields{"error": err})
+		}
+	})
+
+	prometheusWSConnActive.Dec()
+	duration := time.Now().Sub(c.start)
+	prometheusWSConnDuration.Observe(duration.Seconds())
+
+	// wait for the reader to exit after the connection has been closed
+	for range msgChan {
+	}
+
+	return resumable && !c.closedByServer
+}
+
+func (wss *WSS) Subscribe(w http.ResponseWriter, r *http.Request) (sub *Subscription, err error) {
+	clientID := path.Base(r.URL.Path)
+	room := path.Base(path.Dir(r.URL.Path))
+
+	ctx, span := startRequestSpan(r, "WSS.Subscribe",
+		attribute.String("room", room),
+		attribute.String("clientId", clientID),
+	)
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	var identity Identity
+	if wss.auth != nil {
+		identity, err = wss.auth.Authenticate(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return nil, fmt.Errorf("Error authenticating websocket connection: %w", err)
+		}
+	}
+
+	if !identity.CanJoin(room) {
+		w.WriteHeader(http.StatusForbidden)
+		return nil, fmt.Errorf("User %s is not allowed to join room: %s", identity.UserID, room)
+	}
+
+	subprotocol, version, err := negotiateProtocol(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, fmt.Errorf("Error negotiating protocol version: %w", err)
+	}
+	span.SetAttributes(attribute.Int("protocolVersion", version))
+
+	var subprotocols []string
+	if subprotocol != "" {
+		subprotocols = []string{subprotocol}
+	}
+
 	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		CompressionMode: websocket.CompressionDisabled,
+		Subprotocols:    subprotocols,
 	})
 
 	if err != nil {
@@ -44,79 +206,293 @@ func (wss *WSS) Subscribe(w http.ResponseWriter, r *http.Request) (*Subscription
 		return nil, fmt.Errorf("Error accepting websocket connection: %w", err)
 	}
 
-	ctx := r.Context()
+	conn := &wsConn{
+		log: wss.log.WithFields(Fields{
+			"room":     room,
+			"clientId": clientID,
+		}),
+		conn:    c,
+		client:  NewClientWithID(c, clientID),
+		room:    room,
+		start:   time.Now(),
+		version: version,
+	}
+	conn.log.Info("New websocket connection", Fields{"protocolVersion": version})
+
+	prometheusWSConnTotal.Inc()
+	prometheusWSConnActive.Inc()
+
+	if token := r.URL.Query().Get("resume_token"); token != "" && wss.sessions != nil {
+		session, err := wss.sessions.resume(room, clientID, identity.UserID, token)
+		if err == nil {
+			span.SetAttributes(attribute.Bool("resumed", true))
+			return wss.resume(ctx, conn, session, identity), nil
+		}
+		conn.log.Warn("Error resuming session", Fields{"error": err})
+	}
+
+	return wss.subscribe(ctx, conn, identity), nil
+}
+
+// subscribe adds the client to the room after it has been admitted.
+func (wss *WSS) subscribe(ctx context.Context, conn *wsConn, identity Identity) *Subscription {
+	client := conn.client
+	clientID := client.ID()
+	room := conn.room
+	userID := identity.UserID
 
-	clientID := path.Base(r.URL.Path)
-	room := path.Base(path.Dir(r.URL.Path))
 	adapter := wss.rooms.Enter(room)
 	ch := make(chan Message)
+	version := newProtocolVersion(conn.version)
 
-	client := NewClientWithID(c, clientID)
-	wss.log.Printf("[%s] New websocket connection - room: %s", clientID, room)
-
-	prometheusWSConnTotal.Inc()
-	prometheusWSConnActive.Inc()
-	start := time.Now()
+	exit := func() {
+		conn.log.Debug("wss.rooms.Exit", nil)
+		wss.rooms.Exit(room)
+	}
 
 	go func() {
-		defer func() {
-			prometheusWSConnActive.Dec()
-			duration := time.Now().Sub(start)
-			prometheusWSConnDuration.Observe(duration.Seconds())
+		var msgChan <-chan Message
+		var session *resumableSession
 
-			wss.log.Printf("[%s] Closing websocket connection - room: %s", clientID, room)
-			err := c.Close(websocket.StatusNormalClosure, "")
+		teardown := func() {
+			conn.log.Debug("adapter.Remove", nil)
+			err := adapter.Remove(clientID)
 			if err != nil {
-				wss.log.Printf("[%s] Error closing websocket connection: %w", clientID, err)
+				conn.log.Error("Error removing client from adapter", Fields{"error": err})
 			}
-		}()
-		defer func() {
-			wss.log.Printf("[%s] wss.rooms.Exit room: %s", clientID, room)
-			wss.rooms.Exit(room)
-		}()
-		err = adapter.Add(client)
-		if err != nil {
-			wss.log.Printf("[%s] Error adding client to room: %s: %s", clientID, room, err)
+			exit()
 			close(ch)
-			return
 		}
 
-		defer func() {
-			wss.log.Printf("[%s] adapter.Remove room: %s", clientID, room)
-			err := adapter.Remove(clientID)
+		msgChan = client.Subscribe(ctx)
+
+		// the span covers waiting in the lobby and joining the room.
+		_, span := startSpan(ctx, "WSS.subscribe")
+
+		defer wss.expireToken(conn, identity)()
+		defer wss.drain(conn)()
+
+		if wss.access != nil {
+			err := wss.access.Admit(ctx, adapter, client, msgChan, room, identity)
 			if err != nil {
-				wss.log.Printf("[%s] Error removing client from adapter: %s", clientID, err)
+				conn.log.Info("Not admitted to room", Fields{"error": err})
+				var denied *AccessDeniedError
+				if errors.As(err, &denied) {
+					conn.Close(denied.Status, denied.Reason)
+				}
+				endSpan(span, err)
+				exit()
+				close(ch)
+				conn.closed(msgChan)
+				return
 			}
-		}()
+		}
 
-		msgChan := client.Subscribe(ctx)
+		var roomClient ClientWriter = client
+		disconnect := conn.Close
+
+		if wss.sessions != nil {
+			session = &resumableSession{
+				room:     room,
+				clientID: clientID,
+				userID:   userID,
+				adapter:  adapter,
+				messages: ch,
+				version:  version,
+				teardown: teardown,
+				client: &resumableClient{
+					log:        conn.log,
+					id:         clientID,
+					client:     client,
+					disconnect: conn.Close,
+				},
+			}
+			session.client.end = func() {
+				wss.sessions.expire(session)
+			}
+			wss.sessions.add(session)
 
-		for message := range msgChan {
-			ch <- message
+			roomClient = session.client
+			disconnect = session.client.Disconnect
 		}
-		close(ch)
-		err = client.Err()
 
-		if errors.Is(err, context.Canceled) {
-			err = nil
-			return
+		if wss.access != nil {
+			roomClient = wss.access.NewClient(roomClient, adapter, room, userID, disconnect)
 		}
-		if websocket.CloseStatus(err) == websocket.StatusNormalClosure ||
-			websocket.CloseStatus(err) == websocket.StatusGoingAway {
-			err = nil
+
+		err := adapter.Add(roomClient)
+		if err != nil {
+			conn.log.Error("Error adding client to room", Fields{"error": err})
+			endSpan(span, err)
+			if session != nil {
+				wss.sessions.remove(session)
+			}
+			exit()
+			close(ch)
+			conn.closed(msgChan)
 			return
 		}
-		if err != nil {
-			wss.log.Printf("[%s] Subscription error: %s", clientID, err)
+		span.End()
+
+		if session != nil {
+			wss.sendResumeToken(session)
 		}
+
+		wss.forward(msgChan, adapter, conn, identity, ch)
+		wss.end(conn, msgChan, session, teardown)
 	}()
 
-	stream := &Subscription{
+	return &Subscription{
 		Adapter:  adapter,
 		ClientID: clientID,
 		Room:     room,
+		UserID:   userID,
+		Identity: identity,
 		Messages: ch,
+		Context:  ctx,
+
+		Deserializer: wss.deserializer,
+
+		version: version,
+	}
+}
+
+// resume attaches a new connection to a suspended session.
+func (wss *WSS) resume(ctx context.Context, conn *wsConn, session *resumableSession, identity Identity) *Subscription {
+	client := conn.client
+	clientID := client.ID()
+	room := conn.room
+
+	conn.log.Info("Resuming session", nil)
+
+	// the handler of the original subscription replies with the version of
+	// the new connection.
+	session.version.set(conn.version)
+
+	done := make(chan Message)
+
+	go func() {
+		defer close(done)
+
+		msgChan := client.Subscribe(ctx)
+
+		defer wss.expireToken(conn, identity)()
+		defer wss.drain(conn)()
+
+		session.client.attach(client, conn.Close)
+		wss.sendResumeToken(session)
+
+		wss.forward(msgChan, session.adapter, conn, identity, session.messages)
+		wss.end(conn, msgChan, session, session.teardown)
+	}()
+
+	return &Subscription{
+		Adapter:  session.adapter,
+		ClientID: clientID,
+		Room:     room,
+		UserID:   identity.UserID,
+		Identity: identity,
+		Messages: done,
+		Resumed:  true,
+		Context:  ctx,
+
+		Deserializer: wss.deserializer,
+
+		version: session.version,
+	}
+}
+
+// expireToken closes the connection when the user's token expires. The
+// returned function stops the timer.
+func (wss *WSS) expireToken(conn *wsConn, identity Identity) (stop func()) {
+	expiresAt, ok := identity.ExpiresAt()
+	if !ok {
+		return func() {}
 	}
 
-	return stream, nil
+	timer := time.AfterFunc(time.Until(expiresAt), func() {
+		conn.log.Info("Token expired", nil)
+		conn.Close(websocket.StatusPolicyViolation, "Token expired")
+	})
+	return func() {
+		timer.Stop()
+	}
+}
+
+// drain asks the client to reconnect when the server starts draining. The
+// returned function stops tracking the connection.
+func (wss *WSS) drain(conn *wsConn) (stop func()) {
+	if wss.drainer == nil {
+		return func() {}
+	}
+	return wss.drainer.add(conn)
+}
+
+// forward sends the messages read from the connection to the subscriber until
+// the connection closes.
+func (wss *WSS) forward(
+	msgChan <-chan Message,
+	adapter Adapter,
+	conn *wsConn,
+	identity Identity,
+	ch chan<- Message,
+) {
+	log := conn.log
+	room := conn.room
+	clientID := conn.client.ID()
+
+	for message := range msgChan {
+		if wss.access != nil {
+			handled, err := wss.access.HandleMessage(adapter, message, room, clientID, identity)
+			if err != nil {
+				log.Error("Error handling websocket message", Fields{
+					"type":  message.Type,
+					"error": err,
+				})
+				if err := replyError(adapter, room, clientID, conn.version, err); err != nil {
+					log.Error("Error sending error message", Fields{"error": err})
+				}
+			}
+			if handled {
+				continue
+			}
+		}
+		ch <- message
+	}
+}
+
+// end suspends the session when the client can resume it, or removes the
+// client from the room.
+func (wss *WSS) end(conn *wsConn, msgChan <-chan Message, session *resumableSession, teardown func()) {
+	resumable := conn.closed(msgChan)
+
+	// Sessions are not suspended while draining because clients reconnect to
+	// other instances.
+	if wss.drainer != nil && wss.drainer.IsDraining() {
+		resumable = false
+	}
+
+	if session != nil && resumable && wss.sessions.suspend(session) {
+		conn.log.Info("Session suspended", nil)
+		return
+	}
+
+	if session != nil {
+		wss.sessions.remove(session)
+	}
+	teardown()
+}
+
+func (wss *WSS) sendResumeToken(session *resumableSession) {
+	err := session.client.Write(NewMessage("resume_token", session.room, ResumeTokenPayload{
+		ResumeToken: wss.sessions.token(session),
+		Timeout:     wss.sessions.Timeout().Seconds(),
+	}))
+	if err != nil {
+		wss.log.Error("Error sending resume token", Fields{
+			"room":     session.room,
+			"clientId": session.clientID,
+			"error":    err,
+		})
+	}
 }
@@ -58,6 +58,17 @@ export interface SocketEvent {
   connect: undefined
   disconnect: undefined
   ready: Ready
+  resume_token: {
+    resumeToken: string
+    // seconds the session is kept after the connection drops
+    timeout: number
+  }
+  protocol_error: {
+    // type of the message which could not be handled
+    type: string
+    code: string
+    message: string
+  }
 }
 
 export interface RecordingSocket {
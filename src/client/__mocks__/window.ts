@@ -78,4 +78,6 @@ export const nickname = 'nick1234'
 
 export const network = 'mesh'
 
+export const traceParent = ''
+
 export const iceServers = []
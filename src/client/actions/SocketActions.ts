@@ -105,6 +105,10 @@ class SocketHandler {
         stream,
       })(dispatch, getState))
   }
+  handleProtocolError = ({type, code, message}:
+                           SocketEvent['protocol_error']) => {
+    debug('socket protocol_error, type: %s, code: %s, message: %s', type, code, message)
+  }
   handleSetStreamUrl = async ({ stream_url }) => {
     const {dispatch} = this
     dispatch(NotifyActions.info(stream_url))
@@ -145,6 +149,7 @@ export function handshake(options: HandshakeOptions) {
     handler.handleRecordCallback)
 
   socket.on(constants.STREAM_URL, handler.handleSetStreamUrl)
+  socket.on(constants.SOCKET_EVENT_PROTOCOL_ERROR, handler.handleProtocolError)
 
   debug('userId: %s', userId)
 
@@ -160,4 +165,5 @@ export function removeEventListeners(socket: ClientSocket) {
   socket.removeAllListeners(constants.SOCKET_EVENT_SIGNAL)
   socket.removeAllListeners(constants.SOCKET_EVENT_USERS)
   socket.removeAllListeners(constants.SOCKET_EVENT_HANG_UP)
+  socket.removeAllListeners(constants.SOCKET_EVENT_PROTOCOL_ERROR)
 }
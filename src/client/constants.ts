@@ -61,6 +61,7 @@ export const SOCKET_EVENT_USERS = 'users'
 export const SOCKET_EVENT_HANG_UP = 'hangUp'
 export const SOCKET_EVENT_RECORD = 'record'
 export const SOCKET_EVENT_RECORD_CALLBACK = 'record_callback'
+export const SOCKET_EVENT_PROTOCOL_ERROR = 'protocol_error'
 
 export const STREAM_ADD = 'PEER_STREAM_ADD'
 export const STREAM_LOCAL_RECORD = 'RECORD_LOCAL_STREAM'
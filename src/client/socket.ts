@@ -1,9 +1,16 @@
 import { SocketEvent } from './SocketEvent'
-import { baseUrl, callId, userId } from './window'
+import { baseUrl, callId, traceParent, userId } from './window'
 import { SocketClient, TypedEmitter } from './ws'
 export type ClientSocket = TypedEmitter<SocketEvent>
 
+// the traceparent links the websocket connection to the trace of the page
+// request on the server.
 const wsUrl = location.origin.replace(/^http/, 'ws') +
-  baseUrl + '/ws/' + callId + '/' + userId
+  baseUrl + '/ws/' + callId + '/' + userId +
+  (traceParent ? '?traceparent=' + encodeURIComponent(traceParent) : '')
 
-export default new SocketClient<SocketEvent>(wsUrl)
+// the server replies to invalid messages with a protocol_error message since
+// version 2 of the protocol.
+export const protocols = ['peer-calls.v2', 'peer-calls.v1']
+
+export default new SocketClient<SocketEvent>(wsUrl, protocols)
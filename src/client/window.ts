@@ -16,6 +16,7 @@ export const userId = valueOf('userId')!
 export const iceServers = JSON.parse(valueOf('iceServers')!)
 export const nickname = valueOf('nickname')!
 export const network = valueOf('network')!
+export const traceParent = valueOf('traceParent') || ''
 
 debug('Using ice servers: %o', iceServers)
 
@@ -22,22 +22,40 @@ export class SocketClient<E extends Events> extends SimpleEmitter<E> {
   pingIntervalTimeout = 5000
   protected pingInterval: NodeJS.Timeout | undefined
 
-  constructor(readonly url: string) {
+  // resumeToken is received in resume_token messages. It is sent when
+  // reconnecting so that the server resumes the session instead of starting
+  // a new one, and the client stays in the room.
+  protected resumeToken = ''
+
+  // protocols are the websocket subprotocols offered to the server, which
+  // selects the version of the protocol to use.
+  constructor(readonly url: string, readonly protocols: string[] = []) {
     super()
     this.connect()
   }
 
   protected connect() {
-    debug('connecting to: %s', this.url)
-    const ws = this.ws = new WebSocket(this.url)
+    const url = this.connectURL()
+    debug('connecting to: %s', url)
+    const ws = this.ws = new WebSocket(url, this.protocols)
 
     ws.addEventListener('close', this.wsHandleClose)
     ws.addEventListener('open', this.wsHandleOpen)
     ws.addEventListener('message', this.wsHandleMessage)
   }
 
+  protected connectURL() {
+    if (!this.resumeToken) {
+      return this.url
+    }
+    const separator = this.url.indexOf('?') >= 0 ? '&' : '?'
+    return this.url + separator + 'resume_token=' +
+      encodeURIComponent(this.resumeToken)
+  }
+
   public disconnect() {
     this.reconnectTimeout = 0
+    this.resumeToken = ''
     this.wsHandleClose()
   }
 
@@ -60,7 +78,7 @@ export class SocketClient<E extends Events> extends SimpleEmitter<E> {
   }
 
   protected wsHandleOpen = () => {
-    debug('websocket connected')
+    debug('websocket connected, protocol: %s', this.ws.protocol)
     this.connected = true
     this.emitter.emit('connect')
 
@@ -75,6 +93,10 @@ export class SocketClient<E extends Events> extends SimpleEmitter<E> {
 
   protected wsHandleMessage = (e: MessageEvent) => {
     const message: Message = JSON.parse(e.data)
+    if (message.type === 'resume_token') {
+      const { resumeToken } = message.payload as { resumeToken: string }
+      this.resumeToken = resumeToken
+    }
     this.emitter.emit(message.type, message.payload)
   }
 